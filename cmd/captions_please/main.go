@@ -11,22 +11,109 @@ import (
 
 	"github.com/AnilRedshift/captions_please_go/internal/api"
 	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/internal/api/handle_command"
+	"github.com/AnilRedshift/captions_please_go/pkg/limiter"
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
 	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
 )
 
 var PORT = 8080
 
+// Where the internal stats are served, separately from the public webhook
+var statsAddr string
+
 func main() {
+	config := api.ActivityConfig{
+		Workers:            10,
+		MaxOutstandingJobs: 9001,
+		WebhookTimeout:     time.Second * 30,
+	}
+
 	app := &cli.App{
 		Flags: []cli.Flag{
 			&cli.BoolFlag{Name: "verbose"},
+			&cli.IntFlag{Name: "max-tweet-length", Usage: "The weighted length of each reply tweet, for accounts with longer posts"},
+			&cli.BoolFlag{Name: "number-replies", Usage: "Add a (1/N) counter to replies that span multiple tweets"},
+			&cli.StringFlag{Name: "reply-state-dir", Usage: "Save unfinished reply threads, and the ids of posted replies, here so they survive a restart"},
+			&cli.DurationFlag{Name: "reply-retention", Usage: "How long the ids of posted replies are kept, so they can still be deleted. Defaults to 720h"},
+			&cli.UintFlag{Name: "max-deferred-jobs", Usage: "How many commands can wait for twitter's rate limits at once. Any more are dropped. Defaults to the size of the job queue"},
+			&cli.IntFlag{Name: "user-quota", Usage: "How many mentions each user can send per --user-quota-window. 0 for unlimited"},
+			&cli.DurationFlag{Name: "user-quota-window", Value: time.Hour, Usage: "The window for --user-quota"},
+			&cli.StringSliceFlag{Name: "allow-user", Usage: "A user id which isn't subject to the --user-quota. Can be repeated"},
+			&cli.StringSliceFlag{Name: "block-user", Usage: "A user id whose mentions are ignored. Can be repeated"},
+			&cli.StringFlag{Name: "opt-out-file", Usage: "Save the users who asked the bot to stop interpreting their images to this file"},
+			&cli.IntFlag{Name: "google-concurrency", Usage: "The most calls to google that can be made at once, across all workers. Defaults to 8"},
+			&cli.IntFlag{Name: "azure-concurrency", Usage: "The most calls to azure that can be made at once, across all workers. Defaults to 8"},
+			&cli.StringFlag{Name: "stats-addr", Value: "localhost:8081", Usage: "Where to serve how busy the concurrency limits are, at /limiters. Keep it off the public internet. Empty to not serve them"},
+			&cli.StringFlag{Name: "response-policy", Usage: fmt.Sprintf("How to decide what to say about each image, one of %v", handle_command.ResponsePolicyNames())},
+			&cli.Float64Flag{Name: "certain-confidence", Value: float64(message.DefaultConfidenceWording.Certain), Usage: "Descriptions at least this confident are stated as fact"},
+			&cli.Float64Flag{Name: "likely-confidence", Value: float64(message.DefaultConfidenceWording.Likely), Usage: "Descriptions less confident than this are worded as what the image might be"},
+			&cli.BoolFlag{Name: "show-confidence", Usage: "Add how confident the provider was to each description"},
+			&cli.StringFlag{Name: "translator", Value: "google", Usage: "Which service translates the results, one of [google|libretranslate|deepl]. deepl needs the DEEPL_AUTH_KEY secret"},
+			&cli.StringFlag{Name: "libretranslate-url", Usage: "Where the LibreTranslate server is, e.g. http://localhost:5000"},
+			&cli.IntFlag{Name: "translator-concurrency", Usage: "The most calls to libretranslate or deepl that can be made at once, across all workers. Defaults to 8"},
+			&cli.Float64Flag{Name: "ocr-min-confidence", Usage: "Leave out words in images the OCR was less confident than this about, which are often specks read as letters"},
+			&cli.StringFlag{Name: "azure-endpoint", Value: vision.DefaultAzureEndpoint, Usage: "The computer vision resource to call"},
+			&cli.StringFlag{Name: "azure-api-version", Value: vision.AzureAPIv31, Usage: fmt.Sprintf("How images are described, one of [%s|%s]. %s also describes the regions of busy images", vision.AzureAPIv31, vision.AzureAPIv40, vision.AzureAPIv40)},
+			&cli.StringFlag{Name: "describer", Value: "azure", Usage: "Which service describes the images, one of [azure|openai]"},
+			&cli.StringFlag{Name: "labeler", Value: "azure", Usage: "Which service names the objects, landmarks and brands in the images, one of [azure|google]"},
+			&cli.StringFlag{Name: "openai-url", Usage: "Where the OpenAI compatible chat completions API is, e.g. https://api.openai.com/v1 or http://localhost:8080/v1. OPENAI_API_KEY is sent if it's set. Questions about images can only be answered when this is set"},
+			&cli.StringFlag{Name: "openai-model", Usage: "Which vision model describes the images and answers questions about them, e.g. gpt-4o-mini"},
+			&cli.StringFlag{Name: "openai-prompt", Usage: "A text/template asking the model for the description, with {{.Language}} and {{.TweetText}}. Defaults to a prompt for short alt text"},
+			&cli.StringFlag{Name: "openai-question-prompt", Usage: "Like --openai-prompt, with the {{.Question}} the user asked about the image"},
+			&cli.IntFlag{Name: "openai-max-tokens", Usage: "The most tokens each description can be. Defaults to 150"},
+			&cli.IntFlag{Name: "openai-max-length", Usage: "Longer descriptions are cut off at a word. Defaults to 1000 characters"},
+			&cli.BoolFlag{Name: "openai-logprobs", Usage: "Asks the server for logprobs, to word each description by how confident the model is. Not every server supports them"},
+			&cli.IntFlag{Name: "openai-concurrency", Usage: "The most calls to the openai compatible server that can be made at once, across all workers. Defaults to 8"},
+			&cli.DurationFlag{Name: "job-timeout", Usage: "How long each command has before replying with whatever results it has. Defaults to 90s"},
 		},
 		Before: func(c *cli.Context) error {
 			if c.Bool("verbose") {
 				logrus.SetLevel(logrus.DebugLevel)
 			}
+			config.MaxTweetLength = c.Int("max-tweet-length")
+			config.NumberReplies = c.Bool("number-replies")
+			config.ReplyStateDir = c.String("reply-state-dir")
+			config.ReplyRetention = c.Duration("reply-retention")
+			config.MaxDeferredJobs = c.Uint("max-deferred-jobs")
+			config.UserQuota = api.UserQuota{Limit: c.Int("user-quota"), Window: c.Duration("user-quota-window")}
+			config.AllowedUsers = c.StringSlice("allow-user")
+			config.BlockedUsers = c.StringSlice("block-user")
+			config.OptOutFile = c.String("opt-out-file")
+			config.JobTimeout = c.Duration("job-timeout")
+			config.ResponsePolicy = c.String("response-policy")
+			config.ConfidenceWording = message.ConfidenceWording{
+				Certain:        float32(c.Float64("certain-confidence")),
+				Likely:         float32(c.Float64("likely-confidence")),
+				ShowConfidence: c.Bool("show-confidence"),
+			}
+			statsAddr = c.String("stats-addr")
+			config.ProviderLimits = handle_command.ProviderLimits{
+				Google:     c.Int("google-concurrency"),
+				Azure:      c.Int("azure-concurrency"),
+				Translator: c.Int("translator-concurrency"),
+				OpenAI:     c.Int("openai-concurrency"),
+			}
+			config.Translator = handle_command.TranslatorConfig{
+				Provider:          c.String("translator"),
+				LibreTranslateURL: c.String("libretranslate-url"),
+			}
+			config.OCRNormalization = vision.NormalizeOptions{MinConfidence: float32(c.Float64("ocr-min-confidence"))}
+			config.Azure = vision.AzureConfig{Endpoint: c.String("azure-endpoint"), APIVersion: c.String("azure-api-version")}
+			config.Describer = c.String("describer")
+			config.Labeler = c.String("labeler")
+			config.OpenAI = vision.OpenAIConfig{
+				URL:            c.String("openai-url"),
+				Model:          c.String("openai-model"),
+				Prompt:         c.String("openai-prompt"),
+				QuestionPrompt: c.String("openai-question-prompt"),
+				MaxTokens:      c.Int("openai-max-tokens"),
+				MaxLength:      c.Int("openai-max-length"),
+				Logprobs:       c.Bool("openai-logprobs"),
+			}
 			return nil
 		},
 		Writer:    io.Discard,
@@ -46,12 +133,6 @@ func main() {
 		secrets.TwitterAccessTokenSecret,
 		secrets.TwitterBearerToken)
 
-	config := api.ActivityConfig{
-		Workers:            10,
-		MaxOutstandingJobs: 9001,
-		WebhookTimeout:     time.Second * 30,
-	}
-
 	ctx, err = api.WithAccountActivity(ctx, config, client)
 	if err != nil {
 		panic(err)
@@ -101,9 +182,20 @@ func main() {
 		api.WriteResponse(w, response)
 	}
 
-	http.HandleFunc("/status", statusHandler)
-	http.HandleFunc("/webhook", webhookHandler)
-	http.HandleFunc("/", rootHandler)
+	if statsAddr != "" {
+		statsMux := http.NewServeMux()
+		statsMux.HandleFunc("/limiters", limiter.StatsHandler)
+		go func() {
+			log.Printf("captions-please stats at http://%s/limiters\n", statsAddr)
+			log.Fatal(http.ListenAndServe(statsAddr, statsMux))
+		}()
+	}
+
+	// An explicit mux, so nothing registered on http.DefaultServeMux is served publicly
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", statusHandler)
+	mux.HandleFunc("/webhook", webhookHandler)
+	mux.HandleFunc("/", rootHandler)
 	log.Printf("captions-please listening at http://localhost:%d\n", PORT)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", PORT), nil))
+	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", PORT), mux))
 }
@@ -5,10 +5,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
 	"os"
 
 	"github.com/AnilRedshift/captions_please_go/internal/api/common"
 	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
 	"github.com/AnilRedshift/captions_please_go/pkg/vision"
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v2"
@@ -28,6 +31,12 @@ func main() {
 					&cli.StringFlag{Name: "provider", Value: "google"},
 					&cli.StringFlag{Name: "lang", Value: "en"},
 					&cli.StringFlag{Name: "url", Required: true},
+					&cli.BoolFlag{Name: "preprocess", Usage: "Download and preprocess the image, like the bot does, instead of sending the url"},
+					&cli.Float64Flag{Name: "min-confidence", Usage: "Leave out words the provider was less confident than this about"},
+					&cli.StringSliceFlag{Name: "hint", Usage: "A language code the text is probably in. Can be given more than once"},
+					&cli.BoolFlag{Name: "handwriting", Usage: "The text is handwritten"},
+					&cli.StringFlag{Name: "format", Value: "json", Usage: "One of [json|text|markdown]. markdown writes text laid out in a grid as a table"},
+					&cli.StringFlag{Name: "azure-endpoint", Value: vision.DefaultAzureEndpoint},
 				},
 			},
 			{
@@ -35,9 +44,50 @@ func main() {
 				Usage:  "Get a ML generated caption of an image",
 				Action: caption,
 				Flags: []cli.Flag{
-					&cli.StringFlag{Name: "provider", Value: "azure"},
+					&cli.StringFlag{Name: "provider", Value: "azure", Usage: "One of [azure|openai]"},
 					&cli.StringFlag{Name: "lang", Value: "en"},
 					&cli.StringFlag{Name: "url", Required: true},
+					&cli.BoolFlag{Name: "preprocess", Usage: "Download and preprocess the image, like the bot does, instead of sending the url"},
+					&cli.StringFlag{Name: "azure-endpoint", Value: vision.DefaultAzureEndpoint},
+					&cli.StringFlag{Name: "azure-api-version", Value: vision.AzureAPIv31, Usage: fmt.Sprintf("One of [%s|%s]. %s also describes the regions of busy images", vision.AzureAPIv31, vision.AzureAPIv40, vision.AzureAPIv40)},
+					&cli.StringFlag{Name: "openai-url", Value: "http://localhost:8080/v1", Usage: "Where the OpenAI compatible chat completions API is. OPENAI_API_KEY is sent if it's set"},
+					&cli.StringFlag{Name: "openai-model"},
+					&cli.StringFlag{Name: "openai-prompt", Usage: "A text/template with {{.Language}} and {{.TweetText}}"},
+					&cli.StringFlag{Name: "tweet-text", Usage: "What the image was posted with, for the openai prompt"},
+				},
+			},
+			{
+				Name:   "ask",
+				Usage:  "Ask a vision language model a question about an image",
+				Action: ask,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "question", Required: true},
+					&cli.StringFlag{Name: "lang", Value: "en"},
+					&cli.StringFlag{Name: "url", Required: true},
+					&cli.BoolFlag{Name: "preprocess", Usage: "Download and preprocess the image, like the bot does, instead of sending the url"},
+					&cli.StringFlag{Name: "openai-url", Value: "http://localhost:8080/v1", Usage: "Where the OpenAI compatible chat completions API is. OPENAI_API_KEY is sent if it's set"},
+					&cli.StringFlag{Name: "openai-model"},
+					&cli.StringFlag{Name: "openai-question-prompt", Usage: "A text/template with {{.Question}}, {{.Language}} and {{.TweetText}}"},
+					&cli.StringFlag{Name: "tweet-text", Usage: "What the image was posted with, for the openai prompt"},
+				},
+			},
+			{
+				Name:   "labels",
+				Usage:  "Name the objects, landmarks and brands in an image",
+				Action: labels,
+				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "provider", Value: "azure", Usage: "One of [azure|google]"},
+					&cli.StringFlag{Name: "url", Required: true},
+					&cli.BoolFlag{Name: "preprocess", Usage: "Download and preprocess the image, like the bot does, instead of sending the url"},
+					&cli.StringFlag{Name: "azure-endpoint", Value: vision.DefaultAzureEndpoint},
+				},
+			},
+			{
+				Name:   "hash",
+				Usage:  "Print the perceptual hash of each image, and how far apart they are",
+				Action: hash,
+				Flags: []cli.Flag{
+					&cli.StringSliceFlag{Name: "url", Required: true},
 				},
 			},
 			{
@@ -45,6 +95,8 @@ func main() {
 				Usage:  "Convert a string from one language to another",
 				Action: translate,
 				Flags: []cli.Flag{
+					&cli.StringFlag{Name: "provider", Value: "google", Usage: "One of [google|libretranslate|deepl]. deepl needs the DEEPL_AUTH_KEY secret"},
+					&cli.StringFlag{Name: "libretranslate-url", Value: "http://localhost:5000"},
 					&cli.StringFlag{Name: "lang", Required: true},
 					&cli.StringFlag{Name: "message", Required: true},
 				},
@@ -80,24 +132,56 @@ func onBefore(c *cli.Context) error {
 func ocr(c *cli.Context) error {
 	secrets, err := common.NewSecrets()
 	if err == nil {
-		tag, err := language.Parse(c.String("lang"))
+		var tag language.Tag
+		tag, err = language.Parse(c.String("lang"))
 		if err == nil {
 			ctx := message.WithLanguage(context.Background(), tag)
+			ctx = vision.WithNormalizeOptions(ctx, vision.NormalizeOptions{MinConfidence: float32(c.Float64("min-confidence"))})
+			hints := vision.OCRHints{Handwriting: c.Bool("handwriting")}
+			for _, hint := range c.StringSlice("hint") {
+				var hintTag language.Tag
+				hintTag, err = language.Parse(hint)
+				if err != nil {
+					return err
+				}
+				hints.Languages = append(hints.Languages, hintTag)
+			}
+			ctx = vision.WithOCRHints(ctx, hints)
 			var ocr vision.OCR
+			var options preprocess.Options
 			switch c.String("provider") {
 			case "google":
 				ocr, err = vision.NewGoogle(secrets.GooglePrivateKeyID, secrets.GooglePrivateKeySecret)
+				options = vision.GoogleImageOptions
 			case "azure":
-				ocr = vision.NewAzureVision(secrets.AzureComputerVisionKey).(vision.OCR)
+				ocr = vision.NewAzureOCR(secrets.AzureComputerVisionKey, azureConfig(c))
+				options = vision.AzureOCRImageOptions
 			default:
 				err = errors.New("invalid provider, must be [google|azure]")
 			}
 
+			var render func(*vision.OCRResult) (string, error)
+			if err == nil {
+				render, err = ocrRenderer(c.String("format"))
+			}
+
 			if err == nil {
 				var result *vision.OCRResult
-				result, err = ocr.GetOCR(ctx, c.String("url"))
+				if c.Bool("preprocess") {
+					var image []byte
+					image, err = downloadAndPreprocess(ctx, c.String("url"), options)
+					if err == nil {
+						result, err = ocr.GetOCRFromBytes(ctx, image)
+					}
+				} else {
+					result, err = ocr.GetOCR(ctx, c.String("url"))
+				}
+				var rendered string
 				if err == nil {
-					printJSON(result)
+					rendered, err = render(result)
+				}
+				if err == nil {
+					fmt.Println(rendered)
 				}
 			}
 		}
@@ -105,23 +189,51 @@ func ocr(c *cli.Context) error {
 	return err
 }
 
+func ocrRenderer(format string) (func(*vision.OCRResult) (string, error), error) {
+	switch format {
+	case "json":
+		return vision.RenderJSON, nil
+	case "text":
+		return func(result *vision.OCRResult) (string, error) { return vision.RenderText(result), nil }, nil
+	case "markdown":
+		return func(result *vision.OCRResult) (string, error) { return vision.RenderMarkdown(result), nil }, nil
+	}
+	return nil, errors.New("invalid format, must be [json|text|markdown]")
+}
+
 func caption(c *cli.Context) error {
 	secrets, err := common.NewSecrets()
 	if err == nil {
-		tag, err := language.Parse(c.String("lang"))
+		var tag language.Tag
+		tag, err = language.Parse(c.String("lang"))
 		if err == nil {
 			ctx := message.WithLanguage(context.Background(), tag)
+			ctx = vision.WithDescribeHints(ctx, vision.DescribeHints{TweetText: c.String("tweet-text")})
 			var describer vision.Describer
+			options := vision.AzureDescribeImageOptions
 			switch c.String("provider") {
 			case "azure":
-				describer = vision.NewAzureVision(secrets.AzureComputerVisionKey)
+				describer, err = vision.NewAzureVision(secrets.AzureComputerVisionKey, azureConfig(c))
+			case "openai":
+				openAIConfig := vision.OpenAIConfig{URL: c.String("openai-url"), Model: c.String("openai-model"), Prompt: c.String("openai-prompt")}
+				describer, err = vision.NewOpenAI(openAIConfig, secrets.OpenAIKey)
+				options = vision.OpenAIImageOptions
 			case "google":
 				err = errors.New("google is not a supported provider for image captions")
 			default:
-				err = errors.New("invalid provider, must be [google|azure]")
+				err = errors.New("invalid provider, must be [google|azure|openai]")
 			}
 			if err == nil {
-				results, err := describer.Describe(ctx, c.String("url"))
+				var results []vision.VisionResult
+				if c.Bool("preprocess") {
+					var image []byte
+					image, err = downloadAndPreprocess(ctx, c.String("url"), options)
+					if err == nil {
+						results, err = describer.DescribeBytes(ctx, image)
+					}
+				} else {
+					results, err = describer.Describe(ctx, c.String("url"))
+				}
 				if err == nil {
 					for _, result := range results {
 						printJSON(result)
@@ -133,6 +245,78 @@ func caption(c *cli.Context) error {
 	return err
 }
 
+func ask(c *cli.Context) error {
+	secrets, err := common.NewSecrets()
+	if err == nil {
+		var tag language.Tag
+		tag, err = language.Parse(c.String("lang"))
+		if err == nil {
+			ctx := message.WithLanguage(context.Background(), tag)
+			ctx = vision.WithDescribeHints(ctx, vision.DescribeHints{TweetText: c.String("tweet-text")})
+			var answerer vision.QuestionAnswerer
+			openAIConfig := vision.OpenAIConfig{URL: c.String("openai-url"), Model: c.String("openai-model"), QuestionPrompt: c.String("openai-question-prompt")}
+			answerer, err = vision.NewOpenAI(openAIConfig, secrets.OpenAIKey)
+			if err == nil {
+				var results []vision.VisionResult
+				if c.Bool("preprocess") {
+					var image []byte
+					image, err = downloadAndPreprocess(ctx, c.String("url"), vision.OpenAIImageOptions)
+					if err == nil {
+						results, err = answerer.AnswerBytes(ctx, image, c.String("question"))
+					}
+				} else {
+					results, err = answerer.Answer(ctx, c.String("url"), c.String("question"))
+				}
+				if err == nil {
+					for _, result := range results {
+						printJSON(result)
+					}
+				}
+			}
+		}
+	}
+	return err
+}
+
+func labels(c *cli.Context) error {
+	secrets, err := common.NewSecrets()
+	if err == nil {
+		ctx := context.Background()
+		var labeler vision.Labeler
+		switch c.String("provider") {
+		case "azure":
+			labeler = vision.NewAzureLabeler(secrets.AzureComputerVisionKey, vision.AzureConfig{Endpoint: c.String("azure-endpoint")})
+		case "google":
+			labeler, err = vision.NewGoogle(secrets.GooglePrivateKeyID, secrets.GooglePrivateKeySecret)
+		default:
+			err = errors.New("invalid provider, must be [azure|google]")
+		}
+		if err == nil {
+			var results []vision.Label
+			if c.Bool("preprocess") {
+				var image []byte
+				image, err = downloadAndPreprocess(ctx, c.String("url"), vision.LabelImageOptions)
+				if err == nil {
+					results, err = labeler.GetLabelsFromBytes(ctx, image)
+				}
+			} else {
+				results, err = labeler.GetLabels(ctx, c.String("url"))
+			}
+			if err == nil {
+				for _, result := range results {
+					printJSON(result)
+				}
+			}
+		}
+	}
+	return err
+}
+
+// The ocr command doesn't have an api version flag, since azure OCR is always v3.1
+func azureConfig(c *cli.Context) vision.AzureConfig {
+	return vision.AzureConfig{Endpoint: c.String("azure-endpoint"), APIVersion: c.String("azure-api-version")}
+}
+
 func translate(c *cli.Context) error {
 	secrets, err := common.NewSecrets()
 	if err == nil {
@@ -141,7 +325,16 @@ func translate(c *cli.Context) error {
 		if err == nil {
 			ctx := message.WithLanguage(context.Background(), tag)
 			var translator vision.Translator
-			translator, err = vision.NewGoogle(secrets.GooglePrivateKeyID, secrets.GooglePrivateKeySecret)
+			switch c.String("provider") {
+			case "google":
+				translator, err = vision.NewGoogle(secrets.GooglePrivateKeyID, secrets.GooglePrivateKeySecret)
+			case "libretranslate":
+				translator = vision.NewLibreTranslate(c.String("libretranslate-url"), secrets.LibreTranslateKey)
+			case "deepl":
+				translator = vision.NewDeepL(secrets.DeepLAuthKey)
+			default:
+				err = errors.New("invalid provider, must be [google|libretranslate|deepl]")
+			}
 			if err == nil {
 				var result string
 				tag, result, err = translator.Translate(ctx, c.String("message"))
@@ -182,6 +375,51 @@ func transcribe(c *cli.Context) error {
 
 }
 
+func hash(c *cli.Context) error {
+	urls := c.StringSlice("url")
+	hashes := make([]preprocess.Hash, len(urls))
+	for i, url := range urls {
+		image, err := download(c.Context, url)
+		if err == nil {
+			hashes[i], err = preprocess.HashImage(image)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %v", url, err)
+		}
+		fmt.Printf("%s %s\n", hashes[i], url)
+	}
+	for i := range urls {
+		for j := i + 1; j < len(urls); j++ {
+			fmt.Printf("%s <-> %s: %d\n", urls[i], urls[j], hashes[i].Distance(hashes[j]))
+		}
+	}
+	return nil
+}
+
+func downloadAndPreprocess(ctx context.Context, url string, options preprocess.Options) ([]byte, error) {
+	image, err := download(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return preprocess.Process(image, options)
+}
+
+func download(ctx context.Context, url string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return nil, fmt.Errorf("downloading the URL failed with status code %d", response.StatusCode)
+	}
+	return ioutil.ReadAll(response.Body)
+}
+
 func printJSON(v interface{}) {
 	message, _ := json.MarshalIndent(v, "", "  ")
 	fmt.Println(string(message))
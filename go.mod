@@ -13,14 +13,17 @@ require (
 	github.com/Azure/go-autorest/autorest v0.11.19
 	github.com/Azure/go-autorest/autorest/validation v0.3.1 // indirect
 	github.com/fortytw2/leaktest v1.3.0
-	github.com/gofrs/uuid v4.0.0+incompatible // indirect
+	github.com/gofrs/uuid v4.0.0+incompatible
 	github.com/google/uuid v1.3.0
 	github.com/kylemcc/twitter-text-go v0.0.0-20180726194232-7f582f6736ec // indirect
 	github.com/mrjones/oauth v0.0.0-20190623134757-126b35219450
 	github.com/sirupsen/logrus v1.8.1
 	github.com/stretchr/testify v1.7.0
 	github.com/urfave/cli/v2 v2.3.0
-	golang.org/x/text v0.3.6
+	golang.org/x/image v0.18.0
+	golang.org/x/text v0.16.0
 	google.golang.org/api v0.58.0
 	google.golang.org/genproto v0.0.0-20211016002631-37fc39342514
+	google.golang.org/grpc v1.40.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"sync"
 	"time"
@@ -13,27 +14,77 @@ import (
 	"github.com/AnilRedshift/captions_please_go/internal/api/common"
 	"github.com/AnilRedshift/captions_please_go/internal/api/handle_command"
 	"github.com/AnilRedshift/captions_please_go/internal/api/replier"
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
 	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
 	"github.com/sirupsen/logrus"
 )
 
 type activityData struct {
 	CreateData      []twitter.Tweet `json:"tweet_create_events"`
+	DeleteData      []deleteEvent   `json:"tweet_delete_events"`
 	FromBlockedUser bool            `json:"user_has_blocked"`
 	UserId          string          `json:"source"`
 	BotId           string          `json:"for_user_id"`
 }
 
+type deleteEvent struct {
+	Status struct {
+		Id     string `json:"id"`
+		UserId string `json:"user_id"`
+	} `json:"status"`
+}
+
 type ActivityConfig struct {
 	Workers            uint
 	MaxOutstandingJobs uint
 	WebhookTimeout     time.Duration
 	DryRun             bool
+	MaxTweetLength     int
+	NumberReplies      bool
+	// How many commands can wait for twitter's rate limits at once. Any more are dropped. Zero uses MaxOutstandingJobs
+	MaxDeferredJobs uint
+	// Unfinished reply threads, and the ids of the replies we've posted, are saved here so they survive a restart.
+	// If empty they're only kept in memory
+	ReplyStateDir string
+	// How long the ids of the replies we've posted are kept, so they can be deleted. Zero uses the replier's default of 30 days
+	ReplyRetention time.Duration
+	// How many mentions each user can send before being asked to slow down
+	UserQuota UserQuota
+	// User ids which aren't subject to the UserQuota
+	AllowedUsers []string
+	// User ids whose mentions are always ignored
+	BlockedUsers []string
+	// The users who asked us to stop interpreting their tweets are saved here. If empty they're only kept in memory
+	OptOutFile string
+	// How long each command has before replying with whatever results it has. Zero uses the default
+	JobTimeout time.Duration
+	// How many calls can be made to each provider at once, shared by all of the workers
+	ProviderLimits handle_command.ProviderLimits
+	// Decides what to say about each image, see handle_command.ResponsePolicyNames. Empty uses the default
+	ResponsePolicy string
+	// How confidently the descriptions are worded. Zero thresholds use message.DefaultConfidenceWording
+	ConfidenceWording message.ConfidenceWording
+	// Which service translates the results. Defaults to google
+	Translator handle_command.TranslatorConfig
+	// How the text found in images is cleaned up
+	OCRNormalization vision.NormalizeOptions
+	// Which azure resource describes images and reads handwriting, and which API describes them
+	Azure vision.AzureConfig
+	// azure or openai. Empty uses azure
+	Describer string
+	// The server that describes images when Describer is openai. It also answers questions about them when its URL is set
+	OpenAI vision.OpenAIConfig
+	// azure or google. Empty uses azure
+	Labeler string
 }
 
 type activityState struct {
-	jobs   chan common.ActivityJob
+	queue  *fairQueue
+	users  *userLimiter
 	config ActivityConfig
+	// Jobs waiting for twitter's rate limits, which are queued again afterwards
+	deferred *deferredJobs
 }
 
 type activityStateKey int
@@ -46,43 +97,120 @@ func WithAccountActivity(ctx context.Context, config ActivityConfig, client twit
 	logrus.Debug(fmt.Sprintf("Initializing AccountActivity with %d workers and %d outstanding jobs", config.Workers, config.MaxOutstandingJobs))
 	state := &activityState{
 		config: config,
-		jobs:   make(chan common.ActivityJob, config.MaxOutstandingJobs),
+		// Leave room for the jobs being worked on, in addition to the outstanding ones
+		queue:    newFairQueue(int(config.MaxOutstandingJobs + config.Workers)),
+		users:    newUserLimiter(config.UserQuota, config.AllowedUsers, config.BlockedUsers),
+		deferred: newDeferredJobs(int(config.MaxDeferredJobs)),
 	}
 	ctx = context.WithValue(ctx, theActivityStateKey, state)
 	ctx = handle_command.WithHandleCommand(ctx, client)
-	ctx, err = handle_command.WithOCR(ctx)
+	if config.JobTimeout > 0 {
+		ctx = handle_command.WithJobTimeout(ctx, config.JobTimeout)
+	}
+	ctx = handle_command.WithProviderLimits(ctx, config.ProviderLimits)
+	ctx = message.WithConfidenceWording(ctx, config.ConfidenceWording)
+	ctx = vision.WithNormalizeOptions(ctx, config.OCRNormalization)
+	if config.ResponsePolicy != "" {
+		ctx, err = handle_command.WithResponsePolicy(ctx, config.ResponsePolicy)
+		if err != nil {
+			return ctx, err
+		}
+	}
+	if config.OptOutFile != "" {
+		var optOuts handle_command.OptOutStore
+		optOuts, err = handle_command.NewFileOptOutStore(config.OptOutFile)
+		if err != nil {
+			return ctx, err
+		}
+		ctx = handle_command.WithOptOutStore(ctx, optOuts)
+	}
+	ctx, err = handle_command.WithTranslator(ctx, config.Translator)
 	if err == nil {
-		ctx, err = handle_command.WithDescribe(ctx)
+		ctx, err = handle_command.WithOCR(ctx, config.Azure)
+	}
+	if err == nil {
+		ctx, err = handle_command.WithDescribe(ctx, handle_command.DescriberConfig{Provider: config.Describer, Azure: config.Azure, OpenAI: config.OpenAI})
+	}
+
+	if err == nil {
+		ctx, err = handle_command.WithAsk(ctx, config.OpenAI)
+	}
+
+	if err == nil {
+		ctx, err = handle_command.WithLabels(ctx, handle_command.LabelerConfig{Provider: config.Labeler, Azure: config.Azure})
 	}
 
 	if err == nil {
 		ctx, err = handle_command.WithAltText(ctx)
 	}
 
+	var threadStore replier.ThreadStore
+	var replyIndex replier.ReplyIndex
+	if err == nil && config.ReplyStateDir != "" {
+		threadStore, err = replier.NewFileThreadStore(config.ReplyStateDir)
+		if err == nil {
+			replyIndex, err = replier.NewFileReplyIndex(filepath.Join(config.ReplyStateDir, "replies"))
+		}
+	}
+
 	if err == nil {
-		ctx, err = replier.WithReplier(ctx, client, config.DryRun)
+		replierConfig := replier.Config{
+			DryRun:         config.DryRun,
+			Split:          replier.SplitOptions{MaxLength: config.MaxTweetLength, Numbered: config.NumberReplies},
+			Store:          threadStore,
+			Index:          replyIndex,
+			ReplyRetention: config.ReplyRetention,
+		}
+		ctx, err = replier.WithReplier(ctx, client, replierConfig)
 	}
 
 	if err == nil {
 		for i := 0; i < int(config.Workers); i++ {
 			go func(i int) {
 				logrus.Debug(fmt.Sprintf("Initializing Activity worker %d", i))
-				for job := range state.jobs {
+				for {
+					job, ok := state.queue.pop(ctx)
+					if !ok {
+						return
+					}
 					logrus.Debug(fmt.Sprintf("Worker %d processing job %s", i, job.Tweet.Id))
-					job.Out <- handleNewTweetActivity(ctx, job)
+					result := handleNewTweetActivity(ctx, job)
+					if result.RetryAfter > 0 {
+						job.NotBefore = time.Now().Add(result.RetryAfter)
+						err := state.deferred.add(job, func(job common.ActivityJob) {
+							state.queue.requeue(job, job.Tweet.User.Id)
+						})
+						if err == nil {
+							logrus.Info(fmt.Sprintf("Worker %d deferred job %s for %v", i, job.Tweet.Id, result.RetryAfter))
+							// The job keeps its slot and out channel until it's run again
+							continue
+						}
+						result = common.ActivityResult{Tweet: job.Tweet, Action: "dropping rate limited command", Err: err}
+					}
+					job.Out <- result
 					close(job.Out)
+					state.queue.done()
 				}
 			}(i)
 		}
 
 		go func() {
 			<-ctx.Done()
-			close(state.jobs)
+			for _, job := range state.deferred.close() {
+				dropDeferredJob(job, ctx.Err())
+				state.queue.done()
+			}
 		}()
 	}
 	return ctx, err
 }
 
+// Lets the caller know a deferred job won't be run after all
+func dropDeferredJob(job common.ActivityJob, err error) {
+	job.Out <- common.ActivityResult{Tweet: job.Tweet, Action: "dropping rate limited command", Err: err}
+	close(job.Out)
+}
+
 func singleActivityResult(result common.ActivityResult) <-chan common.ActivityResult {
 	logrus.Debug(fmt.Sprintf("Sending single action %s and err %v", result.Action, result.Err))
 	// It's important to buffer this channel because we haven't returned the out channel to the caller
@@ -110,7 +238,7 @@ func AccountActivityWebhook(ctx context.Context, req *http.Request) (APIResponse
 		return APIResponse{Status: http.StatusOK}, singleActivityResult(common.ActivityResult{Action: "ignoring blocked user"})
 	}
 
-	if len(data.CreateData) == 0 {
+	if len(data.CreateData) == 0 && len(data.DeleteData) == 0 {
 		return APIResponse{Status: http.StatusOK}, singleActivityResult(common.ActivityResult{Action: "no creation events"})
 	}
 
@@ -119,7 +247,7 @@ func AccountActivityWebhook(ctx context.Context, req *http.Request) (APIResponse
 
 	// 2. Create a wait group so we know when all the tweets have been processed & we can close the combinedOut multiplexer
 	wg := sync.WaitGroup{}
-	wg.Add(len(data.CreateData))
+	wg.Add(len(data.CreateData) + len(data.DeleteData))
 
 	state := getActivityState(ctx)
 	for _, tweet := range data.CreateData {
@@ -131,13 +259,18 @@ func AccountActivityWebhook(ctx context.Context, req *http.Request) (APIResponse
 		tweet := tweet
 		job := common.ActivityJob{BotId: data.BotId, Tweet: &tweet, Out: out}
 		go func() {
-			select {
-			case state.jobs <- job:
-				logrus.Debug(fmt.Sprintf("Activity: Enqueued tweet %s", tweet.Id))
+			if result := state.admit(&job); result != nil {
+				out <- *result
+				close(out)
+				return
+			}
 
-			case <-time.After(state.config.WebhookTimeout):
+			err := state.queue.push(job, tweet.User.Id, state.config.WebhookTimeout)
+			if err == nil {
+				logrus.Debug(fmt.Sprintf("Activity: Enqueued tweet %s", tweet.Id))
+			} else {
 				logrus.Info(fmt.Sprintf("Job queue is backed up, dropping tweet %s", tweet.Id))
-				result := common.ActivityResult{Action: "enqueue activity job", Err: errors.New("timeout")}
+				result := common.ActivityResult{Action: "enqueue activity job", Err: err}
 				out <- result
 				close(out)
 			}
@@ -154,6 +287,15 @@ func AccountActivityWebhook(ctx context.Context, req *http.Request) (APIResponse
 		}()
 	}
 
+	// Deleting replies is quick, so it doesn't need to go through the job queue
+	for _, event := range data.DeleteData {
+		event := event
+		go func() {
+			combinedOut <- handleDeleteActivity(ctx, event)
+			wg.Done()
+		}()
+	}
+
 	go func() {
 		// 6. Wait for all the goroutines to finish transfering results to combinedOut
 		// Now we can close the combinedOut channel and let callers know we're done
@@ -167,6 +309,24 @@ func getActivityState(ctx context.Context) *activityState {
 	return ctx.Value(theActivityStateKey).(*activityState)
 }
 
+// Applies the allow/block lists and per-user quotas. Returns a result if the job shouldn't be queued
+func (state *activityState) admit(job *common.ActivityJob) *common.ActivityResult {
+	tweet := job.Tweet
+	if getVisibleMention(job.BotId, tweet) == nil || tweet.User.Id == job.BotId || tweet.Type == twitter.Retweet {
+		// The workers ignore these, so they shouldn't count against anyone's quota
+		return nil
+	}
+	switch state.users.admit(tweet.User.Id) {
+	case blocked:
+		return &common.ActivityResult{Tweet: tweet, Action: "ignoring blocked user"}
+	case overQuota:
+		job.SlowDown = true
+	case stillOverQuota:
+		return &common.ActivityResult{Tweet: tweet, Action: "ignoring user over quota"}
+	}
+	return nil
+}
+
 func handleNewTweetActivity(ctx context.Context, job common.ActivityJob) common.ActivityResult {
 	botMention := getVisibleMention(job.BotId, job.Tweet)
 	if botMention == nil || job.Tweet.User.Id == job.BotId {
@@ -177,9 +337,24 @@ func handleNewTweetActivity(ctx context.Context, job common.ActivityJob) common.
 		return common.ActivityResult{Tweet: job.Tweet, Action: "Not responding to a retweet"}
 	}
 	commandMessage := getCommand(job.Tweet, botMention)
+	if job.SlowDown {
+		return handle_command.SlowDown(ctx, commandMessage, job.Tweet)
+	}
 	return handle_command.HandleCommand(ctx, commandMessage, job.Tweet)
 }
 
+// When a tweet we replied to is deleted, our replies to it are deleted too
+func handleDeleteActivity(ctx context.Context, event deleteEvent) common.ActivityResult {
+	tweet := &twitter.Tweet{Id: event.Status.Id, User: twitter.User{Id: event.Status.UserId}}
+	replies, ok := replier.FindReplies(ctx, event.Status.Id)
+	// Only the source tweet counts, deleting one of our own replies shouldn't take the rest of the thread with it
+	if !ok || replies.SourceId != event.Status.Id {
+		return common.ActivityResult{Tweet: tweet, Action: "no replies to delete"}
+	}
+	err := replier.DeleteReplies(ctx, replies)
+	return common.ActivityResult{Tweet: tweet, Action: "deleted replies to a deleted tweet", Err: err}
+}
+
 func getVisibleMention(botId string, tweet *twitter.Tweet) *twitter.Mention {
 	for _, mention := range tweet.Mentions {
 		if mention.Id == botId && mention.Visible {
@@ -236,4 +411,20 @@ func validateActivityConfig(config *ActivityConfig) {
 	if config.Workers == 0 {
 		config.Workers = 1
 	}
+
+	if config.MaxDeferredJobs == 0 {
+		config.MaxDeferredJobs = config.MaxOutstandingJobs
+	}
+
+	if config.ConfidenceWording.Certain == 0 {
+		config.ConfidenceWording.Certain = message.DefaultConfidenceWording.Certain
+	}
+
+	if config.ConfidenceWording.Likely == 0 {
+		config.ConfidenceWording.Likely = message.DefaultConfidenceWording.Likely
+	}
+
+	if config.UserQuota.Limit > 0 && config.UserQuota.Window == 0 {
+		config.UserQuota.Window = time.Hour
+	}
 }
@@ -4,17 +4,20 @@ import (
 	"context"
 	"io"
 	"net/http"
+	"path/filepath"
 	"strings"
 	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/internal/api/replier"
 	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
 	twitter_test "github.com/AnilRedshift/captions_please_go/pkg/twitter/test"
 	vision_test "github.com/AnilRedshift/captions_please_go/pkg/vision/test"
 	"github.com/fortytw2/leaktest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestWithAccountActivity(t *testing.T) {
@@ -35,10 +38,14 @@ func TestAccountActivityWebhook(t *testing.T) {
 	// logrus.SetLevel(logrus.DebugLevel)
 	botEntity := "\"entities\":{\"user_mentions\":[{\"id_str\":\"123\", \"screen_name\":\"captions_please\", \"name\":\"myName\", \"indices\":[0,16]}]}"
 	helpTweet := "{\"id_str\":\"helpTweet\", \"text\": \"@captions_please help\", " + botEntity + "}"
+	userHelpTweet := "{\"id_str\":\"userHelpTweet\", \"user\":{\"id_str\":\"42\"}, \"text\": \"@captions_please help\", " + botEntity + "}"
 	tests := []struct {
 		name               string
 		message            string
 		maxOutstandingJobs uint
+		userQuota          UserQuota
+		blockedUsers       []string
+		savedReplies       []replier.Replies
 		apiResponse        APIResponse
 		timesToDelay       int
 		numErrors          int
@@ -82,6 +89,34 @@ func TestAccountActivityWebhook(t *testing.T) {
 			apiResponse:     APIResponse{Status: http.StatusOK},
 			expectedActions: []string{"Not responding to a retweet"},
 		},
+		{
+			name:            "Ignores mentions from users on the block list",
+			message:         "{\"for_user_id\":\"123\", \"tweet_create_events\":[" + userHelpTweet + "]}",
+			blockedUsers:    []string{"42"},
+			apiResponse:     APIResponse{Status: http.StatusOK},
+			expectedActions: []string{"ignoring blocked user"},
+		},
+		{
+			name:            "Asks users over their quota to slow down once",
+			message:         "{\"for_user_id\":\"123\", \"tweet_create_events\":[" + userHelpTweet + "," + userHelpTweet + "," + userHelpTweet + "]}",
+			userQuota:       UserQuota{Limit: 1, Window: time.Hour},
+			apiResponse:     APIResponse{Status: http.StatusOK},
+			expectedActions: []string{"reply with help", "reply with slow down message", "ignoring user over quota"},
+		},
+		{
+			name:            "Deletes our replies when the tweet we replied to is deleted",
+			message:         "{\"for_user_id\":\"123\", \"tweet_delete_events\":[{\"status\":{\"id\":\"source\", \"user_id\":\"42\"}}]}",
+			savedReplies:    []replier.Replies{{SourceId: "source", RequesterId: "42", ReplyIds: []string{"reply"}}},
+			apiResponse:     APIResponse{Status: http.StatusOK},
+			expectedActions: []string{"deleted replies to a deleted tweet"},
+		},
+		{
+			name:            "Keeps the rest of the thread when one of our replies is deleted",
+			message:         "{\"for_user_id\":\"123\", \"tweet_delete_events\":[{\"status\":{\"id\":\"reply\", \"user_id\":\"123\"}}]}",
+			savedReplies:    []replier.Replies{{SourceId: "source", RequesterId: "42", ReplyIds: []string{"reply", "reply2"}}},
+			apiResponse:     APIResponse{Status: http.StatusOK},
+			expectedActions: []string{"no replies to delete"},
+		},
 		// TODO replace with a new test
 		// {
 		// 	name:            "times out if the webhooks are backed up",
@@ -109,10 +144,24 @@ func TestAccountActivityWebhook(t *testing.T) {
 				tweet := twitter.Tweet{Id: "234"}
 				return &tweet, nil
 			}}
+			mockTwitter.DeleteTweetMock = func(tweetID string) error {
+				assert.Equal(t, "reply", tweetID)
+				return nil
+			}
 			config := ActivityConfig{
 				Workers:            1,
 				MaxOutstandingJobs: test.maxOutstandingJobs,
 				WebhookTimeout:     time.Millisecond * 100,
+				UserQuota:          test.userQuota,
+				BlockedUsers:       test.blockedUsers,
+			}
+			if test.savedReplies != nil {
+				config.ReplyStateDir = t.TempDir()
+				index, err := replier.NewFileReplyIndex(filepath.Join(config.ReplyStateDir, "replies"))
+				require.NoError(t, err)
+				for _, replies := range test.savedReplies {
+					require.NoError(t, index.Put(replies))
+				}
 			}
 			ctx, err := WithAccountActivity(ctx, config, mockTwitter)
 			assert.NoError(t, err)
@@ -214,3 +263,78 @@ func TestGetCommand(t *testing.T) {
 		})
 	}
 }
+
+func TestAccountActivityWebhookDefersRateLimitedCommands(t *testing.T) {
+	userHelpTweet := "{\"id_str\":\"userHelpTweet\", \"user\":{\"id_str\":\"42\"}, \"text\": \"@captions_please help\", \"entities\":{\"user_mentions\":[{\"id_str\":\"123\", \"screen_name\":\"captions_please\", \"name\":\"myName\", \"indices\":[0,16]}]}}"
+	tests := []struct {
+		name               string
+		maxOutstandingJobs uint
+		shutdown           bool
+		expectedAction     string
+		hasErr             bool
+	}{
+		{
+			name:               "Runs the command again once the rate limit has passed",
+			maxOutstandingJobs: 1,
+			expectedAction:     "reply with help",
+		},
+		{
+			name:           "Drops the command when too many are already deferred",
+			expectedAction: "dropping rate limited command",
+			hasErr:         true,
+		},
+		{
+			name:               "Drops the command when shutting down before it runs again",
+			maxOutstandingJobs: 1,
+			shutdown:           true,
+			expectedAction:     "dropping rate limited command",
+			hasErr:             true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer leaktest.Check(t)()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			origAfterFunc := afterFunc
+			defer func() {
+				afterFunc = origAfterFunc
+			}()
+			afterFunc = func(d time.Duration, f func()) *time.Timer {
+				if test.shutdown {
+					cancel()
+				} else {
+					go f()
+				}
+				return time.NewTimer(d)
+			}
+			secrets := &common.Secrets{GooglePrivateKeySecret: vision_test.DummyGoogleCert}
+			ctx = common.SetSecrets(ctx, secrets)
+			var checks int32
+			mockTwitter := &twitter_test.MockTwitter{T: t,
+				TweetReplyMock: func(*twitter.Tweet, string) (*twitter.Tweet, error) {
+					return &twitter.Tweet{Id: "234"}, nil
+				},
+				RateLimitMock: func(route string) twitter.RateLimit {
+					// Only the first command is rate limited
+					if atomic.AddInt32(&checks, 1) <= 2 {
+						return twitter.RateLimit{Delay: time.Minute * 5}
+					}
+					return twitter.RateLimit{}
+				},
+			}
+			config := ActivityConfig{Workers: 1, MaxOutstandingJobs: test.maxOutstandingJobs, WebhookTimeout: time.Second}
+			ctx, err := WithAccountActivity(ctx, config, mockTwitter)
+			require.NoError(t, err)
+			message := "{\"for_user_id\":\"123\", \"tweet_create_events\":[" + userHelpTweet + "]}"
+			_, out := AccountActivityWebhook(ctx, &http.Request{Body: io.NopCloser(strings.NewReader(message))})
+			results := []common.ActivityResult{}
+			for result := range out {
+				results = append(results, result)
+			}
+			require.Len(t, results, 1)
+			assert.Equal(t, test.expectedAction, results[0].Action)
+			assert.Equal(t, test.hasErr, results[0].Err != nil)
+		})
+	}
+}
@@ -1,15 +1,25 @@
 package common
 
-import "github.com/AnilRedshift/captions_please_go/pkg/twitter"
+import (
+	"time"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+)
 
 type ActivityResult struct {
 	Tweet  *twitter.Tweet
 	Action string
 	Err    error
+	// Set when twitter's rate limits mean the command can't run yet. The job should be run again after this long
+	RetryAfter time.Duration
 }
 
 type ActivityJob struct {
 	BotId string
 	Tweet *twitter.Tweet
 	Out   chan<- ActivityResult
+	// The user has gone over their quota, so tell them to slow down instead of running the command
+	SlowDown bool
+	// The job was deferred by the rate limits, and isn't handed out again until then
+	NotBefore time.Time
 }
@@ -18,6 +18,12 @@ type Secrets struct {
 	GooglePrivateKeySecret   string
 	AzureComputerVisionKey   string
 	AssemblyAIKey            string
+	// Only needed when translating with DeepL
+	DeepLAuthKey string
+	// Only needed when the LibreTranslate server requires one
+	LibreTranslateKey string
+	// Only needed when the OpenAI compatible server that describes images requires one
+	OpenAIKey string
 }
 
 type key int
@@ -29,26 +35,30 @@ var lookupEnv = os.LookupEnv
 
 func NewSecrets() (*Secrets, error) {
 	data := []struct {
-		name string
-		env  string
+		name     string
+		env      string
+		optional bool
 	}{
-		{"TwitterConsumerKey", "TWITTER_CONSUMER_KEY"},
-		{"TwitterConsumerSecret", "TWITTER_CONSUMER_SECRET"},
-		{"TwitterAccessToken", "TWITTER_ACCESS_TOKEN"},
-		{"TwitterAccessTokenSecret", "TWITTER_ACCESS_TOKEN_SECRET"},
-		{"TwitterBearerToken", "TWITTER_BEARER_TOKEN"},
-		{"WebhookUrl", "CAPTIONS_PLEASE_CALLBACK_URL"},
-		{"GooglePrivateKeyID", "GOOGLE_PRIVATE_KEY_ID"},
-		{"GooglePrivateKeySecret", "GOOGLE_PRIVATE_KEY_SECRET"},
-		{"AzureComputerVisionKey", "AZURE_COMPUTER_VISION_KEY"},
-		{"AssemblyAIKey", "ASSEMBLY_AI_KEY"},
+		{"TwitterConsumerKey", "TWITTER_CONSUMER_KEY", false},
+		{"TwitterConsumerSecret", "TWITTER_CONSUMER_SECRET", false},
+		{"TwitterAccessToken", "TWITTER_ACCESS_TOKEN", false},
+		{"TwitterAccessTokenSecret", "TWITTER_ACCESS_TOKEN_SECRET", false},
+		{"TwitterBearerToken", "TWITTER_BEARER_TOKEN", false},
+		{"WebhookUrl", "CAPTIONS_PLEASE_CALLBACK_URL", false},
+		{"GooglePrivateKeyID", "GOOGLE_PRIVATE_KEY_ID", false},
+		{"GooglePrivateKeySecret", "GOOGLE_PRIVATE_KEY_SECRET", false},
+		{"AzureComputerVisionKey", "AZURE_COMPUTER_VISION_KEY", false},
+		{"AssemblyAIKey", "ASSEMBLY_AI_KEY", false},
+		{"DeepLAuthKey", "DEEPL_AUTH_KEY", true},
+		{"LibreTranslateKey", "LIBRETRANSLATE_API_KEY", true},
+		{"OpenAIKey", "OPENAI_API_KEY", true},
 	}
 
 	secrets := Secrets{}
 	for _, item := range data {
 		field := reflect.ValueOf(&secrets).Elem().FieldByName(item.name)
 		secret, ok := lookupEnv(item.env)
-		if !ok || secret == "" {
+		if (!ok || secret == "") && !item.optional {
 			return nil, fmt.Errorf("missing %s secret", item.env)
 		}
 		field.Set(reflect.ValueOf(secret))
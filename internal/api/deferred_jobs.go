@@ -0,0 +1,78 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+)
+
+var afterFunc = time.AfterFunc
+
+type deferredJob struct {
+	job   common.ActivityJob
+	timer *time.Timer
+}
+
+// Holds the jobs which are waiting for twitter's rate limits, until they can be queued again
+type deferredJobs struct {
+	lock    sync.Mutex
+	waiting map[int]deferredJob
+	nextId  int
+	max     int
+	closed  bool
+	// Counts the jobs which are being handed back to the queue
+	queueing sync.WaitGroup
+}
+
+func newDeferredJobs(max int) *deferredJobs {
+	return &deferredJobs{waiting: map[int]deferredJob{}, max: max}
+}
+
+// Calls queue with the job once job.NotBefore has passed. Returns an error if too many jobs are already waiting,
+// or the jobs have been closed, and the caller still has to finish the job
+func (d *deferredJobs) add(job common.ActivityJob, queue func(common.ActivityJob)) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.closed {
+		return errors.New("shutting down")
+	}
+	if len(d.waiting) >= d.max {
+		return fmt.Errorf("there are already %d deferred jobs", len(d.waiting))
+	}
+	id := d.nextId
+	d.nextId++
+	timer := afterFunc(time.Until(job.NotBefore), func() {
+		d.lock.Lock()
+		_, ok := d.waiting[id]
+		if ok {
+			delete(d.waiting, id)
+			d.queueing.Add(1)
+		}
+		d.lock.Unlock()
+		if ok {
+			queue(job)
+			d.queueing.Done()
+		}
+	})
+	d.waiting[id] = deferredJob{job: job, timer: timer}
+	return nil
+}
+
+// Stops the waiting jobs from being queued, and returns them so the caller can finish them.
+// Once it returns, no more jobs will be queued
+func (d *deferredJobs) close() []common.ActivityJob {
+	d.lock.Lock()
+	d.closed = true
+	jobs := make([]common.ActivityJob, 0, len(d.waiting))
+	for id, waiting := range d.waiting {
+		waiting.timer.Stop()
+		jobs = append(jobs, waiting.job)
+		delete(d.waiting, id)
+	}
+	d.lock.Unlock()
+	d.queueing.Wait()
+	return jobs
+}
@@ -0,0 +1,65 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeferredJobs(t *testing.T) {
+	origAfterFunc := afterFunc
+	defer func() {
+		afterFunc = origAfterFunc
+	}()
+	fire := make(chan func(), 1)
+	var requestedDelay time.Duration
+	afterFunc = func(d time.Duration, f func()) *time.Timer {
+		requestedDelay = d
+		fire <- f
+		return time.NewTimer(d)
+	}
+
+	deferred := newDeferredJobs(1)
+	queued := make(chan common.ActivityJob, 1)
+	queue := func(job common.ActivityJob) { queued <- job }
+	job := common.ActivityJob{Tweet: &twitter.Tweet{Id: "1"}, NotBefore: time.Now().Add(time.Minute)}
+	assert.NoError(t, deferred.add(job, queue))
+	assert.InDelta(t, time.Minute, requestedDelay, float64(time.Second))
+
+	// Only one job can wait at once
+	other := common.ActivityJob{Tweet: &twitter.Tweet{Id: "2"}}
+	assert.Error(t, deferred.add(other, queue))
+
+	(<-fire)()
+	assert.Equal(t, "1", (<-queued).Tweet.Id)
+	assert.NoError(t, deferred.add(other, queue))
+}
+
+func TestDeferredJobsClose(t *testing.T) {
+	origAfterFunc := afterFunc
+	defer func() {
+		afterFunc = origAfterFunc
+	}()
+	fire := make(chan func(), 1)
+	afterFunc = func(d time.Duration, f func()) *time.Timer {
+		fire <- f
+		return time.NewTimer(d)
+	}
+
+	deferred := newDeferredJobs(1)
+	queue := func(job common.ActivityJob) {
+		assert.Fail(t, "closed jobs shouldn't be queued")
+	}
+	job := common.ActivityJob{Tweet: &twitter.Tweet{Id: "1"}, NotBefore: time.Now().Add(time.Minute)}
+	assert.NoError(t, deferred.add(job, queue))
+	jobs := deferred.close()
+	assert.Len(t, jobs, 1)
+	assert.Equal(t, "1", jobs[0].Tweet.Id)
+
+	// The timer firing anyway doesn't queue the job, and nothing else can be deferred
+	(<-fire)()
+	assert.Error(t, deferred.add(job, queue))
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+)
+
+// Hands out jobs round-robin across users, so a single account sending lots of mentions
+// only delays its own jobs instead of starving everyone else.
+type fairQueue struct {
+	lock sync.Mutex
+	// Users with waiting jobs, in the order they'll next be served
+	users []string
+	jobs  map[string][]common.ActivityJob
+	// Holds a token for every job that's waiting or being worked on, to apply backpressure
+	slots chan struct{}
+	// Holds a token for every job that's waiting
+	ready chan struct{}
+}
+
+// capacity is the maximum number of jobs which can be waiting or in progress at once
+func newFairQueue(capacity int) *fairQueue {
+	return &fairQueue{
+		jobs:  map[string][]common.ActivityJob{},
+		slots: make(chan struct{}, capacity),
+		ready: make(chan struct{}, capacity),
+	}
+}
+
+// Queues job for the given user, or returns an error if the queue is still full after timeout
+func (q *fairQueue) push(job common.ActivityJob, user string, timeout time.Duration) error {
+	select {
+	case q.slots <- struct{}{}:
+	case <-time.After(timeout):
+		return errors.New("timeout")
+	}
+	q.requeue(job, user)
+	return nil
+}
+
+// Queues a job which still has its slot, such as one which was popped and deferred, instead of calling done
+func (q *fairQueue) requeue(job common.ActivityJob, user string) {
+	q.lock.Lock()
+	if len(q.jobs[user]) == 0 {
+		q.users = append(q.users, user)
+	}
+	q.jobs[user] = append(q.jobs[user], job)
+	q.lock.Unlock()
+	// Every job with a slot has room for its token
+	q.ready <- struct{}{}
+}
+
+// Blocks until there's a job to work on. Callers must call done once they've finished with it.
+// Returns false if the context closes first
+func (q *fairQueue) pop(ctx context.Context) (common.ActivityJob, bool) {
+	select {
+	case <-q.ready:
+	case <-ctx.Done():
+		return common.ActivityJob{}, false
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	user := q.users[0]
+	q.users = q.users[1:]
+	job := q.jobs[user][0]
+	q.jobs[user] = q.jobs[user][1:]
+	if len(q.jobs[user]) == 0 {
+		delete(q.jobs, user)
+	} else {
+		// Go to the back of the line
+		q.users = append(q.users, user)
+	}
+	return job, true
+}
+
+func (q *fairQueue) done() {
+	<-q.slots
+}
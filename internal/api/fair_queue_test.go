@@ -0,0 +1,75 @@
+package api
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFairQueueRoundRobin(t *testing.T) {
+	queue := newFairQueue(10)
+	pushes := []struct{ user, tweet string }{
+		{"flooder", "f1"},
+		{"flooder", "f2"},
+		{"flooder", "f3"},
+		{"alice", "a1"},
+		{"bob", "b1"},
+		{"alice", "a2"},
+	}
+	for _, push := range pushes {
+		job := common.ActivityJob{Tweet: &twitter.Tweet{Id: push.tweet}}
+		assert.NoError(t, queue.push(job, push.user, time.Second))
+	}
+
+	order := []string{}
+	for range pushes {
+		job, ok := queue.pop(context.Background())
+		assert.True(t, ok)
+		order = append(order, job.Tweet.Id)
+		queue.done()
+	}
+	assert.Equal(t, []string{"f1", "a1", "b1", "f2", "a2", "f3"}, order)
+}
+
+func TestFairQueueBackpressure(t *testing.T) {
+	queue := newFairQueue(1)
+	job := common.ActivityJob{Tweet: &twitter.Tweet{Id: "1"}}
+	assert.NoError(t, queue.push(job, "user", time.Second))
+	assert.Error(t, queue.push(job, "user", time.Millisecond*10))
+
+	// The slot isn't freed until the job is done, not just when it's picked up
+	_, ok := queue.pop(context.Background())
+	assert.True(t, ok)
+	assert.Error(t, queue.push(job, "user", time.Millisecond*10))
+	queue.done()
+	assert.NoError(t, queue.push(job, "user", time.Second))
+}
+
+func TestFairQueueStopsWhenCancelled(t *testing.T) {
+	queue := newFairQueue(1)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, ok := queue.pop(ctx)
+	assert.False(t, ok)
+}
+
+func TestFairQueueRequeue(t *testing.T) {
+	queue := newFairQueue(1)
+	job := common.ActivityJob{Tweet: &twitter.Tweet{Id: "1"}}
+	assert.NoError(t, queue.push(job, "user", time.Second))
+	job, ok := queue.pop(context.Background())
+	assert.True(t, ok)
+
+	// The popped job still has its slot, so there's no room for another
+	assert.Error(t, queue.push(job, "other", time.Millisecond*10))
+	queue.requeue(job, "user")
+	job, ok = queue.pop(context.Background())
+	assert.True(t, ok)
+	assert.Equal(t, "1", job.Tweet.Id)
+	queue.done()
+	assert.NoError(t, queue.push(job, "other", time.Second))
+}
@@ -3,14 +3,12 @@ package handle_command
 import (
 	"context"
 	"fmt"
-	"sort"
-	"sync"
 
-	"github.com/AnilRedshift/captions_please_go/internal/api/common"
 	"github.com/AnilRedshift/captions_please_go/pkg/message"
 	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
 	"github.com/AnilRedshift/captions_please_go/pkg/vision"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
 )
 
 type altTextCtxKey int
@@ -22,8 +20,7 @@ type altTextState struct {
 }
 
 func WithAltText(ctx context.Context) (context.Context, error) {
-	secrets := common.GetSecrets(ctx)
-	translator, err := vision.NewGoogle(secrets.GooglePrivateKeyID, secrets.GooglePrivateKeySecret)
+	translator, err := getTranslator(ctx)
 	if err == nil {
 		state := &altTextState{translator: translator}
 		ctx = context.WithValue(ctx, theAltTextCtxKey, state)
@@ -37,42 +34,50 @@ func WithAltText(ctx context.Context) (context.Context, error) {
 
 func getAltTextMediaResponse(ctx context.Context, command command, mediaTweet *twitter.Tweet) []mediaResponse {
 	state := ctx.Value(theAltTextCtxKey).(*altTextState)
-	wg := sync.WaitGroup{}
-	wg.Add(len(mediaTweet.Media))
-
+	// The alt text is already in the tweet, so only translating it can run out of time.
+	// If it does, the untranslated alt text is better than nothing
+	responses := make([]mediaResponse, len(mediaTweet.Media))
 	jobs := make(chan mediaResponse, len(mediaTweet.Media))
+	translating := 0
 	for i, media := range mediaTweet.Media {
-		go func(i int, media twitter.Media) {
-			defer wg.Done()
-			var response mediaResponse
-			if media.AltText != nil {
-				response = mediaResponse{index: i, responseType: foundAltTextResponse, reply: message.Localized(*media.AltText)}
-			} else if media.Type == "photo" {
-				reply := message.NoAltText(ctx, mediaTweet.User.Display)
-				response = mediaResponse{index: i, responseType: missingAltTextResponse, reply: reply}
-			} else {
-				response = mediaResponse{index: i, responseType: doNothingResponse}
-			}
+		var response mediaResponse
+		if media.AltText != nil {
+			response = mediaResponse{index: i, responseType: foundAltTextResponse, reply: message.Localized(*media.AltText)}
+		} else if media.Type == "photo" {
+			reply := message.NoAltText(ctx, mediaTweet.User.Display)
+			response = mediaResponse{index: i, responseType: missingAltTextResponse, reply: reply}
+		} else {
+			response = mediaResponse{index: i, responseType: doNothingResponse}
+		}
+		responses[i] = response
 
-			if command.translate && response.responseType == foundAltTextResponse {
-				_, translation, translateErr := state.translator.Translate(ctx, string(response.reply))
+		if command.translate && response.responseType == foundAltTextResponse {
+			translating++
+			go func(response mediaResponse) {
+				_, translation, translateErr := translate(ctx, state.translator, string(response.reply))
 				if translateErr == nil {
+					original := response.reply
 					response.reply = message.Localized(translation)
+					if command.bilingual {
+						// The translator doesn't say what language the alt text was in
+						response = withOriginal(response, original, language.Und)
+					}
 				} else {
 					logrus.Error(fmt.Sprintf("Alt text encountered an error %v when translating", translateErr))
 				}
-			}
-			jobs <- response
-
-		}(i, media)
+				jobs <- response
+			}(response)
+		}
 	}
-	wg.Wait()
-	close(jobs)
 
-	responses := []mediaResponse{}
-	for response := range jobs {
-		responses = append(responses, response)
+	for ; translating > 0; translating-- {
+		select {
+		case response := <-jobs:
+			responses[response.index] = response
+		case <-ctx.Done():
+			logrus.Info("Ran out of time translating the alt text, using the original instead")
+			return responses
+		}
 	}
-	sort.Slice(responses, func(i, j int) bool { return responses[i].index < responses[j].index })
 	return responses
 }
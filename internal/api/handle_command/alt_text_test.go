@@ -57,6 +57,12 @@ func TestGetAltTextMediaResponse(t *testing.T) {
 			command:  command{altText: true, translate: true},
 			expected: []mediaResponse{{index: 0, responseType: foundAltTextResponse, reply: message.Unlocalized("<translated hello alt text />")}},
 		},
+		{
+			name:     "Keeps the original alt text for bilingual replies",
+			tweet:    &tweetWithAltText,
+			command:  command{altText: true, translate: true, bilingual: true},
+			expected: []mediaResponse{{index: 0, responseType: foundAltTextResponse, reply: message.Unlocalized("<translated hello alt text />"), original: message.Unlocalized(altText)}},
+		},
 		{
 			name:         "Ignores translation errors",
 			command:      command{altText: true, translate: true},
@@ -0,0 +1,112 @@
+package handle_command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
+	"github.com/sirupsen/logrus"
+)
+
+type askKey int
+
+const theAskKey askKey = 0
+
+type askState struct {
+	// nil when there isn't a provider which can answer questions
+	answerer     vision.QuestionAnswerer
+	imageOptions preprocess.Options
+	provider     provider
+}
+
+// Answers questions about images with the openai compatible server.
+// Without its url, every question is answered with an error
+func WithAsk(ctx context.Context, config vision.OpenAIConfig) (context.Context, error) {
+	state := &askState{provider: openAIProvider, imageOptions: vision.OpenAIImageOptions}
+	if config.URL == "" {
+		logrus.Info("There's no openai compatible server, so questions about images can't be answered")
+		return setAskState(ctx, state), nil
+	}
+	answerer, err := vision.NewOpenAI(config, common.GetSecrets(ctx).OpenAIKey)
+	state.answerer = answerer
+	return setAskState(ctx, state), err
+}
+
+// Whether there's a provider which can answer questions
+func answersQuestions(ctx context.Context) bool {
+	state, ok := ctx.Value(theAskKey).(*askState)
+	return ok && state.answerer != nil
+}
+
+func setAskState(ctx context.Context, state *askState) context.Context {
+	return context.WithValue(ctx, theAskKey, state)
+}
+
+func getAskState(ctx context.Context) *askState {
+	return ctx.Value(theAskKey).(*askState)
+}
+
+// Asks the provider the question about the media, unless we've already answered it for the same image
+func (state *askState) answer(ctx context.Context, media twitter.Media, question string) ([]vision.VisionResult, structured_error.StructuredError) {
+	if state.answerer == nil {
+		return nil, structured_error.Wrap(errors.New("there isn't a provider which can answer questions"), structured_error.AnswerError)
+	}
+	// The answers are written in the requested language
+	kind := fmt.Sprintf("ask/%s/%s", message.GetLanguage(ctx).String(), question)
+	if cached, ok := cachedMediaResult(ctx, kind, media, exactImage); ok {
+		return cached.([]vision.VisionResult), nil
+	}
+	var answers []vision.VisionResult
+	image, downloaded := prepareMedia(ctx, media, state.imageOptions)
+	release, err := waitForProvider(ctx, state.provider)
+	if err != nil {
+		return nil, err
+	}
+	if downloaded {
+		answers, err = state.answerer.AnswerBytes(ctx, image, question)
+	} else {
+		answers, err = state.answerer.Answer(ctx, media.Url, question)
+	}
+	release()
+	if err == nil {
+		cacheMediaResult(ctx, kind, media, exactImage, answers)
+	}
+	return answers, err
+}
+
+func getAnswerMediaResponse(ctx context.Context, command command, mediaTweet *twitter.Tweet) []mediaResponse {
+	state := getAskState(ctx)
+	ctx = vision.WithDescribeHints(ctx, vision.DescribeHints{TweetText: mediaTweet.VisibleText})
+	jobs := make(chan mediaResponse, len(mediaTweet.Media))
+	for i, media := range mediaTweet.Media {
+		i := i
+		media := media
+		go func() {
+			if media.Type == "photo" {
+				answers, err := state.answer(ctx, media, command.question)
+				jobs <- getAnswerResponse(i, answers, err)
+			} else {
+				jobs <- mediaResponse{index: i, responseType: doNothingResponse}
+			}
+		}()
+	}
+	return collectMediaResponses(ctx, len(mediaTweet.Media), jobs, foundAnswerResponse)
+}
+
+// The most likely answer is said on its own, since the provider already wrote it in the user's language
+func getAnswerResponse(index int, answers []vision.VisionResult, err structured_error.StructuredError) mediaResponse {
+	if err == nil && len(answers) == 0 {
+		err = structured_error.Wrap(errors.New("there weren't any answers"), structured_error.AnswerError)
+	}
+	if err != nil {
+		logrus.Debug(fmt.Sprintf("Error trying to answer the question: %v", err))
+		return mediaResponse{index: index, responseType: foundAnswerResponse, err: err}
+	}
+	return mediaResponse{index: index, responseType: foundAnswerResponse, reply: message.Unlocalized(answers[0].Text), confidence: answers[0].Confidence}
+}
@@ -0,0 +1,135 @@
+package handle_command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
+	vision_test "github.com/AnilRedshift/captions_please_go/pkg/vision/test"
+	"github.com/fortytw2/leaktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithAsk(t *testing.T) {
+	tests := []struct {
+		name        string
+		config      vision.OpenAIConfig
+		hasAnswerer bool
+		hasErr      bool
+	}{
+		{
+			name:        "Answers questions with the openai compatible server",
+			config:      vision.OpenAIConfig{URL: "http://localhost:8080/v1"},
+			hasAnswerer: true,
+		},
+		{
+			name: "Can't answer questions without a server",
+		},
+		{
+			name:   "Fails when the question prompt is broken",
+			config: vision.OpenAIConfig{URL: "http://localhost:8080/v1", QuestionPrompt: "{{.Question"},
+			hasErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := common.SetSecrets(context.Background(), &common.Secrets{})
+			ctx, err := WithAsk(ctx, test.config)
+			if test.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.hasAnswerer, getAskState(ctx).answerer != nil)
+			assert.Equal(t, test.hasAnswerer, answersQuestions(ctx))
+		})
+	}
+}
+
+func TestGetAnswerMediaResponse(t *testing.T) {
+	user := twitter.User{Display: "Ada Bear", Id: "999", Username: "@ada_bear"}
+	mixedMedia := []twitter.Media{{Type: "photo", Url: "photo.jpg"}, {Type: "video", Url: "video.mp4"}}
+	tweet := twitter.Tweet{Id: "withMixedMedia", User: user, Media: mixedMedia, VisibleText: "Bruno at the beach"}
+	question := "what breed is the dog?"
+
+	tests := []struct {
+		name       string
+		answers    []vision.VisionResult
+		answerErr  error
+		noAnswerer bool
+		expected   []mediaResponse
+		hasErr     bool
+	}{
+		{
+			name:    "Answers with the most likely answer",
+			answers: []vision.VisionResult{{Text: "It's a corgi", Confidence: 0.9}, {Text: "It's a fox", Confidence: 0.1}},
+			expected: []mediaResponse{
+				{index: 0, responseType: foundAnswerResponse, reply: message.Unlocalized("It's a corgi (photo.jpg, what breed is the dog?)"), confidence: 0.9},
+				{index: 1, responseType: doNothingResponse},
+			},
+		},
+		{
+			name:     "Fails when there aren't any answers",
+			expected: []mediaResponse{{index: 0, responseType: foundAnswerResponse}, {index: 1, responseType: doNothingResponse}},
+			hasErr:   true,
+		},
+		{
+			name:      "Fails when the provider does",
+			answerErr: errors.New("too blurry"),
+			expected:  []mediaResponse{{index: 0, responseType: foundAnswerResponse}, {index: 1, responseType: doNothingResponse}},
+			hasErr:    true,
+		},
+		{
+			name:       "Fails when there isn't a provider which can answer questions",
+			noAnswerer: true,
+			expected:   []mediaResponse{{index: 0, responseType: foundAnswerResponse}, {index: 1, responseType: doNothingResponse}},
+			hasErr:     true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer leaktest.Check(t)()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			origFetchMedia := fetchMedia
+			defer func() {
+				fetchMedia = origFetchMedia
+			}()
+			fetchMedia = func(ctx context.Context, url string) ([]byte, error) {
+				return []byte(url), nil
+			}
+
+			answerer := &vision_test.MockQuestionAnswerer{T: t, AnswerMock: func(url string, question string) ([]vision.VisionResult, error) {
+				answers := make([]vision.VisionResult, len(test.answers))
+				for i, answer := range test.answers {
+					answer.Text = fmt.Sprintf("%s (%s, %s)", answer.Text, url, question)
+					answers[i] = answer
+				}
+				return answers, test.answerErr
+			}}
+			state := &askState{answerer: answerer, provider: openAIProvider}
+			if test.noAnswerer {
+				state.answerer = nil
+			}
+			ctx = setAskState(ctx, state)
+
+			result := getAnswerMediaResponse(ctx, command{question: question}, &tweet)
+			require.Equal(t, len(test.expected), len(result))
+			if !test.hasErr {
+				assert.Equal(t, test.expected, result)
+				return
+			}
+			require.Error(t, result[0].err)
+			assert.Equal(t, structured_error.AnswerError, result[0].err.Type())
+			result[0].err = nil
+			assert.Equal(t, test.expected, result)
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package handle_command
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/internal/api/replier"
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/sirupsen/logrus"
+)
+
+// Deletes the reply thread that tweet is replying to, if it was sent by the requester or the author of the media.
+// No confirmation is sent, since that would just be another reply to clean up
+func Delete(ctx context.Context, tweet *twitter.Tweet) common.ActivityResult {
+	replies, ok := replier.FindReplies(ctx, tweet.ParentTweetId)
+	if tweet.ParentTweetId == "" || !ok {
+		return replyWith(ctx, tweet, message.NothingToDeleteMessage(ctx), "nothing to delete")
+	}
+	if !canDelete(ctx, tweet.User.Id, replies) {
+		return replyWith(ctx, tweet, message.CannotDeleteMessage(ctx), "not allowed to delete")
+	}
+	err := replier.DeleteReplies(ctx, replies)
+	return common.ActivityResult{Tweet: tweet, Action: "deleted replies", Err: err}
+}
+
+func canDelete(ctx context.Context, userId string, replies replier.Replies) bool {
+	if userId == replies.RequesterId {
+		return true
+	}
+	state := getHandleCommandState(ctx)
+	source, err := state.client.GetTweet(ctx, replies.SourceId)
+	if err == nil {
+		var mediaTweet *twitter.Tweet
+		mediaTweet, err = findTweet(ctx, state.client, source)
+		if err == nil {
+			return mediaTweet.User.Id == userId
+		}
+	}
+	logrus.Info(fmt.Sprintf("%s: Unable to find the media author to check who can delete the replies: %v", replies.SourceId, err))
+	return false
+}
+
+func replyWith(ctx context.Context, tweet *twitter.Tweet, reply message.Localized, action string) common.ActivityResult {
+	result := _reply(ctx, tweet, reply)
+	if result.Err != nil {
+		logrus.Info(fmt.Sprintf("%s: Replying for %s failed with %v", tweet.Id, action, result.Err))
+	}
+	return common.ActivityResult{Tweet: tweet, Action: action}
+}
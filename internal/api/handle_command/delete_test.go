@@ -0,0 +1,113 @@
+package handle_command
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/replier"
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	twitter_test "github.com/AnilRedshift/captions_please_go/pkg/twitter/test"
+	"github.com/fortytw2/leaktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDelete(t *testing.T) {
+	tests := []struct {
+		name     string
+		sender   string
+		parentId string
+		expected message.Localized
+		action   string
+		deleted  []string
+	}{
+		{
+			name:     "The requester can delete the replies",
+			sender:   "requester",
+			parentId: "reply2",
+			action:   "deleted replies",
+			deleted:  []string{"reply2", "reply1"},
+		},
+		{
+			name:     "The media author can delete the replies",
+			sender:   "author",
+			parentId: "reply1",
+			action:   "deleted replies",
+			deleted:  []string{"reply2", "reply1"},
+		},
+		{
+			name:     "Nobody else can delete the replies",
+			sender:   "someone else",
+			parentId: "reply1",
+			expected: message.CannotDeleteMessage(context.Background()),
+			action:   "not allowed to delete",
+		},
+		{
+			name:     "Lets the user know when they aren't replying to one of our replies",
+			sender:   "requester",
+			parentId: "unknown",
+			expected: message.NothingToDeleteMessage(context.Background()),
+			action:   "nothing to delete",
+		},
+		{
+			name:     "Lets the user know when they aren't replying to anything",
+			sender:   "requester",
+			expected: message.NothingToDeleteMessage(context.Background()),
+			action:   "nothing to delete",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer leaktest.Check(t)()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var origFindTweet = findTweet
+			var origReply = _reply
+			defer func() {
+				findTweet = origFindTweet
+				_reply = origReply
+			}()
+
+			findTweet = func(ctx context.Context, client twitter.Twitter, tweet *twitter.Tweet) (*twitter.Tweet, structured_error.StructuredError) {
+				assert.Equal(t, "source", tweet.Id)
+				return &twitter.Tweet{Id: "mediaTweet", User: twitter.User{Id: "author"}}, nil
+			}
+			sentMessage := message.Localized("")
+			_reply = func(ctx context.Context, tweet *twitter.Tweet, message message.Localized) replier.ReplyResult {
+				sentMessage = message
+				return replier.ReplyResult{ParentTweet: &twitter.Tweet{Id: "123"}}
+			}
+
+			deleted := []string{}
+			mockTwitter := &twitter_test.MockTwitter{T: t,
+				GetTweetMock: func(tweetID string) (*twitter.Tweet, error) {
+					return &twitter.Tweet{Id: tweetID}, nil
+				},
+				DeleteTweetMock: func(tweetID string) error {
+					deleted = append(deleted, tweetID)
+					return nil
+				},
+			}
+			index := replier.NewMemoryReplyIndex()
+			require.NoError(t, index.Put(replier.Replies{SourceId: "source", RequesterId: "requester", ReplyIds: []string{"reply1", "reply2"}}))
+			ctx, err := replier.WithReplier(ctx, mockTwitter, replier.Config{Index: index})
+			require.NoError(t, err)
+			ctx = WithHandleCommand(ctx, mockTwitter)
+
+			tweet := &twitter.Tweet{Id: "command", ParentTweetId: test.parentId, User: twitter.User{Id: test.sender}}
+			result := handleCommand(ctx, command{delete: true}, tweet)
+			assert.NoError(t, result.Err)
+			assert.Equal(t, test.action, result.Action)
+			assert.Equal(t, test.expected, sentMessage)
+			if test.deleted == nil {
+				assert.Empty(t, deleted)
+			} else {
+				assert.Equal(t, test.deleted, deleted)
+				_, ok := replier.FindReplies(ctx, "source")
+				assert.False(t, ok)
+			}
+		})
+	}
+}
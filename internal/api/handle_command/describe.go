@@ -2,13 +2,11 @@ package handle_command
 
 import (
 	"context"
-	"errors"
 	"fmt"
-	"sort"
-	"sync"
 
 	"github.com/AnilRedshift/captions_please_go/internal/api/common"
 	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
 	"github.com/AnilRedshift/captions_please_go/pkg/vision"
@@ -19,29 +17,51 @@ type describeKey int
 
 const theDescribeKey describeKey = 0
 
-type describeState struct {
-	describer  vision.Describer
-	translator vision.Translator
+// Which service describes the images
+type DescriberConfig struct {
+	// azure or openai. Empty uses azure
+	Provider string
+	Azure    vision.AzureConfig
+	// Only used by the openai provider
+	OpenAI vision.OpenAIConfig
 }
 
-type visionJobResult struct {
-	index   int
-	results []vision.VisionResult
-	err     structured_error.StructuredError
+type describeState struct {
+	describer    vision.Describer
+	translator   vision.Translator
+	imageOptions preprocess.Options
+	provider     provider
+	// The describer puts the tweet text in its prompt
+	usesTweetText bool
 }
 
 const lowVisionConfidenceCutoff = 0.25
 
-func WithDescribe(ctx context.Context) (context.Context, error) {
+// At most this many regions of a busy image are described, after the image as a whole
+const maxRegionDescriptions = 3
+
+func WithDescribe(ctx context.Context, config DescriberConfig) (context.Context, error) {
 	secrets := common.GetSecrets(ctx)
-	translator, err := vision.NewGoogle(secrets.GooglePrivateKeyID, secrets.GooglePrivateKeySecret)
+	state := describeState{provider: provider(config.Provider)}
+	var err error
+	switch state.provider {
+	case "", azureProvider:
+		state.provider = azureProvider
+		state.describer, err = vision.NewAzureVision(secrets.AzureComputerVisionKey, config.Azure)
+		state.imageOptions = vision.AzureDescribeImageOptions
+	case openAIProvider:
+		state.describer, err = vision.NewOpenAI(config.OpenAI, secrets.OpenAIKey)
+		state.imageOptions = vision.OpenAIImageOptions
+		state.usesTweetText = true
+	default:
+		err = fmt.Errorf("unknown describe provider %s, must be [azure|openai]", config.Provider)
+	}
 	if err != nil {
 		return ctx, err
 	}
-	describer := vision.NewAzureVision(secrets.AzureComputerVisionKey)
-	state := describeState{
-		describer:  describer,
-		translator: translator,
+	state.translator, err = getTranslator(ctx)
+	if err != nil {
+		return ctx, err
 	}
 	go func() {
 		<-ctx.Done()
@@ -50,6 +70,40 @@ func WithDescribe(ctx context.Context) (context.Context, error) {
 	return setDescribeState(ctx, &state), err
 }
 
+// Asks the provider to describe the media, unless we've already seen the same image
+func (state *describeState) describe(ctx context.Context, media twitter.Media, tweetText string) ([]vision.VisionResult, structured_error.StructuredError) {
+	kind := state.cacheKind(ctx, tweetText)
+	if cached, ok := cachedMediaResult(ctx, kind, media, exactImage); ok {
+		return cached.([]vision.VisionResult), nil
+	}
+	var visionResult []vision.VisionResult
+	image, downloaded := prepareMedia(ctx, media, state.imageOptions)
+	release, err := waitForProvider(ctx, state.provider)
+	if err != nil {
+		return nil, err
+	}
+	if downloaded {
+		visionResult, err = state.describer.DescribeBytes(ctx, image)
+	} else {
+		visionResult, err = state.describer.Describe(ctx, media.Url)
+	}
+	release()
+	if err == nil {
+		cacheMediaResult(ctx, kind, media, exactImage, visionResult)
+	}
+	return visionResult, err
+}
+
+func (state *describeState) cacheKind(ctx context.Context, tweetText string) string {
+	// The descriptions are written in the requested language
+	kind := "describe/" + message.GetLanguage(ctx).String()
+	if state.usesTweetText {
+		// The same image can be described differently depending on the tweet it was posted with
+		kind = fmt.Sprintf("%s/%s", kind, tweetText)
+	}
+	return kind
+}
+
 func setDescribeState(ctx context.Context, state *describeState) context.Context {
 	return context.WithValue(ctx, theDescribeKey, state)
 }
@@ -60,22 +114,20 @@ func getDescriberState(ctx context.Context) *describeState {
 
 func getDescribeMediaResponse(ctx context.Context, mediaTweet *twitter.Tweet) []mediaResponse {
 	state := getDescriberState(ctx)
-
-	wg := sync.WaitGroup{}
-	wg.Add(len(mediaTweet.Media))
-	jobs := make(chan visionJobResult, len(mediaTweet.Media))
+	ctx = vision.WithDescribeHints(ctx, vision.DescribeHints{TweetText: mediaTweet.VisibleText})
+	jobs := make(chan mediaResponse, len(mediaTweet.Media))
 	for i, media := range mediaTweet.Media {
 		i := i
 		media := media
 		go func() {
 			if media.Type == "photo" {
-				visionResult, err := state.describer.Describe(ctx, media.Url)
+				visionResult, err := state.describe(ctx, media, mediaTweet.VisibleText)
 				if err != nil && err.Type() == structured_error.UnsupportedLanguage {
 					logrus.Debug("The results are valid, but in the wrong language. Trying to translate")
 					translatedResult := make([]vision.VisionResult, len(visionResult))
 					for i, result := range visionResult {
 						var translated string
-						_, translated, err = state.translator.Translate(ctx, result.Text)
+						_, translated, err = translate(ctx, state.translator, result.Text)
 						if err != nil {
 							break
 						}
@@ -88,49 +140,51 @@ func getDescribeMediaResponse(ctx context.Context, mediaTweet *twitter.Tweet) []
 						visionResult = translatedResult
 					}
 				}
-				jobs <- visionJobResult{index: i, results: visionResult, err: err}
+				jobs <- getDescribeResponse(ctx, i, visionResult, err)
 			} else {
-				jobs <- visionJobResult{index: i, err: structured_error.Wrap(errors.New("media is not a photo"), structured_error.WrongMediaType)}
+				jobs <- mediaResponse{index: i, responseType: doNothingResponse}
 			}
-			wg.Done()
 		}()
 	}
+	return collectMediaResponses(ctx, len(mediaTweet.Media), jobs, foundVisionResponse)
+}
 
-	wg.Wait()
-	close(jobs)
-	jobResults := []visionJobResult{}
-	for job := range jobs {
-		jobResults = append(jobResults, job)
-	}
-	sort.Slice(jobResults, func(i, j int) bool { return jobResults[i].index < jobResults[j].index })
-	responses := make([]mediaResponse, len(mediaTweet.Media))
-	for i := range mediaTweet.Media {
-		var response mediaResponse
-		jobResult := jobResults[i]
-		if jobResult.err == nil {
-			reply, err := formatVisionReply(ctx, jobResult.results)
-			response = mediaResponse{index: i, responseType: foundVisionResponse, reply: reply, err: err}
-		} else if jobResult.err.Type() == structured_error.WrongMediaType {
-			response = mediaResponse{index: i, responseType: doNothingResponse}
-		} else {
-			logrus.Debug(fmt.Sprintf("Error trying to get the description: %v", jobResult.err))
-			response = mediaResponse{index: i, responseType: foundVisionResponse, err: jobResult.err}
-
+func getDescribeResponse(ctx context.Context, index int, visionResult []vision.VisionResult, err structured_error.StructuredError) mediaResponse {
+	if err == nil {
+		reply, err := formatVisionReply(ctx, visionResult)
+		response := mediaResponse{index: index, responseType: foundVisionResponse, reply: reply, err: err}
+		if len(visionResult) > 0 {
+			// Like formatVisionReply, this assumes the best result comes first
+			response.confidence = visionResult[0].Confidence
 		}
-		responses[i] = response
+		return response
 	}
-	return responses
+	logrus.Debug(fmt.Sprintf("Error trying to get the description: %v", err))
+	return mediaResponse{index: index, responseType: foundVisionResponse, err: err}
 }
 
 func formatVisionReply(ctx context.Context, visionResults []vision.VisionResult) (message.Localized, structured_error.StructuredError) {
 	var localized message.Localized
 	var err structured_error.StructuredError = nil
-	filteredResults := make([]string, 0, len(visionResults))
-	for i, visionResult := range visionResults {
-		if i > 2 || visionResult.Confidence < lowVisionConfidenceCutoff {
-			break
+	filteredResults := make([]message.Description, 0, len(visionResults))
+	descriptions, regions := 0, 0
+	for _, visionResult := range visionResults {
+		if visionResult.Confidence < lowVisionConfidenceCutoff {
+			continue
+		}
+		region := visionResult.Bounds != nil
+		if region {
+			if regions >= maxRegionDescriptions {
+				continue
+			}
+			regions++
+		} else {
+			if descriptions > 2 {
+				continue
+			}
+			descriptions++
 		}
-		filteredResults = append(filteredResults, visionResult.Text)
+		filteredResults = append(filteredResults, message.Description{Text: visionResult.Text, Confidence: visionResult.Confidence, Region: region})
 	}
 
 	if len(filteredResults) == 0 {
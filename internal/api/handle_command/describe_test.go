@@ -24,23 +24,81 @@ func TestWithDescribe(t *testing.T) {
 	defer cancel()
 	secrets := &common.Secrets{GooglePrivateKeySecret: vision_test.DummyGoogleCert, AzureComputerVisionKey: "123"}
 	ctx = common.SetSecrets(ctx, secrets)
-	ctx, err := WithDescribe(ctx)
+	ctx, err := WithDescribe(ctx, DescriberConfig{})
 	assert.NoError(t, err)
 	state := getDescriberState(ctx)
 	assert.NotNil(t, state)
 }
 
+func TestWithDescribeConfig(t *testing.T) {
+	tests := []struct {
+		name   string
+		config DescriberConfig
+		hasErr bool
+	}{
+		{
+			name:   "Describes with image analysis 4.0",
+			config: DescriberConfig{Azure: vision.AzureConfig{Endpoint: "https://example.cognitiveservices.azure.com/", APIVersion: vision.AzureAPIv40}},
+		},
+		{
+			name:   "Rejects unknown api versions",
+			config: DescriberConfig{Azure: vision.AzureConfig{APIVersion: "v2.0"}},
+			hasErr: true,
+		},
+		{
+			name:   "Describes with an openai compatible server",
+			config: DescriberConfig{Provider: "openai", OpenAI: vision.OpenAIConfig{URL: "http://localhost:8080/v1"}},
+		},
+		{
+			name:   "Needs the url of the openai compatible server",
+			config: DescriberConfig{Provider: "openai"},
+			hasErr: true,
+		},
+		{
+			name:   "Rejects unknown providers",
+			config: DescriberConfig{Provider: "google"},
+			hasErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer leaktest.Check(t)()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			secrets := &common.Secrets{GooglePrivateKeySecret: vision_test.DummyGoogleCert, AzureComputerVisionKey: "123"}
+			ctx = common.SetSecrets(ctx, secrets)
+			_, err := WithDescribe(ctx, test.config)
+			if test.hasErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
 func TestWithDescribeHandlesGoogleFailure(t *testing.T) {
 	defer leaktest.Check(t)()
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	secrets := &common.Secrets{GooglePrivateKeySecret: "a bad cert", AzureComputerVisionKey: "123"}
 	ctx = common.SetSecrets(ctx, secrets)
-	_, err := WithDescribe(ctx)
+	_, err := WithDescribe(ctx, DescriberConfig{})
 	assert.Error(t, err)
 
 }
 
+func TestDescribeCacheKind(t *testing.T) {
+	ctx := message.WithLanguage(context.Background(), language.German)
+	azure := describeState{provider: azureProvider}
+	assert.Equal(t, "describe/de", azure.cacheKind(ctx, "my cat"))
+	assert.Equal(t, "describe/de", azure.cacheKind(ctx, "my dog"))
+
+	openAI := describeState{provider: openAIProvider, usesTweetText: true}
+	assert.Equal(t, "describe/de/my cat", openAI.cacheKind(ctx, "my cat"))
+	assert.NotEqual(t, openAI.cacheKind(ctx, "my cat"), openAI.cacheKind(ctx, "my dog"))
+}
+
 func TestGetDescribeMediaResponse(t *testing.T) {
 	user := twitter.User{Display: "Ada Bear", Id: "999", Username: "@ada_bear"}
 
@@ -60,6 +118,7 @@ func TestGetDescribeMediaResponse(t *testing.T) {
 		tweet        *twitter.Tweet
 		lang         *language.Tag
 		confidences  []float32
+		regions      []float32
 		azureErr     error
 		translateErr error
 		expected     []mediaResponse
@@ -68,7 +127,7 @@ func TestGetDescribeMediaResponse(t *testing.T) {
 			name:        "Returns a single description",
 			tweet:       &tweetWithOnePhoto,
 			confidences: []float32{0.8},
-			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("photo.jpg is so pretty(0.8)")}},
+			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("I think it's photo.jpg is so pretty(0.8)"), confidence: 0.8}},
 		},
 		{
 			name:        "Returns a single description in the users language",
@@ -76,27 +135,34 @@ func TestGetDescribeMediaResponse(t *testing.T) {
 			azureErr:    wrongLangErr,
 			tweet:       &tweetWithOnePhoto,
 			confidences: []float32{0.8},
-			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("<translated photo.jpg is so pretty(0.8) />")}},
+			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("I think it's <translated photo.jpg is so pretty(0.8) />"), confidence: 0.8}},
 		},
 		{
 			name:        "Returns two descriptions for an image",
 			tweet:       &tweetWithOnePhoto,
 			confidences: []float32{0.8, 0.6},
-			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("photo.jpg is so pretty(0.8). It might also be photo.jpg is so pretty(0.6)")}},
+			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("I think it's photo.jpg is so pretty(0.8). It might also be photo.jpg is so pretty(0.6)"), confidence: 0.8}},
 		},
 		{
 			name:        "Returns three descriptions for an image",
 			tweet:       &tweetWithOnePhoto,
 			confidences: []float32{0.8, 0.6, 0.5},
-			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("photo.jpg is so pretty(0.8). It might also be photo.jpg is so pretty(0.6). It might also be photo.jpg is so pretty(0.5)")}},
+			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("I think it's photo.jpg is so pretty(0.8). It might also be photo.jpg is so pretty(0.6). It might also be photo.jpg is so pretty(0.5)"), confidence: 0.8}},
+		},
+		{
+			name:        "Describes a few of the regions in the image",
+			tweet:       &tweetWithOnePhoto,
+			confidences: []float32{0.8},
+			regions:     []float32{0.9, 0.7, 0.6, 0.5, 0.1},
+			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("I think it's photo.jpg is so pretty(0.8). It also shows a corner of photo.jpg(0.9), a corner of photo.jpg(0.7), a corner of photo.jpg(0.6)"), confidence: 0.8}},
 		},
 		{
 			name:        "Responds with the description for two photos",
 			tweet:       &tweetWithTwoPhotos,
 			confidences: []float32{0.8, 0.7},
 			expected: []mediaResponse{
-				{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("photo1.jpg is so pretty(0.8). It might also be photo1.jpg is so pretty(0.7)")},
-				{index: 1, responseType: foundVisionResponse, reply: message.Unlocalized("photo2.jpg is so pretty(0.8). It might also be photo2.jpg is so pretty(0.7)")},
+				{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("I think it's photo1.jpg is so pretty(0.8). It might also be photo1.jpg is so pretty(0.7)"), confidence: 0.8},
+				{index: 1, responseType: foundVisionResponse, reply: message.Unlocalized("I think it's photo2.jpg is so pretty(0.8). It might also be photo2.jpg is so pretty(0.7)"), confidence: 0.8},
 			},
 		},
 		{
@@ -104,7 +170,7 @@ func TestGetDescribeMediaResponse(t *testing.T) {
 			tweet:       &tweetWithMixedMedia,
 			confidences: []float32{0.8},
 			expected: []mediaResponse{
-				{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("photo.jpg is so pretty(0.8)")},
+				{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("I think it's photo.jpg is so pretty(0.8)"), confidence: 0.8},
 				{index: 1, responseType: doNothingResponse},
 			},
 		},
@@ -112,7 +178,7 @@ func TestGetDescribeMediaResponse(t *testing.T) {
 			name:        "Ignores low confidence suggestions",
 			tweet:       &tweetWithOnePhoto,
 			confidences: []float32{0.8, 0.1},
-			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("photo.jpg is so pretty(0.8)")}},
+			expected:    []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Unlocalized("I think it's photo.jpg is so pretty(0.8)"), confidence: 0.8}},
 		},
 		{
 			name:         "Returns unsupported error message if translating fails",
@@ -147,6 +213,13 @@ func TestGetDescribeMediaResponse(t *testing.T) {
 			defer leaktest.Check(t)()
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
+			origFetchMedia := fetchMedia
+			defer func() {
+				fetchMedia = origFetchMedia
+			}()
+			fetchMedia = func(ctx context.Context, url string) ([]byte, error) {
+				return []byte(url), nil
+			}
 
 			mockAzure := vision_test.MockAzure{T: t, DescribeMock: func(url string) ([]vision.VisionResult, error) {
 				results := make([]vision.VisionResult, len(test.confidences))
@@ -154,6 +227,10 @@ func TestGetDescribeMediaResponse(t *testing.T) {
 					text := fmt.Sprintf("%s is so pretty(%.1f)", url, confidence)
 					results[i] = vision.VisionResult{Text: text, Confidence: confidence}
 				}
+				for _, confidence := range test.regions {
+					text := fmt.Sprintf("a corner of %s(%.1f)", url, confidence)
+					results = append(results, vision.VisionResult{Text: text, Confidence: confidence, Bounds: &vision.Bounds{Width: 10, Height: 10}})
+				}
 				return results, test.azureErr
 			}}
 
@@ -0,0 +1,150 @@
+package handle_command
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/sirupsen/logrus"
+)
+
+type downloadsKey int
+
+const theDownloadsKey downloadsKey = 0
+
+// Larger than any provider accepts, preprocessing shrinks the images to fit each of them.
+// Anything bigger is left for the providers to fetch from the url themselves
+const maxMediaBytes = 20 * 1024 * 1024
+
+// Every media in a job is downloaded at most once, no matter how many providers look at it
+type mediaDownloads struct {
+	lock      sync.Mutex
+	downloads map[string]*mediaDownload
+}
+
+type mediaDownload struct {
+	once  sync.Once
+	image []byte
+	err   error
+	// The perceptual hash is only computed when something asks for it
+	hashOnce sync.Once
+	hash     preprocess.Hash
+	hashErr  error
+}
+
+// used for mocking
+var fetchMedia = fetchMediaFromURL
+
+func withMediaDownloads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, theDownloadsKey, &mediaDownloads{downloads: map[string]*mediaDownload{}})
+}
+
+// Returns the bytes of the media, shared with any other provider in the same job.
+// Returns false if it couldn't be downloaded, in which case the provider should be given the url instead
+func downloadMedia(ctx context.Context, media twitter.Media) ([]byte, bool) {
+	download := getMediaDownload(ctx, media)
+	download.once.Do(func() {
+		download.image, download.err = fetchMedia(ctx, media.Url)
+		if download.err != nil {
+			logrus.Info(fmt.Sprintf("Downloading %s failed with %v, the providers will fetch it instead", media.Url, download.err))
+		}
+	})
+	return download.image, download.err == nil
+}
+
+// Returns what the image cache knows the media by, or false if it couldn't be downloaded.
+// The perceptual hash is only worked out for similarImage matches, and left out if the image can't be decoded
+func mediaKey(ctx context.Context, media twitter.Media, match imageMatch) (imageKey, bool) {
+	image, ok := downloadMedia(ctx, media)
+	if !ok {
+		return imageKey{}, false
+	}
+	key := imageKey{digest: sha256.Sum256(image)}
+	if match == similarImage {
+		download := getMediaDownload(ctx, media)
+		download.hashOnce.Do(func() {
+			download.hash, download.hashErr = preprocess.HashImage(image)
+			if download.hashErr != nil {
+				logrus.Debug(fmt.Sprintf("Unable to hash %s: %v", media.Url, download.hashErr))
+			}
+		})
+		key.hash, key.hashed = download.hash, download.hashErr == nil
+	}
+	return key, true
+}
+
+func getMediaDownload(ctx context.Context, media twitter.Media) *mediaDownload {
+	downloads, ok := ctx.Value(theDownloadsKey).(*mediaDownloads)
+	if !ok {
+		// Outside of a job, so there's nothing to share it with
+		return &mediaDownload{}
+	}
+	downloads.lock.Lock()
+	defer downloads.lock.Unlock()
+	download, ok := downloads.downloads[media.Url]
+	if !ok {
+		download = &mediaDownload{}
+		downloads.downloads[media.Url] = download
+	}
+	return download
+}
+
+// Downloads the media and prepares it for a provider with the given limits.
+// Returns false if it couldn't be downloaded, in which case the provider should be given the url instead
+func prepareMedia(ctx context.Context, media twitter.Media, options preprocess.Options) ([]byte, bool) {
+	image, ok := downloadMedia(ctx, media)
+	if !ok {
+		return nil, false
+	}
+	processed, err := preprocess.Process(image, options)
+	if err != nil {
+		// The provider might still understand it
+		logrus.Info(fmt.Sprintf("Preprocessing %s failed with %v, sending it as is", media.Url, err))
+		return image, true
+	}
+	return processed, true
+}
+
+func fetchMediaFromURL(ctx context.Context, url string) ([]byte, error) {
+	var image []byte
+	err := retry.Do(ctx, retry.DefaultPolicy, func() error {
+		request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			if ctx.Err() == nil {
+				return structured_error.WrapRetryable(err, structured_error.Unknown, 0)
+			}
+			return err
+		}
+		defer response.Body.Close()
+		if response.StatusCode < 200 || response.StatusCode >= 300 {
+			err = fmt.Errorf("downloading the media failed with status code %d", response.StatusCode)
+			if retry.IsTransientStatus(response.StatusCode) {
+				return structured_error.WrapRetryable(err, structured_error.Unknown, retry.RetryAfter(response))
+			}
+			return err
+		}
+		if response.ContentLength > maxMediaBytes {
+			return fmt.Errorf("the media is %d bytes, over the limit of %d", response.ContentLength, maxMediaBytes)
+		}
+		// The content length can be missing, so don't trust it to bound the read
+		image, err = ioutil.ReadAll(io.LimitReader(response.Body, maxMediaBytes+1))
+		if err == nil && len(image) > maxMediaBytes {
+			err = errors.New("the media is over the size limit")
+		}
+		return err
+	})
+	return image, err
+}
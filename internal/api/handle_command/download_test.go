@@ -0,0 +1,129 @@
+package handle_command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/fortytw2/leaktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDownloadMediaOncePerJob(t *testing.T) {
+	defer leaktest.Check(t)()
+	origFetchMedia := fetchMedia
+	defer func() {
+		fetchMedia = origFetchMedia
+	}()
+	var fetches int32
+	fetchMedia = func(ctx context.Context, url string) ([]byte, error) {
+		atomic.AddInt32(&fetches, 1)
+		return []byte(url), nil
+	}
+
+	ctx := withMediaDownloads(context.Background())
+	wg := sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			image, ok := downloadMedia(ctx, twitter.Media{Url: "photo.jpg"})
+			assert.True(t, ok)
+			assert.Equal(t, []byte("photo.jpg"), image)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(1), fetches)
+
+	// A new job downloads it again
+	_, ok := downloadMedia(withMediaDownloads(context.Background()), twitter.Media{Url: "photo.jpg"})
+	assert.True(t, ok)
+	assert.Equal(t, int32(2), fetches)
+}
+
+func TestFetchMediaFromURL(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		body     string
+		expected []byte
+		hasErr   bool
+	}{
+		{
+			name:     "Returns the media",
+			status:   http.StatusOK,
+			body:     "image bytes",
+			expected: []byte("image bytes"),
+		},
+		{
+			name:   "Errors if the media is too large",
+			status: http.StatusOK,
+			body:   strings.Repeat("a", maxMediaBytes+1),
+			hasErr: true,
+		},
+		{
+			name:   "Errors if the media is missing",
+			status: http.StatusNotFound,
+			hasErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.body))
+			}))
+			defer server.Close()
+
+			image, err := fetchMediaFromURL(context.Background(), server.URL)
+			assert.Equal(t, test.hasErr, err != nil)
+			if !test.hasErr {
+				assert.Equal(t, test.expected, image)
+			}
+		})
+	}
+}
+
+func TestPrepareMedia(t *testing.T) {
+	origFetchMedia := fetchMedia
+	defer func() {
+		fetchMedia = origFetchMedia
+	}()
+	tiny := &bytes.Buffer{}
+	require.NoError(t, png.Encode(tiny, image.NewGray(image.Rect(0, 0, 10, 5))))
+	images := map[string][]byte{"tiny.png": tiny.Bytes(), "unknown.bin": []byte("not an image")}
+	fetchMedia = func(ctx context.Context, url string) ([]byte, error) {
+		image, ok := images[url]
+		if !ok {
+			return nil, errors.New("not found")
+		}
+		return image, nil
+	}
+	ctx := withMediaDownloads(context.Background())
+
+	prepared, ok := prepareMedia(ctx, twitter.Media{Url: "tiny.png"}, preprocess.Options{MinDimension: 100})
+	assert.True(t, ok)
+	config, err := png.DecodeConfig(bytes.NewReader(prepared))
+	require.NoError(t, err)
+	assert.Equal(t, 100, config.Width)
+	assert.Equal(t, 50, config.Height)
+
+	// Images the preprocessor doesn't understand are sent as is
+	prepared, ok = prepareMedia(ctx, twitter.Media{Url: "unknown.bin"}, preprocess.Options{MinDimension: 100})
+	assert.True(t, ok)
+	assert.Equal(t, []byte("not an image"), prepared)
+
+	_, ok = prepareMedia(ctx, twitter.Media{Url: "missing.png"}, preprocess.Options{})
+	assert.False(t, ok)
+}
@@ -4,8 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/pkg/limiter"
 	"github.com/AnilRedshift/captions_please_go/pkg/message"
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
@@ -17,20 +20,41 @@ type commandCtxKey int
 const theCommandCtxKey commandCtxKey = 0
 const longOCRMessageThreshold = 50
 
+// Rather than tie up a worker, commands which would wait longer than this on twitter's rate limits are handed back to be run later
+const maxRateLimitWait = time.Second * 30
+
+// How long a command has to find the media and hear back from the providers, before replying with whatever it has
+const defaultJobTimeout = time.Second * 90
+
 type commandState struct {
-	client twitter.Twitter
+	client     twitter.Twitter
+	optOuts    OptOutStore
+	images     *imageCache
+	jobTimeout time.Duration
+	// Shared by every job, so the providers aren't flooded when several jobs arrive at once
+	providers map[provider]*limiter.Weighted
+	// Decides what to say about each media
+	policy responsePolicy
 }
 
 var getAltText = getAltTextMediaResponse
 var getOcr = getOCRMediaResponse
 var getDescription = getDescribeMediaResponse
+var getAnswer = getAnswerMediaResponse
+var getLabels = getLabelsMediaResponse
 var findTweet = findTweetWithMedia
 
 func WithHandleCommand(ctx context.Context, client twitter.Twitter) context.Context {
-	state := commandState{client: client}
+	state := commandState{client: client, optOuts: NewMemoryOptOutStore(), images: newImageCache(), jobTimeout: defaultJobTimeout, providers: newProviderLimiters(ProviderLimits{}), policy: defaultResponsePolicy{}}
 	return context.WithValue(ctx, theCommandCtxKey, &state)
 }
 
+// Replaces the default time budget for each command set up by WithHandleCommand
+func WithJobTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	getHandleCommandState(ctx).jobTimeout = timeout
+	return ctx
+}
+
 func getHandleCommandState(ctx context.Context) *commandState {
 	return ctx.Value(theCommandCtxKey).(*commandState)
 }
@@ -42,36 +66,73 @@ func HandleCommand(ctx context.Context, commandMessage string, tweet *twitter.Tw
 			replyWithError(ctx, tweet, structured_error.Wrap(errors.New("panic at the disco"), structured_error.Unknown))
 		}
 	}()
-	command := parseCommand(commandMessage)
+	command := parseCommand(commandMessage, answersQuestions(ctx))
 	logrus.Debug(fmt.Sprintf("running command %v", &command))
 	ctx = message.WithLanguage(ctx, command.tag)
-	result = handleCommand(ctx, command, tweet)
+	if delay := rateLimitDelay(ctx); delay > maxRateLimitWait {
+		logrus.Info(fmt.Sprintf("%s: the command has to wait %v for the rate limits", tweet.Id, delay))
+		result = common.ActivityResult{Tweet: tweet, Action: fmt.Sprintf("rate limited for %v", delay), RetryAfter: delay}
+	} else {
+		result = handleCommand(ctx, command, tweet)
+	}
 	didPanic = false
 	return result
 }
 
+// Every command needs to look up tweets and reply to them, so returns
+// how long the slowest of those would need to wait for the rate limit
+func rateLimitDelay(ctx context.Context) time.Duration {
+	state := getHandleCommandState(ctx)
+	var delay time.Duration
+	for _, route := range []string{twitter.GetTweetRoute, twitter.TweetReplyRoute} {
+		if limit := state.client.RateLimit(route); limit.Delay > delay {
+			delay = limit.Delay
+		}
+	}
+	return delay
+}
+
 func handleCommand(ctx context.Context, command command, tweet *twitter.Tweet) (result common.ActivityResult) {
 	tweetToReplyTo := tweet
 	if command.help {
 		result = Help(ctx, tweet)
 	} else if command.unknown {
 		result = Unknown(ctx, tweet)
+	} else if command.stop || command.start {
+		result = SetOptOut(ctx, tweet, command.stop)
+	} else if command.delete {
+		result = Delete(ctx, tweet)
 	} else {
 
 		state := getHandleCommandState(ctx)
+		// The reply is sent with ctx, so it still goes out after the job runs out of time
+		jobCtx, cancel := context.WithTimeout(ctx, state.jobTimeout)
+		defer cancel()
 		var mediaTweet *twitter.Tweet
-		mediaTweet, err := findTweet(ctx, state.client, tweet)
-		if err == nil {
-			responses := getResponses(ctx, command, mediaTweet)
+		mediaTweet, err := findTweet(jobCtx, state.client, tweet)
+		if err == nil && isOptedOut(ctx, mediaTweet) {
+			// Check before calling any of the providers, so the media is never even downloaded
+			result = AuthorOptedOut(ctx, tweet)
+		} else if err == nil {
+			// The providers share the downloaded media, so each photo is only fetched once
+			responses, incomplete := getResponses(withMediaDownloads(jobCtx), command, mediaTweet)
+			cancel()
 			combinedResponses := make([]mediaResponse, len(mediaTweet.Media))
 			for i := range combinedResponses {
 				combinedResponses[i] = combineResponsesForSingleImage(ctx, mediaTweet, i, responses[i])
 			}
 
 			replyMessage := getReplyMessageFromResponses(ctx, combinedResponses)
+			if incomplete {
+				logrus.Info(fmt.Sprintf("%s: ran out of time, replying with partial results", tweet.Id))
+				replyMessage = message.AddPartialReplyNote(ctx, replyMessage)
+			}
 			replyResult := _reply(ctx, tweet, replyMessage)
 			if replyResult.Err == nil {
 				result = common.ActivityResult{Tweet: tweet, Err: combinedError(combinedResponses)}
+			} else if replyResult.Resuming {
+				// The replier will finish the thread (or report the error) on its own
+				result = common.ActivityResult{Tweet: tweet, Action: "resuming reply later", Err: replyResult.Err}
 			} else {
 				err = replyResult.Err
 				tweetToReplyTo = replyResult.ParentTweet
@@ -95,122 +156,118 @@ func doNothings(count int) (responses []mediaResponse) {
 	return responses
 }
 
-func getResponses(ctx context.Context, command command, mediaTweet *twitter.Tweet) (responses [][]mediaResponse) {
+// Returns the responses to use for each media. incomplete is true if any of them ran out of time,
+// but were left out in favor of the ones which didn't, so the user needs to be told something is missing
+func getResponses(ctx context.Context, command command, mediaTweet *twitter.Tweet) (responses [][]mediaResponse, incomplete bool) {
 	numMedia := len(mediaTweet.Media)
 	responses = make([][]mediaResponse, numMedia)
-	var altTextResponses, ocrResponses, describeResponses []mediaResponse
-	if command.altText || command.auto {
-		altTextResponses = getAltText(ctx, command, mediaTweet)
-	} else {
-		altTextResponses = doNothings(numMedia)
+	var altTextResponses, ocrResponses, describeResponses, answerResponses, labelsResponses []mediaResponse
+	// Each of these gives up on its own when ctx runs out of time
+	wg := sync.WaitGroup{}
+	run := func(enabled bool, responses *[]mediaResponse, get func() []mediaResponse) {
+		if !enabled {
+			*responses = doNothings(numMedia)
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			*responses = get()
+		}()
 	}
-
-	if command.ocr || command.auto {
-		ocrResponses = getOcr(ctx, command, mediaTweet)
-	} else {
-		ocrResponses = doNothings(numMedia)
+	run(command.altText || command.auto, &altTextResponses, func() []mediaResponse { return getAltText(ctx, command, mediaTweet) })
+	run(command.ocr || command.auto, &ocrResponses, func() []mediaResponse { return getOcr(ctx, command, mediaTweet) })
+	run(command.describe || command.auto, &describeResponses, func() []mediaResponse { return getDescription(ctx, mediaTweet) })
+	run(command.labels, &labelsResponses, func() []mediaResponse { return getLabels(ctx, mediaTweet) })
+	run(command.question != "", &answerResponses, func() []mediaResponse { return getAnswer(ctx, command, mediaTweet) })
+	wg.Wait()
+	if command.auto && !command.labels {
+		labelsResponses = getFallbackLabels(ctx, mediaTweet, describeResponses)
 	}
 
-	if command.describe || command.auto {
-		describeResponses = getDescription(ctx, mediaTweet)
-	} else {
-		describeResponses = doNothings(numMedia)
+	policy := getHandleCommandState(ctx).policy
+	for i := range responses {
+		results := mediaResults{altText: altTextResponses[i], ocr: ocrResponses[i], description: describeResponses[i], answer: answerResponses[i], labels: labelsResponses[i]}
+		responses[i] = policy.segments(command, results)
+		if !containsTimeout(responses[i]) && usesTimedOutResults(policy, command, results) {
+			incomplete = true
+		}
 	}
+	return responses, incomplete
+}
 
-	for i := range responses {
-		altTextResponse := altTextResponses[i]
-		ocrResponse := ocrResponses[i]
-		describeResponse := describeResponses[i]
-		hasAltText := altTextResponse.err == nil && altTextResponse.responseType == foundAltTextResponse
-		hasOCR := ocrResponse.err == nil && ocrResponse.responseType == foundOCRResponse
-		hasDescription := describeResponse.err == nil && describeResponse.responseType == foundVisionResponse
-		// This logic is closely intertwined with combineResponsesForSingleImage
-		// The returning array for each media has implicit rules, such as the ordering of which type goes first
-		// and also whether errors are included.
-		if altTextResponse.responseType == doNothingResponse && ocrResponse.responseType == doNothingResponse && describeResponse.responseType == doNothingResponse {
-			responses[i] = doNothings(1)
-		} else if command.auto {
-			if hasAltText {
-				responses[i] = []mediaResponse{altTextResponse}
-			} else if hasOCR && hasDescription && len(ocrResponse.reply) < longOCRMessageThreshold {
-				responses[i] = []mediaResponse{describeResponse, ocrResponse}
-			} else if hasOCR {
-				responses[i] = []mediaResponse{ocrResponse}
-			} else if hasDescription {
-				responses[i] = []mediaResponse{describeResponse}
-
-			} else if ocrResponse.err != nil {
-				// If there's an error, prefer the OCR one for auto
-				responses[i] = []mediaResponse{ocrResponse}
-			} else {
-				responses[i] = []mediaResponse{describeResponse}
-			}
-		} else if hasAltText || hasOCR || hasDescription {
-			// At least one thing succeeded, so only add things which didn't error
-			responses[i] = []mediaResponse{altTextResponse}
-			if hasDescription {
-				responses[i] = append(responses[i], describeResponse)
-			}
-			if hasOCR {
-				responses[i] = append(responses[i], ocrResponse)
-			}
-		} else if ocrResponse.responseType != doNothingResponse {
-			// Prefer the OCR error
-			responses[i] = []mediaResponse{altTextResponse, ocrResponse}
-		} else {
-			// Fallback to the describe error
-			responses[i] = []mediaResponse{altTextResponse, describeResponse}
+// Auto only says the labels when the description isn't good enough, so they're only asked for those media
+func getFallbackLabels(ctx context.Context, mediaTweet *twitter.Tweet, descriptions []mediaResponse) []mediaResponse {
+	responses := doNothings(len(mediaTweet.Media))
+	fallbackTweet := *mediaTweet
+	fallbackTweet.Media = nil
+	indexes := []int{}
+	for i, description := range descriptions {
+		if needsLabels(description) {
+			fallbackTweet.Media = append(fallbackTweet.Media, mediaTweet.Media[i])
+			indexes = append(indexes, i)
 		}
 	}
+	if len(indexes) == 0 {
+		return responses
+	}
+	for i, response := range getLabels(ctx, &fallbackTweet) {
+		response.index = indexes[i]
+		responses[indexes[i]] = response
+	}
 	return responses
 }
 
+func containsTimeout(responses []mediaResponse) bool {
+	for _, response := range responses {
+		if isTimedOut(response) {
+			return true
+		}
+	}
+	return false
+}
+
+// Joins the responses chosen by the response policy into a single reply, in the order they were chosen.
+// Translated responses from bilingual commands keep their original text next to the translation
 func combineResponsesForSingleImage(ctx context.Context, mediaTweet *twitter.Tweet, index int, responses []mediaResponse) (response mediaResponse) {
 	responses = removeDoNothings(responses)
 	if len(responses) == 0 {
 		response = mediaResponse{index: index, responseType: doNothingResponse}
-		response.responseType = doNothingResponse
 	} else if len(responses) == 1 {
 		response = responses[0]
+		response.reply = bilingualReply(ctx, response)
 	} else {
 		response = mediaResponse{index: index, responseType: combinedResponse}
-		var altTextReply, descriptionReply, ocrReply message.Localized
-		// Handle the alt text, if it exists
-		if responses[0].responseType == foundAltTextResponse {
-			altTextReply = message.HasAltText(ctx, mediaTweet.User.Display, string(responses[0].reply))
-			responses = responses[1:]
-			// alt text can't throw an error, otherwise this needs to be handled here
-		} else if responses[0].responseType == missingAltTextResponse {
-			altTextReply = responses[0].reply
-			responses = responses[1:]
-		}
-
-		if len(responses) == 1 && responses[0].err != nil {
-			response.err = responses[0].err
-			if !altTextReply.IsEmpty() {
-				response.reply = message.AddBotError(ctx, altTextReply, response.err)
+		for _, segment := range responses {
+			segment.reply = bilingualReply(ctx, segment)
+			if segment.err != nil {
+				if response.err == nil {
+					response.err = segment.err
+				}
+				if !response.reply.IsEmpty() {
+					response.reply = message.AddBotError(ctx, response.reply, segment.err)
+				}
+				continue
 			}
-		} else if len(responses) > 0 {
-			for _, r := range responses {
-				if r.responseType == foundVisionResponse {
-					descriptionReply = r.reply
-				} else if r.responseType == foundOCRResponse {
-					ocrReply = r.reply
+			switch segment.responseType {
+			case foundAltTextResponse:
+				response.reply = message.HasAltText(ctx, mediaTweet.User.Display, string(segment.reply))
+			case missingAltTextResponse:
+				response.reply = segment.reply
+			case foundVisionResponse, foundLabelsResponse:
+				if response.reply.IsEmpty() {
+					response.reply = segment.reply
+				} else {
+					response.reply = message.AddDescription(ctx, response.reply, segment.reply)
+				}
+			case foundOCRResponse:
+				if response.reply.IsEmpty() {
+					response.reply = segment.reply
+				} else {
+					response.reply = message.AddOCR(ctx, response.reply, segment.reply, segment.confidence)
 				}
 			}
 		}
-
-		// There must be > 1 non-empty reply to get this far
-		// First we check to see if all 3 are non-empty, otherwise we walk through the remaining 2-reply cases
-		if !altTextReply.IsEmpty() && !descriptionReply.IsEmpty() && !ocrReply.IsEmpty() {
-			response.reply = message.AddDescription(ctx, altTextReply, message.AddOCR(ctx, descriptionReply, ocrReply))
-		} else if altTextReply.IsEmpty() {
-			response.reply = message.AddOCR(ctx, descriptionReply, ocrReply)
-		} else if descriptionReply.IsEmpty() {
-			response.reply = message.AddOCR(ctx, altTextReply, ocrReply)
-		} else {
-			response.reply = message.AddDescription(ctx, altTextReply, descriptionReply)
-		}
 	}
 	return response
 }
@@ -3,9 +3,11 @@ package handle_command
 import (
 	"context"
 	"errors"
+	"fmt"
 	"math"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/AnilRedshift/captions_please_go/internal/api/replier"
 	"github.com/AnilRedshift/captions_please_go/pkg/message"
@@ -15,6 +17,7 @@ import (
 	"github.com/fortytw2/leaktest"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
 )
 
 func TestHandleCommand(t *testing.T) {
@@ -26,16 +29,21 @@ func TestHandleCommand(t *testing.T) {
 	noPhotosFoundErr := structured_error.Wrap(errors.New(""), structured_error.NoPhotosFound)
 	ocrErr := structured_error.Wrap(errors.New("no results"), structured_error.OCRError)
 	describeErr := structured_error.Wrap(errors.New("no results"), structured_error.DescribeError)
+	answerErr := structured_error.Wrap(errors.New("no answer"), structured_error.AnswerError)
+	labelsErr := structured_error.Wrap(errors.New("no labels"), structured_error.LabelError)
 	tests := []struct {
-		name         string
-		command      command
-		altText      []mediaResponse
-		ocr          []mediaResponse
-		description  []mediaResponse
-		replyErr     structured_error.StructuredError
-		findTweetErr structured_error.StructuredError
-		expected     string
-		hasErr       bool
+		name          string
+		command       command
+		altText       []mediaResponse
+		ocr           []mediaResponse
+		description   []mediaResponse
+		answer        []mediaResponse
+		labels        []mediaResponse
+		replyErr      structured_error.StructuredError
+		replyResuming bool
+		findTweetErr  structured_error.StructuredError
+		expected      string
+		hasErr        bool
 	}{
 		{
 			name:     "replies with help",
@@ -111,6 +119,19 @@ func TestHandleCommand(t *testing.T) {
 			ocr:      []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: message.Localized(someText)}},
 			expected: someText,
 		},
+		{
+			name:     "returns the original ocr next to its translation",
+			command:  command{ocr: true, translate: true, bilingual: true},
+			ocr:      []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "hello", original: "こんにちは", sourceLanguage: language.Japanese}},
+			expected: "こんにちは (translated from Japanese: hello)",
+		},
+		{
+			name:     "returns the original alt text and ocr next to their translations",
+			command:  command{altText: true, ocr: true, translate: true, bilingual: true},
+			altText:  []mediaResponse{{index: 0, responseType: foundAltTextResponse, reply: "a cat", original: "un gato"}},
+			ocr:      []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "meow", original: "miau", sourceLanguage: language.Spanish}},
+			expected: "UserPostingMedia says it's un gato (translated: a cat). It contains the text: miau (translated from Spanish: meow)",
+		},
 		{
 			name:     "informs the user no OCR could be computed",
 			command:  command{ocr: true},
@@ -209,7 +230,7 @@ func TestHandleCommand(t *testing.T) {
 			name:        "alt text and description for an image",
 			command:     command{altText: true, describe: true},
 			altText:     []mediaResponse{{index: 0, responseType: foundAltTextResponse, reply: message.Localized(someText)}},
-			description: []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Localized("my cool description")}},
+			description: []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Localized("I think it's my cool description")}},
 			expected:    "UserPostingMedia says it's buffalo buffalo etc. etc.. I think it's my cool description",
 		},
 		{
@@ -231,7 +252,7 @@ func TestHandleCommand(t *testing.T) {
 			name:        "description but no alt text for an image",
 			command:     command{altText: true, describe: true},
 			altText:     []mediaResponse{{index: 0, responseType: missingAltTextResponse, reply: message.Localized(noAltText)}},
-			description: []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Localized("my cool description")}},
+			description: []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Localized("I think it's my cool description")}},
 			expected:    "no alt text hiss. I think it's my cool description",
 		},
 		{
@@ -246,7 +267,7 @@ func TestHandleCommand(t *testing.T) {
 			command:     command{altText: true, ocr: true, describe: true},
 			altText:     []mediaResponse{{index: 0, responseType: foundAltTextResponse, reply: message.Localized(someText)}},
 			ocr:         []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: message.Localized("my cool ocr")}},
-			description: []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Localized("my cool description")}},
+			description: []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Localized("I think it's my cool description")}},
 			expected:    "UserPostingMedia says it's buffalo buffalo etc. etc.. I think it's my cool description. It contains the text: my cool ocr",
 		},
 		{
@@ -254,7 +275,7 @@ func TestHandleCommand(t *testing.T) {
 			command:     command{altText: true, ocr: true, describe: true},
 			altText:     []mediaResponse{{index: 0, responseType: missingAltTextResponse, reply: message.Localized(noAltText)}},
 			ocr:         []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: message.Localized("my cool ocr")}},
-			description: []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Localized("my cool description")}},
+			description: []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Localized("I think it's my cool description")}},
 			expected:    "no alt text hiss. I think it's my cool description. It contains the text: my cool ocr",
 		},
 		{
@@ -341,6 +362,55 @@ func TestHandleCommand(t *testing.T) {
 			expected:    string(message.ErrorMessage(context.Background(), anErr)),
 			hasErr:      true,
 		},
+		{
+			name:    "answers the question about each image",
+			command: command{question: "what breed is the dog?"},
+			answer: []mediaResponse{
+				{index: 0, responseType: foundAnswerResponse, reply: message.Localized("It's a corgi")},
+				{index: 1, responseType: foundAnswerResponse, reply: message.Localized("There isn't a dog in this image")},
+			},
+			expected: "Image 1: It's a corgi\nImage 2: There isn't a dog in this image",
+		},
+		{
+			name:     "replies with an error if the question can't be answered",
+			command:  command{question: "what breed is the dog?"},
+			answer:   []mediaResponse{{index: 0, responseType: foundAnswerResponse, err: answerErr}},
+			expected: "I couldn't answer your question about this image, sorry!",
+			hasErr:   true,
+		},
+		{
+			name:     "lists the things in the image",
+			command:  command{labels: true},
+			labels:   []mediaResponse{{index: 0, responseType: foundLabelsResponse, reply: message.Localized("I see: dog, frisbee")}},
+			expected: "I see: dog, frisbee",
+		},
+		{
+			name:     "replies with an error if nothing in the image was recognized",
+			command:  command{labels: true},
+			labels:   []mediaResponse{{index: 0, responseType: foundLabelsResponse, err: labelsErr}},
+			expected: "I couldn't find anything I recognize, sorry!",
+			hasErr:   true,
+		},
+		{
+			name:        "auto lists the things in the image when the description is unsure",
+			command:     command{auto: true},
+			altText:     []mediaResponse{{index: 0, responseType: missingAltTextResponse, reply: message.Localized(noAltText)}},
+			ocr:         []mediaResponse{{index: 0, responseType: doNothingResponse}},
+			description: []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: message.Localized("It might be a cat"), confidence: 0.2}},
+			labels:      []mediaResponse{{index: 0, responseType: foundLabelsResponse, reply: message.Localized("I see: dog, frisbee"), confidence: 0.9}},
+			expected:    "I see: dog, frisbee",
+		},
+		{
+			name:          "does not reply with a failure message if the replier is going to retry",
+			command:       command{auto: true},
+			altText:       []mediaResponse{{index: 0, responseType: foundAltTextResponse, reply: message.Localized(someText)}},
+			ocr:           []mediaResponse{{index: 0, responseType: doNothingResponse}},
+			description:   []mediaResponse{{index: 0, responseType: doNothingResponse}},
+			replyErr:      anErr,
+			replyResuming: true,
+			expected:      someText,
+			hasErr:        true,
+		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -351,12 +421,16 @@ func TestHandleCommand(t *testing.T) {
 			var origGetAltText = getAltText
 			var origGetOcr = getOcr
 			var origGetDescription = getDescription
+			var origGetAnswer = getAnswer
+			var origGetLabels = getLabels
 			var origFindTweet = findTweet
 			var origReply = _reply
 			defer func() {
 				getAltText = origGetAltText
 				getOcr = origGetOcr
 				getDescription = origGetDescription
+				getAnswer = origGetAnswer
+				getLabels = origGetLabels
 				findTweet = origFindTweet
 				_reply = origReply
 			}()
@@ -366,9 +440,19 @@ func TestHandleCommand(t *testing.T) {
 			}
 			getOcr = func(ctx context.Context, command command, mediaTweet *twitter.Tweet) []mediaResponse { return test.ocr }
 			getDescription = func(ctx context.Context, mediaTweet *twitter.Tweet) []mediaResponse { return test.description }
+			getAnswer = func(ctx context.Context, command command, mediaTweet *twitter.Tweet) []mediaResponse {
+				return test.answer
+			}
+			getLabels = func(ctx context.Context, mediaTweet *twitter.Tweet) []mediaResponse {
+				if test.labels == nil {
+					// Auto asks for the labels when the description isn't good enough, but most cases don't care about them
+					return doNothings(len(mediaTweet.Media))
+				}
+				return test.labels
+			}
 			findTweet = func(ctx context.Context, client twitter.Twitter, tweet *twitter.Tweet) (*twitter.Tweet, structured_error.StructuredError) {
 				// Golangs lack of generics are super-cool!
-				numMedia := int(math.Max(math.Max(float64(len(test.altText)), float64(len(test.ocr))), float64(len(test.description))))
+				numMedia := int(math.Max(math.Max(math.Max(float64(len(test.altText)), float64(len(test.ocr))), float64(len(test.description))), math.Max(float64(len(test.answer)), float64(len(test.labels)))))
 				media := make([]twitter.Media, numMedia)
 				mediaTweet := &twitter.Tweet{
 					Id: "mediaTweet",
@@ -388,13 +472,14 @@ func TestHandleCommand(t *testing.T) {
 				return replier.ReplyResult{
 					ParentTweet: parentTweet,
 					Err:         test.replyErr,
+					Resuming:    test.replyResuming,
 				}
 			}
 
 			mockTwitter := &twitter_test.MockTwitter{T: t}
 
 			ctx = WithHandleCommand(ctx, mockTwitter)
-			ctx, err := replier.WithReplier(ctx, mockTwitter, false)
+			ctx, err := replier.WithReplier(ctx, mockTwitter, replier.Config{})
 			assert.NoError(t, err)
 			parentTweet := &twitter.Tweet{Id: "parentTweet"}
 			result := handleCommand(ctx, test.command, parentTweet)
@@ -436,7 +521,7 @@ func TestHandleCommandRespondsToAPanic(t *testing.T) {
 	mockTwitter := &twitter_test.MockTwitter{T: t}
 
 	ctx = WithHandleCommand(ctx, mockTwitter)
-	ctx, err := replier.WithReplier(ctx, mockTwitter, false)
+	ctx, err := replier.WithReplier(ctx, mockTwitter, replier.Config{})
 	assert.NoError(t, err)
 	assert.Panics(t, func() {
 		HandleCommand(ctx, "help", &twitter.Tweet{})
@@ -445,3 +530,263 @@ func TestHandleCommandRespondsToAPanic(t *testing.T) {
 	expected := string(message.ErrorMessage(ctx, unknownErr))
 	assert.Equal(t, expected, sentMessage)
 }
+
+func TestHandleCommandDefersWhenRateLimited(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var origReply = _reply
+	defer func() {
+		_reply = origReply
+	}()
+
+	sent := make(chan string, 1)
+	_reply = func(ctx context.Context, tweet *twitter.Tweet, message message.Localized) replier.ReplyResult {
+		sent <- string(message)
+		return replier.ReplyResult{ParentTweet: tweet}
+	}
+
+	limited := true
+	mockTwitter := &twitter_test.MockTwitter{T: t,
+		RateLimitMock: func(route string) twitter.RateLimit {
+			if limited && route == twitter.TweetReplyRoute {
+				return twitter.RateLimit{Delay: time.Minute * 5}
+			}
+			return twitter.RateLimit{}
+		},
+	}
+
+	ctx = WithHandleCommand(ctx, mockTwitter)
+	ctx, err := replier.WithReplier(ctx, mockTwitter, replier.Config{})
+	assert.NoError(t, err)
+	result := HandleCommand(ctx, "help", &twitter.Tweet{Id: "1"})
+	assert.NoError(t, result.Err)
+	// It's up to the caller to run the command again later
+	assert.Equal(t, time.Minute*5, result.RetryAfter)
+	assert.Empty(t, sent)
+
+	limited = false
+	result = HandleCommand(ctx, "help", &twitter.Tweet{Id: "1"})
+	assert.NoError(t, result.Err)
+	assert.Zero(t, result.RetryAfter)
+	assert.Equal(t, string(message.HelpMessage(ctx)), <-sent)
+}
+
+func TestHandleCommandOptOut(t *testing.T) {
+	author := twitter.User{Id: "author", Display: "UserPostingMedia"}
+	tests := []struct {
+		name          string
+		command       command
+		sender        string
+		optedOut      bool
+		expected      message.Localized
+		action        string
+		expectOptOut  bool
+		callsProvider bool
+	}{
+		{
+			name:         "The author can opt out",
+			command:      command{stop: true},
+			sender:       "author",
+			expected:     message.OptedOutMessage(context.Background()),
+			action:       "opted out",
+			expectOptOut: true,
+		},
+		{
+			name:     "The author can opt back in",
+			command:  command{start: true},
+			sender:   "author",
+			optedOut: true,
+			expected: message.OptedInMessage(context.Background()),
+			action:   "opted in",
+		},
+		{
+			name:         "Doesn't interpret images from authors who opted out",
+			command:      command{ocr: true},
+			sender:       "someone else",
+			optedOut:     true,
+			expected:     message.AuthorOptedOutMessage(context.Background()),
+			action:       "author opted out",
+			expectOptOut: true,
+		},
+		{
+			name:          "Interprets images from everyone else",
+			command:       command{ocr: true},
+			sender:        "someone else",
+			expected:      "some text",
+			callsProvider: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer leaktest.Check(t)()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var origGetOcr = getOcr
+			var origFindTweet = findTweet
+			var origReply = _reply
+			defer func() {
+				getOcr = origGetOcr
+				findTweet = origFindTweet
+				_reply = origReply
+			}()
+
+			calledProvider := false
+			getOcr = func(ctx context.Context, command command, mediaTweet *twitter.Tweet) []mediaResponse {
+				calledProvider = true
+				return []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "some text"}}
+			}
+			findTweet = func(ctx context.Context, client twitter.Twitter, tweet *twitter.Tweet) (*twitter.Tweet, structured_error.StructuredError) {
+				return &twitter.Tweet{Id: "mediaTweet", User: author, Media: []twitter.Media{{Type: "photo"}}}, nil
+			}
+			sentMessage := message.Localized("")
+			_reply = func(ctx context.Context, tweet *twitter.Tweet, message message.Localized) replier.ReplyResult {
+				sentMessage = message
+				return replier.ReplyResult{ParentTweet: &twitter.Tweet{Id: "123"}}
+			}
+
+			mockTwitter := &twitter_test.MockTwitter{T: t}
+			ctx = WithHandleCommand(ctx, mockTwitter)
+			store := NewMemoryOptOutStore()
+			require.NoError(t, store.SetOptedOut("author", test.optedOut))
+			ctx = WithOptOutStore(ctx, store)
+
+			tweet := &twitter.Tweet{Id: "parentTweet", User: twitter.User{Id: test.sender}}
+			result := handleCommand(ctx, test.command, tweet)
+			assert.NoError(t, result.Err)
+			assert.Equal(t, test.action, result.Action)
+			assert.Equal(t, test.expected, sentMessage)
+			assert.Equal(t, test.expectOptOut, store.IsOptedOut("author"))
+			assert.Equal(t, test.callsProvider, calledProvider)
+		})
+	}
+}
+
+func TestHandleCommandRepliesWithPartialResultsOnTimeout(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var origGetOcr = getOcr
+	var origGetDescription = getDescription
+	var origFindTweet = findTweet
+	var origReply = _reply
+	defer func() {
+		getOcr = origGetOcr
+		getDescription = origGetDescription
+		findTweet = origFindTweet
+		_reply = origReply
+	}()
+
+	getOcr = func(ctx context.Context, command command, mediaTweet *twitter.Tweet) []mediaResponse {
+		// The provider never answers, so the job runs out of time
+		<-ctx.Done()
+		return []mediaResponse{timedOutResponse(0, foundOCRResponse)}
+	}
+	getDescription = func(ctx context.Context, mediaTweet *twitter.Tweet) []mediaResponse {
+		return []mediaResponse{{index: 0, responseType: foundVisionResponse, reply: "a cat"}}
+	}
+	findTweet = func(ctx context.Context, client twitter.Twitter, tweet *twitter.Tweet) (*twitter.Tweet, structured_error.StructuredError) {
+		return &twitter.Tweet{Id: "mediaTweet", Media: []twitter.Media{{Type: "photo"}}}, nil
+	}
+	sentMessage := message.Localized("")
+	_reply = func(ctx context.Context, tweet *twitter.Tweet, message message.Localized) replier.ReplyResult {
+		// The reply still goes out even though the job's deadline has passed
+		assert.NoError(t, ctx.Err())
+		sentMessage = message
+		return replier.ReplyResult{ParentTweet: &twitter.Tweet{Id: "123"}}
+	}
+
+	mockTwitter := &twitter_test.MockTwitter{T: t}
+	ctx = WithHandleCommand(ctx, mockTwitter)
+	ctx = WithJobTimeout(ctx, time.Millisecond*10)
+	result := handleCommand(ctx, command{ocr: true, describe: true}, &twitter.Tweet{Id: "parentTweet"})
+	assert.NoError(t, result.Err)
+	assert.Equal(t, message.AddPartialReplyNote(ctx, "a cat"), sentMessage)
+}
+
+func TestGetResponsesOnlyAsksForLabelsWhenTheDescriptionIsUnsure(t *testing.T) {
+	tests := []struct {
+		name        string
+		description []mediaResponse
+		labelled    []string
+	}{
+		{
+			name: "Never asks when every description is confident",
+			description: []mediaResponse{
+				{index: 0, responseType: foundVisionResponse, reply: "a cat", confidence: 0.9},
+				{index: 1, responseType: foundVisionResponse, reply: "a dog", confidence: 0.8},
+			},
+		},
+		{
+			name: "Asks for the media with unsure or missing descriptions",
+			description: []mediaResponse{
+				{index: 0, responseType: foundVisionResponse, reply: "a cat", confidence: 0.9},
+				{index: 1, responseType: foundVisionResponse, reply: "a dog", confidence: 0.2},
+				{index: 2, responseType: foundVisionResponse, err: structured_error.Wrap(errors.New("no results"), structured_error.DescribeError)},
+			},
+			labelled: []string{"photo1.jpg", "photo2.jpg"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			var origGetAltText = getAltText
+			var origGetOcr = getOcr
+			var origGetDescription = getDescription
+			var origGetLabels = getLabels
+			defer func() {
+				getAltText = origGetAltText
+				getOcr = origGetOcr
+				getDescription = origGetDescription
+				getLabels = origGetLabels
+			}()
+
+			getAltText = func(ctx context.Context, command command, mediaTweet *twitter.Tweet) []mediaResponse {
+				return doNothings(len(mediaTweet.Media))
+			}
+			getOcr = func(ctx context.Context, command command, mediaTweet *twitter.Tweet) []mediaResponse {
+				return doNothings(len(mediaTweet.Media))
+			}
+			getDescription = func(ctx context.Context, mediaTweet *twitter.Tweet) []mediaResponse { return test.description }
+			var labelled []string
+			getLabels = func(ctx context.Context, mediaTweet *twitter.Tweet) []mediaResponse {
+				responses := make([]mediaResponse, len(mediaTweet.Media))
+				for i, media := range mediaTweet.Media {
+					labelled = append(labelled, media.Url)
+					responses[i] = mediaResponse{index: i, responseType: foundLabelsResponse, reply: message.Localized("I see: " + media.Url)}
+				}
+				return responses
+			}
+
+			media := make([]twitter.Media, len(test.description))
+			for i := range media {
+				media[i] = twitter.Media{Type: "photo", Url: fmt.Sprintf("photo%d.jpg", i)}
+			}
+			ctx = WithHandleCommand(ctx, &twitter_test.MockTwitter{T: t})
+			responses, _ := getResponses(ctx, command{auto: true}, &twitter.Tweet{Id: "mediaTweet", Media: media})
+			assert.Equal(t, test.labelled, labelled)
+			require.Len(t, responses, len(media))
+			for i, description := range test.description {
+				if needsLabels(description) {
+					assert.Equal(t, []mediaResponse{{index: i, responseType: foundLabelsResponse, reply: message.Localized("I see: " + media[i].Url)}}, responses[i])
+				} else {
+					assert.Equal(t, []mediaResponse{description}, responses[i])
+				}
+			}
+		})
+	}
+}
+
+func TestCollectMediaResponsesTimesOut(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	jobs := make(chan mediaResponse, 2)
+	jobs <- mediaResponse{index: 1, responseType: foundOCRResponse, reply: "second"}
+	cancel()
+	responses := collectMediaResponses(ctx, 2, jobs, foundOCRResponse)
+	require.Len(t, responses, 2)
+	assert.True(t, isTimedOut(responses[0]))
+	assert.EqualValues(t, foundOCRResponse, responses[0].responseType)
+	// The select may pick either case once the context is done, so the finished job can be dropped as well
+	assert.True(t, isTimedOut(responses[1]) || responses[1].reply == "second")
+}
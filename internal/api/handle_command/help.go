@@ -26,3 +26,13 @@ func Unknown(ctx context.Context, tweet *twitter.Tweet) common.ActivityResult {
 	return common.ActivityResult{Tweet: tweet, Action: "reply with unknown message"}
 
 }
+
+// Lets a user who has gone over their quota know why we're ignoring them
+func SlowDown(ctx context.Context, commandMessage string, tweet *twitter.Tweet) common.ActivityResult {
+	ctx = message.WithLanguage(ctx, parseCommand(commandMessage, answersQuestions(ctx)).tag)
+	result := _reply(ctx, tweet, message.SlowDownMessage(ctx))
+	if result.Err != nil {
+		logrus.Info(fmt.Sprintf("%s: Replying with the slow down message failed with %v", tweet.Id, result.Err))
+	}
+	return common.ActivityResult{Tweet: tweet, Action: "reply with slow down message"}
+}
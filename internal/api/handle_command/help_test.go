@@ -19,11 +19,16 @@ func TestHandleHelp(t *testing.T) {
 	helpMessages := []string{`Tag @captions_please in a tweet to interpret the images.
 You can customize the response by adding one of the following commands after tagging me:
 alt text: See what description the user gave when creating the tweet
-get text: Scan the image for text
-describe: Use AI to create a`,
-		`description of the image
+get text: Scan the image for text`,
+		`handwriting: Scan the image for handwriting. Add the language it's written in if you know it (e.g. handwriting in de)
+describe: Use AI to create a description of the image
+ask: Ask a question about the image, or just tag me with your question (e.g. ask what does the sign say?)`,
+		`tags: List the objects, landmarks and brands in the image
 get everything: Get the user's description, the scanned text, and an AI generated description
 translate: Automatically convert the result to the language code specified. (e.g. translate into ja-jp)`,
+		`bilingual: Like translate, but keeps the original text next to the translation
+stop: Stop me from interpreting your images. Tag me with start to undo it
+delete: Reply to one of my replies with this to remove them`,
 	}
 	tests := []struct {
 		name       string
@@ -59,7 +64,7 @@ translate: Automatically convert the result to the language code specified. (e.g
 
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
-			ctx, err := replier.WithReplier(ctx, mockTwitter, false)
+			ctx, err := replier.WithReplier(ctx, mockTwitter, replier.Config{})
 			assert.NoError(t, err)
 
 			tweet := &twitter.Tweet{Id: "0"}
@@ -0,0 +1,128 @@
+package handle_command
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"sync"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/sirupsen/logrus"
+)
+
+// Images whose hashes are at most this many bits apart are treated as the same image
+const maxHashDistance = 3
+
+// How many results are remembered before the oldest are forgotten
+const maxImageCacheEntries = 10000
+
+// How closely an image has to match one in the cache to reuse its results
+type imageMatch int
+
+const (
+	// The same bytes. Images which look alike can still have different text, so anything that reads the image needs this
+	exactImage imageMatch = iota
+	// A close enough perceptual hash, for results which don't depend on the details
+	similarImage
+)
+
+// What the cache knows an image by
+type imageKey struct {
+	digest [sha256.Size]byte
+	// Only set for similarImage matches
+	hash   preprocess.Hash
+	hashed bool
+}
+
+// Remembers what the providers said about each image, keyed by its contents and perceptual hash.
+// The same meme gets posted over and over under different urls, so this lets us skip the providers for the copies
+type imageCache struct {
+	lock sync.Mutex
+	// Oldest first
+	entries []imageCacheEntry
+}
+
+type imageCacheEntry struct {
+	key imageKey
+	// What kind of result this is, since OCR and descriptions are cached separately
+	kind   string
+	result interface{}
+}
+
+func newImageCache() *imageCache {
+	return &imageCache{}
+}
+
+// Returns the result for the same image as key. For similarImage matches, that's the closest image to key's hash,
+// if it's close enough to count as the same image
+func (c *imageCache) find(kind string, key imageKey, match imageMatch) (interface{}, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var closest *imageCacheEntry
+	closestDistance := maxHashDistance + 1
+	for i := range c.entries {
+		entry := &c.entries[i]
+		if entry.kind != kind {
+			continue
+		}
+		if entry.key.digest == key.digest {
+			return entry.result, true
+		}
+		if match != similarImage || !key.hashed || !entry.key.hashed {
+			continue
+		}
+		if distance := entry.key.hash.Distance(key.hash); distance < closestDistance {
+			closest = entry
+			closestDistance = distance
+		}
+	}
+	if closest == nil {
+		return nil, false
+	}
+	return closest.result, true
+}
+
+func (c *imageCache) put(kind string, key imageKey, result interface{}) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if len(c.entries) >= maxImageCacheEntries {
+		c.entries = c.entries[1:]
+	}
+	c.entries = append(c.entries, imageCacheEntry{key: key, kind: kind, result: result})
+}
+
+func getImageCache(ctx context.Context) *imageCache {
+	state, ok := ctx.Value(theCommandCtxKey).(*commandState)
+	if !ok {
+		return nil
+	}
+	return state.images
+}
+
+// Returns a previous result for the same image, if there is one. The cache is shared by every user,
+// so only results which can't give away what's in someone else's image should use similarImage
+func cachedMediaResult(ctx context.Context, kind string, media twitter.Media, match imageMatch) (interface{}, bool) {
+	cache := getImageCache(ctx)
+	if cache == nil {
+		return nil, false
+	}
+	key, ok := mediaKey(ctx, media, match)
+	if !ok {
+		return nil, false
+	}
+	result, ok := cache.find(kind, key, match)
+	if ok {
+		logrus.Debug(fmt.Sprintf("Reusing the %s result for %s, which looks like an image we've already seen", kind, media.Url))
+	}
+	return result, ok
+}
+
+// match should be the same as the one the result is looked up with
+func cacheMediaResult(ctx context.Context, kind string, media twitter.Media, match imageMatch, result interface{}) {
+	if cache := getImageCache(ctx); cache != nil {
+		if key, ok := mediaKey(ctx, media, match); ok {
+			cache.put(kind, key, result)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+package handle_command
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"image"
+	"image/color"
+	"image/png"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
+	vision_test "github.com/AnilRedshift/captions_please_go/pkg/vision/test"
+	"github.com/fortytw2/leaktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
+)
+
+// A different image for every hash
+func testImageKey(hash preprocess.Hash) imageKey {
+	return imageKey{digest: sha256.Sum256([]byte(hash.String())), hash: hash, hashed: true}
+}
+
+func TestImageCache(t *testing.T) {
+	cache := newImageCache()
+	_, ok := cache.find("labels", testImageKey(0), similarImage)
+	assert.False(t, ok)
+
+	cache.put("labels", testImageKey(0xff00), "first")
+	cache.put("labels", testImageKey(0xff0f), "second")
+	cache.put("describe/en", testImageKey(0xff00), "description")
+
+	result, ok := cache.find("labels", testImageKey(0xff01), similarImage)
+	assert.True(t, ok)
+	assert.Equal(t, "first", result)
+	result, ok = cache.find("labels", testImageKey(0xff0e), similarImage)
+	assert.True(t, ok)
+	assert.Equal(t, "second", result)
+	result, ok = cache.find("describe/en", testImageKey(0xff00), exactImage)
+	assert.True(t, ok)
+	assert.Equal(t, "description", result)
+
+	_, ok = cache.find("labels", testImageKey(0x00ff), similarImage)
+	assert.False(t, ok, "too far away")
+	_, ok = cache.find("describe/de", testImageKey(0xff00), exactImage)
+	assert.False(t, ok, "different kind")
+	_, ok = cache.find("labels", testImageKey(0xff01), exactImage)
+	assert.False(t, ok, "only looks the same")
+}
+
+func TestImageCacheForgetsTheOldest(t *testing.T) {
+	cache := newImageCache()
+	for i := 0; i < maxImageCacheEntries; i++ {
+		cache.put("ocr", testImageKey(0xffff), i)
+	}
+	cache.put("ocr", testImageKey(0), "newest")
+	assert.Len(t, cache.entries, maxImageCacheEntries)
+	assert.Equal(t, 1, cache.entries[0].result)
+	result, ok := cache.find("ocr", testImageKey(0), exactImage)
+	assert.True(t, ok)
+	assert.Equal(t, "newest", result)
+}
+
+func TestOCRReusesResultsForTheSameImage(t *testing.T) {
+	defer leaktest.Check(t)()
+	origFetchMedia := fetchMedia
+	defer func() {
+		fetchMedia = origFetchMedia
+	}()
+	gradient := image.NewGray(image.Rect(0, 0, 64, 64))
+	for x := 0; x < 64; x++ {
+		for y := 0; y < 64; y++ {
+			gradient.SetGray(x, y, color.Gray{Y: uint8((x * y) % 256)})
+		}
+	}
+	encoded := &bytes.Buffer{}
+	require.NoError(t, png.Encode(encoded, gradient))
+	fetchMedia = func(ctx context.Context, url string) ([]byte, error) {
+		return encoded.Bytes(), nil
+	}
+
+	var calls int32
+	mockGoogle := &vision_test.MockGoogle{T: t, GetOCRFromBytesMock: func(image []byte) (*vision.OCRResult, error) {
+		atomic.AddInt32(&calls, 1)
+		return &vision.OCRResult{Text: "some text", Language: vision.OCRLanguage{Tag: language.English, Confidence: 1.0}}, nil
+	}}
+	ctx := WithHandleCommand(context.Background(), nil)
+	ctx = setOCRState(ctx, &ocrState{google: mockGoogle, translator: mockGoogle})
+
+	for _, url := range []string{"first.png", "reposted.png"} {
+		mediaTweet := &twitter.Tweet{Media: []twitter.Media{{Type: "photo", Url: url}}}
+		responses := getOCRMediaResponse(withMediaDownloads(ctx), command{ocr: true}, mediaTweet)
+		assert.Equal(t, []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "some text", confidence: 1.0, language: language.English}}, responses)
+	}
+	assert.Equal(t, int32(1), calls)
+}
+
+// Screenshots of text on a white background have almost the same perceptual hash, whatever the text says
+func TestOCRDoesNotReuseResultsForDifferentText(t *testing.T) {
+	defer leaktest.Check(t)()
+	origFetchMedia := fetchMedia
+	defer func() {
+		fetchMedia = origFetchMedia
+	}()
+	screenshots := map[string][]byte{}
+	for i, url := range []string{"first.png", "second.png"} {
+		screenshot := image.NewGray(image.Rect(0, 0, 600, 200))
+		for x := 0; x < 600; x++ {
+			for y := 0; y < 200; y++ {
+				screenshot.SetGray(x, y, color.Gray{Y: 255})
+				// A line of thin letters, spaced differently in each screenshot
+				if y >= 90 && y < 100 && x >= 20 && x < 580 && (x*(7+i)/3)%5 == 0 {
+					screenshot.SetGray(x, y, color.Gray{Y: 0})
+				}
+			}
+		}
+		encoded := &bytes.Buffer{}
+		require.NoError(t, png.Encode(encoded, screenshot))
+		screenshots[url] = encoded.Bytes()
+	}
+	first, err := preprocess.HashImage(screenshots["first.png"])
+	require.NoError(t, err)
+	second, err := preprocess.HashImage(screenshots["second.png"])
+	require.NoError(t, err)
+	require.LessOrEqual(t, first.Distance(second), maxHashDistance)
+
+	fetchMedia = func(ctx context.Context, url string) ([]byte, error) {
+		return screenshots[url], nil
+	}
+	mockGoogle := &vision_test.MockGoogle{T: t, GetOCRFromBytesMock: func(image []byte) (*vision.OCRResult, error) {
+		text := "the first screenshot"
+		if bytes.Equal(image, screenshots["second.png"]) {
+			text = "the second screenshot"
+		}
+		return &vision.OCRResult{Text: text, Language: vision.OCRLanguage{Tag: language.English, Confidence: 1.0}}, nil
+	}}
+	ctx := WithHandleCommand(context.Background(), nil)
+	ctx = setOCRState(ctx, &ocrState{google: mockGoogle, translator: mockGoogle})
+
+	for _, url := range []string{"first.png", "second.png"} {
+		mediaTweet := &twitter.Tweet{Media: []twitter.Media{{Type: "photo", Url: url}}}
+		responses := getOCRMediaResponse(withMediaDownloads(ctx), command{ocr: true}, mediaTweet)
+		require.Len(t, responses, 1)
+		assert.Equal(t, message.Localized("the "+strings.TrimSuffix(url, ".png")+" screenshot"), responses[0].reply)
+	}
+}
@@ -0,0 +1,202 @@
+package handle_command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
+)
+
+type labelsKey int
+
+const theLabelsKey labelsKey = 0
+
+// Every provider names things in English, so they're cached before any translation
+const labelsCacheKind = "labels"
+
+var englishOnly = []language.Tag{language.English}
+
+// Which service names the things in the images
+type LabelerConfig struct {
+	// azure or google. Empty uses azure
+	Provider string
+	Azure    vision.AzureConfig
+}
+
+type labelsState struct {
+	labeler      vision.Labeler
+	translator   vision.Translator
+	imageOptions preprocess.Options
+	provider     provider
+}
+
+// Providers return lots of vague labels, so only the ones they're fairly sure about are said
+const lowLabelConfidenceCutoff = 0.5
+
+// At most this many labels are said for each image
+const maxLabels = 6
+
+// Specific names are more useful than what kind of thing something is, so they're said first
+var labelKindOrder = map[vision.LabelKind]int{
+	vision.LandmarkLabel: 0,
+	vision.BrandLabel:    1,
+	vision.ObjectLabel:   2,
+	vision.TagLabel:      3,
+}
+
+func WithLabels(ctx context.Context, config LabelerConfig) (context.Context, error) {
+	secrets := common.GetSecrets(ctx)
+	state := &labelsState{provider: provider(config.Provider), imageOptions: vision.LabelImageOptions}
+	var err error
+	switch state.provider {
+	case "", azureProvider:
+		state.provider = azureProvider
+		state.labeler = vision.NewAzureLabeler(secrets.AzureComputerVisionKey, config.Azure)
+	case googleProvider:
+		var google vision.Google
+		google, err = vision.NewGoogle(secrets.GooglePrivateKeyID, secrets.GooglePrivateKeySecret)
+		if err == nil {
+			state.labeler = google
+			go func() {
+				<-ctx.Done()
+				google.Close()
+			}()
+		}
+	default:
+		err = fmt.Errorf("unknown labels provider %s, must be [azure|google]", config.Provider)
+	}
+	if err != nil {
+		return ctx, err
+	}
+	state.translator, err = getTranslator(ctx)
+	if err != nil {
+		return ctx, err
+	}
+	go func() {
+		<-ctx.Done()
+		state.translator.Close()
+	}()
+	return setLabelsState(ctx, state), nil
+}
+
+func setLabelsState(ctx context.Context, state *labelsState) context.Context {
+	return context.WithValue(ctx, theLabelsKey, state)
+}
+
+func getLabelsState(ctx context.Context) *labelsState {
+	return ctx.Value(theLabelsKey).(*labelsState)
+}
+
+// Asks the provider to name the things in the media, unless we've already seen the same image.
+// Like the providers, returns the labels along with an UnsupportedLanguage error if they need translating
+func (state *labelsState) getLabels(ctx context.Context, media twitter.Media) ([]vision.Label, structured_error.StructuredError) {
+	_, wrongLangErr := message.GetCompatibleLanguage(ctx, englishOnly)
+	if cached, ok := cachedMediaResult(ctx, labelsCacheKind, media, similarImage); ok {
+		return cached.([]vision.Label), wrongLangErr
+	}
+	var labels []vision.Label
+	image, downloaded := prepareMedia(ctx, media, state.imageOptions)
+	release, err := waitForProvider(ctx, state.provider)
+	if err != nil {
+		return nil, err
+	}
+	if downloaded {
+		labels, err = state.labeler.GetLabelsFromBytes(ctx, image)
+	} else {
+		labels, err = state.labeler.GetLabels(ctx, media.Url)
+	}
+	release()
+	if err == nil || err.Type() == structured_error.UnsupportedLanguage {
+		cacheMediaResult(ctx, labelsCacheKind, media, similarImage, labels)
+	}
+	return labels, err
+}
+
+func getLabelsMediaResponse(ctx context.Context, mediaTweet *twitter.Tweet) []mediaResponse {
+	state := getLabelsState(ctx)
+	jobs := make(chan mediaResponse, len(mediaTweet.Media))
+	for i, media := range mediaTweet.Media {
+		i := i
+		media := media
+		go func() {
+			if media.Type == "photo" {
+				labels, err := state.getLabels(ctx, media)
+				labels = filterLabels(labels)
+				if err != nil && err.Type() == structured_error.UnsupportedLanguage {
+					logrus.Debug("The labels are valid, but in the wrong language. Trying to translate")
+					labels, err = state.translate(ctx, labels)
+				}
+				jobs <- getLabelsResponse(ctx, i, labels, err)
+			} else {
+				jobs <- mediaResponse{index: i, responseType: doNothingResponse}
+			}
+		}()
+	}
+	return collectMediaResponses(ctx, len(mediaTweet.Media), jobs, foundLabelsResponse)
+}
+
+// Only translates the labels which are going to be said
+func (state *labelsState) translate(ctx context.Context, labels []vision.Label) ([]vision.Label, structured_error.StructuredError) {
+	translated := make([]vision.Label, len(labels))
+	for i, label := range labels {
+		var err structured_error.StructuredError
+		_, label.Text, err = translate(ctx, state.translator, label.Text)
+		if err != nil {
+			return nil, err
+		}
+		translated[i] = label
+	}
+	return translated, nil
+}
+
+// Keeps the labels worth saying, with the most specific ones first, and drops any that name the same thing twice
+func filterLabels(labels []vision.Label) []vision.Label {
+	sorted := make([]vision.Label, len(labels))
+	copy(sorted, labels)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return labelKindOrder[sorted[i].Kind] < labelKindOrder[sorted[j].Kind]
+	})
+	filtered := make([]vision.Label, 0, maxLabels)
+	seen := map[string]bool{}
+	for _, label := range sorted {
+		key := strings.ToLower(strings.TrimSpace(label.Text))
+		if label.Confidence < lowLabelConfidenceCutoff || key == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		filtered = append(filtered, label)
+		if len(filtered) == maxLabels {
+			break
+		}
+	}
+	return filtered
+}
+
+func getLabelsResponse(ctx context.Context, index int, labels []vision.Label, err structured_error.StructuredError) mediaResponse {
+	if err == nil && len(labels) == 0 {
+		err = structured_error.Wrap(errors.New("none of the labels were high-confidence"), structured_error.LabelError)
+	}
+	if err != nil {
+		logrus.Debug(fmt.Sprintf("Error trying to get the labels: %v", err))
+		return mediaResponse{index: index, responseType: foundLabelsResponse, err: err}
+	}
+	descriptions := make([]message.Description, len(labels))
+	var confidence float32
+	for i, label := range labels {
+		descriptions[i] = message.Description{Text: label.Text, Confidence: label.Confidence}
+		if label.Confidence > confidence {
+			confidence = label.Confidence
+		}
+	}
+	return mediaResponse{index: index, responseType: foundLabelsResponse, reply: message.Labels(ctx, descriptions), confidence: confidence}
+}
@@ -0,0 +1,170 @@
+package handle_command
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
+	vision_test "github.com/AnilRedshift/captions_please_go/pkg/vision/test"
+	"github.com/fortytw2/leaktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
+)
+
+func TestWithLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		config LabelerConfig
+		hasErr bool
+	}{
+		{
+			name: "Labels with azure by default",
+		},
+		{
+			name:   "Labels with google",
+			config: LabelerConfig{Provider: "google"},
+		},
+		{
+			name:   "Rejects unknown providers",
+			config: LabelerConfig{Provider: "openai"},
+			hasErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer leaktest.Check(t)()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			secrets := &common.Secrets{GooglePrivateKeySecret: vision_test.DummyGoogleCert, AzureComputerVisionKey: "123"}
+			ctx = common.SetSecrets(ctx, secrets)
+			ctx, err := WithLabels(ctx, test.config)
+			if test.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.NotNil(t, getLabelsState(ctx).labeler)
+		})
+	}
+}
+
+func TestGetLabelsMediaResponse(t *testing.T) {
+	mixedMedia := []twitter.Media{{Type: "photo", Url: "photo.jpg"}, {Type: "video", Url: "video.mp4"}}
+	tweet := twitter.Tweet{Id: "withMixedMedia", Media: mixedMedia}
+	wrongLangErr := structured_error.Wrap(errors.New("english only"), structured_error.UnsupportedLanguage)
+	translateErr := structured_error.Wrap(errors.New("google is confused"), structured_error.TranslateError)
+
+	tests := []struct {
+		name         string
+		lang         *language.Tag
+		labels       []vision.Label
+		labelsErr    structured_error.StructuredError
+		translateErr error
+		expected     []mediaResponse
+		hasErr       bool
+		errType      structured_error.ErrorType
+	}{
+		{
+			name: "Lists the most specific labels first",
+			labels: []vision.Label{
+				{Text: "dog", Confidence: 0.9, Kind: vision.TagLabel},
+				{Text: "frisbee", Confidence: 0.8, Kind: vision.ObjectLabel},
+				{Text: "Golden Gate Bridge", Confidence: 0.7, Kind: vision.LandmarkLabel},
+			},
+			expected: []mediaResponse{
+				{index: 0, responseType: foundLabelsResponse, reply: message.Unlocalized("I see: Golden Gate Bridge, frisbee, dog"), confidence: 0.9},
+				{index: 1, responseType: doNothingResponse},
+			},
+		},
+		{
+			name: "Leaves out unsure and repeated labels",
+			labels: []vision.Label{
+				{Text: "Dog", Confidence: 0.9, Kind: vision.ObjectLabel},
+				{Text: "dog", Confidence: 0.95, Kind: vision.TagLabel},
+				{Text: "cat", Confidence: 0.2, Kind: vision.TagLabel},
+			},
+			expected: []mediaResponse{
+				{index: 0, responseType: foundLabelsResponse, reply: message.Unlocalized("I see: Dog"), confidence: 0.9},
+				{index: 1, responseType: doNothingResponse},
+			},
+		},
+		{
+			name:   "Translates the labels for other languages",
+			lang:   &language.Hindi,
+			labels: []vision.Label{{Text: "dog", Confidence: 0.9, Kind: vision.TagLabel}},
+			// The mock provider can only name things in English
+			labelsErr: wrongLangErr,
+			expected: []mediaResponse{
+				{index: 0, responseType: foundLabelsResponse, reply: message.Unlocalized("I see: <dog>"), confidence: 0.9},
+				{index: 1, responseType: doNothingResponse},
+			},
+		},
+		{
+			name:         "Fails when the labels can't be translated",
+			lang:         &language.Hindi,
+			labels:       []vision.Label{{Text: "dog", Confidence: 0.9, Kind: vision.TagLabel}},
+			labelsErr:    wrongLangErr,
+			translateErr: translateErr,
+			expected:     []mediaResponse{{index: 0, responseType: foundLabelsResponse}, {index: 1, responseType: doNothingResponse}},
+			errType:      structured_error.TranslateError,
+			hasErr:       true,
+		},
+		{
+			name:     "Fails when nothing is recognized",
+			labels:   []vision.Label{{Text: "cat", Confidence: 0.2, Kind: vision.TagLabel}},
+			expected: []mediaResponse{{index: 0, responseType: foundLabelsResponse}, {index: 1, responseType: doNothingResponse}},
+			errType:  structured_error.LabelError,
+			hasErr:   true,
+		},
+		{
+			name:      "Fails when the provider does",
+			labelsErr: structured_error.Wrap(errors.New("too blurry"), structured_error.LabelError),
+			expected:  []mediaResponse{{index: 0, responseType: foundLabelsResponse}, {index: 1, responseType: doNothingResponse}},
+			errType:   structured_error.LabelError,
+			hasErr:    true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer leaktest.Check(t)()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			origFetchMedia := fetchMedia
+			defer func() {
+				fetchMedia = origFetchMedia
+			}()
+			fetchMedia = func(ctx context.Context, url string) ([]byte, error) {
+				return []byte(url), nil
+			}
+
+			labeler := &vision_test.MockLabeler{T: t, LabelsMock: func(url string) ([]vision.Label, structured_error.StructuredError) {
+				assert.Equal(t, "photo.jpg", url)
+				return test.labels, test.labelsErr
+			}}
+			translator := &vision_test.MockGoogle{T: t, TranslateMock: func(message string) (language.Tag, string, error) {
+				return language.English, "<" + message + ">", test.translateErr
+			}}
+			ctx = setLabelsState(ctx, &labelsState{labeler: labeler, translator: translator})
+			if test.lang != nil {
+				ctx = message.WithLanguage(ctx, *test.lang)
+			}
+
+			result := getLabelsMediaResponse(ctx, &tweet)
+			require.Equal(t, len(test.expected), len(result))
+			if !test.hasErr {
+				assert.Equal(t, test.expected, result)
+				return
+			}
+			require.Error(t, result[0].err)
+			assert.Equal(t, test.errType, result[0].err.Type())
+			result[0].err = nil
+			assert.Equal(t, test.expected, result)
+		})
+	}
+}
@@ -4,11 +4,11 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"sort"
-	"sync"
+	"strings"
 
 	"github.com/AnilRedshift/captions_please_go/internal/api/common"
 	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
 	"github.com/AnilRedshift/captions_please_go/pkg/vision"
@@ -20,96 +20,182 @@ type ocrKey int
 
 const theOcrKey ocrKey = 0
 
-type ocrState struct {
-	google     vision.OCR
-	translator vision.Translator
-}
+// The text in an image doesn't depend on the requested language, so it's cached before any translation.
+// The hints do change what's read, so they're part of the kind
+const ocrCacheKind = "ocr"
 
-type ocrJobResult struct {
-	index int
-	ocr   *vision.OCRResult
-	err   structured_error.StructuredError
+type ocrState struct {
+	google       vision.OCR
+	translator   vision.Translator
+	imageOptions preprocess.Options
+	// Google reads handwriting the same as printed text, azure has an API just for it
+	handwriting             vision.OCR
+	handwritingImageOptions preprocess.Options
 }
 
-func WithOCR(ctx context.Context) (context.Context, error) {
+func WithOCR(ctx context.Context, config vision.AzureConfig) (context.Context, error) {
 	secrets := common.GetSecrets(ctx)
 	google, err := vision.NewGoogle(secrets.GooglePrivateKeyID, secrets.GooglePrivateKeySecret)
 	state := &ocrState{
-		google:     google,
-		translator: google.(vision.Translator),
+		google:                  google,
+		translator:              google.(vision.Translator),
+		imageOptions:            vision.GoogleImageOptions,
+		handwriting:             vision.NewAzureOCR(secrets.AzureComputerVisionKey, config),
+		handwritingImageOptions: vision.AzureOCRImageOptions,
+	}
+	if translator, ok := getSharedTranslator(ctx); ok {
+		state.translator = translator
 	}
 
 	go func() {
 		<-ctx.Done()
 		state.google.Close()
+		state.handwriting.Close()
 	}()
 	return setOCRState(ctx, state), err
 }
 
 func getOCRMediaResponse(ctx context.Context, command command, mediaTweet *twitter.Tweet) []mediaResponse {
 	state := getOCRState(ctx)
-	wg := sync.WaitGroup{}
-	wg.Add(len(mediaTweet.Media))
-
-	jobs := make(chan ocrJobResult, len(mediaTweet.Media))
+	hints := getOCRHints(command)
+	ctx = vision.WithOCRHints(ctx, hints)
+	jobs := make(chan mediaResponse, len(mediaTweet.Media))
 	for i, media := range mediaTweet.Media {
 		i := i
 		media := media
 		go func() {
-			var ocrResult *vision.OCRResult
+			var ocrResult, original *vision.OCRResult
+			var source language.Tag
 			var err structured_error.StructuredError = nil
 			if media.Type != "photo" {
 				err = structured_error.Wrap(errors.New("media is not a photo"), structured_error.WrongMediaType)
 			} else {
-				ocrResult, err = state.google.GetOCR(ctx, media.Url)
+				ocrResult, err = state.detectText(ctx, media, hints)
 				if err == nil && command.translate {
-					shouldTranslate := ocrResult.Language.Confidence < 0.7
-					if !shouldTranslate {
-						desiredLanguage := message.GetLanguage(ctx)
-						matcher := language.NewMatcher([]language.Tag{desiredLanguage})
-						_, _, confidence := matcher.Match(ocrResult.Language.Tag)
-						shouldTranslate = confidence < language.High
-					}
-
-					if shouldTranslate {
-						translatedTag, translatedText, translatedErr := state.translator.Translate(ctx, ocrResult.Text)
-						if translatedErr == nil {
-							ocrResult = &vision.OCRResult{Text: translatedText, Language: vision.OCRLanguage{Tag: translatedTag, Confidence: 1.0}}
-						} else {
-							logrus.Error(fmt.Sprintf("Error %v trying to translate the OCR result", translatedErr))
-						}
-					}
+					original = ocrResult
+					ocrResult, source = state.translate(ctx, ocrResult)
 				}
-
 			}
-			jobs <- ocrJobResult{index: i, ocr: ocrResult, err: err}
-			wg.Done()
+			response := getOCRResponse(i, ocrResult, err)
+			if command.bilingual && original != nil && original != ocrResult {
+				response = withOriginal(response, message.Unlocalized(original.Text), source)
+			}
+			jobs <- response
 		}()
 	}
+	return collectMediaResponses(ctx, len(mediaTweet.Media), jobs, foundOCRResponse)
+}
+
+// The language the user asked for is probably the one the text is in, unless they want it translated into that language
+func getOCRHints(command command) vision.OCRHints {
+	hints := vision.OCRHints{Handwriting: command.handwriting}
+	if command.namedTag && !command.translate {
+		hints.Languages = []language.Tag{command.tag}
+	}
+	return hints
+}
+
+// Translates each block of text which isn't already in the requested language, leaving the rest as is.
+// source is the language the translated blocks were in, or Und if there were several
+func (state *ocrState) translate(ctx context.Context, ocrResult *vision.OCRResult) (translated *vision.OCRResult, source language.Tag) {
+	blocks := ocrResult.Blocks
+	if len(blocks) == 0 {
+		blocks = []vision.OCRBlock{{Text: ocrResult.Text, Language: ocrResult.Language}}
+	}
+
+	translatedBlocks := make([]vision.OCRBlock, len(blocks))
+	texts := make([]string, len(blocks))
+	var translatedTag language.Tag
+	sources := map[language.Tag]bool{}
+	for i, block := range blocks {
+		translatedBlocks[i] = block
+		if needsTranslation(ctx, block.Language) {
+			tag, text, err := translate(ctx, state.translator, block.Text)
+			if err == nil {
+				translatedTag = tag
+				sources[block.Language.Tag] = true
+				translatedBlocks[i] = vision.OCRBlock{Text: text, Language: vision.OCRLanguage{Tag: tag, Confidence: 1.0}}
+			} else {
+				logrus.Error(fmt.Sprintf("Error %v trying to translate the OCR result", err))
+			}
+		}
+		texts[i] = translatedBlocks[i].Text
+	}
 
-	wg.Wait()
-	close(jobs)
-	jobResults := []ocrJobResult{}
-	for job := range jobs {
-		jobResults = append(jobResults, job)
-	}
-	sort.Slice(jobResults, func(i, j int) bool { return jobResults[i].index < jobResults[j].index })
-	responses := make([]mediaResponse, len(mediaTweet.Media))
-
-	for i := range mediaTweet.Media {
-		var response mediaResponse
-		jobResult := jobResults[i]
-		if jobResult.err == nil {
-			response = mediaResponse{index: i, responseType: foundOCRResponse, reply: message.Unlocalized(jobResult.ocr.Text)}
-		} else if jobResult.err.Type() == structured_error.WrongMediaType {
-			response = mediaResponse{index: i, responseType: doNothingResponse}
-		} else {
-			logrus.Debug(fmt.Sprintf("Error trying to get the ocr: %v", jobResult.err))
-			response = mediaResponse{index: i, responseType: foundOCRResponse, err: jobResult.err}
+	if len(sources) == 0 {
+		return ocrResult, language.Und
+	}
+	source = language.Und
+	if len(sources) == 1 {
+		for tag := range sources {
+			source = tag
+		}
+	}
+	translated = &vision.OCRResult{
+		Text:     strings.Join(texts, "\n\n"),
+		Language: vision.OCRLanguage{Tag: translatedTag, Confidence: 1.0},
+		Blocks:   translatedBlocks,
+	}
+	return translated, source
+}
+
+// Text the OCR wasn't sure about is translated too, since it might not be in the language the OCR guessed
+func needsTranslation(ctx context.Context, ocrLanguage vision.OCRLanguage) bool {
+	if ocrLanguage.Confidence < 0.7 {
+		return true
+	}
+	matcher := language.NewMatcher([]language.Tag{message.GetLanguage(ctx)})
+	_, _, confidence := matcher.Match(ocrLanguage.Tag)
+	return confidence < language.High
+}
+
+func getOCRResponse(index int, ocrResult *vision.OCRResult, err structured_error.StructuredError) mediaResponse {
+	if err == nil {
+		return mediaResponse{
+			index:        index,
+			responseType: foundOCRResponse,
+			reply:        message.Unlocalized(ocrResult.Text),
+			confidence:   ocrResult.Language.Confidence,
+			language:     ocrResult.Language.Tag,
 		}
-		responses[i] = response
+	} else if err.Type() == structured_error.WrongMediaType {
+		return mediaResponse{index: index, responseType: doNothingResponse}
+	}
+	logrus.Debug(fmt.Sprintf("Error trying to get the ocr: %v", err))
+	return mediaResponse{index: index, responseType: foundOCRResponse, err: err}
+}
+
+// Asks the provider for the text in the media, unless we've already seen the same image
+func (state *ocrState) detectText(ctx context.Context, media twitter.Media, hints vision.OCRHints) (*vision.OCRResult, structured_error.StructuredError) {
+	kind := ocrCacheKind
+	ocr, imageOptions, ocrProvider := state.google, state.imageOptions, googleProvider
+	if hints.Handwriting {
+		kind += "/handwriting"
+		ocr, imageOptions, ocrProvider = state.handwriting, state.handwritingImageOptions, azureProvider
+	}
+	for _, tag := range hints.Languages {
+		kind += "/" + tag.String()
+	}
+	if cached, ok := cachedMediaResult(ctx, kind, media, exactImage); ok {
+		return cached.(*vision.OCRResult), nil
+	}
+
+	var ocrResult *vision.OCRResult
+	image, downloaded := prepareMedia(ctx, media, imageOptions)
+	release, err := waitForProvider(ctx, ocrProvider)
+	if err != nil {
+		return nil, err
+	}
+	if downloaded {
+		ocrResult, err = ocr.GetOCRFromBytes(ctx, image)
+	} else {
+		ocrResult, err = ocr.GetOCR(ctx, media.Url)
+	}
+	release()
+	if err == nil {
+		cacheMediaResult(ctx, kind, media, exactImage, ocrResult)
 	}
-	return responses
+	return ocrResult, err
 }
 
 func setOCRState(ctx context.Context, state *ocrState) context.Context {
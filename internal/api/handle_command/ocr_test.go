@@ -22,7 +22,7 @@ func TestWithOCR(t *testing.T) {
 	defer cancel()
 	secrets := &common.Secrets{GooglePrivateKeySecret: vision_test.DummyGoogleCert}
 	ctx = common.SetSecrets(ctx, secrets)
-	ctx, err := WithOCR(ctx)
+	ctx, err := WithOCR(ctx, vision.AzureConfig{})
 	assert.NoError(t, err)
 	state := getOCRState(ctx)
 	assert.NotNil(t, state)
@@ -53,21 +53,53 @@ func TestHandleOCR(t *testing.T) {
 		{
 			name:     "Responds with the OCR of a single image",
 			tweet:    &tweetWithOnePhoto,
-			expected: []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "ocr response for photo.jpg"}},
+			expected: []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "ocr response for photo.jpg", confidence: 1.0, language: language.English}},
+		},
+		{
+			name:     "Reads handwriting with azure",
+			command:  command{ocr: true, handwriting: true},
+			tweet:    &tweetWithOnePhoto,
+			expected: []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "handwriting for photo.jpg", confidence: 1.0, language: language.English}},
 		},
 		{
 			name:     "Translates the response if the confidence is low",
 			command:  command{ocr: true, translate: true},
 			ocr:      &vision.OCRResult{Text: "ocr response for", Language: vision.OCRLanguage{Tag: language.English, Confidence: 0.3}},
 			tweet:    &tweetWithOnePhoto,
-			expected: []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "<translated ocr response for photo.jpg />"}},
+			expected: []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "<translated ocr response for photo.jpg />", confidence: 1.0, language: language.English}},
 		},
 		{
 			name:     "Translates tho response into the requested language",
 			command:  command{ocr: true, translate: true},
 			ocr:      &vision.OCRResult{Text: "ocr response for", Language: vision.OCRLanguage{Tag: language.Spanish, Confidence: 0.8}},
 			tweet:    &tweetWithOnePhoto,
-			expected: []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "<translated ocr response for photo.jpg />"}},
+			expected: []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "<translated ocr response for photo.jpg />", confidence: 1.0, language: language.English}},
+		},
+		{
+			name:     "Keeps the original text for bilingual replies",
+			command:  command{ocr: true, translate: true, bilingual: true},
+			ocr:      &vision.OCRResult{Text: "ocr response for", Language: vision.OCRLanguage{Tag: language.Spanish, Confidence: 0.8}},
+			tweet:    &tweetWithOnePhoto,
+			expected: []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "<translated ocr response for photo.jpg />", confidence: 1.0, language: language.English, original: "ocr response for photo.jpg", sourceLanguage: language.Spanish}},
+		},
+		{
+			name:    "Only translates the blocks which aren't in the requested language",
+			command: command{ocr: true, translate: true, bilingual: true},
+			ocr: &vision.OCRResult{Text: "hello hola", Language: vision.OCRLanguage{Tag: language.English, Confidence: 0.9}, Blocks: []vision.OCRBlock{
+				{Text: "hello", Language: vision.OCRLanguage{Tag: language.English, Confidence: 0.9}},
+				{Text: "hola", Language: vision.OCRLanguage{Tag: language.Spanish, Confidence: 0.8}},
+			}},
+			tweet:    &tweetWithOnePhoto,
+			expected: []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "hello\n\n<translated hola />", confidence: 1.0, language: language.English, original: "hello hola photo.jpg", sourceLanguage: language.Spanish}},
+		},
+		{
+			name:    "Leaves the text alone when every block is already in the requested language",
+			command: command{ocr: true, translate: true, bilingual: true},
+			ocr: &vision.OCRResult{Text: "hello", Language: vision.OCRLanguage{Tag: language.English, Confidence: 0.9}, Blocks: []vision.OCRBlock{
+				{Text: "hello", Language: vision.OCRLanguage{Tag: language.English, Confidence: 0.9}},
+			}},
+			tweet:    &tweetWithOnePhoto,
+			expected: []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "hello photo.jpg", confidence: 0.9, language: language.English}},
 		},
 		{
 			name:         "Silently eats the translation error and returns the untranslated text",
@@ -75,7 +107,7 @@ func TestHandleOCR(t *testing.T) {
 			ocr:          &vision.OCRResult{Text: "ocr response for", Language: vision.OCRLanguage{Tag: language.Spanish, Confidence: 0.8}},
 			translateErr: googleErr,
 			tweet:        &tweetWithOnePhoto,
-			expected:     []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "ocr response for photo.jpg"}},
+			expected:     []mediaResponse{{index: 0, responseType: foundOCRResponse, reply: "ocr response for photo.jpg", confidence: 0.8, language: language.Spanish}},
 		},
 		{
 			name:      "Responds with an error if OCR fails",
@@ -90,15 +122,15 @@ func TestHandleOCR(t *testing.T) {
 			name:  "Responds with the OCR of multiple images",
 			tweet: &tweetWithTwoPhotos,
 			expected: []mediaResponse{
-				{index: 0, responseType: foundOCRResponse, reply: "ocr response for photo1.jpg"},
-				{index: 1, responseType: foundOCRResponse, reply: "ocr response for photo2.jpg"},
+				{index: 0, responseType: foundOCRResponse, reply: "ocr response for photo1.jpg", confidence: 1.0, language: language.English},
+				{index: 1, responseType: foundOCRResponse, reply: "ocr response for photo2.jpg", confidence: 1.0, language: language.English},
 			},
 		},
 		{
 			name:  "Responds with the OCR for mixed media, ignoring non-photos",
 			tweet: &tweetWithMixedMedia,
 			expected: []mediaResponse{
-				{index: 0, responseType: foundOCRResponse, reply: "ocr response for photo.jpg"},
+				{index: 0, responseType: foundOCRResponse, reply: "ocr response for photo.jpg", confidence: 1.0, language: language.English},
 				{index: 1, responseType: doNothingResponse}},
 		},
 		{
@@ -113,6 +145,13 @@ func TestHandleOCR(t *testing.T) {
 			defer leaktest.Check(t)()
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
+			origFetchMedia := fetchMedia
+			defer func() {
+				fetchMedia = origFetchMedia
+			}()
+			fetchMedia = func(ctx context.Context, url string) ([]byte, error) {
+				return []byte(url), nil
+			}
 
 			getOCRMock := func(url string) (result *vision.OCRResult, err error) {
 				var ocr vision.OCRResult
@@ -130,10 +169,14 @@ func TestHandleOCR(t *testing.T) {
 			}
 
 			mockGoogle := vision_test.MockGoogle{T: t, GetOCRMock: getOCRMock, TranslateMock: transalteMock}
+			mockAzure := vision_test.MockAzure{T: t, GetOCRMock: func(url string) (*vision.OCRResult, error) {
+				return &vision.OCRResult{Text: "handwriting for " + url, Language: vision.OCRLanguage{Tag: language.English, Confidence: 1.0}}, nil
+			}}
 
 			state := ocrState{
-				google:     &mockGoogle,
-				translator: &mockGoogle,
+				google:      &mockGoogle,
+				translator:  &mockGoogle,
+				handwriting: &mockAzure,
 			}
 			ctx = setOCRState(ctx, &state)
 			result := getOCRMediaResponse(ctx, test.command, test.tweet)
@@ -152,3 +195,37 @@ func TestHandleOCR(t *testing.T) {
 		})
 	}
 }
+
+func TestGetOCRHints(t *testing.T) {
+	tests := []struct {
+		name     string
+		command  command
+		expected vision.OCRHints
+	}{
+		{
+			name:     "Doesn't hint at the default language",
+			command:  command{ocr: true, tag: language.English},
+			expected: vision.OCRHints{},
+		},
+		{
+			name:     "Hints at the language the user asked for",
+			command:  command{ocr: true, tag: language.German, namedTag: true},
+			expected: vision.OCRHints{Languages: []language.Tag{language.German}},
+		},
+		{
+			name:     "Doesn't hint at the language the text is being translated into",
+			command:  command{ocr: true, translate: true, tag: language.German, namedTag: true},
+			expected: vision.OCRHints{},
+		},
+		{
+			name:     "Reads handwriting",
+			command:  command{ocr: true, handwriting: true, tag: language.Japanese, namedTag: true},
+			expected: vision.OCRHints{Languages: []language.Tag{language.Japanese}, Handwriting: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, getOCRHints(test.command))
+		})
+	}
+}
@@ -0,0 +1,151 @@
+package handle_command
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/sirupsen/logrus"
+)
+
+// Remembers which users have asked the bot to leave their tweets alone
+type OptOutStore interface {
+	IsOptedOut(userId string) bool
+	SetOptedOut(userId string, optedOut bool) error
+}
+
+type memoryOptOutStore struct {
+	mutex    sync.Mutex
+	optedOut map[string]bool
+}
+
+// Keeps opt outs in memory, so they won't survive a restart
+func NewMemoryOptOutStore() OptOutStore {
+	return &memoryOptOutStore{optedOut: map[string]bool{}}
+}
+
+func (m *memoryOptOutStore) IsOptedOut(userId string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.optedOut[userId]
+}
+
+func (m *memoryOptOutStore) SetOptedOut(userId string, optedOut bool) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.set(userId, optedOut)
+	return nil
+}
+
+// Must be called with the mutex held
+func (m *memoryOptOutStore) set(userId string, optedOut bool) {
+	if optedOut {
+		m.optedOut[userId] = true
+	} else {
+		delete(m.optedOut, userId)
+	}
+}
+
+type fileOptOutStore struct {
+	memoryOptOutStore
+	path string
+}
+
+// Saves the opted out user ids as a json list in the file at path.
+// The list is read once and kept in memory, and the whole file is rewritten on every change
+func NewFileOptOutStore(path string) (OptOutStore, error) {
+	store := &fileOptOutStore{memoryOptOutStore: memoryOptOutStore{optedOut: map[string]bool{}}, path: path}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return store, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	userIds := []string{}
+	if err := json.Unmarshal(data, &userIds); err != nil {
+		return nil, fmt.Errorf("%s is not a valid opt out list: %v", path, err)
+	}
+	for _, userId := range userIds {
+		store.optedOut[userId] = true
+	}
+	return store, nil
+}
+
+func (f *fileOptOutStore) SetOptedOut(userId string, optedOut bool) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.optedOut[userId] == optedOut {
+		return nil
+	}
+	f.set(userId, optedOut)
+	err := f.save()
+	if err != nil {
+		// Keep memory consistent with the file
+		f.set(userId, !optedOut)
+	}
+	return err
+}
+
+// Must be called with the mutex held
+func (f *fileOptOutStore) save() error {
+	userIds := make([]string, 0, len(f.optedOut))
+	for userId := range f.optedOut {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+	data, err := json.Marshal(userIds)
+	if err != nil {
+		return err
+	}
+	return common.WriteFileAtomically(f.path, data)
+}
+
+// Replaces the in-memory opt out store set up by WithHandleCommand
+func WithOptOutStore(ctx context.Context, store OptOutStore) context.Context {
+	getHandleCommandState(ctx).optOuts = store
+	return ctx
+}
+
+func isOptedOut(ctx context.Context, tweet *twitter.Tweet) bool {
+	return getHandleCommandState(ctx).optOuts.IsOptedOut(tweet.User.Id)
+}
+
+// Handles the stop and start commands, which toggle whether the bot will process the sender's tweets
+func SetOptOut(ctx context.Context, tweet *twitter.Tweet, optedOut bool) common.ActivityResult {
+	err := getHandleCommandState(ctx).optOuts.SetOptedOut(tweet.User.Id, optedOut)
+	if err != nil {
+		logrus.Error(fmt.Sprintf("%s: Saving the opt out for %s failed with %v", tweet.Id, tweet.User.Id, err))
+		return common.ActivityResult{Tweet: tweet, Err: err}
+	}
+
+	var reply message.Localized
+	action := "opted in"
+	if optedOut {
+		reply = message.OptedOutMessage(ctx)
+		action = "opted out"
+	} else {
+		reply = message.OptedInMessage(ctx)
+	}
+	result := _reply(ctx, tweet, reply)
+	if result.Err != nil {
+		logrus.Info(fmt.Sprintf("%s: Confirming the user %s failed with %v", tweet.Id, action, result.Err))
+	}
+	return common.ActivityResult{Tweet: tweet, Action: action}
+}
+
+// Lets the requester know the author of the media doesn't want it described
+func AuthorOptedOut(ctx context.Context, tweet *twitter.Tweet) common.ActivityResult {
+	result := _reply(ctx, tweet, message.AuthorOptedOutMessage(ctx))
+	if result.Err != nil {
+		logrus.Info(fmt.Sprintf("%s: Replying with the opted out message failed with %v", tweet.Id, result.Err))
+	}
+	return common.ActivityResult{Tweet: tweet, Action: "author opted out"}
+}
@@ -0,0 +1,46 @@
+package handle_command
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileOptOutStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "opt_outs.json")
+	store, err := NewFileOptOutStore(path)
+	require.NoError(t, err)
+	assert.False(t, store.IsOptedOut("1"))
+
+	require.NoError(t, store.SetOptedOut("2", true))
+	require.NoError(t, store.SetOptedOut("1", true))
+	require.NoError(t, store.SetOptedOut("3", true))
+	require.NoError(t, store.SetOptedOut("3", false))
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, `["1","2"]`, string(data))
+
+	// A new store picks up where the old one left off, like after a restart
+	store, err = NewFileOptOutStore(path)
+	require.NoError(t, err)
+	assert.True(t, store.IsOptedOut("1"))
+	assert.True(t, store.IsOptedOut("2"))
+	assert.False(t, store.IsOptedOut("3"))
+}
+
+func TestFileOptOutStoreRejectsInvalidFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "opt_outs.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte("not json"), 0o644))
+	_, err := NewFileOptOutStore(path)
+	assert.Error(t, err)
+}
+
+func TestFileOptOutStoreKeepsMemoryInSyncOnFailure(t *testing.T) {
+	store, err := NewFileOptOutStore(filepath.Join(t.TempDir(), "missing_dir", "opt_outs.json"))
+	require.NoError(t, err)
+	assert.Error(t, store.SetOptedOut("1", true))
+	assert.False(t, store.IsOptedOut("1"))
+}
@@ -16,15 +16,28 @@ type command struct {
 	describe  bool
 	unknown   bool
 	translate bool
-	tag       language.Tag
+	// Keeps the original text alongside the translation
+	bilingual bool
+	// The text is handwritten, which needs a different OCR
+	handwriting bool
+	stop        bool
+	start       bool
+	delete      bool
+	tag         language.Tag
+	// The user asked for the language, rather than it being assumed. The text is probably in that language
+	namedTag bool
+	// What the user asked about the images, as they wrote it
+	question string
+	// Names the objects, landmarks and brands in the images
+	labels bool
 }
 
 func (c *command) isEmpty() bool {
-	return !(c.auto || c.help || c.altText || c.ocr || c.describe || c.unknown)
+	return !(c.auto || c.help || c.altText || c.ocr || c.describe || c.unknown || c.stop || c.start || c.delete || c.question != "" || c.labels)
 }
 
 func (c *command) String() string {
-	return fmt.Sprintf(`command{"auto": %v, "help": %v, "altText": %v, "ocr": %v, "describe": %v, "unknown": %v, "translate": %v, "tag": %s}`,
+	return fmt.Sprintf(`command{"auto": %v, "help": %v, "altText": %v, "ocr": %v, "describe": %v, "unknown": %v, "translate": %v, "bilingual": %v, "handwriting": %v, "stop": %v, "start": %v, "delete": %v, "tag": %s, "namedTag": %v, "question": %q, "labels": %v}`,
 		c.auto,
 		c.help,
 		c.altText,
@@ -32,10 +45,21 @@ func (c *command) String() string {
 		c.describe,
 		c.unknown,
 		c.translate,
-		c.tag.String())
+		c.bilingual,
+		c.handwriting,
+		c.stop,
+		c.start,
+		c.delete,
+		c.tag.String(),
+		c.namedTag,
+		c.question,
+		c.labels)
 }
 
-func parseCommand(message string) command {
+// Messages which only end in a question mark are questions when bareQuestions is set,
+// so they aren't mistaken for one when there's nothing to answer them
+func parseCommand(message string, bareQuestions bool) command {
+	original := strings.TrimSpace(message)
 	message = strings.TrimSpace(strings.ToLower(message))
 	message = strings.ReplaceAll(message, ",", "")
 	tokens := strings.Fields(message)
@@ -46,12 +70,51 @@ func parseCommand(message string) command {
 	}
 
 	c = parseEnglish(tokens)
+	if c == nil {
+		c = parseQuestion(original, bareQuestions)
+	}
 	if c == nil {
 		c = &command{unknown: true, tag: language.English}
 	}
 	return *c
 }
 
+// Anything which isn't a command is a question if it starts with ask, or ends with a question mark when bareQuestions is set.
+// The question keeps the user's wording, so it's split from the original message rather than the tokens
+func parseQuestion(message string, bareQuestions bool) *command {
+	c := &command{tag: language.English}
+	fields := strings.Fields(message)
+	if len(fields) > 0 {
+		switch strings.TrimRight(strings.ToLower(fields[0]), ",:") {
+		case "ask":
+			fields = fields[1:]
+		case "fragen":
+			c.tag = language.German
+			fields = fields[1:]
+		default:
+			if !bareQuestions || !strings.HasSuffix(message, "?") {
+				return nil
+			}
+		}
+	}
+	if c.tag == language.English {
+		lowered := make([]string, len(fields))
+		for i, field := range fields {
+			lowered[i] = strings.ToLower(field)
+		}
+		if tag, remainder := parseEnglishLang(lowered); tag != nil {
+			c.tag = *tag
+			c.namedTag = true
+			fields = fields[len(fields)-len(remainder):]
+		}
+	}
+	c.question = strings.Join(fields, " ")
+	if c.question == "" {
+		return nil
+	}
+	return c
+}
+
 func parseGerman(tokens []string) *command {
 	c := &command{tag: language.German}
 	tokens = parseGermanRemoveModifiers(tokens)
@@ -85,8 +148,21 @@ func parseGermanDirectives(c *command, tokens []string) (remainder []string) {
 			c.altText = true
 		case "scannen":
 			c.ocr = true
+		case "handschrift":
+			c.ocr = true
+			c.handwriting = true
 		case "beschreiben":
 			c.describe = true
+		case "schlagwörter":
+			fallthrough
+		case "objekte":
+			c.labels = true
+		case "stopp":
+			c.stop = true
+		case "starten":
+			c.start = true
+		case "löschen":
+			c.delete = true
 		case "text":
 		default:
 			foundToken = false
@@ -114,6 +190,7 @@ func parseEnglish(tokens []string) *command {
 		if tag == nil {
 			tag, remainder = parseEnglishLang(remainder)
 		}
+		c.namedTag = tag != nil
 		if tag == nil {
 			tag = &language.English
 		}
@@ -121,8 +198,8 @@ func parseEnglish(tokens []string) *command {
 
 		// Special case for English,tag but no directive = auto in that language
 		if c.isEmpty() && tag != nil && len(remainder) == 0 {
-			// Note: Make sure to propagate the translate bit, as that can be set even if empty.
-			c = &command{auto: true, tag: *tag, translate: c.translate}
+			// Note: Make sure to propagate the translate bits, as they can be set even if empty.
+			c = &command{auto: true, tag: *tag, namedTag: c.namedTag, translate: c.translate, bilingual: c.bilingual}
 		}
 	}
 
@@ -162,11 +239,24 @@ func parseEnglishDirectives(c *command, tokens []string) (remainder []string) {
 		case "ocr":
 			c.ocr = true
 			remainder = remainder[1:]
+		case "handwriting":
+			fallthrough
+		case "handwritten":
+			c.ocr = true
+			c.handwriting = true
+			remainder = remainder[1:]
 		case "describe":
 			fallthrough
 		case "caption":
 			c.describe = true
 			remainder = remainder[1:]
+		case "tags":
+			fallthrough
+		case "labels":
+			fallthrough
+		case "objects":
+			c.labels = true
+			remainder = remainder[1:]
 		case "alttext":
 			fallthrough
 		case "alt_text":
@@ -180,6 +270,19 @@ func parseEnglishDirectives(c *command, tokens []string) (remainder []string) {
 		case "translate":
 			c.translate = true
 			remainder = remainder[1:]
+		case "bilingual":
+			c.translate = true
+			c.bilingual = true
+			remainder = remainder[1:]
+		case "stop":
+			c.stop = true
+			remainder = remainder[1:]
+		case "start":
+			c.start = true
+			remainder = remainder[1:]
+		case "delete":
+			c.delete = true
+			remainder = remainder[1:]
 		case "get":
 			remainder = remainder[1:]
 		case "everything":
@@ -30,35 +30,43 @@ func TestParseCommand(t *testing.T) {
 		},
 		{
 			command:  "in english",
-			expected: command{auto: true, tag: language.English},
+			expected: command{auto: true, tag: language.English, namedTag: true},
 		},
 		{
 			command:  "into english",
-			expected: command{auto: true, tag: language.English},
+			expected: command{auto: true, tag: language.English, namedTag: true},
 		},
 		{
 			command:  "translate into english",
-			expected: command{auto: true, translate: true, tag: language.English},
+			expected: command{auto: true, translate: true, tag: language.English, namedTag: true},
 		},
 		{
 			command:  "translate into german",
-			expected: command{auto: true, translate: true, tag: language.German},
+			expected: command{auto: true, translate: true, tag: language.German, namedTag: true},
+		},
+		{
+			command:  "bilingual into ja",
+			expected: command{auto: true, translate: true, bilingual: true, tag: language.Japanese, namedTag: true},
+		},
+		{
+			command:  "ocr bilingual",
+			expected: command{ocr: true, translate: true, bilingual: true, tag: language.English},
 		},
 		{
 			command:  "in en",
-			expected: command{auto: true, tag: language.English},
+			expected: command{auto: true, tag: language.English, namedTag: true},
 		},
 		{
 			command:  "in en-US",
-			expected: command{auto: true, tag: language.AmericanEnglish},
+			expected: command{auto: true, tag: language.AmericanEnglish, namedTag: true},
 		},
 		{
 			command:  "in german",
-			expected: command{auto: true, tag: language.German},
+			expected: command{auto: true, tag: language.German, namedTag: true},
 		},
 		{
 			command:  "in de",
-			expected: command{auto: true, tag: language.German},
+			expected: command{auto: true, tag: language.German, namedTag: true},
 		},
 		{
 			command:  "Help",
@@ -88,6 +96,14 @@ func TestParseCommand(t *testing.T) {
 			command:  "describe",
 			expected: command{describe: true, tag: language.English},
 		},
+		{
+			command:  "tags",
+			expected: command{labels: true, tag: language.English},
+		},
+		{
+			command:  "describe and objects",
+			expected: command{describe: true, labels: true, tag: language.English},
+		},
 		{
 			command:  "caption",
 			expected: command{describe: true, tag: language.English},
@@ -104,9 +120,17 @@ func TestParseCommand(t *testing.T) {
 			command:  "alt text",
 			expected: command{altText: true, tag: language.English},
 		},
+		{
+			command:  "handwriting",
+			expected: command{ocr: true, handwriting: true, tag: language.English},
+		},
+		{
+			command:  "get the handwritten text in german",
+			expected: command{ocr: true, handwriting: true, tag: language.German, namedTag: true},
+		},
 		{
 			command:  "alt text in english",
-			expected: command{altText: true, tag: language.English},
+			expected: command{altText: true, tag: language.English, namedTag: true},
 		},
 		{
 			command:  "get text and describe",
@@ -118,31 +142,55 @@ func TestParseCommand(t *testing.T) {
 		},
 		{
 			command:  "get everything in german",
-			expected: command{ocr: true, describe: true, altText: true, tag: language.German},
+			expected: command{ocr: true, describe: true, altText: true, tag: language.German, namedTag: true},
 		},
 		{
 			command:  "alt text, get text, and describe in english",
-			expected: command{ocr: true, altText: true, describe: true, tag: language.English},
+			expected: command{ocr: true, altText: true, describe: true, tag: language.English, namedTag: true},
 		},
 		{
 			command:  "alt text, get text, describe, and translate into english",
-			expected: command{ocr: true, altText: true, describe: true, translate: true, tag: language.English},
+			expected: command{ocr: true, altText: true, describe: true, translate: true, tag: language.English, namedTag: true},
 		},
 		{
 			command:  "alt text in german",
-			expected: command{altText: true, tag: language.German},
+			expected: command{altText: true, tag: language.German, namedTag: true},
 		},
 		{
 			command:  "alttext in german",
-			expected: command{altText: true, tag: language.German},
+			expected: command{altText: true, tag: language.German, namedTag: true},
 		},
 		{
 			command:  "in german, alt text",
-			expected: command{altText: true, tag: language.German},
+			expected: command{altText: true, tag: language.German, namedTag: true},
 		},
 		{
 			command:  "in german, get alt text",
-			expected: command{altText: true, tag: language.German},
+			expected: command{altText: true, tag: language.German, namedTag: true},
+		},
+		{
+			command:  "stop",
+			expected: command{stop: true, tag: language.English},
+		},
+		{
+			command:  "Start",
+			expected: command{start: true, tag: language.English},
+		},
+		{
+			command:  "delete",
+			expected: command{delete: true, tag: language.English},
+		},
+		{
+			command:  "löschen",
+			expected: command{delete: true, tag: language.German},
+		},
+		{
+			command:  "stopp",
+			expected: command{stop: true, tag: language.German},
+		},
+		{
+			command:  "starten",
+			expected: command{start: true, tag: language.German},
 		},
 		{
 			command:  "hilfe",
@@ -164,19 +212,63 @@ func TestParseCommand(t *testing.T) {
 			command:  "Text scannen",
 			expected: command{ocr: true, tag: language.German},
 		},
+		{
+			command:  "Handschrift scannen",
+			expected: command{ocr: true, handwriting: true, tag: language.German},
+		},
 		{
 			command:  "beschreiben",
 			expected: command{describe: true, tag: language.German},
 		},
+		{
+			command:  "Schlagwörter",
+			expected: command{labels: true, tag: language.German},
+		},
 		{
 			command:  "Text beschreiben",
 			expected: command{describe: true, tag: language.German},
 		},
+		{
+			command:  "ask what does the sign at the bottom say",
+			expected: command{question: "what does the sign at the bottom say", tag: language.English},
+		},
+		{
+			command:  "What color is the dress?",
+			expected: command{question: "What color is the dress?", tag: language.English},
+		},
+		{
+			command:  "Ask, is it a Corgi?",
+			expected: command{question: "is it a Corgi?", tag: language.English},
+		},
+		{
+			command:  "ask in de what breed is the dog?",
+			expected: command{question: "what breed is the dog?", tag: language.German, namedTag: true},
+		},
+		{
+			command:  "fragen welche Farbe hat das Kleid?",
+			expected: command{question: "welche Farbe hat das Kleid?", tag: language.German},
+		},
+		{
+			command:  "ask",
+			expected: command{unknown: true, tag: language.English},
+		},
+		{
+			command:  "describe this?",
+			expected: command{describe: true, tag: language.English},
+		},
 	}
 
 	for _, test := range tests {
 		t.Run(test.command, func(t *testing.T) {
-			assert.Equal(t, test.expected, parseCommand(test.command))
+			assert.Equal(t, test.expected, parseCommand(test.command, true))
 		})
 	}
 }
+
+func TestParseCommandWithoutAnAnswerer(t *testing.T) {
+	assert.Equal(t, command{unknown: true, tag: language.English}, parseCommand("What color is the dress?", false))
+	assert.Equal(t, command{unknown: true, tag: language.English}, parseCommand("in de what breed is the dog?", false))
+	// Asking outright still gets a reply saying the question couldn't be answered
+	assert.Equal(t, command{question: "what color is the dress?", tag: language.English}, parseCommand("ask what color is the dress?", false))
+	assert.Equal(t, command{describe: true, tag: language.English}, parseCommand("describe this?", false))
+}
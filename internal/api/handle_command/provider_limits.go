@@ -0,0 +1,80 @@
+package handle_command
+
+import (
+	"context"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/limiter"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
+	"golang.org/x/text/language"
+)
+
+type provider string
+
+const (
+	googleProvider         provider = "google"
+	azureProvider          provider = "azure"
+	libreTranslateProvider provider = "libretranslate"
+	deepLProvider          provider = "deepl"
+	openAIProvider         provider = "openai"
+)
+
+// How many calls can be made to each provider at once, across every job. Zero uses the default
+type ProviderLimits struct {
+	Google int
+	Azure  int
+	// Used by libretranslate or deepl, when they're translating instead of google
+	Translator int
+	// Used by the openai compatible server, when it's describing images instead of azure
+	OpenAI int
+}
+
+const defaultProviderLimit = 8
+
+func newProviderLimiters(limits ProviderLimits) map[provider]*limiter.Weighted {
+	limit := func(value int) int64 {
+		if value <= 0 {
+			return defaultProviderLimit
+		}
+		return int64(value)
+	}
+	return map[provider]*limiter.Weighted{
+		googleProvider: limiter.NewWeighted(string(googleProvider), limit(limits.Google)),
+		azureProvider:  limiter.NewWeighted(string(azureProvider), limit(limits.Azure)),
+		// Only one of these is ever used, so they can share the limit
+		libreTranslateProvider: limiter.NewWeighted(string(libreTranslateProvider), limit(limits.Translator)),
+		deepLProvider:          limiter.NewWeighted(string(deepLProvider), limit(limits.Translator)),
+		openAIProvider:         limiter.NewWeighted(string(openAIProvider), limit(limits.OpenAI)),
+	}
+}
+
+// Replaces the default concurrency limits set up by WithHandleCommand
+func WithProviderLimits(ctx context.Context, limits ProviderLimits) context.Context {
+	getHandleCommandState(ctx).providers = newProviderLimiters(limits)
+	return ctx
+}
+
+// Waits for a turn to call the provider. Callers must call release once the call returns.
+// Returns a timeout error if the job runs out of time while waiting
+func waitForProvider(ctx context.Context, name provider) (release func(), err structured_error.StructuredError) {
+	state, ok := ctx.Value(theCommandCtxKey).(*commandState)
+	if !ok {
+		// Outside of a job, so there's nothing to share the provider with
+		return func() {}, nil
+	}
+	providerLimiter := state.providers[name]
+	if acquireErr := providerLimiter.Acquire(ctx, 1); acquireErr != nil {
+		return nil, structured_error.Wrap(acquireErr, structured_error.Timeout)
+	}
+	return func() { providerLimiter.Release(1) }, nil
+}
+
+// Translates text once it's the translation provider's turn
+func translate(ctx context.Context, translator vision.Translator, text string) (language.Tag, string, structured_error.StructuredError) {
+	release, err := waitForProvider(ctx, getTranslationProvider(ctx))
+	if err != nil {
+		return language.Tag{}, "", err
+	}
+	defer release()
+	return translator.Translate(ctx, text)
+}
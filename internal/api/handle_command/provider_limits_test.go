@@ -0,0 +1,55 @@
+package handle_command
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/limiter"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	twitter_test "github.com/AnilRedshift/captions_please_go/pkg/twitter/test"
+	"github.com/fortytw2/leaktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWaitForProvider(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = WithHandleCommand(ctx, &twitter_test.MockTwitter{T: t})
+	ctx = WithProviderLimits(ctx, ProviderLimits{Google: 1})
+
+	release, err := waitForProvider(ctx, googleProvider)
+	require.NoError(t, err)
+	assert.Equal(t, limiter.Stats{Capacity: 1, InUse: 1, Acquired: 1}, limiter.AllStats()["google"])
+
+	// Azure has its own limit, so it isn't held up by google
+	releaseAzure, err := waitForProvider(ctx, azureProvider)
+	require.NoError(t, err)
+	releaseAzure()
+
+	// The job runs out of time waiting for its turn
+	jobCtx, jobCancel := context.WithTimeout(ctx, time.Millisecond*10)
+	defer jobCancel()
+	_, err = waitForProvider(jobCtx, googleProvider)
+	require.Error(t, err)
+	assert.Equal(t, structured_error.Timeout, err.Type())
+
+	waited := make(chan struct{})
+	go func() {
+		release, err := waitForProvider(ctx, googleProvider)
+		assert.NoError(t, err)
+		release()
+		close(waited)
+	}()
+	release()
+	<-waited
+	assert.Equal(t, limiter.Stats{Capacity: 1, Acquired: 2, Canceled: 1}, limiter.AllStats()["google"])
+}
+
+func TestWaitForProviderOutsideOfAJob(t *testing.T) {
+	release, err := waitForProvider(context.Background(), azureProvider)
+	require.NoError(t, err)
+	release()
+}
@@ -0,0 +1,187 @@
+package handle_command
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// What each provider came back with for a single media.
+// Providers which weren't asked have a doNothingResponse
+type mediaResults struct {
+	altText     mediaResponse
+	ocr         mediaResponse
+	description mediaResponse
+	answer      mediaResponse
+	labels      mediaResponse
+}
+
+func (r mediaResults) hasAltText() bool {
+	return r.altText.err == nil && r.altText.responseType == foundAltTextResponse
+}
+
+func (r mediaResults) hasOCR() bool {
+	return r.ocr.err == nil && r.ocr.responseType == foundOCRResponse
+}
+
+// Also true when autoDescription has put the labels in its place
+func (r mediaResults) hasDescription() bool {
+	return r.description.err == nil && (r.description.responseType == foundVisionResponse || r.description.responseType == foundLabelsResponse)
+}
+
+func (r mediaResults) hasLabels() bool {
+	return r.labels.err == nil && r.labels.responseType == foundLabelsResponse
+}
+
+func (r mediaResults) isEmpty() bool {
+	return r.altText.responseType == doNothingResponse && r.ocr.responseType == doNothingResponse && r.description.responseType == doNothingResponse &&
+		r.answer.responseType == doNothingResponse && r.labels.responseType == doNothingResponse
+}
+
+// Below this, auto mode would rather list what's in the image than guess at a description
+const lowDescriptionConfidence = 0.5
+
+// Whether the description is missing, or the provider wasn't sure about it
+func needsLabels(description mediaResponse) bool {
+	results := mediaResults{description: description}
+	return !results.hasDescription() || (description.confidence > 0 && description.confidence < lowDescriptionConfidence)
+}
+
+// Auto mode says the labels instead of the description when it needs them
+func autoDescription(results mediaResults) mediaResults {
+	if results.hasLabels() && needsLabels(results.description) {
+		results.description = results.labels
+	}
+	return results
+}
+
+// Decides what to say about a single media, given everything the providers found
+type responsePolicy interface {
+	// Returns the responses to include in the reply, in the order they're said.
+	// If there are several, a missing or found alt text has to go first, and an error can only follow the alt text
+	segments(command command, results mediaResults) []mediaResponse
+}
+
+// Says the alt text when there is some in auto mode, otherwise whatever seems most useful.
+// The other modes say everything that worked, or the most relevant error if nothing did.
+// Questions are only ever answered on their own
+type defaultResponsePolicy struct{}
+
+// Like the default, but auto mode always includes any text in the image,
+// since a description or the alt text can leave it out
+type alwaysIncludeOCRResponsePolicy struct{}
+
+const defaultResponsePolicyName = "default"
+
+var responsePolicies = map[string]responsePolicy{
+	defaultResponsePolicyName: defaultResponsePolicy{},
+	"always-ocr":              alwaysIncludeOCRResponsePolicy{},
+}
+
+// Returns the names of the policies which can be passed to WithResponsePolicy
+func ResponsePolicyNames() []string {
+	names := make([]string, 0, len(responsePolicies))
+	for name := range responsePolicies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Replaces the default policy for deciding what to say about each media set up by WithHandleCommand
+func WithResponsePolicy(ctx context.Context, name string) (context.Context, error) {
+	policy, ok := responsePolicies[name]
+	if !ok {
+		return ctx, fmt.Errorf("unknown response policy %s, expected one of %v", name, ResponsePolicyNames())
+	}
+	getHandleCommandState(ctx).policy = policy
+	return ctx, nil
+}
+
+func (defaultResponsePolicy) segments(command command, results mediaResults) []mediaResponse {
+	if results.isEmpty() {
+		return doNothings(1)
+	}
+	if command.question != "" {
+		return []mediaResponse{results.answer}
+	}
+	if command.auto {
+		return defaultAutoSegments(results)
+	}
+	if results.hasAltText() || results.hasOCR() || results.hasDescription() || results.hasLabels() {
+		// At least one thing succeeded, so only add things which didn't error
+		segments := []mediaResponse{results.altText}
+		if results.hasDescription() {
+			segments = append(segments, results.description)
+		}
+		if results.hasLabels() {
+			segments = append(segments, results.labels)
+		}
+		if results.hasOCR() {
+			segments = append(segments, results.ocr)
+		}
+		return segments
+	}
+	if results.ocr.responseType != doNothingResponse {
+		// Prefer the OCR error
+		return []mediaResponse{results.altText, results.ocr}
+	}
+	if results.description.responseType != doNothingResponse {
+		// Fallback to the describe error
+		return []mediaResponse{results.altText, results.description}
+	}
+	return []mediaResponse{results.altText, results.labels}
+}
+
+func defaultAutoSegments(results mediaResults) []mediaResponse {
+	results = autoDescription(results)
+	if results.hasAltText() {
+		return []mediaResponse{results.altText}
+	} else if results.hasOCR() && results.hasDescription() && len(results.ocr.reply) < longOCRMessageThreshold {
+		return []mediaResponse{results.description, results.ocr}
+	} else if results.hasOCR() {
+		return []mediaResponse{results.ocr}
+	} else if results.hasDescription() {
+		return []mediaResponse{results.description}
+	} else if results.ocr.err != nil {
+		// If there's an error, prefer the OCR one for auto
+		return []mediaResponse{results.ocr}
+	}
+	return []mediaResponse{results.description}
+}
+
+func (alwaysIncludeOCRResponsePolicy) segments(command command, results mediaResults) []mediaResponse {
+	if !command.auto || !results.hasOCR() {
+		return defaultResponsePolicy{}.segments(command, results)
+	}
+	results = autoDescription(results)
+	if results.hasAltText() {
+		return []mediaResponse{results.altText, results.ocr}
+	} else if results.hasDescription() {
+		return []mediaResponse{results.description, results.ocr}
+	}
+	return []mediaResponse{results.ocr}
+}
+
+// Returns true if the policy would have said something which timed out, had it finished in time.
+// Otherwise the timeout doesn't matter, because the reply is the same either way
+func usesTimedOutResults(policy responsePolicy, command command, results mediaResults) bool {
+	finished := results
+	timedOut := map[mediaResponseType]bool{}
+	for _, response := range []*mediaResponse{&finished.altText, &finished.ocr, &finished.description, &finished.answer, &finished.labels} {
+		if isTimedOut(*response) {
+			timedOut[response.responseType] = true
+			// Stand in for whatever the provider would have found
+			*response = mediaResponse{index: response.index, responseType: response.responseType}
+		}
+	}
+	if len(timedOut) == 0 {
+		return false
+	}
+	for _, segment := range policy.segments(command, finished) {
+		if timedOut[segment.responseType] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,236 @@
+package handle_command
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponsePolicies(t *testing.T) {
+	ocrErr := structured_error.Wrap(errors.New("no text"), structured_error.OCRError)
+	describeErr := structured_error.Wrap(errors.New("no words"), structured_error.DescribeError)
+	altText := mediaResponse{responseType: foundAltTextResponse, reply: "alt text"}
+	missingAltText := mediaResponse{responseType: missingAltTextResponse, reply: "no alt text"}
+	ocr := mediaResponse{responseType: foundOCRResponse, reply: "short text"}
+	longOCR := mediaResponse{responseType: foundOCRResponse, reply: "a whole lot of text which goes on and on and on and on"}
+	failedOCR := mediaResponse{responseType: foundOCRResponse, err: ocrErr}
+	description := mediaResponse{responseType: foundVisionResponse, reply: "a cat"}
+	failedDescription := mediaResponse{responseType: foundVisionResponse, err: describeErr}
+	answer := mediaResponse{responseType: foundAnswerResponse, reply: "a corgi"}
+	unsureDescription := mediaResponse{responseType: foundVisionResponse, reply: "maybe a cat", confidence: 0.3}
+	labels := mediaResponse{responseType: foundLabelsResponse, reply: "I see: dog, frisbee", confidence: 0.9}
+	failedLabels := mediaResponse{responseType: foundLabelsResponse, err: structured_error.Wrap(errors.New("no labels"), structured_error.LabelError)}
+	nothing := mediaResponse{responseType: doNothingResponse}
+
+	auto := command{auto: true}
+	everything := command{altText: true, ocr: true, describe: true}
+	tests := []struct {
+		name       string
+		policy     responsePolicy
+		command    command
+		results    mediaResults
+		expected   []mediaResponse
+		incomplete bool
+	}{
+		{
+			name:     "Does nothing for media nobody looked at",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: nothing, ocr: nothing, description: nothing},
+			expected: doNothings(1),
+		},
+		{
+			name:     "Auto prefers the alt text",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: altText, ocr: ocr, description: description},
+			expected: []mediaResponse{altText},
+		},
+		{
+			name:     "Auto pairs short text with the description",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: missingAltText, ocr: ocr, description: description},
+			expected: []mediaResponse{description, ocr},
+		},
+		{
+			name:     "Auto only says long text",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: missingAltText, ocr: longOCR, description: description},
+			expected: []mediaResponse{longOCR},
+		},
+		{
+			name:     "Auto falls back to the description",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: missingAltText, ocr: failedOCR, description: description},
+			expected: []mediaResponse{description},
+		},
+		{
+			name:     "Auto prefers the OCR error",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: missingAltText, ocr: failedOCR, description: failedDescription},
+			expected: []mediaResponse{failedOCR},
+		},
+		{
+			name:     "Everything says whatever worked",
+			policy:   defaultResponsePolicy{},
+			command:  everything,
+			results:  mediaResults{altText: altText, ocr: failedOCR, description: description},
+			expected: []mediaResponse{altText, description},
+		},
+		{
+			name:     "Everything says the OCR error if nothing worked",
+			policy:   defaultResponsePolicy{},
+			command:  everything,
+			results:  mediaResults{altText: missingAltText, ocr: failedOCR, description: failedDescription},
+			expected: []mediaResponse{missingAltText, failedOCR},
+		},
+		{
+			name:     "Everything says the describe error when OCR wasn't asked for",
+			policy:   defaultResponsePolicy{},
+			command:  command{describe: true},
+			results:  mediaResults{altText: nothing, ocr: nothing, description: failedDescription},
+			expected: []mediaResponse{nothing, failedDescription},
+		},
+		{
+			name:     "Always OCR adds the text to the alt text",
+			policy:   alwaysIncludeOCRResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: altText, ocr: longOCR, description: description},
+			expected: []mediaResponse{altText, longOCR},
+		},
+		{
+			name:     "Always OCR adds long text to the description",
+			policy:   alwaysIncludeOCRResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: missingAltText, ocr: longOCR, description: description},
+			expected: []mediaResponse{description, longOCR},
+		},
+		{
+			name:     "Always OCR falls back to the default without any text",
+			policy:   alwaysIncludeOCRResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: altText, ocr: failedOCR, description: description},
+			expected: []mediaResponse{altText},
+		},
+		{
+			name:     "Only answers the question",
+			policy:   defaultResponsePolicy{},
+			command:  command{question: "what breed is it?"},
+			results:  mediaResults{altText: nothing, ocr: nothing, description: nothing, answer: answer},
+			expected: []mediaResponse{answer},
+		},
+		{
+			name:     "Always OCR only answers the question",
+			policy:   alwaysIncludeOCRResponsePolicy{},
+			command:  command{question: "what breed is it?"},
+			results:  mediaResults{altText: nothing, ocr: nothing, description: nothing, answer: answer},
+			expected: []mediaResponse{answer},
+		},
+		{
+			name:     "Auto lists the things in the image when the description is unsure",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: missingAltText, ocr: ocr, description: unsureDescription, labels: labels},
+			expected: []mediaResponse{labels, ocr},
+		},
+		{
+			name:     "Auto lists the things in the image when it can't describe it",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: missingAltText, ocr: nothing, description: failedDescription, labels: labels},
+			expected: []mediaResponse{labels},
+		},
+		{
+			name:     "Auto keeps an unsure description without any labels",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: missingAltText, ocr: nothing, description: unsureDescription, labels: failedLabels},
+			expected: []mediaResponse{unsureDescription},
+		},
+		{
+			name:     "Auto prefers a sure description to the labels",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: missingAltText, ocr: nothing, description: description, labels: labels},
+			expected: []mediaResponse{description},
+		},
+		{
+			name:     "Always OCR adds the text to the labels when the description is unsure",
+			policy:   alwaysIncludeOCRResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: missingAltText, ocr: longOCR, description: unsureDescription, labels: labels},
+			expected: []mediaResponse{labels, longOCR},
+		},
+		{
+			name:     "Tags only lists the things in the image",
+			policy:   defaultResponsePolicy{},
+			command:  command{labels: true},
+			results:  mediaResults{altText: nothing, ocr: nothing, description: nothing, labels: labels},
+			expected: []mediaResponse{nothing, labels},
+		},
+		{
+			name:     "Tags says its error if nothing worked",
+			policy:   defaultResponsePolicy{},
+			command:  command{labels: true},
+			results:  mediaResults{altText: nothing, ocr: nothing, description: nothing, labels: failedLabels},
+			expected: []mediaResponse{nothing, failedLabels},
+		},
+		{
+			name:       "Is incomplete when it would have listed labels which timed out",
+			policy:     defaultResponsePolicy{},
+			command:    auto,
+			results:    mediaResults{altText: missingAltText, ocr: nothing, description: failedDescription, labels: timedOutResponse(0, foundLabelsResponse)},
+			expected:   []mediaResponse{failedDescription},
+			incomplete: true,
+		},
+		{
+			name:       "Is incomplete when it would have said something which timed out",
+			policy:     defaultResponsePolicy{},
+			command:    everything,
+			results:    mediaResults{altText: altText, ocr: timedOutResponse(0, foundOCRResponse), description: description},
+			expected:   []mediaResponse{altText, description},
+			incomplete: true,
+		},
+		{
+			name:     "Is complete when the timeout wouldn't have been said anyway",
+			policy:   defaultResponsePolicy{},
+			command:  auto,
+			results:  mediaResults{altText: altText, ocr: timedOutResponse(0, foundOCRResponse), description: description},
+			expected: []mediaResponse{altText},
+		},
+		{
+			name:       "Always OCR is incomplete without the text",
+			policy:     alwaysIncludeOCRResponsePolicy{},
+			command:    auto,
+			results:    mediaResults{altText: altText, ocr: timedOutResponse(0, foundOCRResponse), description: description},
+			expected:   []mediaResponse{altText},
+			incomplete: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, test.policy.segments(test.command, test.results))
+			assert.Equal(t, test.incomplete, usesTimedOutResults(test.policy, test.command, test.results))
+		})
+	}
+}
+
+func TestWithResponsePolicy(t *testing.T) {
+	ctx := WithHandleCommand(context.Background(), nil)
+	assert.Equal(t, defaultResponsePolicy{}, getHandleCommandState(ctx).policy)
+
+	ctx, err := WithResponsePolicy(ctx, "always-ocr")
+	require.NoError(t, err)
+	assert.Equal(t, alwaysIncludeOCRResponsePolicy{}, getHandleCommandState(ctx).policy)
+
+	_, err = WithResponsePolicy(ctx, "whatever")
+	assert.Error(t, err)
+}
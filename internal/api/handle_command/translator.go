@@ -0,0 +1,93 @@
+package handle_command
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
+)
+
+type translatorCtxKey int
+
+const theTranslatorCtxKey translatorCtxKey = 0
+
+// Which service translates the alt text, OCR and descriptions
+type TranslatorConfig struct {
+	// google, libretranslate or deepl. Empty uses google
+	Provider string
+	// Where the LibreTranslate server is, e.g. http://localhost:5000
+	LibreTranslateURL string
+}
+
+type translatorState struct {
+	translator vision.Translator
+	provider   provider
+}
+
+// Shared translators are closed by WithTranslator, not by each of their users
+type sharedTranslator struct {
+	vision.Translator
+}
+
+func (sharedTranslator) Close() error {
+	return nil
+}
+
+// Sets up a single translator for WithOCR, WithDescribe and WithAltText to share. Call it before them
+func WithTranslator(ctx context.Context, config TranslatorConfig) (context.Context, error) {
+	secrets := common.GetSecrets(ctx)
+	state := &translatorState{provider: provider(config.Provider)}
+	var err error
+	switch state.provider {
+	case "", googleProvider:
+		state.provider = googleProvider
+		state.translator, err = vision.NewGoogle(secrets.GooglePrivateKeyID, secrets.GooglePrivateKeySecret)
+	case libreTranslateProvider:
+		if config.LibreTranslateURL == "" {
+			err = errors.New("translating with libretranslate needs its url")
+		}
+		state.translator = vision.NewLibreTranslate(config.LibreTranslateURL, secrets.LibreTranslateKey)
+	case deepLProvider:
+		if secrets.DeepLAuthKey == "" {
+			err = errors.New("translating with deepl needs the DEEPL_AUTH_KEY secret")
+		}
+		state.translator = vision.NewDeepL(secrets.DeepLAuthKey)
+	default:
+		err = fmt.Errorf("unknown translation provider %s, must be [google|libretranslate|deepl]", config.Provider)
+	}
+	if err != nil {
+		return ctx, err
+	}
+	go func() {
+		<-ctx.Done()
+		state.translator.Close()
+	}()
+	return context.WithValue(ctx, theTranslatorCtxKey, state), nil
+}
+
+// Returns the translator set up by WithTranslator, or a new google translator if there isn't one.
+// Either way the caller should close it when it's done
+func getTranslator(ctx context.Context) (vision.Translator, error) {
+	if translator, ok := getSharedTranslator(ctx); ok {
+		return translator, nil
+	}
+	secrets := common.GetSecrets(ctx)
+	return vision.NewGoogle(secrets.GooglePrivateKeyID, secrets.GooglePrivateKeySecret)
+}
+
+func getSharedTranslator(ctx context.Context) (vision.Translator, bool) {
+	if state, ok := ctx.Value(theTranslatorCtxKey).(*translatorState); ok {
+		return sharedTranslator{state.translator}, true
+	}
+	return nil, false
+}
+
+// The provider whose concurrency limit translations count against
+func getTranslationProvider(ctx context.Context) provider {
+	if state, ok := ctx.Value(theTranslatorCtxKey).(*translatorState); ok {
+		return state.provider
+	}
+	return googleProvider
+}
@@ -0,0 +1,79 @@
+package handle_command
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWithTranslator(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   TranslatorConfig
+		secrets  common.Secrets
+		provider provider
+		hasErr   bool
+	}{
+		{
+			name:     "Translates with libretranslate",
+			config:   TranslatorConfig{Provider: "libretranslate", LibreTranslateURL: "http://localhost:5000"},
+			provider: libreTranslateProvider,
+		},
+		{
+			name:   "Needs the libretranslate url",
+			config: TranslatorConfig{Provider: "libretranslate"},
+			hasErr: true,
+		},
+		{
+			name:     "Translates with deepl",
+			config:   TranslatorConfig{Provider: "deepl"},
+			secrets:  common.Secrets{DeepLAuthKey: "key:fx"},
+			provider: deepLProvider,
+		},
+		{
+			name:   "Needs the deepl key",
+			config: TranslatorConfig{Provider: "deepl"},
+			hasErr: true,
+		},
+		{
+			name:   "Rejects unknown providers",
+			config: TranslatorConfig{Provider: "babelfish"},
+			hasErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			secrets := test.secrets
+			ctx = common.SetSecrets(ctx, &secrets)
+			ctx, err := WithTranslator(ctx, test.config)
+			if test.hasErr {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.provider, getTranslationProvider(ctx))
+
+			// Everything shares the same translator, and can't close it out from under the others
+			translator, err := getTranslator(ctx)
+			require.NoError(t, err)
+			shared, ok := translator.(sharedTranslator)
+			require.True(t, ok)
+			assert.Equal(t, ctx.Value(theTranslatorCtxKey).(*translatorState).translator, shared.Translator)
+			assert.NoError(t, translator.Close())
+		})
+	}
+}
+
+func TestGetTranslatorDefaultsToGoogle(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ctx = common.SetSecrets(ctx, &common.Secrets{})
+	assert.Equal(t, googleProvider, getTranslationProvider(ctx))
+	_, ok := getSharedTranslator(ctx)
+	assert.False(t, ok)
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
 )
 
 type mediaResponseType int
@@ -20,6 +21,8 @@ const (
 	missingAltTextResponse
 	foundOCRResponse
 	foundVisionResponse
+	foundAnswerResponse
+	foundLabelsResponse
 	combinedResponse
 )
 
@@ -28,6 +31,30 @@ type mediaResponse struct {
 	responseType mediaResponseType
 	reply        message.Localized
 	err          structured_error.StructuredError
+	// How sure the provider was about the reply, for the response policy. Zero if it didn't say
+	confidence float32
+	// The language the OCR found the text in, or Und for everything else
+	language language.Tag
+	// For bilingual commands, the text before it was translated into reply, and the language it was in if known
+	original       message.Localized
+	sourceLanguage language.Tag
+}
+
+// Remembers the untranslated text, unless the translation didn't change anything
+func withOriginal(response mediaResponse, original message.Localized, source language.Tag) mediaResponse {
+	if original != response.reply {
+		response.original = original
+		response.sourceLanguage = source
+	}
+	return response
+}
+
+// The reply, followed by its translation for bilingual commands
+func bilingualReply(ctx context.Context, response mediaResponse) message.Localized {
+	if response.original.IsEmpty() {
+		return response.reply
+	}
+	return message.Bilingual(ctx, response.original, response.sourceLanguage, response.reply)
 }
 
 func combinedError(responses []mediaResponse) structured_error.StructuredError {
@@ -82,3 +109,34 @@ func removeDoNothings(responses []mediaResponse) []mediaResponse {
 	}
 	return filtered
 }
+
+// Gathers a response for each of the count media until the job runs out of time.
+// Any media which haven't finished by then get a timeout error of the given responseType
+func collectMediaResponses(ctx context.Context, count int, jobs <-chan mediaResponse, responseType mediaResponseType) []mediaResponse {
+	responses := make([]mediaResponse, count)
+	finished := make([]bool, count)
+	for remaining := count; remaining > 0; remaining-- {
+		select {
+		case response := <-jobs:
+			responses[response.index] = response
+			finished[response.index] = true
+		case <-ctx.Done():
+			for i := range responses {
+				if !finished[i] {
+					responses[i] = timedOutResponse(i, responseType)
+				}
+			}
+			return responses
+		}
+	}
+	return responses
+}
+
+func timedOutResponse(index int, responseType mediaResponseType) mediaResponse {
+	err := structured_error.Wrap(errors.New("the job ran out of time"), structured_error.Timeout)
+	return mediaResponse{index: index, responseType: responseType, err: err}
+}
+
+func isTimedOut(response mediaResponse) bool {
+	return response.err != nil && response.err.Type() == structured_error.Timeout
+}
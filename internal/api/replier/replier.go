@@ -4,47 +4,95 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/AnilRedshift/captions_please_go/pkg/message"
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
 )
 
 type ReplyResult struct {
 	ParentTweet *twitter.Tweet
 	Remaining   []string
 	Err         structured_error.StructuredError
+	// The rest of the thread will be retried in the background, so the caller shouldn't reply with Err
+	Resuming bool
+}
+
+type Config struct {
+	DryRun bool
+	Split  SplitOptions
+	// Where unfinished threads are kept so they can be resumed. Defaults to memory
+	Store ThreadStore
+	// How many times to try posting a thread before giving up. Defaults to 5
+	MaxAttempts int
+	// How long to wait before the first retry, doubling after each failure. Defaults to 30 seconds
+	RetryBackoff time.Duration
+	// Remembers which tweets were posted in reply to each source tweet, so they can be deleted. Defaults to memory
+	Index ReplyIndex
+	// How long the posted replies are remembered for. Defaults to 30 days
+	ReplyRetention time.Duration
 }
 
 type replierState struct {
 	client twitter.Twitter
-	dryRun bool
+	config Config
+	// Retries happen outside of any one job, so they use the context the replier was created with
+	ctx     context.Context
+	retries sync.WaitGroup
+	lock    sync.Mutex
+	// Source tweets with a thread which is being posted or waiting to be retried
+	active map[string]bool
+	// Active threads whose replies were deleted, so they should stop posting
+	deleted map[string]bool
+	// When the index last forgot the old replies
+	lastPrune time.Time
 }
 type replierCtxKey int
 
 const theReplierKey replierCtxKey = 0
+const defaultMaxAttempts = 5
+const defaultRetryBackoff = time.Second * 30
+const defaultReplyRetention = time.Hour * 24 * 30
+
+// Searching the whole index for old replies every time one is posted would be wasteful
+const pruneInterval = time.Hour
 
 var after func(time.Duration) <-chan time.Time = time.After
 
-func WithReplier(ctx context.Context, client twitter.Twitter, dryRun bool) (context.Context, error) {
+func WithReplier(ctx context.Context, client twitter.Twitter, config Config) (context.Context, error) {
 	err := message.LoadMessages()
 	if err == nil {
-		state := &replierState{client: client, dryRun: dryRun}
+		validateConfig(&config)
+		state := &replierState{client: client, config: config, active: map[string]bool{}, deleted: map[string]bool{}}
 		ctx = setReplierState(ctx, state)
+		state.ctx = ctx
+		state.pruneReplies()
+
+		var threads []Thread
+		threads, err = config.Store.Load()
+		for _, thread := range threads {
+			logrus.Info(fmt.Sprintf("%s: Resuming a reply thread with %d tweets remaining", thread.Id, len(thread.Remaining)))
+			state.scheduleRetry(thread)
+		}
 	}
 	return ctx, err
 }
 
-func Reply(ctx context.Context, tweet *twitter.Tweet, message message.Localized) (result ReplyResult) {
-	logrus.Debug(fmt.Sprintf("%s Reply called with %s", tweet.Id, message))
-	remaining, err := splitMessage(string(message))
+func Reply(ctx context.Context, tweet *twitter.Tweet, reply message.Localized) (result ReplyResult) {
+	logrus.Debug(fmt.Sprintf("%s Reply called with %s", tweet.Id, reply))
+	state := getReplierState(ctx)
+	options := state.config.Split
+	options.labelLength = func(line string) int { return message.ImageLabelLength(ctx, line) }
+	options.isTranslation = func(text string) bool { return message.IsTranslationNote(ctx, text) }
+	remaining, err := splitMessage(string(reply), options)
 	if err != nil {
 		return ReplyResult{Err: err, ParentTweet: tweet}
 	}
-	state := getReplierState(ctx)
-	if state.dryRun {
+	if state.config.DryRun {
 		fmt.Println("DRY RUN WOULD HAVE TWEETED THE FOLLOWING TWEETS:")
 		for _, message := range remaining {
 			fmt.Println(message)
@@ -54,62 +102,279 @@ func Reply(ctx context.Context, tweet *twitter.Tweet, message message.Localized)
 			ParentTweet: tweet,
 		}
 	} else {
-		result = replyHelper(ctx, state.client, tweet, remaining)
+		thread := Thread{
+			Id:          tweet.Id,
+			Parent:      newThreadParent(tweet),
+			Posted:      []string{},
+			Remaining:   remaining,
+			RequesterId: tweet.User.Id,
+			Language:    message.GetLanguage(ctx).String(),
+		}
+		result = state.postThread(ctx, thread, tweet)
+	}
+	return result
+}
+
+// Posts the rest of the thread. If twitter fails in a way that might work later,
+// the thread is saved and retried in the background with an increasing delay
+func (state *replierState) postThread(ctx context.Context, thread Thread, parent *twitter.Tweet) ReplyResult {
+	state.startThread(thread.Id)
+	thread.Attempts++
+	result := replyHelper(ctx, state, &thread, parent)
+	if state.isDeleted(thread.Id) {
+		logrus.Info(fmt.Sprintf("%s: Stopped replying because the replies were deleted", thread.Id))
+		state.forget(thread)
+		result = ReplyResult{ParentTweet: result.ParentTweet}
+	} else if result.Err == nil {
+		state.forget(thread)
+	} else if ctx.Err() != nil {
+		// We're shutting down, so leave the thread in the store to be resumed after a restart
+		logrus.Debug(fmt.Sprintf("%s: context closed while replying", thread.Id))
+		state.save(thread)
+	} else if isRetryable(result.Err) && thread.Attempts < state.config.MaxAttempts {
+		logrus.Info(fmt.Sprintf("%s: Retrying the reply later after error %v", thread.Id, result.Err))
+		state.save(thread)
+		state.scheduleRetry(thread)
+		result.Resuming = true
+	} else {
+		state.forget(thread)
+	}
+	if !result.Resuming {
+		state.endThread(thread.Id)
 	}
 	return result
 }
 
-func replyHelper(ctx context.Context, client twitter.Twitter, tweet *twitter.Tweet, remaining []string) ReplyResult {
-	if len(remaining) == 0 {
-		return ReplyResult{ParentTweet: tweet}
+func (state *replierState) scheduleRetry(thread Thread) {
+	state.startThread(thread.Id)
+	delay := state.config.RetryBackoff
+	for i := 1; i < thread.Attempts; i++ {
+		delay *= 2
+	}
+	state.retries.Add(1)
+	go func() {
+		defer state.retries.Done()
+		select {
+		case <-state.ctx.Done():
+			logrus.Debug(fmt.Sprintf("%s: context closed before retrying the reply", thread.Id))
+			state.endThread(thread.Id)
+		case <-after(delay):
+			state.resume(thread)
+		}
+	}()
+}
+
+func (state *replierState) resume(thread Thread) {
+	if state.isDeleted(thread.Id) {
+		logrus.Info(fmt.Sprintf("%s: Not resuming the reply because it was deleted", thread.Id))
+		state.forget(thread)
+		state.endThread(thread.Id)
+		return
+	}
+	ctx := message.WithLanguage(state.ctx, language.Make(thread.Language))
+	logrus.Debug(fmt.Sprintf("%s: retrying reply, attempt %d", thread.Id, thread.Attempts+1))
+	result := state.postThread(ctx, thread, thread.Parent.tweet())
+	if result.Err != nil && !result.Resuming && ctx.Err() == nil {
+		// Nobody is waiting on the result anymore, so let the user know we gave up
+		errorMessage := message.ErrorMessage(ctx, result.Err)
+		if _, err := state.client.TweetReply(ctx, result.ParentTweet, string(errorMessage)); err != nil {
+			logrus.Info(fmt.Sprintf("%s Tried to reply with %v but there was an error %v", thread.Id, errorMessage, err))
+		}
+	}
+}
+
+func (state *replierState) save(thread Thread) {
+	if err := state.config.Store.Save(thread); err != nil {
+		logrus.Error(fmt.Sprintf("%s: Unable to save the reply thread: %v", thread.Id, err))
+	}
+}
+
+func (state *replierState) forget(thread Thread) {
+	if err := state.config.Store.Delete(thread.Id); err != nil {
+		logrus.Error(fmt.Sprintf("%s: Unable to delete the reply thread: %v", thread.Id, err))
+	}
+}
+
+// Adds replyId to the index of tweets posted in reply to the thread's source tweet
+func (state *replierState) recordReply(thread *Thread, replyId string) {
+	replies, ok := state.config.Index.Find(thread.Id)
+	if !ok || replies.SourceId != thread.Id {
+		state.pruneReplies()
+		replies = Replies{SourceId: thread.Id, RequesterId: thread.RequesterId, PostedAt: time.Now()}
+	}
+	replies.ReplyIds = append(append([]string{}, replies.ReplyIds...), replyId)
+	if err := state.config.Index.Put(replies); err != nil {
+		logrus.Error(fmt.Sprintf("%s: Unable to record reply %s: %v", thread.Id, replyId, err))
+	}
+}
+
+func (state *replierState) startThread(sourceId string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	state.active[sourceId] = true
+}
+
+// Called once the thread has finished posting, or given up, so there's nothing left to stop
+func (state *replierState) endThread(sourceId string) {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	delete(state.active, sourceId)
+	delete(state.deleted, sourceId)
+}
+
+// Returns true if the replies to sourceId were deleted while its thread was still active
+func (state *replierState) isDeleted(sourceId string) bool {
+	state.lock.Lock()
+	defer state.lock.Unlock()
+	return state.deleted[sourceId]
+}
+
+// Forgets the replies which are older than the retention, at most once every pruneInterval
+func (state *replierState) pruneReplies() {
+	now := time.Now()
+	state.lock.Lock()
+	due := now.Sub(state.lastPrune) >= pruneInterval
+	if due {
+		state.lastPrune = now
 	}
-	nextTweet, err := client.TweetReply(ctx, tweet, remaining[0])
+	state.lock.Unlock()
+	if !due {
+		return
+	}
+	if err := state.config.Index.Prune(now.Add(-state.config.ReplyRetention)); err != nil {
+		logrus.Error(fmt.Sprintf("Unable to forget the old replies: %v", err))
+	}
+}
+
+// Returns the replies to id if it's a tweet we replied to, or the rest of the thread if id is one of our replies
+func FindReplies(ctx context.Context, id string) (Replies, bool) {
+	return getReplierState(ctx).config.Index.Find(id)
+}
+
+// Deletes the replies newest first, so the thread never has a gap in the middle.
+// Any part of the thread which hasn't been posted yet is abandoned
+func DeleteReplies(ctx context.Context, replies Replies) structured_error.StructuredError {
+	state := getReplierState(ctx)
+	state.lock.Lock()
+	// Only a thread which is still going needs to be told to stop. It clears the flag once it has
+	if state.active[replies.SourceId] {
+		state.deleted[replies.SourceId] = true
+	}
+	state.lock.Unlock()
+	state.forget(Thread{Id: replies.SourceId})
+
+	for i := len(replies.ReplyIds) - 1; i >= 0; i-- {
+		err := state.client.DeleteTweet(ctx, replies.ReplyIds[i])
+		if err != nil && err.Type() != structured_error.TweetNotFound {
+			// Keep the ones which are left, so they can be deleted later
+			replies.ReplyIds = replies.ReplyIds[:i+1]
+			if putErr := state.config.Index.Put(replies); putErr != nil {
+				logrus.Error(fmt.Sprintf("%s: Unable to record the remaining replies: %v", replies.SourceId, putErr))
+			}
+			return err
+		}
+	}
+	if err := state.config.Index.Delete(replies.SourceId); err != nil {
+		logrus.Error(fmt.Sprintf("%s: Unable to remove the deleted replies from the index: %v", replies.SourceId, err))
+	}
+	return nil
+}
+
+func isRetryable(err structured_error.StructuredError) bool {
+	switch err.Type() {
+	case structured_error.CaseOfTheMissingTweet, structured_error.RateLimited:
+		return true
+	}
+	// The twitter client has already retried these, but they might still work later
+	return structured_error.IsRetryable(err)
+}
+
+func replyHelper(ctx context.Context, state *replierState, thread *Thread, parent *twitter.Tweet) ReplyResult {
+	for len(thread.Remaining) > 0 {
+		if state.isDeleted(thread.Id) {
+			return ReplyResult{ParentTweet: parent, Remaining: thread.Remaining}
+		}
+		nextTweet, err := postNextTweet(ctx, state.client, thread, parent)
+		if err != nil {
+			return ReplyResult{Err: err, ParentTweet: parent, Remaining: thread.Remaining}
+		}
+		if state.isDeleted(thread.Id) {
+			// The replies were deleted while this one was being posted, so it may have been missed
+			if err := state.client.DeleteTweet(ctx, nextTweet.Id); err != nil && err.Type() != structured_error.TweetNotFound {
+				logrus.Error(fmt.Sprintf("%s: Unable to delete reply %s: %v", thread.Id, nextTweet.Id, err))
+			}
+			return ReplyResult{ParentTweet: parent, Remaining: thread.Remaining}
+		}
+		parent = nextTweet
+		thread.Parent = newThreadParent(nextTweet)
+		thread.Posted = append(thread.Posted, nextTweet.Id)
+		state.recordReply(thread, nextTweet.Id)
+		thread.Remaining = thread.Remaining[1:]
+		if len(thread.Remaining) > 0 {
+			state.save(*thread)
+		}
+	}
+	return ReplyResult{ParentTweet: parent}
+}
+
+func postNextTweet(ctx context.Context, client twitter.Twitter, thread *Thread, parent *twitter.Tweet) (*twitter.Tweet, structured_error.StructuredError) {
+	nextTweet, err := client.TweetReply(ctx, parent, thread.Remaining[0])
 	if err != nil && err.Type() == structured_error.TweetTooLong {
-		// The twitter-text library we use isn't fully up to date and gets in wrong sometimes
+		// Our weighted length counter can disagree with twitter on edge cases like internationalized domains
 		// As a fallback just cut the tweet in half and try to send it
-		logrus.Error(fmt.Sprintf("%s: The reply was too long: %s", tweet.Id, remaining[0]))
-		first, second := splitInTwo(remaining[0])
-		logrus.Debug(fmt.Sprintf("%s: Trying to send the smaller tweet %s", tweet.Id, first))
-		nextTweet, err = client.TweetReply(ctx, tweet, first)
+		logrus.Error(fmt.Sprintf("%s: The reply was too long: %s", parent.Id, thread.Remaining[0]))
+		first, second := splitInTwo(thread.Remaining[0])
+		logrus.Debug(fmt.Sprintf("%s: Trying to send the smaller tweet %s", parent.Id, first))
+		nextTweet, err = client.TweetReply(ctx, parent, first)
 		if err == nil {
-			logrus.Debug(fmt.Sprintf("%s: Succeeded sending the smaller tweet", tweet.Id))
+			logrus.Debug(fmt.Sprintf("%s: Succeeded sending the smaller tweet", parent.Id))
 			// We were successful, so convert remaining from [tooLong, nextTweet...]
 			// into [first, second, nextTweet, ...]
 			// so we don't lose the remainder
-			remaining = append([]string{first, second}, remaining[1:]...)
+			thread.Remaining = append([]string{first, second}, thread.Remaining[1:]...)
 		}
 	}
 
-	if err != nil && err.Type() == structured_error.CaseOfTheMissingTweet {
-		// Sometimes, inexplicably we get this error in the middle of replying with a chain of tweets
-		// Best working theory is that twitter needs some time to catch-up to the tweets being created, so
-		// we'll wait and try one more time
-		select {
-		case <-ctx.Done():
-			// do nothing if the context gets closed before we're done waiting
-			logrus.Debug(fmt.Sprintf("%s: timeout before retrying CaseOfTheMissingTweet", tweet.Id))
-		case <-after(time.Second * 30):
-			logrus.Debug(fmt.Sprintf("%s retrying reply", tweet.Id))
-			nextTweet, err = client.TweetReply(ctx, tweet, remaining[0])
-			if err != nil && err.Type() == structured_error.DuplicateTweet {
-				// Twitter is really having trouble with their API
-				// Sometimes, we get the following behavior: The first tweet returns CaseOfTheMissingTweet
-				// but... actually it suceeds. Then, after we wait 30 seconds and try again
-				// now twitter is: Actually that tweet exists. So, now we have to go find it
-				// because the first attempt returned an error, not the new tweet Id.
-				logrus.Debug(fmt.Sprintf("%s: First CaseOfTheMissingTweet, now duplicate tweet", tweet.Id))
-				nextTweet, err = findMissingReply(ctx, client, tweet.Id, remaining[0])
-				if err == nil {
-					logrus.Debug(fmt.Sprintf("%s Found the formerly missing, and now duplicate tweet %v", tweet.Id, nextTweet))
-				}
-			}
+	if err != nil && err.Type() == structured_error.DuplicateTweet && thread.MaybePosted {
+		// Twitter is really having trouble with their API
+		// Sometimes, we get the following behavior: The first tweet returns CaseOfTheMissingTweet
+		// but... actually it suceeds. Then, when we try again later
+		// now twitter is: Actually that tweet exists. So, now we have to go find it
+		// because the first attempt returned an error, not the new tweet Id.
+		logrus.Debug(fmt.Sprintf("%s: First CaseOfTheMissingTweet, now duplicate tweet", parent.Id))
+		nextTweet, err = findMissingReply(ctx, client, parent.Id, thread.Remaining[0])
+		if err == nil {
+			logrus.Debug(fmt.Sprintf("%s Found the formerly missing, and now duplicate tweet %v", parent.Id, nextTweet))
 		}
 	}
 
-	if err != nil {
-		return ReplyResult{Err: err, ParentTweet: tweet, Remaining: remaining}
+	// Sometimes, inexplicably we get CaseOfTheMissingTweet in the middle of replying with a chain of tweets
+	// Best working theory is that twitter needs some time to catch-up to the tweets being created,
+	// so it gets retried later, but it's possible the tweet was posted anyways
+	thread.MaybePosted = err != nil && err.Type() == structured_error.CaseOfTheMissingTweet
+	return nextTweet, err
+}
+
+func validateConfig(config *Config) {
+	if config.Store == nil {
+		config.Store = NewMemoryThreadStore()
+	}
+
+	if config.Index == nil {
+		config.Index = NewMemoryReplyIndex()
+	}
+
+	if config.MaxAttempts == 0 {
+		config.MaxAttempts = defaultMaxAttempts
+	}
+
+	if config.RetryBackoff == 0 {
+		config.RetryBackoff = defaultRetryBackoff
+	}
+
+	if config.ReplyRetention == 0 {
+		config.ReplyRetention = defaultReplyRetention
 	}
-	return replyHelper(ctx, client, nextTweet, remaining[1:])
 }
 
 func findMissingReply(ctx context.Context, client twitter.Twitter, parentTweetId string, text string) (*twitter.Tweet, structured_error.StructuredError) {
@@ -4,7 +4,6 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
 	"testing"
 	"time"
@@ -22,7 +21,7 @@ func TestWithReplier(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	mockTwitter := twitter_test.MockTwitter{T: t}
-	ctx, err := WithReplier(ctx, &mockTwitter, false)
+	ctx, err := WithReplier(ctx, &mockTwitter, Config{})
 	assert.NoError(t, err)
 	state := getReplierState(ctx)
 	assert.NotNil(t, state)
@@ -38,6 +37,10 @@ func TestReply(t *testing.T) {
 	missingTweetError := structured_error.Wrap(anError, structured_error.CaseOfTheMissingTweet)
 	duplicateTweetError := structured_error.Wrap(anError, structured_error.DuplicateTweet)
 	tweetNotFoundError := structured_error.Wrap(anError, structured_error.TweetNotFound)
+	rateLimitedError := structured_error.Wrap(anError, structured_error.RateLimited)
+	assert.NoError(t, message.LoadMessages())
+	missingTweetMessage := string(message.ErrorMessage(context.Background(), missingTweetError))
+	tweetNotFoundMessage := string(message.ErrorMessage(context.Background(), tweetNotFoundError))
 	invalidMessage := "\xbd\xb2\x3d\xbc\x20\xe2\x8c\x98"
 	tests := []struct {
 		name              string
@@ -48,6 +51,7 @@ func TestReply(t *testing.T) {
 		userTimelineErr   error
 		shouldCancelEarly bool
 		result            ReplyResult
+		stored            []string
 	}{
 		{
 			name:     "Replies with a message that fits in one tweet",
@@ -97,11 +101,28 @@ func TestReply(t *testing.T) {
 			result:    ReplyResult{ParentTweet: &twitter.Tweet{Id: "3"}},
 		},
 		{
-			name:      "Retries the tweet with CaseOfTheMissingTweet response",
+			name:      "Retries the tweet with CaseOfTheMissingTweet response in the background",
 			message:   "hello",
 			expected:  []string{"hello", "hello"},
 			replyErrs: []structured_error.StructuredError{missingTweetError, nil},
-			result:    ReplyResult{ParentTweet: &twitter.Tweet{Id: "2"}},
+			result: ReplyResult{
+				Err:         missingTweetError,
+				ParentTweet: &twitter.Tweet{Id: "0"},
+				Remaining:   []string{"hello"},
+				Resuming:    true,
+			},
+		},
+		{
+			name:      "Resumes from the last successful tweet",
+			message:   longMessage,
+			expected:  []string{twoHundred, oneHundred, oneHundred},
+			replyErrs: []structured_error.StructuredError{nil, rateLimitedError, nil},
+			result: ReplyResult{
+				Err:         rateLimitedError,
+				ParentTweet: &twitter.Tweet{Id: "1"},
+				Remaining:   []string{oneHundred},
+				Resuming:    true,
+			},
 		},
 		{
 			name:      "Times out trying to resend a CaseOfTheMissingTweet response",
@@ -112,8 +133,10 @@ func TestReply(t *testing.T) {
 				Err:         missingTweetError,
 				ParentTweet: &twitter.Tweet{Id: "0"},
 				Remaining:   []string{"hello"},
+				Resuming:    true,
 			},
 			shouldCancelEarly: true,
+			stored:            []string{"hello"},
 		},
 		{
 			name:         "Successfully finds the CaseOfTheMissingTweet in the user timeline",
@@ -121,12 +144,17 @@ func TestReply(t *testing.T) {
 			expected:     []string{"hello", "hello"},
 			replyErrs:    []structured_error.StructuredError{missingTweetError, duplicateTweetError},
 			userTimeline: []*twitter.Tweet{{Id: "1", ParentTweetId: "0", VisibleText: "hello"}},
-			result:       ReplyResult{ParentTweet: &twitter.Tweet{Id: "1"}},
+			result: ReplyResult{
+				Err:         missingTweetError,
+				ParentTweet: &twitter.Tweet{Id: "0"},
+				Remaining:   []string{"hello"},
+				Resuming:    true,
+			},
 		},
 		{
-			name:            "Errors when UserTimeline fails during CaseOfTheMissingTweet",
+			name:            "Replies with an error when UserTimeline fails during CaseOfTheMissingTweet",
 			message:         "hello",
-			expected:        []string{"hello", "hello"},
+			expected:        []string{"hello", "hello", missingTweetMessage},
 			replyErrs:       []structured_error.StructuredError{missingTweetError, duplicateTweetError},
 			userTimeline:    []*twitter.Tweet{{Id: "1", ParentTweetId: "0", VisibleText: "hello"}},
 			userTimelineErr: missingTweetError,
@@ -134,29 +162,32 @@ func TestReply(t *testing.T) {
 				Err:         missingTweetError,
 				ParentTweet: &twitter.Tweet{Id: "0"},
 				Remaining:   []string{"hello"},
+				Resuming:    true,
 			},
 		},
 		{
-			name:         "Errors if the tweet is not found in the timeline for CaseOfTheMissingTweet",
+			name:         "Replies with an error if the tweet is not found in the timeline for CaseOfTheMissingTweet",
 			message:      "hello",
-			expected:     []string{"hello", "hello"},
+			expected:     []string{"hello", "hello", tweetNotFoundMessage},
 			replyErrs:    []structured_error.StructuredError{missingTweetError, duplicateTweetError},
 			userTimeline: []*twitter.Tweet{{Id: "1", ParentTweetId: "0", VisibleText: "wrong text"}},
 			result: ReplyResult{
-				Err:         tweetNotFoundError,
+				Err:         missingTweetError,
 				ParentTweet: &twitter.Tweet{Id: "0"},
 				Remaining:   []string{"hello"},
+				Resuming:    true,
 			},
 		},
 		{
 			name:      "Gives up after two CaseOfTheMissingTweets",
 			message:   "hello",
-			expected:  []string{"hello", "hello"},
+			expected:  []string{"hello", "hello", missingTweetMessage},
 			replyErrs: []structured_error.StructuredError{missingTweetError, missingTweetError},
 			result: ReplyResult{
 				Err:         missingTweetError,
 				ParentTweet: &twitter.Tweet{Id: "0"},
 				Remaining:   []string{"hello"},
+				Resuming:    true,
 			},
 		},
 	}
@@ -164,29 +195,22 @@ func TestReply(t *testing.T) {
 		t.Run(test.name, func(t *testing.T) {
 
 			tweetId := 0
+			lastSuccessfulId := "0"
 			mockTwitter := &twitter_test.MockTwitter{T: t,
 				TweetReplyMock: func(parentTweet *twitter.Tweet, message string) (*twitter.Tweet, error) {
-					parentAsInt, err := strconv.Atoi(parentTweet.Id)
-					assert.NoError(t, err)
-					if test.replyErrs != nil &&
-						tweetId > 0 &&
-						test.replyErrs[tweetId-1] != nil &&
-						(test.replyErrs[tweetId-1].Type() == structured_error.TweetTooLong || test.replyErrs[tweetId-1].Type() == structured_error.CaseOfTheMissingTweet) {
-						assert.Equal(t, tweetId-1, parentAsInt)
-					} else {
-						assert.Equal(t, tweetId, parentAsInt)
-
-					}
+					assert.Equal(t, lastSuccessfulId, parentTweet.Id)
 					assert.Equal(t, test.expected[tweetId], message)
 
-					if tweetId < len(test.replyErrs) {
+					var err error
+					if tweetId < len(test.replyErrs) && test.replyErrs[tweetId] != nil {
 						err = test.replyErrs[tweetId]
-					} else {
-						err = nil
 					}
 
 					tweetId++
 					tweet := twitter.Tweet{Id: fmt.Sprintf("%d", tweetId)}
+					if err == nil {
+						lastSuccessfulId = tweet.Id
+					}
 					return &tweet, err
 				},
 				UserTimelineMock: func(screenName, tweetID string) ([]*twitter.Tweet, error) {
@@ -212,10 +236,12 @@ func TestReply(t *testing.T) {
 				earlyTimer = time.AfterFunc(time.Millisecond*50, cancel)
 			}
 
-			ctx, err := WithReplier(ctx, mockTwitter, false)
+			store := NewMemoryThreadStore()
+			ctx, err := WithReplier(ctx, mockTwitter, Config{Store: store, MaxAttempts: 2})
 			assert.NoError(t, err)
 			tweet := &twitter.Tweet{Id: "0"}
 			result := Reply(ctx, tweet, message.Unlocalized(test.message))
+			getReplierState(ctx).retries.Wait()
 
 			if earlyTimer != nil {
 				earlyTimer.Stop()
@@ -228,7 +254,210 @@ func TestReply(t *testing.T) {
 			}
 			assert.Equal(t, test.result.Remaining, result.Remaining)
 			assert.Equal(t, test.result.ParentTweet.Id, result.ParentTweet.Id)
+			assert.Equal(t, test.result.Resuming, result.Resuming)
 			assert.Equal(t, len(test.expected), tweetId)
+
+			threads, err := store.Load()
+			assert.NoError(t, err)
+			if test.stored == nil {
+				assert.Empty(t, threads)
+			} else if assert.Len(t, threads, 1) {
+				assert.Equal(t, test.stored, threads[0].Remaining)
+			}
 		})
 	}
 }
+
+func TestReplyResumesSavedThreads(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	originalAfter := after
+	defer func() {
+		after = originalAfter
+	}()
+	after = func(d time.Duration) <-chan time.Time {
+		return time.After(time.Millisecond)
+	}
+
+	store := NewMemoryThreadStore()
+	saved := Thread{
+		Id:        "0",
+		Parent:    threadParent{Id: "5", UserId: "bot"},
+		Posted:    []string{"5"},
+		Remaining: []string{"second", "third"},
+		Language:  "en",
+		Attempts:  1,
+	}
+	assert.NoError(t, store.Save(saved))
+
+	sent := []string{}
+	mockTwitter := &twitter_test.MockTwitter{T: t,
+		TweetReplyMock: func(parentTweet *twitter.Tweet, message string) (*twitter.Tweet, error) {
+			expectedParent := "5"
+			if len(sent) > 0 {
+				expectedParent = "6"
+			}
+			assert.Equal(t, expectedParent, parentTweet.Id)
+			sent = append(sent, message)
+			return &twitter.Tweet{Id: fmt.Sprintf("%d", 5+len(sent))}, nil
+		},
+	}
+
+	ctx, err := WithReplier(ctx, mockTwitter, Config{Store: store})
+	assert.NoError(t, err)
+	getReplierState(ctx).retries.Wait()
+	assert.Equal(t, []string{"second", "third"}, sent)
+
+	threads, err := store.Load()
+	assert.NoError(t, err)
+	assert.Empty(t, threads)
+}
+
+func TestReplyRecordsPostedReplies(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	posted := 0
+	mockTwitter := &twitter_test.MockTwitter{T: t,
+		TweetReplyMock: func(parentTweet *twitter.Tweet, message string) (*twitter.Tweet, error) {
+			posted++
+			return &twitter.Tweet{Id: fmt.Sprintf("reply%d", posted)}, nil
+		},
+	}
+	index := NewMemoryReplyIndex()
+	ctx, err := WithReplier(ctx, mockTwitter, Config{Index: index})
+	assert.NoError(t, err)
+
+	tweet := &twitter.Tweet{Id: "source", User: twitter.User{Id: "requester"}}
+	result := Reply(ctx, tweet, message.Unlocalized(strings.Repeat("a ", 200)))
+	assert.NoError(t, result.Err)
+	assert.Equal(t, 2, posted)
+
+	replies, ok := FindReplies(ctx, "reply2")
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Now(), replies.PostedAt, time.Minute)
+	replies.PostedAt = time.Time{}
+	assert.Equal(t, Replies{SourceId: "source", RequesterId: "requester", ReplyIds: []string{"reply1", "reply2"}}, replies)
+}
+
+func TestReplierForgetsOldReplies(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	index := NewMemoryReplyIndex()
+	assert.NoError(t, index.Put(Replies{SourceId: "old", ReplyIds: []string{"1"}, PostedAt: time.Now().Add(-time.Hour * 3)}))
+	assert.NoError(t, index.Put(Replies{SourceId: "new", ReplyIds: []string{"2"}, PostedAt: time.Now().Add(-time.Hour)}))
+	_, err := WithReplier(ctx, &twitter_test.MockTwitter{T: t}, Config{Index: index, ReplyRetention: time.Hour * 2})
+	assert.NoError(t, err)
+
+	_, ok := index.Find("1")
+	assert.False(t, ok)
+	_, ok = index.Find("2")
+	assert.True(t, ok)
+}
+
+func TestDeleteReplies(t *testing.T) {
+	tests := []struct {
+		name      string
+		errors    map[string]error
+		deleted   []string
+		remaining []string
+		hasErr    bool
+	}{
+		{
+			name:    "Deletes the replies newest first",
+			deleted: []string{"3", "2", "1"},
+		},
+		{
+			name:    "Ignores replies which were already deleted",
+			errors:  map[string]error{"2": structured_error.Wrap(errors.New("gone"), structured_error.TweetNotFound)},
+			deleted: []string{"3", "2", "1"},
+		},
+		{
+			name:      "Keeps the replies which are left after an error",
+			errors:    map[string]error{"2": errors.New("failwhale")},
+			deleted:   []string{"3", "2"},
+			remaining: []string{"1", "2"},
+			hasErr:    true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer leaktest.Check(t)()
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			deleted := []string{}
+			mockTwitter := &twitter_test.MockTwitter{T: t,
+				DeleteTweetMock: func(tweetID string) error {
+					deleted = append(deleted, tweetID)
+					return test.errors[tweetID]
+				},
+			}
+			index := NewMemoryReplyIndex()
+			replies := Replies{SourceId: "0", RequesterId: "requester", ReplyIds: []string{"1", "2", "3"}}
+			assert.NoError(t, index.Put(replies))
+			ctx, err := WithReplier(ctx, mockTwitter, Config{Index: index})
+			assert.NoError(t, err)
+
+			err = DeleteReplies(ctx, replies)
+			assert.Equal(t, test.hasErr, err != nil)
+			assert.Equal(t, test.deleted, deleted)
+
+			found, ok := index.Find("0")
+			if test.remaining == nil {
+				assert.False(t, ok)
+			} else {
+				assert.True(t, ok)
+				assert.Equal(t, test.remaining, found.ReplyIds)
+			}
+			// There wasn't a thread to stop, so nothing is left behind
+			assert.Empty(t, getReplierState(ctx).deleted)
+		})
+	}
+}
+
+func TestDeleteRepliesStopsAThreadBeingPosted(t *testing.T) {
+	defer leaktest.Check(t)()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	posted := 0
+	deleted := []string{}
+	mockTwitter := &twitter_test.MockTwitter{T: t,
+		DeleteTweetMock: func(tweetID string) error {
+			deleted = append(deleted, tweetID)
+			return nil
+		},
+	}
+	mockTwitter.TweetReplyMock = func(parentTweet *twitter.Tweet, message string) (*twitter.Tweet, error) {
+		posted++
+		if posted == 1 {
+			// The user deletes the replies while the first one is being posted, before it's in the index
+			assert.NoError(t, DeleteReplies(ctx, Replies{SourceId: "source"}))
+		}
+		return &twitter.Tweet{Id: fmt.Sprintf("reply%d", posted)}, nil
+	}
+	store := NewMemoryThreadStore()
+	ctx, err := WithReplier(ctx, mockTwitter, Config{Store: store})
+	assert.NoError(t, err)
+
+	tweet := &twitter.Tweet{Id: "source", User: twitter.User{Id: "requester"}}
+	result := Reply(ctx, tweet, message.Unlocalized(strings.Repeat("a ", 400)))
+	assert.NoError(t, result.Err)
+	assert.False(t, result.Resuming)
+	assert.Equal(t, 1, posted)
+	assert.Equal(t, []string{"reply1"}, deleted)
+
+	threads, err := store.Load()
+	assert.NoError(t, err)
+	assert.Empty(t, threads)
+	state := getReplierState(ctx)
+	assert.Empty(t, state.active)
+	assert.Empty(t, state.deleted)
+}
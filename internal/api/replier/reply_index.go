@@ -0,0 +1,159 @@
+package replier
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+)
+
+// The tweets the bot posted in reply to a source tweet, so they can be deleted later
+type Replies struct {
+	// The id of the tweet we were asked to reply to
+	SourceId    string   `json:"source_id"`
+	RequesterId string   `json:"requester_id"`
+	ReplyIds    []string `json:"reply_ids"`
+	// When the first reply was posted, so the index can forget old replies
+	PostedAt time.Time `json:"posted_at"`
+}
+
+type ReplyIndex interface {
+	Put(replies Replies) error
+	Delete(sourceId string) error
+	// Returns the replies to id if it's a source tweet, or the replies which contain id if it's one of the replies
+	Find(id string) (Replies, bool)
+	// Forgets every source tweet whose replies were posted before cutoff. Replies without a PostedAt are kept
+	Prune(cutoff time.Time) error
+}
+
+type replyIndex struct {
+	mutex   sync.Mutex
+	sources map[string]Replies
+	// Maps each reply id back to its source tweet
+	replyIds map[string]string
+	// Where each Replies is saved as a json file. Empty if it's only kept in memory
+	dir string
+}
+
+// Keeps the index in memory, so replies posted before a restart can't be deleted
+func NewMemoryReplyIndex() ReplyIndex {
+	return &replyIndex{sources: map[string]Replies{}, replyIds: map[string]string{}}
+}
+
+// Saves each source tweet's replies as a json file in dir. The whole index is also kept in memory
+func NewFileReplyIndex(dir string) (ReplyIndex, error) {
+	index := &replyIndex{sources: map[string]Replies{}, replyIds: map[string]string{}, dir: dir}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), threadFileExtension) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		replies := Replies{}
+		if err := json.Unmarshal(data, &replies); err != nil {
+			return nil, fmt.Errorf("%s is not a valid reply list: %v", entry.Name(), err)
+		}
+		if replies.PostedAt.IsZero() {
+			// Saved before the time was recorded, so the last change to the file is the best guess
+			replies.PostedAt = entry.ModTime()
+		}
+		index.add(replies)
+	}
+	return index, nil
+}
+
+func (r *replyIndex) Put(replies Replies) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.dir != "" {
+		data, err := json.Marshal(replies)
+		if err != nil {
+			return err
+		}
+		if err := common.WriteFileAtomically(r.path(replies.SourceId), data); err != nil {
+			return err
+		}
+	}
+	r.remove(replies.SourceId)
+	r.add(replies)
+	return nil
+}
+
+func (r *replyIndex) Delete(sourceId string) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.dir != "" {
+		err := os.Remove(r.path(sourceId))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	r.remove(sourceId)
+	return nil
+}
+
+func (r *replyIndex) Find(id string) (Replies, bool) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if replies, ok := r.sources[id]; ok {
+		return replies, true
+	}
+	if sourceId, ok := r.replyIds[id]; ok {
+		return r.sources[sourceId], true
+	}
+	return Replies{}, false
+}
+
+func (r *replyIndex) Prune(cutoff time.Time) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for sourceId, replies := range r.sources {
+		if replies.PostedAt.IsZero() || !replies.PostedAt.Before(cutoff) {
+			continue
+		}
+		if r.dir != "" {
+			err := os.Remove(r.path(sourceId))
+			if err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		r.remove(sourceId)
+	}
+	return nil
+}
+
+// Must be called with the mutex held
+func (r *replyIndex) add(replies Replies) {
+	r.sources[replies.SourceId] = replies
+	for _, replyId := range replies.ReplyIds {
+		r.replyIds[replyId] = replies.SourceId
+	}
+}
+
+// Must be called with the mutex held
+func (r *replyIndex) remove(sourceId string) {
+	for _, replyId := range r.sources[sourceId].ReplyIds {
+		delete(r.replyIds, replyId)
+	}
+	delete(r.sources, sourceId)
+}
+
+func (r *replyIndex) path(sourceId string) string {
+	return filepath.Join(r.dir, filepath.Base(sourceId)+threadFileExtension)
+}
@@ -0,0 +1,118 @@
+package replier
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReplyIndexes(t *testing.T) {
+	newFileIndex := func(t *testing.T) ReplyIndex {
+		index, err := NewFileReplyIndex(filepath.Join(t.TempDir(), "replies"))
+		require.NoError(t, err)
+		return index
+	}
+	indexes := map[string]func(t *testing.T) ReplyIndex{
+		"memory": func(*testing.T) ReplyIndex { return NewMemoryReplyIndex() },
+		"file":   newFileIndex,
+	}
+	for name, newIndex := range indexes {
+		t.Run(name, func(t *testing.T) {
+			index := newIndex(t)
+			_, ok := index.Find("1")
+			assert.False(t, ok)
+
+			replies := Replies{SourceId: "1", RequesterId: "2", ReplyIds: []string{"3", "4"}}
+			assert.NoError(t, index.Put(replies))
+			for _, id := range []string{"1", "3", "4"} {
+				found, ok := index.Find(id)
+				assert.True(t, ok)
+				assert.Equal(t, replies, found)
+			}
+
+			// Replacing the replies forgets the ids which aren't there anymore
+			replies.ReplyIds = []string{"3"}
+			assert.NoError(t, index.Put(replies))
+			_, ok = index.Find("4")
+			assert.False(t, ok)
+
+			assert.NoError(t, index.Delete("1"))
+			assert.NoError(t, index.Delete("does not exist"))
+			for _, id := range []string{"1", "3"} {
+				_, ok = index.Find(id)
+				assert.False(t, ok)
+			}
+
+			now := time.Now()
+			assert.NoError(t, index.Put(Replies{SourceId: "5", ReplyIds: []string{"6"}, PostedAt: now.Add(-time.Hour)}))
+			assert.NoError(t, index.Put(Replies{SourceId: "7", ReplyIds: []string{"8"}, PostedAt: now}))
+			assert.NoError(t, index.Put(Replies{SourceId: "9", ReplyIds: []string{"10"}}))
+			assert.NoError(t, index.Prune(now.Add(-time.Minute)))
+			for _, id := range []string{"5", "6"} {
+				_, ok = index.Find(id)
+				assert.False(t, ok)
+			}
+			for _, id := range []string{"7", "8", "9", "10"} {
+				_, ok = index.Find(id)
+				assert.True(t, ok)
+			}
+		})
+	}
+}
+
+func TestFileReplyIndexReloads(t *testing.T) {
+	dir := t.TempDir()
+	index, err := NewFileReplyIndex(dir)
+	require.NoError(t, err)
+	replies := Replies{SourceId: "1", RequesterId: "2", ReplyIds: []string{"3", "4"}, PostedAt: time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)}
+	require.NoError(t, index.Put(replies))
+	require.NoError(t, index.Put(Replies{SourceId: "5", ReplyIds: []string{"6"}}))
+	require.NoError(t, index.Delete("5"))
+
+	index, err = NewFileReplyIndex(dir)
+	require.NoError(t, err)
+	found, ok := index.Find("4")
+	assert.True(t, ok)
+	assert.Equal(t, replies, found)
+	_, ok = index.Find("6")
+	assert.False(t, ok)
+}
+
+func TestFileReplyIndexPrunesFiles(t *testing.T) {
+	dir := t.TempDir()
+	index, err := NewFileReplyIndex(dir)
+	require.NoError(t, err)
+	require.NoError(t, index.Put(Replies{SourceId: "1", ReplyIds: []string{"2"}, PostedAt: time.Now().Add(-time.Hour)}))
+	require.NoError(t, index.Prune(time.Now()))
+
+	index, err = NewFileReplyIndex(dir)
+	require.NoError(t, err)
+	_, ok := index.Find("2")
+	assert.False(t, ok)
+}
+
+func TestFileReplyIndexDatesOldFilesByWhenTheyChanged(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "1.json")
+	require.NoError(t, ioutil.WriteFile(path, []byte(`{"source_id":"1","reply_ids":["2"]}`), 0o644))
+	changed := time.Now().Add(-time.Hour).Truncate(time.Second)
+	require.NoError(t, os.Chtimes(path, changed, changed))
+
+	index, err := NewFileReplyIndex(dir)
+	require.NoError(t, err)
+	found, ok := index.Find("2")
+	assert.True(t, ok)
+	assert.True(t, changed.Equal(found.PostedAt))
+}
+
+func TestFileReplyIndexRejectsCorruptFiles(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1.json"), []byte("{not json"), 0o644))
+	_, err := NewFileReplyIndex(dir)
+	assert.Error(t, err)
+}
@@ -2,104 +2,208 @@ package replier
 
 import (
 	"fmt"
+	"math"
 	"strings"
 	"unicode"
 	"unicode/utf8"
 
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter_text"
 	"github.com/AnilRedshift/twitter-text-go/validate"
 	"github.com/sirupsen/logrus"
 )
 
-var parseTweet = validate.ParseTweet
-var parseTweetSecondPass = validate.ParseTweet
+const defaultMaxTweetLength = twitter_text.MaxWeightedLength
+const counterFormat = "%s (%d/%d)"
 
-func splitMessage(message string) ([]string, structured_error.StructuredError) {
+type SplitOptions struct {
+	// The maximum weighted length of each tweet. Defaults to the twitter limit of 280
+	MaxLength int
+	// Appends a (1/N) counter to every tweet when the message needs more than one
+	Numbered bool
+	// Returns the length of the "Image N:" label the line starts with, or 0. It should never be separated from its content
+	labelLength func(line string) int
+	// Returns true if text starts with the translation that follows some original text, which should stay with it
+	isTranslation func(text string) bool
+}
+
+func (o SplitOptions) maxLength() int {
+	if o.MaxLength <= 0 {
+		return defaultMaxTweetLength
+	}
+	return o.MaxLength
+}
+
+type lengthCounter interface {
+	Add(r rune)
+	WeightedLength() int
+}
+
+var newCounter = func() lengthCounter { return twitter_text.NewCounter() }
+
+func splitMessage(message string, options SplitOptions) ([]string, structured_error.StructuredError) {
 	if !utf8.ValidString(message) {
 		logrus.Debug("Not a valid utf-8 string")
 		return nil, structured_error.Wrap(validate.InvalidCharacterError{}, structured_error.CannotSplitMessage)
 	}
-	_, err := parseTweet(message)
-	if err == nil {
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return nil, structured_error.Wrap(validate.EmptyError{}, structured_error.CannotSplitMessage)
+	}
+
+	maxLength := options.maxLength()
+	if weightedLength(message) <= maxLength {
 		return []string{message}, nil
 	}
 
-	// To make sure we break the last tweet properly, add a whitespace to the end. This gets trimmed anyways
-	message = message + " "
+	if !options.Numbered {
+		return splitWithinLength(message, maxLength, options), nil
+	}
+
+	// The counter eats into the space available for each tweet, but we don't know
+	// how wide it is until we know how many tweets there are. Start by assuming
+	// a single digit, and try again with a wider counter if we guessed wrong
+	var tweets []string
+	for digits := 1; ; digits++ {
+		widest := int(math.Pow10(digits)) - 1
+		counterLength := weightedLength(fmt.Sprintf(counterFormat, "", widest, widest))
+		if counterLength >= maxLength {
+			err := fmt.Errorf("a max length of %d cannot fit the tweet counter", maxLength)
+			logrus.Debug(fmt.Sprintf("splitMessage error %v", err))
+			return nil, structured_error.Wrap(err, structured_error.CannotSplitMessage)
+		}
+		tweets = splitWithinLength(message, maxLength-counterLength, options)
+		if len(tweets) <= widest {
+			break
+		}
+	}
+	for i, tweet := range tweets {
+		tweets[i] = fmt.Sprintf(counterFormat, tweet, i+1, len(tweets))
+	}
+	return tweets, nil
+}
+
+func splitWithinLength(message string, maxLength int, options SplitOptions) []string {
 	tweets := make([]string, 0)
-	whitespaceIndex := -1
-	whitespaceLen := 0
-	start, end, runeValue := 0, 0, rune(0)
-	for end, runeValue = range message {
-	repeat:
-		if start == end {
-			// We tried to repeat, but didn't make any progress. Skip the loop to prevent
-			// a false error trying to parse an empty text
-			continue
+	remaining := message
+	for len(remaining) > 0 {
+		end := longestPrefix(remaining, maxLength)
+		if end == len(remaining) {
+			tweets = appendTweet(tweets, remaining)
+			break
+		}
+		cut := findBreak(remaining, end, options)
+		tweets = appendTweet(tweets, remaining[:cut])
+		remaining = strings.TrimLeftFunc(remaining[cut:], unicode.IsSpace)
+	}
+	return tweets
+}
+
+// Returns the largest byte index such that text[:index] fits in the tweet.
+// Always returns at least one rune so the caller is guaranteed to make progress
+func longestPrefix(text string, maxLength int) int {
+	counter := newCounter()
+	for i, r := range text {
+		counter.Add(r)
+		if i > 0 && counter.WeightedLength() > maxLength {
+			return i
+		}
+	}
+	return len(text)
+}
+
+type breakPriority int
+
+const (
+	wordBreak breakPriority = iota
+	sentenceBreak
+	paragraphBreak
+)
+
+// Picks the best place to end the tweet, somewhere within text[:end].
+// Paragraphs are preferred over sentences, which are preferred over words, as long as
+// it doesn't make the tweet too short. If there's no good place to break, cut at end
+func findBreak(text string, end int, options SplitOptions) int {
+	lastBreaks := map[breakPriority]int{}
+	latest := -1
+	lineStart := 0
+	labelEnd := labelLength(text, options)
+	var previous rune
+	for i, r := range text {
+		if i > end {
+			break
+		}
+
+		isBreak := true
+		priority := wordBreak
+		if r == '\n' {
+			priority = paragraphBreak
+		} else if unicode.IsSpace(r) && isSentenceEnd(previous) {
+			priority = sentenceBreak
+		} else if isWideSentenceEnd(previous) {
+			// Full-width punctuation doesn't need a trailing space to end a sentence
+			priority = sentenceBreak
+		} else if !unicode.IsSpace(r) {
+			isBreak = false
+		}
+
+		inLabel := i > lineStart && i <= labelEnd
+		if isBreak && i > 0 && !inLabel && !keepsTranslation(text[i:], options) {
+			lastBreaks[priority] = i
+			latest = i
+		}
+
+		if r == '\n' {
+			lineStart = i + 1
+			labelEnd = lineStart + labelLength(text[lineStart:], options)
 		}
-		// Don't need to error check RuneLen since we called utf8.ValidString above
-		runeLen := utf8.RuneLen(runeValue)
-
-		if unicode.IsSpace(runeValue) {
-			_, err = parseTweet(message[start:end])
-			if err == nil {
-				// There was a whitespace, but so far it's within the bounds of the tweet length
-				// Save the index and continue.
-				whitespaceIndex = end
-				whitespaceLen = runeLen
-			} else if _, ok := err.(validate.TooLongError); !ok {
-				// There was some kind of parsing error, give up
-				logrus.Debug(fmt.Sprintf("splitMessage errored when calling parseTweet for [%d:%d]%s", start, end, message[start:end]))
-				goto finally
-			} else if whitespaceIndex >= 0 {
-				// The current tweet is too long, but there was a previous whitespace we can
-				// break into parts
-				tweets = appendTweet(tweets, message[start:whitespaceIndex])
-				start = whitespaceIndex + whitespaceLen // Eat the whitespace character as the new tweet serves as the whitespace
-				whitespaceIndex = -1
-				whitespaceLen = 0
-				err = nil
-				// We promoted one word, but the text could still be too long.
-				// Don't advance to the next rune, but repeat the process with the new start index
-				goto repeat
-			} else {
-				// The entire tweet doesn't contain a whitespace
-				// Search from the beginning to find a valid end, then continue
-				for secondPassIndex, secondPassRune := range message[start : end+runeLen] {
-					secondPassIndex = start + secondPassIndex // secondPassIndex starts at 0 due to the slice
-					// but to make the logic simpler we want to use global indices
-					_, err = parseTweetSecondPass(message[start : secondPassIndex+utf8.RuneLen(secondPassRune)])
-					if _, ok := err.(validate.TooLongError); ok {
-						// We found the first index where the string is too long
-						// Don't include that rune, and add the string to the list
-						tweets = appendTweet(tweets, message[start:secondPassIndex])
-						start = secondPassIndex
-						whitespaceIndex = -1
-						whitespaceLen = 0
-						err = nil
-						// We promoted one word, but the text could still be too long.
-						// Don't advance to the next rune, but repeat the process with the new start index
-						goto repeat
-					} else if err != nil {
-						logrus.Debug(fmt.Sprintf("splitMessage errored when backtracking to find a cutoff point at index %d for %s", secondPassIndex, message[start:end+runeLen]))
-						// There was some kind of parsing error, give up
-						goto finally
-					}
-				}
-			}
+		previous = r
+	}
+
+	for _, priority := range []breakPriority{paragraphBreak, sentenceBreak} {
+		if index, ok := lastBreaks[priority]; ok && index >= end/2 {
+			return index
 		}
 	}
+	if latest > 0 {
+		return latest
+	}
+	return end
+}
+
+func isSentenceEnd(r rune) bool {
+	switch r {
+	case '.', '!', '?':
+		return true
+	}
+	return isWideSentenceEnd(r)
+}
 
-finally:
+func isWideSentenceEnd(r rune) bool {
+	switch r {
+	case '。', '！', '？':
+		return true
+	}
+	return false
+}
 
-	if err == nil && start < end {
-		tweets = appendTweet(tweets, message[start:])
+func labelLength(line string, options SplitOptions) int {
+	if options.labelLength == nil {
+		return 0
 	}
+	return options.labelLength(line)
+}
+
+func keepsTranslation(text string, options SplitOptions) bool {
+	return options.isTranslation != nil && options.isTranslation(text)
+}
 
-	if err != nil {
-		logrus.Debug(fmt.Sprintf("splitMessage error %v", err))
+func weightedLength(text string) int {
+	counter := newCounter()
+	for _, r := range text {
+		counter.Add(r)
 	}
-	return tweets, structured_error.Wrap(err, structured_error.CannotSplitMessage)
+	return counter.WeightedLength()
 }
 
 func appendTweet(tweets []string, tweet string) []string {
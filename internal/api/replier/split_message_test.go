@@ -1,9 +1,9 @@
 package replier
 
 import (
-	"errors"
 	"strings"
 	"testing"
+	"unicode/utf8"
 
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/AnilRedshift/twitter-text-go/validate"
@@ -11,16 +11,8 @@ import (
 )
 
 func TestSplitMessage(t *testing.T) {
-	fiveCharacterValidate := func(s string) (validate.Tweet, error) {
-		tweet := validate.Tweet{}
-		if len(s) > 5 {
-			return tweet, validate.TooLongError(len(s))
-		}
-		if len(s) == 0 {
-			return tweet, validate.EmptyError{}
-		}
-		return tweet, nil
-	}
+	byteLength := func() lengthCounter { return &byteCounter{} }
+	fiveCharacters := SplitOptions{MaxLength: 5}
 
 	tenCharacters := "0123456789"
 	longMessage := strings.Repeat(tenCharacters, 27) + "ab cde\u3000fg\u3000" + tenCharacters
@@ -28,87 +20,180 @@ func TestSplitMessage(t *testing.T) {
 	longMessageResult[0] = strings.Repeat(tenCharacters, 27) + "ab cde\u3000fg"
 	longMessageResult[1] = tenCharacters
 
-	myError := errors.New("oops I parsed it again")
 	tests := []struct {
-		name                 string
-		message              string
-		parseTweet           func(string) (validate.Tweet, error)
-		parseTweetSecondPass func(string) (validate.Tweet, error)
-		tweets               []string
-		err                  error
+		name       string
+		message    string
+		newCounter func() lengthCounter
+		options    SplitOptions
+		tweets     []string
+		err        error
+		hasErr     bool
 	}{
 		{
-			name:                 "regression test: tweet splits consecutive spaces",
-			message:              "0123   7",
-			parseTweet:           fiveCharacterValidate,
-			parseTweetSecondPass: parseTweetSecondPass,
-			tweets:               []string{"0123", "7"},
+			name:       "regression test: tweet splits consecutive spaces",
+			message:    "0123   7",
+			newCounter: byteLength,
+			options:    fiveCharacters,
+			tweets:     []string{"0123", "7"},
 		},
 		{
 			name:       "Simple case where the message is one valid tweet",
 			message:    "hey there",
-			parseTweet: func(string) (validate.Tweet, error) { return validate.Tweet{}, nil },
+			newCounter: byteLength,
 			tweets:     []string{"hey there"},
 		},
 		{
 			name:       "Message breaks into two tweets along whitespace",
 			message:    "012 456",
-			parseTweet: fiveCharacterValidate,
+			newCounter: byteLength,
+			options:    fiveCharacters,
 			tweets:     []string{"012", "456"},
 		},
 		{
 			name:       "Whitespace occurs just before the character limit",
 			message:    "0123 56",
-			parseTweet: fiveCharacterValidate,
+			newCounter: byteLength,
+			options:    fiveCharacters,
 			tweets:     []string{"0123", "56"},
 		},
 		{
-			name:                 "Whitespace occurs on the character limit",
-			message:              "01234 67",
-			parseTweet:           fiveCharacterValidate,
-			parseTweetSecondPass: fiveCharacterValidate,
-			tweets:               []string{"01234", "67"},
+			name:       "Whitespace occurs on the character limit",
+			message:    "01234 67",
+			newCounter: byteLength,
+			options:    fiveCharacters,
+			tweets:     []string{"01234", "67"},
 		},
 		{
-			name:                 "Whitespace occurs just after the character limit",
-			message:              "012345 78",
-			parseTweet:           fiveCharacterValidate,
-			parseTweetSecondPass: fiveCharacterValidate,
-			tweets:               []string{"01234", "5 78"},
+			name:       "Whitespace occurs just after the character limit",
+			message:    "012345 78",
+			newCounter: byteLength,
+			options:    fiveCharacters,
+			tweets:     []string{"01234", "5 78"},
 		},
 		{
 			name:       "Messages containing all whitespace are dropped",
 			message:    "012  5  8 ",
-			parseTweet: fiveCharacterValidate,
+			newCounter: byteLength,
+			options:    fiveCharacters,
 			tweets:     []string{"012", "5  8"},
 		},
 		{
-			name:                 "Too long message in the middle of shorter messages",
-			message:              "012 456789 123 45",
-			parseTweet:           fiveCharacterValidate,
-			parseTweetSecondPass: fiveCharacterValidate,
-			tweets:               []string{"012", "45678", "9 123", "45"},
+			name:       "Too long message in the middle of shorter messages",
+			message:    "012 456789 123 45",
+			newCounter: byteLength,
+			options:    fiveCharacters,
+			tweets:     []string{"012", "45678", "9 123", "45"},
+		},
+		{
+			name:       "Too long message needs to be broken up multiple times",
+			message:    "012345678901 34567890 1 2",
+			newCounter: byteLength,
+			options:    fiveCharacters,
+			tweets:     []string{"01234", "56789", "01", "34567", "890 1", "2"},
+		},
+		{
+			name:       "Message with multi-byte space character is split properly",
+			message:    "0123\u300078\u30002345678901\u3000\u30008\u30009\u30003",
+			newCounter: byteLength,
+			options:    fiveCharacters,
+			tweets:     []string{"0123", "78", "23456", "78901", "8\u30009", "3"},
+		},
+		{
+			name:       "Prefers to break on a paragraph",
+			message:    "The cat sat.\nOn the mat all day",
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 20},
+			tweets:     []string{"The cat sat.", "On the mat all day"},
+		},
+		{
+			name:       "Prefers to break on a sentence over a word",
+			message:    "The cat sat. On the mat all day",
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 20},
+			tweets:     []string{"The cat sat.", "On the mat all day"},
+		},
+		{
+			name:       "Breaks on a word if the sentence would make the tweet too short",
+			message:    "Hi. The cat sat on the mat",
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 20},
+			tweets:     []string{"Hi. The cat sat on", "the mat"},
+		},
+		{
+			name:       "Breaks after full width punctuation",
+			message:    "猫が座った。マットの上に",
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 24},
+			tweets:     []string{"猫が座った。", "マットの上に"},
+		},
+		{
+			name:       "Keeps the image label with its content",
+			message:    "Image 1: a cat\nImage 2: a dog on a mat",
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 22, labelLength: imageTwoLabel},
+			tweets:     []string{"Image 1: a cat", "Image 2: a dog on a", "mat"},
+		},
+		{
+			name:       "Never leaves the image label by itself",
+			message:    "Image 2: abcdefghijklmnop",
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 12, labelLength: imageTwoLabel},
+			tweets:     []string{"Image 2: abc", "defghijklmno", "p"},
+		},
+		{
+			name:       "Breaks after a word which only starts like an image label",
+			message:    "Image two: abcdefgh",
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 8, labelLength: imageTwoLabel},
+			tweets:     []string{"Image", "two:", "abcdefgh"},
 		},
 		{
-			name:                 "Too long message needs to be broken up multiple times",
-			message:              "012345678901 34567890 1 2",
-			parseTweet:           fiveCharacterValidate,
-			parseTweetSecondPass: fiveCharacterValidate,
-			tweets:               []string{"01234", "56789", "01", "34567", "890 1", "2"},
+			name:       "Keeps the original text with its translation",
+			message:    "Image 1: cat\nImage 2: hola (tr: hi)",
+			newCounter: byteLength,
+			options: SplitOptions{
+				MaxLength:     30,
+				labelLength:   imageTwoLabel,
+				isTranslation: func(text string) bool { return strings.HasPrefix(strings.TrimSpace(text), "(tr:") },
+			},
+			tweets: []string{"Image 1: cat", "Image 2: hola (tr: hi)"},
 		},
 		{
-			name:                 "Message with multi-byte space character is split properly",
-			message:              "0123\u300078\u30002345678901\u3000\u30008\u30009\u30003",
-			parseTweet:           fiveCharacterValidate,
-			parseTweetSecondPass: fiveCharacterValidate,
-			tweets:               []string{"0123", "78", "23456", "78901", "8", "9\u30003"},
+			name:       "Adds a counter to each tweet",
+			message:    "012 456 890",
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 10, Numbered: true},
+			tweets:     []string{"012 (1/3)", "456 (2/3)", "890 (3/3)"},
 		},
 		{
-			name:                 "Full example with the real API",
-			message:              longMessage,
-			parseTweet:           parseTweet,
-			parseTweetSecondPass: parseTweetSecondPass,
-			tweets:               longMessageResult,
+			name:       "Does not add a counter when the message fits",
+			message:    "0123",
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 10, Numbered: true},
+			tweets:     []string{"0123"},
+		},
+		{
+			name:       "Widens the counter when there are more than 9 tweets",
+			message:    strings.Repeat("abcd ", 10),
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 12, Numbered: true},
+			tweets: []string{
+				"abcd (1/10)", "abcd (2/10)", "abcd (3/10)", "abcd (4/10)", "abcd (5/10)",
+				"abcd (6/10)", "abcd (7/10)", "abcd (8/10)", "abcd (9/10)", "abcd (10/10)",
+			},
+		},
+		{
+			name:       "Errors if the counter cannot fit",
+			message:    "012 456",
+			newCounter: byteLength,
+			options:    SplitOptions{MaxLength: 6, Numbered: true},
+			hasErr:     true,
+		},
+		{
+			name:       "Full example with the real API",
+			message:    longMessage,
+			newCounter: newCounter,
+			tweets:     longMessageResult,
 		},
 		{
 			name:    "Message contains an invalid character",
@@ -116,41 +201,58 @@ func TestSplitMessage(t *testing.T) {
 			err:     validate.InvalidCharacterError{},
 		},
 		{
-			name:       "Propagates an error message from validateTweet",
-			message:    "hey there",
-			parseTweet: func(string) (validate.Tweet, error) { return validate.Tweet{}, myError },
-			err:        myError,
-		},
-		{
-			name:                 "Propagates an error message from validateSecondPass",
-			message:              "1234567",
-			parseTweet:           fiveCharacterValidate,
-			parseTweetSecondPass: func(string) (validate.Tweet, error) { return validate.Tweet{}, myError },
-			err:                  myError,
+			name:       "Counts CJK characters and urls the way twitter does",
+			message:    "猫が座った https://example.com/a/very/long/path/to/the/cat/picture",
+			newCounter: newCounter,
+			options:    SplitOptions{MaxLength: 30},
+			tweets:     []string{"猫が座った", "https://example.com/a/very/long/path/to/the/cat/picture"},
 		},
 		{
-			name:                 "Returns EmptyError{} if the string is empty",
-			message:              "",
-			parseTweet:           parseTweet,
-			parseTweetSecondPass: parseTweetSecondPass,
-			err:                  validate.EmptyError{},
+			name:       "Returns EmptyError{} if the string is empty",
+			message:    "",
+			newCounter: newCounter,
+			err:        validate.EmptyError{},
 		},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
-			originalParseTweet := parseTweet
-			originalSecondPass := parseTweetSecondPass
+			originalNewCounter := newCounter
 			defer func() {
-				parseTweet = originalParseTweet
-				parseTweetSecondPass = originalSecondPass
+				newCounter = originalNewCounter
 			}()
-			parseTweet = test.parseTweet
-			parseTweetSecondPass = test.parseTweetSecondPass
-			tweets, err := splitMessage(test.message)
-			assert.Equal(t, structured_error.Wrap(test.err, structured_error.CannotSplitMessage), err)
-			if test.err == nil {
+			newCounter = test.newCounter
+			tweets, err := splitMessage(test.message, test.options)
+			if test.err == nil && !test.hasErr {
+				assert.NoError(t, err)
 				assert.Equal(t, test.tweets, tweets)
+			} else {
+				assert.Error(t, err)
+				assert.Equal(t, structured_error.CannotSplitMessage, err.Type())
+				if test.err != nil {
+					assert.ErrorIs(t, err, test.err)
+				}
+				assert.Nil(t, tweets)
 			}
 		})
 	}
 }
+
+type byteCounter struct {
+	length int
+}
+
+func (c *byteCounter) Add(r rune) {
+	c.length += utf8.RuneLen(r)
+}
+
+func (c *byteCounter) WeightedLength() int {
+	return c.length
+}
+
+// Treats "Image 2:" at the start of a line as a label
+func imageTwoLabel(line string) int {
+	if strings.HasPrefix(line, "Image 2:") {
+		return len("Image 2:")
+	}
+	return 0
+}
@@ -0,0 +1,155 @@
+package replier
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/AnilRedshift/captions_please_go/internal/api/common"
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+)
+
+// A reply thread which may not have finished posting yet.
+// It's saved after every tweet so the rest can be posted later if twitter fails part way through
+type Thread struct {
+	// The id of the tweet we were asked to reply to
+	Id string `json:"id"`
+	// The tweet the next chunk should reply to
+	Parent threadParent `json:"parent"`
+	// The ids of the tweets which have been posted so far
+	Posted    []string `json:"posted"`
+	Remaining []string `json:"remaining"`
+	// The user who asked for the reply, who is allowed to delete it later
+	RequesterId string `json:"requester_id"`
+	// The language of the original reply, used if we give up and need to send an error
+	Language string `json:"language"`
+	Attempts int    `json:"attempts"`
+	// The last attempt got CaseOfTheMissingTweet, so the next tweet might have been posted anyways
+	MaybePosted bool `json:"maybe_posted"`
+}
+
+// twitter.Tweet can only be read from the twitter API format,
+// so keep the parts needed to reply to it
+type threadParent struct {
+	Id         string   `json:"id"`
+	UserId     string   `json:"user_id"`
+	MentionIds []string `json:"mention_ids"`
+}
+
+func newThreadParent(tweet *twitter.Tweet) threadParent {
+	parent := threadParent{Id: tweet.Id, UserId: tweet.User.Id, MentionIds: []string{}}
+	for _, mention := range tweet.Mentions {
+		parent.MentionIds = append(parent.MentionIds, mention.Id)
+	}
+	return parent
+}
+
+func (p threadParent) tweet() *twitter.Tweet {
+	tweet := &twitter.Tweet{Id: p.Id, User: twitter.User{Id: p.UserId}}
+	for _, id := range p.MentionIds {
+		tweet.Mentions = append(tweet.Mentions, twitter.Mention{User: twitter.User{Id: id}})
+	}
+	return tweet
+}
+
+type ThreadStore interface {
+	Save(thread Thread) error
+	Delete(id string) error
+	Load() ([]Thread, error)
+}
+
+type memoryThreadStore struct {
+	mutex   sync.Mutex
+	threads map[string]Thread
+}
+
+// Keeps threads in memory, so they can be retried but won't survive a restart
+func NewMemoryThreadStore() ThreadStore {
+	return &memoryThreadStore{threads: map[string]Thread{}}
+}
+
+func (m *memoryThreadStore) Save(thread Thread) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.threads[thread.Id] = thread
+	return nil
+}
+
+func (m *memoryThreadStore) Delete(id string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.threads, id)
+	return nil
+}
+
+func (m *memoryThreadStore) Load() ([]Thread, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	threads := make([]Thread, 0, len(m.threads))
+	for _, thread := range m.threads {
+		threads = append(threads, thread)
+	}
+	return threads, nil
+}
+
+type fileThreadStore struct {
+	dir string
+}
+
+const threadFileExtension = ".json"
+
+// Saves each thread as a json file in dir, so unfinished threads can be resumed after a restart
+func NewFileThreadStore(dir string) (ThreadStore, error) {
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	return &fileThreadStore{dir: dir}, nil
+}
+
+func (f *fileThreadStore) Save(thread Thread) error {
+	data, err := json.Marshal(thread)
+	if err != nil {
+		return err
+	}
+	return common.WriteFileAtomically(f.path(thread.Id), data)
+}
+
+func (f *fileThreadStore) Delete(id string) error {
+	err := os.Remove(f.path(id))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	return err
+}
+
+func (f *fileThreadStore) Load() ([]Thread, error) {
+	entries, err := ioutil.ReadDir(f.dir)
+	if err != nil {
+		return nil, err
+	}
+	threads := []Thread{}
+	for _, entry := range entries {
+		if entry.IsDir() || !strings.HasSuffix(entry.Name(), threadFileExtension) {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(f.dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		thread := Thread{}
+		if err := json.Unmarshal(data, &thread); err != nil {
+			return nil, fmt.Errorf("%s is not a valid thread: %v", entry.Name(), err)
+		}
+		threads = append(threads, thread)
+	}
+	return threads, nil
+}
+
+func (f *fileThreadStore) path(id string) string {
+	return filepath.Join(f.dir, filepath.Base(id)+threadFileExtension)
+}
@@ -0,0 +1,72 @@
+package replier
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/twitter"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestThreadStores(t *testing.T) {
+	newFileStore := func(t *testing.T) ThreadStore {
+		store, err := NewFileThreadStore(filepath.Join(t.TempDir(), "threads"))
+		require.NoError(t, err)
+		return store
+	}
+	stores := map[string]func(t *testing.T) ThreadStore{
+		"memory": func(*testing.T) ThreadStore { return NewMemoryThreadStore() },
+		"file":   newFileStore,
+	}
+	for name, newStore := range stores {
+		t.Run(name, func(t *testing.T) {
+			store := newStore(t)
+			threads, err := store.Load()
+			assert.NoError(t, err)
+			assert.Empty(t, threads)
+
+			first := Thread{Id: "1", Parent: threadParent{Id: "1", UserId: "2", MentionIds: []string{"3"}}, Posted: []string{}, Remaining: []string{"a", "b"}, Language: "en"}
+			second := Thread{Id: "2", Parent: threadParent{Id: "7", MentionIds: []string{}}, Posted: []string{"7"}, Remaining: []string{"c"}, Language: "de", Attempts: 2, MaybePosted: true}
+			assert.NoError(t, store.Save(first))
+			assert.NoError(t, store.Save(second))
+
+			first.Remaining = []string{"b"}
+			assert.NoError(t, store.Save(first))
+
+			threads, err = store.Load()
+			assert.NoError(t, err)
+			assert.ElementsMatch(t, []Thread{first, second}, threads)
+
+			assert.NoError(t, store.Delete("1"))
+			assert.NoError(t, store.Delete("does not exist"))
+			threads, err = store.Load()
+			assert.NoError(t, err)
+			assert.Equal(t, []Thread{second}, threads)
+		})
+	}
+}
+
+func TestFileThreadStoreRejectsCorruptThreads(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "1.json"), []byte("{not json"), 0o644))
+	store, err := NewFileThreadStore(dir)
+	require.NoError(t, err)
+	_, err = store.Load()
+	assert.Error(t, err)
+}
+
+func TestThreadParent(t *testing.T) {
+	tweet := &twitter.Tweet{
+		Id:       "1",
+		User:     twitter.User{Id: "2", Username: "someone"},
+		Mentions: []twitter.Mention{{User: twitter.User{Id: "3"}}, {User: twitter.User{Id: "4"}}},
+	}
+	parent := newThreadParent(tweet)
+	assert.Equal(t, threadParent{Id: "1", UserId: "2", MentionIds: []string{"3", "4"}}, parent)
+	restored := parent.tweet()
+	assert.Equal(t, "1", restored.Id)
+	assert.Equal(t, "2", restored.User.Id)
+	assert.Equal(t, []twitter.Mention{{User: twitter.User{Id: "3"}}, {User: twitter.User{Id: "4"}}}, restored.Mentions)
+}
@@ -0,0 +1,111 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// Allows each user Limit requests within any Window. A zero Limit means there's no quota
+type UserQuota struct {
+	Limit  int
+	Window time.Duration
+}
+
+type admission int
+
+const (
+	admitted admission = iota
+	// The user just went over their quota, so let them know to slow down
+	overQuota
+	// The user is over their quota and has already been told
+	stillOverQuota
+	blocked
+)
+
+type userLimiter struct {
+	lock    sync.Mutex
+	now     func() time.Time
+	quota   UserQuota
+	allowed map[string]bool
+	blocked map[string]bool
+	// When each user's requests within the current window were made
+	requests map[string][]time.Time
+	// When we last told each user to slow down
+	warned    map[string]time.Time
+	lastSweep time.Time
+}
+
+func newUserLimiter(quota UserQuota, allowed []string, blocked []string) *userLimiter {
+	l := &userLimiter{
+		now:      time.Now,
+		quota:    quota,
+		allowed:  map[string]bool{},
+		blocked:  map[string]bool{},
+		requests: map[string][]time.Time{},
+		warned:   map[string]time.Time{},
+	}
+	for _, id := range allowed {
+		l.allowed[id] = true
+	}
+	for _, id := range blocked {
+		l.blocked[id] = true
+	}
+	return l
+}
+
+// Records a request from userId, and decides whether it should be handled
+func (l *userLimiter) admit(userId string) admission {
+	if l.blocked[userId] {
+		return blocked
+	}
+	if l.allowed[userId] || l.quota.Limit <= 0 {
+		return admitted
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	now := l.now()
+	l.sweep(now)
+	requests := pruneRequests(l.requests[userId], now.Add(-l.quota.Window))
+	if len(requests) < l.quota.Limit {
+		l.requests[userId] = append(requests, now)
+		return admitted
+	}
+	l.requests[userId] = requests
+
+	if warnedAt, ok := l.warned[userId]; ok && now.Sub(warnedAt) < l.quota.Window {
+		return stillOverQuota
+	}
+	l.warned[userId] = now
+	return overQuota
+}
+
+// Forgets about users who haven't made a request within the window, so the maps don't grow forever.
+// Must be called with the lock held
+func (l *userLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.quota.Window {
+		return
+	}
+	l.lastSweep = now
+	since := now.Add(-l.quota.Window)
+	for userId, requests := range l.requests {
+		if requests = pruneRequests(requests, since); len(requests) == 0 {
+			delete(l.requests, userId)
+		} else {
+			l.requests[userId] = requests
+		}
+	}
+	for userId, warnedAt := range l.warned {
+		if !warnedAt.After(since) {
+			delete(l.warned, userId)
+		}
+	}
+}
+
+func pruneRequests(requests []time.Time, since time.Time) []time.Time {
+	expired := 0
+	for expired < len(requests) && !requests[expired].After(since) {
+		expired++
+	}
+	return requests[expired:]
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUserLimiter(t *testing.T) {
+	type request struct {
+		user     string
+		after    time.Duration
+		expected admission
+	}
+	tests := []struct {
+		name     string
+		quota    UserQuota
+		requests []request
+	}{
+		{
+			name:  "Admits everyone without a quota",
+			quota: UserQuota{},
+			requests: []request{
+				{user: "1", expected: admitted},
+				{user: "1", expected: admitted},
+			},
+		},
+		{
+			name:  "Tells the user to slow down once per window",
+			quota: UserQuota{Limit: 2, Window: time.Hour},
+			requests: []request{
+				{user: "1", expected: admitted},
+				{user: "1", expected: admitted},
+				{user: "1", expected: overQuota},
+				{user: "1", after: time.Minute, expected: stillOverQuota},
+				{user: "2", expected: admitted},
+			},
+		},
+		{
+			name:  "Admits the user again once the window slides past their requests",
+			quota: UserQuota{Limit: 1, Window: time.Hour},
+			requests: []request{
+				{user: "1", expected: admitted},
+				{user: "1", after: time.Minute * 30, expected: overQuota},
+				{user: "1", after: time.Minute * 30, expected: admitted},
+				{user: "1", after: time.Minute, expected: stillOverQuota},
+				{user: "1", after: time.Minute * 30, expected: overQuota},
+			},
+		},
+		{
+			name:  "Allowed users are not subject to the quota",
+			quota: UserQuota{Limit: 1, Window: time.Hour},
+			requests: []request{
+				{user: "allowed", expected: admitted},
+				{user: "allowed", expected: admitted},
+			},
+		},
+		{
+			name:  "Blocked users are always blocked",
+			quota: UserQuota{},
+			requests: []request{
+				{user: "blocked", expected: blocked},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			now := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+			limiter := newUserLimiter(test.quota, []string{"allowed"}, []string{"blocked"})
+			limiter.now = func() time.Time { return now }
+			for i, r := range test.requests {
+				now = now.Add(r.after)
+				assert.Equal(t, r.expected, limiter.admit(r.user), "request %d", i)
+			}
+		})
+	}
+}
+
+func TestUserLimiterForgetsIdleUsers(t *testing.T) {
+	now := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	limiter := newUserLimiter(UserQuota{Limit: 1, Window: time.Hour}, nil, nil)
+	limiter.now = func() time.Time { return now }
+	limiter.admit("1")
+	limiter.admit("1")
+	assert.Len(t, limiter.requests, 1)
+	assert.Len(t, limiter.warned, 1)
+
+	now = now.Add(time.Hour * 2)
+	limiter.admit("2")
+	assert.Len(t, limiter.requests, 1)
+	assert.Len(t, limiter.warned, 0)
+}
@@ -0,0 +1,158 @@
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// A weighted semaphore which hands out capacity in the order it was asked for,
+// so a large request isn't starved by a stream of small ones
+type Weighted struct {
+	name     string
+	lock     sync.Mutex
+	capacity int64
+	inUse    int64
+	// Oldest first
+	waiters []*waiter
+	// Running totals, for the metrics
+	acquired int64
+	canceled int64
+}
+
+type waiter struct {
+	weight int64
+	ready  chan struct{}
+}
+
+// A snapshot of how busy a limiter is
+type Stats struct {
+	Capacity int64 `json:"capacity"`
+	InUse    int64 `json:"in_use"`
+	Waiting  int   `json:"waiting"`
+	Acquired int64 `json:"acquired"`
+	Canceled int64 `json:"canceled"`
+}
+
+var registryLock sync.Mutex
+var registry = map[string]*Weighted{}
+
+// Creates a limiter which allows at most capacity weight to be held at once.
+// It's reported in the metrics under name, replacing any earlier limiter with the same name
+func NewWeighted(name string, capacity int64) *Weighted {
+	w := &Weighted{name: name, capacity: capacity}
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry[name] = w
+	return w
+}
+
+// Blocks until weight is available, or returns the context's error if it closes first.
+// Callers must Release the same weight once they're finished
+func (w *Weighted) Acquire(ctx context.Context, weight int64) error {
+	if weight > w.capacity {
+		return fmt.Errorf("%s can never fit a weight of %d, its capacity is %d", w.name, weight, w.capacity)
+	}
+	w.lock.Lock()
+	if len(w.waiters) == 0 && w.inUse+weight <= w.capacity {
+		w.inUse += weight
+		w.acquired++
+		w.lock.Unlock()
+		return nil
+	}
+	waiter := &waiter{weight: weight, ready: make(chan struct{})}
+	w.waiters = append(w.waiters, waiter)
+	w.lock.Unlock()
+
+	select {
+	case <-waiter.ready:
+		return nil
+	case <-ctx.Done():
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		select {
+		case <-waiter.ready:
+			// It was handed the capacity just as the context closed, so give it back
+			w.inUse -= weight
+			w.acquired--
+		default:
+			w.removeWaiter(waiter)
+		}
+		w.canceled++
+		// Whoever was queued behind might fit now
+		w.notifyWaiters()
+		return ctx.Err()
+	}
+}
+
+func (w *Weighted) Release(weight int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.inUse -= weight
+	if w.inUse < 0 {
+		panic(fmt.Sprintf("%s released more than it acquired", w.name))
+	}
+	w.notifyWaiters()
+}
+
+func (w *Weighted) Stats() Stats {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return Stats{
+		Capacity: w.capacity,
+		InUse:    w.inUse,
+		Waiting:  len(w.waiters),
+		Acquired: w.acquired,
+		Canceled: w.canceled,
+	}
+}
+
+// Returns the stats of every limiter, keyed by name
+func AllStats() map[string]Stats {
+	registryLock.Lock()
+	limiters := make([]*Weighted, 0, len(registry))
+	for _, w := range registry {
+		limiters = append(limiters, w)
+	}
+	registryLock.Unlock()
+	stats := make(map[string]Stats, len(limiters))
+	for _, w := range limiters {
+		stats[w.name] = w.Stats()
+	}
+	return stats
+}
+
+// Writes AllStats as json. It isn't registered anywhere, so it's up to the caller which server, if any, exposes it
+func StatsHandler(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(AllStats())
+}
+
+// Hands out capacity to the waiters in order, stopping at the first which doesn't fit. Must hold the lock
+func (w *Weighted) notifyWaiters() {
+	for len(w.waiters) > 0 {
+		next := w.waiters[0]
+		if w.inUse+next.weight > w.capacity {
+			return
+		}
+		w.inUse += next.weight
+		w.acquired++
+		w.waiters = w.waiters[1:]
+		close(next.ready)
+	}
+}
+
+func (w *Weighted) removeWaiter(waiter *waiter) {
+	for i, other := range w.waiters {
+		if other == waiter {
+			w.waiters = append(w.waiters[:i], w.waiters[i+1:]...)
+			return
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package limiter
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/fortytw2/leaktest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAcquireWithinCapacity(t *testing.T) {
+	w := NewWeighted("TestAcquireWithinCapacity", 3)
+	require.NoError(t, w.Acquire(context.Background(), 1))
+	require.NoError(t, w.Acquire(context.Background(), 2))
+	assert.Equal(t, Stats{Capacity: 3, InUse: 3, Acquired: 2}, w.Stats())
+	w.Release(3)
+	assert.Equal(t, Stats{Capacity: 3, Acquired: 2}, w.Stats())
+}
+
+func TestAcquireRejectsWeightsOverCapacity(t *testing.T) {
+	w := NewWeighted("TestAcquireRejectsWeightsOverCapacity", 1)
+	assert.Error(t, w.Acquire(context.Background(), 2))
+}
+
+func TestAcquireWaitsInOrder(t *testing.T) {
+	defer leaktest.Check(t)()
+	w := NewWeighted("TestAcquireWaitsInOrder", 2)
+	require.NoError(t, w.Acquire(context.Background(), 2))
+
+	order := make(chan int64, 2)
+	waitFor := func(weight int64) {
+		go func() {
+			assert.NoError(t, w.Acquire(context.Background(), weight))
+			order <- weight
+		}()
+		// Make sure they queue up in a known order
+		for w.Stats().Waiting == 0 || (weight == 1 && w.Stats().Waiting != 2) {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	waitFor(2)
+	waitFor(1)
+
+	// The small request fits, but has to wait its turn behind the large one
+	w.Release(1)
+	select {
+	case weight := <-order:
+		t.Fatalf("acquired %d out of order", weight)
+	case <-time.After(time.Millisecond * 20):
+	}
+	w.Release(1)
+	assert.Equal(t, int64(2), <-order)
+	w.Release(2)
+	assert.Equal(t, int64(1), <-order)
+	w.Release(1)
+	assert.Equal(t, Stats{Capacity: 2, Acquired: 3}, w.Stats())
+}
+
+func TestAcquireCancels(t *testing.T) {
+	defer leaktest.Check(t)()
+	w := NewWeighted("TestAcquireCancels", 1)
+	require.NoError(t, w.Acquire(context.Background(), 1))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	assert.ErrorIs(t, w.Acquire(ctx, 1), context.DeadlineExceeded)
+	assert.Equal(t, Stats{Capacity: 1, InUse: 1, Acquired: 1, Canceled: 1}, w.Stats())
+
+	w.Release(1)
+	require.NoError(t, w.Acquire(context.Background(), 1))
+}
+
+func TestAllStats(t *testing.T) {
+	w := NewWeighted("TestAllStats", 4)
+	require.NoError(t, w.Acquire(context.Background(), 1))
+	defer w.Release(1)
+	assert.Equal(t, Stats{Capacity: 4, InUse: 1, Acquired: 1}, AllStats()["TestAllStats"])
+}
+
+func TestStatsHandler(t *testing.T) {
+	w := NewWeighted("TestStatsHandler", 2)
+	require.NoError(t, w.Acquire(context.Background(), 2))
+	defer w.Release(2)
+
+	recorder := httptest.NewRecorder()
+	StatsHandler(recorder, httptest.NewRequest(http.MethodGet, "/limiters", nil))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var stats map[string]Stats
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &stats))
+	assert.Equal(t, Stats{Capacity: 2, InUse: 2, Acquired: 1}, stats["TestStatsHandler"])
+
+	recorder = httptest.NewRecorder()
+	StatsHandler(recorder, httptest.NewRequest(http.MethodPost, "/limiters", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, recorder.Code)
+}
@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"strings"
+	"unicode"
 
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/text/language"
+	"golang.org/x/text/language/display"
 	"golang.org/x/text/message"
 	"golang.org/x/text/message/catalog"
 )
@@ -21,11 +23,45 @@ func (l Localized) IsEmpty() bool {
 type messageCtxKey int
 
 const theMessageKey messageCtxKey = 0
+const theConfidenceWordingKey messageCtxKey = 1
+
+// How sure a provider has to be before its results are worded more confidently
+type ConfidenceWording struct {
+	// At or above this, descriptions are stated as fact
+	Certain float32
+	// At or above this, descriptions are what the bot thinks it is. Below it, they're what it might be
+	Likely float32
+	// Adds how sure the provider was to each description, as a percentage
+	ShowConfidence bool
+}
+
+var DefaultConfidenceWording = ConfidenceWording{Certain: 0.9, Likely: 0.5}
+
+// A single caption from a provider
+type Description struct {
+	Text string
+	// Between 0 and 1. Zero means the provider didn't say
+	Confidence float32
+	// Describes part of the image, rather than all of it
+	Region bool
+}
 
 func WithLanguage(ctx context.Context, tag language.Tag) context.Context {
 	return context.WithValue(ctx, theMessageKey, tag)
 }
 
+// Replaces DefaultConfidenceWording for the messages created with ctx
+func WithConfidenceWording(ctx context.Context, wording ConfidenceWording) context.Context {
+	return context.WithValue(ctx, theConfidenceWordingKey, wording)
+}
+
+func getConfidenceWording(ctx context.Context) ConfidenceWording {
+	if wording, ok := ctx.Value(theConfidenceWordingKey).(ConfidenceWording); ok {
+		return wording
+	}
+	return DefaultConfidenceWording
+}
+
 func GetLanguage(ctx context.Context) language.Tag {
 	if tag, ok := ctx.Value(theMessageKey).(language.Tag); ok {
 		return tag
@@ -60,30 +96,60 @@ const (
 	cannotRespondErrorFormat = "The message can't be written out as a tweet. Maybe it's by Prince?"
 	altTextUsageFormat       = "See what description the user gave when creating the tweet"
 	ocrUsageFormat           = "Scan the image for text"
+	handwritingUsageFormat   = "Scan the image for handwriting. Add the language it's written in if you know it (e.g. handwriting in de)"
 	describeUsageFormat      = "Use AI to create a description of the image"
+	labelsUsageFormat        = "List the objects, landmarks and brands in the image"
+	askUsageFormat           = "Ask a question about the image, or just tag me with your question (e.g. ask what does the sign say?)"
 	everythingUsageFormat    = "Get the user's description, the scanned text, and an AI generated description"
 	translateUsageFormat     = "Automatically convert the result to the language code specified. (e.g. translate into ja-jp)"
+	bilingualUsageFormat     = "Like translate, but keeps the original text next to the translation"
 	helpUsageFormat          = `Tag @captions_please in a tweet to interpret the images.
 You can customize the response by adding one of the following commands after tagging me:`
 	helpCommandFormat                = "help"
 	altTextCommandFormat             = "alt text"
 	ocrCommandFormat                 = "get text"
+	handwritingCommandFormat         = "handwriting"
 	describeCommandFormat            = "describe"
+	askCommandFormat                 = "ask"
+	labelsCommandFormat              = "tags"
 	everythingCommandFormat          = "get everything"
 	translateFormat                  = "translate"
+	bilingualCommandFormat           = "bilingual"
 	noPhotosFormat                   = "I didn't find any photos to interpret, but I appreciate the shoutout! Try \"@captions_please help\" to learn more"
 	wrongMediaFormat                 = "I only know how to interpret photos right now, sorry!"
 	imageLabelFormat                 = "Image %d: %s"
 	hasAltTextFormat                 = "%s says it's %s"
 	noAltTextFormat                  = "%s didn't provide any alt text when posting the image"
 	noDescriptionsFormat             = "I'm at a loss for words, sorry!"
+	noAnswerFormat                   = "I couldn't answer your question about this image, sorry!"
+	noLabelsFormat                   = "I couldn't find anything I recognize, sorry!"
+	labelsFormat                     = "I see: %s"
 	multipleDescriptionsJoinerFormat = "It might also be %s"
+	regionDescriptionsFormat         = "It also shows %s"
 	addBotErrorFormat                = "However; %s"
-	addDescriptionFormat             = "I think it's %s"
+	certainDescriptionFormat         = "It's %s"
+	likelyDescriptionFormat          = "I think it's %s"
+	possibleDescriptionFormat        = "It might be %s"
+	descriptionConfidenceFormat      = "%s (%d%% sure)"
 	addOCRFormat                     = "It contains the text: %s"
+	addUncertainOCRFormat            = "It might contain the text: %s"
+	translatedFromFormat             = "(translated from %s: %s)"
+	translatedFormat                 = "(translated: %s)"
 	unsupportedLanguageFormat        = "I'm unable to support that language right now, sorry!"
 	unknownCommandFormat             = "I didn't understand your message, but I appreciate the shoutout! Try \"@captions_please help\" to learn more"
 	userBlockedBotCommandFormat      = "I'm blocked from viewing the parent tweet, sorry!"
+	slowDownFormat                   = "Whoa, that's a lot of requests! Please give me a little while before tagging me again"
+	stopUsageFormat                  = "Stop me from interpreting your images. Tag me with start to undo it"
+	stopCommandFormat                = "stop"
+	optedOutFormat                   = "Got it, I won't interpret your images anymore. Tag me with \"start\" if you change your mind"
+	optedInFormat                    = "Welcome back! I'll interpret your images again"
+	authorOptedOutFormat             = "The author of this tweet has asked me not to interpret their images, sorry!"
+	deleteUsageFormat                = "Reply to one of my replies with this to remove them"
+	deleteCommandFormat              = "delete"
+	nothingToDeleteFormat            = "I couldn't find any of my replies to delete here"
+	cannotDeleteFormat               = "Only the person who asked me, or who posted the images, can delete my replies"
+	timeoutFormat                    = "I ran out of time before I could finish this one, sorry!"
+	partialReplyFormat               = "I ran out of time before I could finish everything, so some of this is missing"
 )
 
 var errorMapping map[structured_error.ErrorType]string = map[structured_error.ErrorType]string{
@@ -91,10 +157,13 @@ var errorMapping map[structured_error.ErrorType]string = map[structured_error.Er
 	structured_error.NoPhotosFound:       noPhotosFormat,
 	structured_error.WrongMediaType:      wrongMediaFormat,
 	structured_error.DescribeError:       noDescriptionsFormat,
+	structured_error.AnswerError:         noAnswerFormat,
+	structured_error.LabelError:          noLabelsFormat,
 	structured_error.OCRError:            noDescriptionsFormat,
 	structured_error.TranslateError:      noDescriptionsFormat,
 	structured_error.UnsupportedLanguage: unsupportedLanguageFormat,
 	structured_error.UserBlockedBot:      userBlockedBotCommandFormat,
+	structured_error.Timeout:             timeoutFormat,
 }
 
 func ErrorMessage(ctx context.Context, err structured_error.StructuredError) Localized {
@@ -109,9 +178,15 @@ func HelpMessage(ctx context.Context) Localized {
 	lines := [][]string{
 		{altTextCommandFormat, altTextUsageFormat},
 		{ocrCommandFormat, ocrUsageFormat},
+		{handwritingCommandFormat, handwritingUsageFormat},
 		{describeCommandFormat, describeUsageFormat},
+		{askCommandFormat, askUsageFormat},
+		{labelsCommandFormat, labelsUsageFormat},
 		{everythingCommandFormat, everythingUsageFormat},
 		{translateFormat, translateUsageFormat},
+		{bilingualCommandFormat, bilingualUsageFormat},
+		{stopCommandFormat, stopUsageFormat},
+		{deleteCommandFormat, deleteUsageFormat},
 	}
 	builder := &strings.Builder{}
 	builder.WriteString(string(sprint(ctx, helpUsageFormat)))
@@ -128,10 +203,54 @@ func UnknownCommandMessage(ctx context.Context) Localized {
 	return sprint(ctx, unknownCommandFormat)
 }
 
+func SlowDownMessage(ctx context.Context) Localized {
+	return sprint(ctx, slowDownFormat)
+}
+
+func OptedOutMessage(ctx context.Context) Localized {
+	return sprint(ctx, optedOutFormat)
+}
+
+func OptedInMessage(ctx context.Context) Localized {
+	return sprint(ctx, optedInFormat)
+}
+
+func AuthorOptedOutMessage(ctx context.Context) Localized {
+	return sprint(ctx, authorOptedOutFormat)
+}
+
+func NothingToDeleteMessage(ctx context.Context) Localized {
+	return sprint(ctx, nothingToDeleteFormat)
+}
+
+func CannotDeleteMessage(ctx context.Context) Localized {
+	return sprint(ctx, cannotDeleteFormat)
+}
+
+// Lets the user know the reply is missing some results because the job ran out of time
+func AddPartialReplyNote(ctx context.Context, reply Localized) Localized {
+	return CombineMessages([]Localized{reply, sprint(ctx, partialReplyFormat)}, "\n\n")
+}
+
 func LabelImage(ctx context.Context, description Localized, index int) Localized {
 	return sprintf(ctx, imageLabelFormat, index+1, description)
 }
 
+// Twitter allows at most 4 photos per tweet
+const maxLabeledImages = 4
+
+// Returns the length of the "Image N:" label text starts with, including any spaces before it, or 0 if there isn't one
+func ImageLabelLength(ctx context.Context, text string) int {
+	trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+	for i := 0; i < maxLabeledImages; i++ {
+		label := strings.TrimSpace(string(LabelImage(ctx, Unlocalized(""), i)))
+		if strings.HasPrefix(trimmed, label) {
+			return len(text) - len(trimmed) + len(label)
+		}
+	}
+	return 0
+}
+
 func NoAltText(ctx context.Context, userDisplayName string) Localized {
 	return sprintf(ctx, noAltTextFormat, userDisplayName)
 }
@@ -148,21 +267,59 @@ func CombineMessages(messages []Localized, joiner string) Localized {
 	return Localized(strings.Join(asStrings, joiner))
 }
 
-func CombineDescriptions(ctx context.Context, descriptions []string) Localized {
-	messages := make([]Localized, len(descriptions))
-	for i, description := range descriptions {
-		if i == 0 {
-			messages[i] = Unlocalized(description)
-
+// Words the descriptions from most to least confident. The first is hedged according to how sure the provider was,
+// see ConfidenceWording, and the rest are offered as alternatives. The regions of the image are listed after them
+func CombineDescriptions(ctx context.Context, descriptions []Description) Localized {
+	wording := getConfidenceWording(ctx)
+	messages := make([]Localized, 0, len(descriptions))
+	regions := []Localized{}
+	for _, description := range descriptions {
+		text := Unlocalized(description.Text)
+		if wording.ShowConfidence && description.Confidence > 0 {
+			text = sprintf(ctx, descriptionConfidenceFormat, text, int(description.Confidence*100+0.5))
+		}
+		if description.Region {
+			regions = append(regions, text)
+		} else if len(messages) == 0 {
+			messages = append(messages, sprintf(ctx, descriptionFormat(wording, description.Confidence), text))
 		} else {
-			messages[i] = sprintf(ctx, multipleDescriptionsJoinerFormat, description)
+			messages = append(messages, sprintf(ctx, multipleDescriptionsJoinerFormat, text))
 		}
 	}
+	if len(regions) > 0 {
+		messages = append(messages, sprintf(ctx, regionDescriptionsFormat, CombineMessages(regions, ", ")))
+	}
 	return CombineMessages(messages, ". ")
 }
 
+func descriptionFormat(wording ConfidenceWording, confidence float32) string {
+	if confidence == 0 {
+		// We don't know, so stick to the middle ground
+		return likelyDescriptionFormat
+	} else if confidence >= wording.Certain {
+		return certainDescriptionFormat
+	} else if confidence >= wording.Likely {
+		return likelyDescriptionFormat
+	}
+	return possibleDescriptionFormat
+}
+
+// Lists the things found in the image, in the order given
+func Labels(ctx context.Context, labels []Description) Localized {
+	wording := getConfidenceWording(ctx)
+	texts := make([]Localized, len(labels))
+	for i, label := range labels {
+		texts[i] = Unlocalized(label.Text)
+		if wording.ShowConfidence && label.Confidence > 0 {
+			texts[i] = sprintf(ctx, descriptionConfidenceFormat, texts[i], int(label.Confidence*100+0.5))
+		}
+	}
+	return sprintf(ctx, labelsFormat, CombineMessages(texts, ", "))
+}
+
+// Adds the description from CombineDescriptions after the alt text
 func AddDescription(ctx context.Context, altText Localized, description Localized) Localized {
-	messages := []Localized{altText, sprintf(ctx, addDescriptionFormat, description)}
+	messages := []Localized{altText, description}
 	return CombineMessages(messages, ". ")
 }
 
@@ -171,11 +328,47 @@ func AddBotError(ctx context.Context, altText Localized, err structured_error.St
 	return sprintf(ctx, addBotErrorFormat, errMessage)
 }
 
-func AddOCR(ctx context.Context, description Localized, ocr Localized) Localized {
-	messages := []Localized{description, sprintf(ctx, addOCRFormat, ocr)}
+// Adds the text in the image after the description. confidence is how sure the OCR was about the text's language,
+// which is low when the text is garbled. Zero means it didn't say
+func AddOCR(ctx context.Context, description Localized, ocr Localized, confidence float32) Localized {
+	format := addOCRFormat
+	if confidence > 0 && confidence < getConfidenceWording(ctx).Likely {
+		format = addUncertainOCRFormat
+	}
+	messages := []Localized{description, sprintf(ctx, format, ocr)}
 	return CombineMessages(messages, ". ")
 }
 
+// Follows the original text with its translation, naming the language it was translated from if it's known
+func Bilingual(ctx context.Context, original Localized, source language.Tag, translation Localized) Localized {
+	var note Localized
+	name := ""
+	if source != language.Und {
+		name = display.Tags(getServerSupportedLanguage(ctx)).Name(source)
+	}
+	if name == "" {
+		note = sprintf(ctx, translatedFormat, translation)
+	} else {
+		note = sprintf(ctx, translatedFromFormat, name, translation)
+	}
+	return CombineMessages([]Localized{original, note}, " ")
+}
+
+// Returns true if text starts with the note Bilingual puts before a translation
+func IsTranslationNote(ctx context.Context, text string) bool {
+	text = strings.TrimSpace(text)
+	// Everything up to the first argument is the same for every translation
+	const marker = "\x00"
+	notes := []Localized{sprintf(ctx, translatedFromFormat, marker, marker), sprintf(ctx, translatedFormat, marker)}
+	for _, note := range notes {
+		prefix := strings.SplitN(string(note), marker, 2)[0]
+		if strings.HasPrefix(text, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
 func GetCompatibleLanguage(ctx context.Context, supportedTags []language.Tag) (language.Tag, structured_error.StructuredError) {
 	matcher := language.NewMatcher(supportedTags)
 	tag := language.English
@@ -212,7 +405,15 @@ var messages = [...]struct {
 	{"en", helpCommandFormat, helpCommandFormat},
 	{"en", altTextCommandFormat, altTextCommandFormat},
 	{"en", ocrCommandFormat, ocrCommandFormat},
+	{"en", handwritingCommandFormat, handwritingCommandFormat},
+	{"en", handwritingUsageFormat, handwritingUsageFormat},
 	{"en", describeCommandFormat, describeCommandFormat},
+	{"en", askCommandFormat, askCommandFormat},
+	{"en", askUsageFormat, askUsageFormat},
+	{"en", labelsCommandFormat, labelsCommandFormat},
+	{"en", labelsUsageFormat, labelsUsageFormat},
+	{"en", labelsFormat, catalog.String("I see: %[1]s")},
+	{"en", noLabelsFormat, noLabelsFormat},
 	{"en", everythingCommandFormat, everythingCommandFormat},
 	{"en", translateFormat, translateFormat},
 	{"en", noPhotosFormat, noPhotosFormat},
@@ -222,20 +423,71 @@ var messages = [...]struct {
 	{"en", hasAltTextFormat, catalog.String("%[1]s says it's %[2]s")},
 	{"en", addBotErrorFormat, catalog.String("However; %[1]s")},
 	{"en", noDescriptionsFormat, noDescriptionsFormat},
+	{"en", noAnswerFormat, noAnswerFormat},
 	{"en", multipleDescriptionsJoinerFormat, catalog.String("It might also be %[1]s")},
-	{"en", addDescriptionFormat, catalog.String("I think it's %[1]s")},
+	{"en", regionDescriptionsFormat, catalog.String("It also shows %[1]s")},
+	{"en", certainDescriptionFormat, catalog.String("It's %[1]s")},
+	{"en", likelyDescriptionFormat, catalog.String("I think it's %[1]s")},
+	{"en", possibleDescriptionFormat, catalog.String("It might be %[1]s")},
+	{"en", descriptionConfidenceFormat, catalog.String("%[1]s (%[2]d%% sure)")},
 	{"en", addOCRFormat, catalog.String("It contains the text: %[1]s")},
+	{"en", addUncertainOCRFormat, catalog.String("It might contain the text: %[1]s")},
+	{"en", translatedFromFormat, catalog.String("(translated from %[1]s: %[2]s)")},
+	{"en", translatedFormat, catalog.String("(translated: %[1]s)")},
+	{"en", bilingualCommandFormat, bilingualCommandFormat},
+	{"en", bilingualUsageFormat, bilingualUsageFormat},
 	{"en", unsupportedLanguageFormat, unsupportedLanguageFormat},
 	{"en", unknownCommandFormat, unknownCommandFormat},
 	{"en", userBlockedBotCommandFormat, userBlockedBotCommandFormat},
+	{"en", slowDownFormat, slowDownFormat},
+	{"en", stopUsageFormat, stopUsageFormat},
+	{"en", stopCommandFormat, stopCommandFormat},
+	{"en", optedOutFormat, optedOutFormat},
+	{"en", optedInFormat, optedInFormat},
+	{"en", authorOptedOutFormat, authorOptedOutFormat},
+	{"en", deleteUsageFormat, deleteUsageFormat},
+	{"en", deleteCommandFormat, deleteCommandFormat},
+	{"en", nothingToDeleteFormat, nothingToDeleteFormat},
+	{"en", cannotDeleteFormat, cannotDeleteFormat},
+	{"en", timeoutFormat, timeoutFormat},
+	{"en", partialReplyFormat, partialReplyFormat},
 	{"de", helpCommandFormat, "Hilfe"},
 	{"de", altTextCommandFormat, "Alternativtext"},
 	{"de", ocrCommandFormat, "Text scannen"},
+	{"de", handwritingCommandFormat, "Handschrift scannen"},
+	{"de", handwritingUsageFormat, "Scanne handgeschriebenen Text im Bild"},
 	{"de", describeCommandFormat, "beschreiben"},
+	{"de", askCommandFormat, "fragen"},
+	{"de", askUsageFormat, "Stelle eine Frage zum Bild (z.B. fragen was steht auf dem Schild?)"},
+	{"de", labelsCommandFormat, "Schlagwörter"},
+	{"de", labelsUsageFormat, "Liste die Objekte, Sehenswürdigkeiten und Marken im Bild auf"},
+	{"de", labelsFormat, catalog.String("Ich sehe: %[1]s")},
+	{"de", noLabelsFormat, "Ich habe nichts erkannt, sorry!"},
+	{"de", noAnswerFormat, "Ich konnte deine Frage zu diesem Bild nicht beantworten, sorry!"},
 	{"de", helpUsageFormat, "Markiere @captions_please in einem Tweet, um eine Bildbeschreibung zu bekommen. Füge eines der Kommandos hinzu, wie"},
 	{"de", altTextUsageFormat, "Lese, was schon als Bildbeschreibung hinzugefügt ist"},
 	{"de", ocrUsageFormat, "Scanne, was an Text im Bild vorhanden ist (Text in Bildform)"},
 	{"de", describeUsageFormat, "Nutze KI (Künstliche Intelligenz), um eine Bildbeschreibung zu erzeugen"},
+	{"de", stopCommandFormat, "stopp"},
+	{"de", stopUsageFormat, "Ich interpretiere deine Bilder nicht mehr. Markiere mich mit starten, um es rückgängig zu machen"},
+	{"de", optedOutFormat, "Alles klar, ich interpretiere deine Bilder nicht mehr. Markiere mich mit \"starten\", wenn du es dir anders überlegst"},
+	{"de", optedInFormat, "Willkommen zurück! Ich interpretiere deine Bilder wieder"},
+	{"de", authorOptedOutFormat, "Die Person, die diesen Tweet geschrieben hat, möchte nicht, dass ich ihre Bilder interpretiere, sorry!"},
+	{"de", deleteCommandFormat, "löschen"},
+	{"de", deleteUsageFormat, "Antworte hiermit auf eine meiner Antworten, um sie zu entfernen"},
+	{"de", nothingToDeleteFormat, "Ich konnte hier keine meiner Antworten zum Löschen finden"},
+	{"de", cannotDeleteFormat, "Nur die Person, die mich gefragt hat, oder die die Bilder gepostet hat, kann meine Antworten löschen"},
+	{"de", timeoutFormat, "Mir ist die Zeit ausgegangen, bevor ich damit fertig wurde, sorry!"},
+	{"de", partialReplyFormat, "Mir ist die Zeit ausgegangen, bevor ich alles fertig hatte, also fehlt hier etwas"},
+	{"de", certainDescriptionFormat, catalog.String("Es ist %[1]s")},
+	{"de", likelyDescriptionFormat, catalog.String("Ich glaube, es ist %[1]s")},
+	{"de", possibleDescriptionFormat, catalog.String("Es könnte %[1]s sein")},
+	{"de", descriptionConfidenceFormat, catalog.String("%[1]s (%[2]d%% sicher)")},
+	{"de", multipleDescriptionsJoinerFormat, catalog.String("Es könnte auch %[1]s sein")},
+	{"de", regionDescriptionsFormat, catalog.String("Außerdem zu sehen: %[1]s")},
+	{"de", translatedFromFormat, catalog.String("(aus %[1]s übersetzt: %[2]s)")},
+	{"de", translatedFormat, catalog.String("(übersetzt: %[1]s)")},
+	{"de", slowDownFormat, "Hoppla, das sind viele Anfragen! Bitte warte ein bisschen, bevor du mich wieder markierst"},
 }
 
 func sprint(ctx context.Context, format string) Localized {
@@ -47,3 +47,128 @@ func TestLabelImage(t *testing.T) {
 	assert.Equal(t, Localized("Image 1: foo"), LabelImage(context.Background(), Unlocalized("foo"), 0))
 	assert.Equal(t, Localized("Image 2: foo"), LabelImage(context.Background(), Unlocalized("foo"), 1))
 }
+
+func TestLabels(t *testing.T) {
+	assert.NoError(t, LoadMessages())
+	labels := []Description{{Text: "dog", Confidence: 0.92}, {Text: "frisbee", Confidence: 0.6}}
+	assert.Equal(t, Localized("I see: dog, frisbee"), Labels(context.Background(), labels))
+	ctx := WithLanguage(context.Background(), language.German)
+	assert.Equal(t, Localized("Ich sehe: dog, frisbee"), Labels(ctx, labels))
+	ctx = WithConfidenceWording(context.Background(), ConfidenceWording{ShowConfidence: true})
+	assert.Equal(t, Localized("I see: dog (92% sure), frisbee (60% sure)"), Labels(ctx, labels))
+}
+
+func TestImageLabelLength(t *testing.T) {
+	assert.NoError(t, LoadMessages())
+	ctx := context.Background()
+	assert.Equal(t, len("Image 1:"), ImageLabelLength(ctx, "Image 1:"))
+	assert.Equal(t, len(" Image 4:"), ImageLabelLength(ctx, " Image 4: a cat"))
+	assert.Equal(t, 0, ImageLabelLength(ctx, "Image"))
+	assert.Equal(t, 0, ImageLabelLength(ctx, "Image processing is hard"))
+	assert.Equal(t, 0, ImageLabelLength(ctx, ""))
+}
+
+func TestCombineDescriptions(t *testing.T) {
+	assert.NoError(t, LoadMessages())
+	tests := []struct {
+		name         string
+		wording      *ConfidenceWording
+		language     language.Tag
+		descriptions []Description
+		expected     Localized
+	}{
+		{
+			name:         "States certain descriptions as fact",
+			descriptions: []Description{{Text: "a cat", Confidence: 0.95}},
+			expected:     "It's a cat",
+		},
+		{
+			name:         "Thinks it's a likely description",
+			descriptions: []Description{{Text: "a cat", Confidence: 0.6}},
+			expected:     "I think it's a cat",
+		},
+		{
+			name:         "Hedges unlikely descriptions",
+			descriptions: []Description{{Text: "a cat", Confidence: 0.3}},
+			expected:     "It might be a cat",
+		},
+		{
+			name:         "Thinks it's a description without a confidence",
+			descriptions: []Description{{Text: "a cat"}},
+			expected:     "I think it's a cat",
+		},
+		{
+			name:         "Offers the rest as alternatives",
+			descriptions: []Description{{Text: "a cat", Confidence: 0.95}, {Text: "a dog", Confidence: 0.4}},
+			expected:     "It's a cat. It might also be a dog",
+		},
+		{
+			name: "Lists the regions of the image after the descriptions",
+			descriptions: []Description{
+				{Text: "a busy street", Confidence: 0.95},
+				{Text: "a red car", Confidence: 0.8, Region: true},
+				{Text: "a man riding a bike", Confidence: 0.7, Region: true},
+			},
+			expected: "It's a busy street. It also shows a red car, a man riding a bike",
+		},
+		{
+			name:         "Uses the configured thresholds",
+			wording:      &ConfidenceWording{Certain: 0.99, Likely: 0.2},
+			descriptions: []Description{{Text: "a cat", Confidence: 0.95}},
+			expected:     "I think it's a cat",
+		},
+		{
+			name:         "Shows the confidence",
+			wording:      &ConfidenceWording{Certain: 0.9, Likely: 0.5, ShowConfidence: true},
+			descriptions: []Description{{Text: "a cat", Confidence: 0.954}, {Text: "a dog", Confidence: 0.4}},
+			expected:     "It's a cat (95% sure). It might also be a dog (40% sure)",
+		},
+		{
+			name:         "Hedges in German",
+			language:     language.German,
+			wording:      &ConfidenceWording{Certain: 0.9, Likely: 0.5, ShowConfidence: true},
+			descriptions: []Description{{Text: "eine Katze", Confidence: 0.3}},
+			expected:     "Es könnte eine Katze (30% sicher) sein",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.language != language.Und {
+				ctx = WithLanguage(ctx, test.language)
+			}
+			if test.wording != nil {
+				ctx = WithConfidenceWording(ctx, *test.wording)
+			}
+			assert.Equal(t, test.expected, CombineDescriptions(ctx, test.descriptions))
+		})
+	}
+}
+
+func TestAddOCR(t *testing.T) {
+	assert.NoError(t, LoadMessages())
+	ctx := context.Background()
+	assert.Equal(t, Localized("a cat. It contains the text: meow"), AddOCR(ctx, "a cat", "meow", 0.9))
+	assert.Equal(t, Localized("a cat. It contains the text: meow"), AddOCR(ctx, "a cat", "meow", 0))
+	assert.Equal(t, Localized("a cat. It might contain the text: m3ow"), AddOCR(ctx, "a cat", "m3ow", 0.2))
+}
+
+func TestBilingual(t *testing.T) {
+	assert.NoError(t, LoadMessages())
+	ctx := context.Background()
+	assert.Equal(t, Localized("こんにちは (translated from Japanese: hello)"), Bilingual(ctx, "こんにちは", language.Japanese, "hello"))
+	assert.Equal(t, Localized("hola (translated: hello)"), Bilingual(ctx, "hola", language.Und, "hello"))
+
+	ctx = WithLanguage(ctx, language.German)
+	assert.Equal(t, Localized("こんにちは (aus Japanisch übersetzt: hallo)"), Bilingual(ctx, "こんにちは", language.Japanese, "hallo"))
+}
+
+func TestIsTranslationNote(t *testing.T) {
+	assert.NoError(t, LoadMessages())
+	ctx := context.Background()
+	assert.True(t, IsTranslationNote(ctx, "(translated from Japanese: hello)"))
+	assert.True(t, IsTranslationNote(ctx, " (translated: hello)"))
+	assert.False(t, IsTranslationNote(ctx, "(translated"))
+	assert.False(t, IsTranslationNote(ctx, "hello (translated: hello)"))
+	assert.True(t, IsTranslationNote(WithLanguage(ctx, language.German), "(aus Japanisch übersetzt: hallo)"))
+}
@@ -0,0 +1,48 @@
+package preprocess
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"math/bits"
+
+	"golang.org/x/image/draw"
+)
+
+// A difference hash of an image. Copies of an image which have been resized, recompressed,
+// or converted to another format hash to the same value, or one only a few bits away
+type Hash uint64
+
+func (h Hash) String() string {
+	return fmt.Sprintf("%016x", uint64(h))
+}
+
+// The number of bits which differ between the two hashes. Anything under 5 or so is very likely the same image
+func (h Hash) Distance(other Hash) int {
+	return bits.OnesCount64(uint64(h ^ other))
+}
+
+// Hashes the image as it would be displayed, so the EXIF orientation is applied first.
+// See http://www.hackerfactor.com/blog/index.php?/archives/529-Kind-of-Like-That.html
+func HashImage(data []byte) (Hash, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return 0, fmt.Errorf("unable to decode the image: %v", err)
+	}
+	if format == "jpeg" {
+		img = orient(img, exifOrientation(data))
+	}
+	// Each row has one more pixel than there are bits, since each bit compares neighbouring pixels
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(small, small.Bounds(), img, img.Bounds(), draw.Src, nil)
+	var hash Hash
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			hash <<= 1
+			if small.GrayAt(x, y).Y < small.GrayAt(x+1, y).Y {
+				hash |= 1
+			}
+		}
+	}
+	return hash, nil
+}
@@ -0,0 +1,43 @@
+package preprocess
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashImage(t *testing.T) {
+	large, err := HashImage(readFixture(t, "large.png"))
+	require.NoError(t, err)
+
+	// The same image after it's been resized and recompressed
+	processed, err := Process(readFixture(t, "large.png"), Options{MaxDimension: 600, MaxBytes: 4000})
+	require.NoError(t, err)
+	copy, err := HashImage(processed)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, large.Distance(copy), 2)
+
+	// Rotating an image by its EXIF orientation gives the same hash as rotating the pixels
+	rotated, err := HashImage(readFixture(t, "rotated.jpg"))
+	require.NoError(t, err)
+	fixed, err := Process(readFixture(t, "rotated.jpg"), Options{})
+	require.NoError(t, err)
+	fixedHash, err := HashImage(fixed)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, rotated.Distance(fixedHash), 2)
+
+	different, err := HashImage(readFixture(t, "photo.webp"))
+	require.NoError(t, err)
+	assert.Greater(t, large.Distance(different), 10)
+
+	_, err = HashImage([]byte("not an image"))
+	assert.Error(t, err)
+}
+
+func TestHashDistance(t *testing.T) {
+	assert.Equal(t, 0, Hash(0xff).Distance(0xff))
+	assert.Equal(t, 3, Hash(0xf0).Distance(0xf7))
+	assert.Equal(t, 64, Hash(0).Distance(^Hash(0)))
+	assert.Equal(t, "00000000000000ff", Hash(0xff).String())
+}
@@ -0,0 +1,240 @@
+package preprocess
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+
+	// Registers the formats twitter serves, so image.Decode understands them
+	_ "image/gif"
+
+	_ "golang.org/x/image/webp"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/image/draw"
+)
+
+// The limits a provider puts on the images it's sent. Zero values mean there's no limit
+type Options struct {
+	// Images with a side longer than this are scaled down to fit
+	MaxDimension int
+	// Images whose longest side is shorter than this are scaled up, since OCR struggles with tiny text
+	MinDimension int
+	// Images which are still larger than this once encoded are converted to JPEG, then scaled down until they fit
+	MaxBytes int
+}
+
+const jpegQuality = 90
+
+// Gives up on shrinking the image to MaxBytes after this many attempts
+const maxShrinkAttempts = 8
+
+// Fixes the EXIF orientation, scales the image to fit within options, and converts anything which isn't a JPEG or PNG
+// (e.g. WebP, or the first frame of a GIF) to PNG. Images which don't need any changes are returned as is
+func Process(data []byte, options Options) ([]byte, error) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("unable to decode the image: %v", err)
+	}
+	orientation := 1
+	if format == "jpeg" {
+		orientation = exifOrientation(data)
+	}
+	width, height := scaledSize(img.Bounds().Dx(), img.Bounds().Dy(), orientation, options)
+
+	changed := orientation != 1 || width != img.Bounds().Dx() || height != img.Bounds().Dy()
+	if !changed && (format == "jpeg" || format == "png") && fits(data, options) {
+		return data, nil
+	}
+	logrus.Debug(fmt.Sprintf("Preprocessing a %s image, orientation %d, resizing from %dx%d to %dx%d", format, orientation, img.Bounds().Dx(), img.Bounds().Dy(), width, height))
+
+	img = resize(orient(img, orientation), width, height)
+	// Keep lossless formats lossless, text screenshots suffer the most from JPEG artifacts
+	useJPEG := format == "jpeg"
+	for attempt := 0; ; attempt++ {
+		data, err = encode(img, useJPEG)
+		if err != nil || fits(data, options) {
+			return data, err
+		}
+		if attempt == maxShrinkAttempts {
+			return nil, fmt.Errorf("unable to shrink the image below %d bytes", options.MaxBytes)
+		}
+		if useJPEG {
+			bounds := img.Bounds()
+			img = resize(img, bounds.Dx()*3/4, bounds.Dy()*3/4)
+		}
+		useJPEG = true
+	}
+}
+
+func fits(data []byte, options Options) bool {
+	return options.MaxBytes == 0 || len(data) <= options.MaxBytes
+}
+
+// Returns the size of the image after it's been oriented and scaled to fit options
+func scaledSize(width int, height int, orientation int, options Options) (int, int) {
+	if orientation >= 5 {
+		// These orientations rotate the image by 90 degrees
+		width, height = height, width
+	}
+	longest := width
+	if height > longest {
+		longest = height
+	}
+	target := longest
+	if options.MinDimension > 0 && longest < options.MinDimension {
+		target = options.MinDimension
+	}
+	if options.MaxDimension > 0 && target > options.MaxDimension {
+		target = options.MaxDimension
+	}
+	if target == longest || longest == 0 {
+		return width, height
+	}
+	scale := func(side int) int {
+		scaled := side * target / longest
+		if scaled < 1 {
+			return 1
+		}
+		return scaled
+	}
+	return scale(width), scale(height)
+}
+
+func resize(img image.Image, width int, height int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() == width && bounds.Dy() == height {
+		return img
+	}
+	resized := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.CatmullRom.Scale(resized, resized.Bounds(), img, bounds, draw.Src, nil)
+	return resized
+}
+
+func encode(img image.Image, useJPEG bool) ([]byte, error) {
+	buffer := &bytes.Buffer{}
+	var err error
+	if useJPEG {
+		err = jpeg.Encode(buffer, flatten(img), &jpeg.Options{Quality: jpegQuality})
+	} else {
+		err = png.Encode(buffer, img)
+	}
+	return buffer.Bytes(), err
+}
+
+// JPEG doesn't support transparency, so put the image on a white background
+func flatten(img image.Image) image.Image {
+	if opaque, ok := img.(interface{ Opaque() bool }); ok && opaque.Opaque() {
+		return img
+	}
+	bounds := img.Bounds()
+	flattened := image.NewRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(flattened, flattened.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+	draw.Draw(flattened, flattened.Bounds(), img, bounds.Min, draw.Over)
+	return flattened
+}
+
+// Rotates and flips the image so it's displayed the way the camera intended.
+// See the orientation tag in https://www.cipa.jp/std/documents/e/DC-008-2012_E.pdf
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+	bounds := img.Bounds()
+	src := image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+	draw.Draw(src, src.Bounds(), img, bounds.Min, draw.Src)
+	width, height := bounds.Dx(), bounds.Dy()
+	dstWidth, dstHeight := width, height
+	if orientation >= 5 {
+		dstWidth, dstHeight = height, width
+	}
+	// Maps each pixel in the oriented image back to where it is in the source
+	sourceOf := map[int]func(x, y int) (int, int){
+		2: func(x, y int) (int, int) { return width - 1 - x, y },
+		3: func(x, y int) (int, int) { return width - 1 - x, height - 1 - y },
+		4: func(x, y int) (int, int) { return x, height - 1 - y },
+		5: func(x, y int) (int, int) { return y, x },
+		6: func(x, y int) (int, int) { return y, height - 1 - x },
+		7: func(x, y int) (int, int) { return width - 1 - y, height - 1 - x },
+		8: func(x, y int) (int, int) { return width - 1 - y, x },
+	}[orientation]
+	dst := image.NewNRGBA(image.Rect(0, 0, dstWidth, dstHeight))
+	for y := 0; y < dstHeight; y++ {
+		for x := 0; x < dstWidth; x++ {
+			sx, sy := sourceOf(x, y)
+			copy(dst.Pix[dst.PixOffset(x, y):dst.PixOffset(x, y)+4], src.Pix[src.PixOffset(sx, sy):src.PixOffset(sx, sy)+4])
+		}
+	}
+	return dst
+}
+
+// Returns the EXIF orientation of a JPEG, or 1 (unchanged) if it doesn't have one
+func exifOrientation(data []byte) int {
+	orientation, err := readExifOrientation(data)
+	if err != nil {
+		logrus.Debug(fmt.Sprintf("Ignoring the EXIF orientation: %v", err))
+		return 1
+	}
+	return orientation
+}
+
+func readExifOrientation(data []byte) (int, error) {
+	if len(data) < 2 || data[0] != 0xFF || data[1] != 0xD8 {
+		return 0, errors.New("not a JPEG")
+	}
+	offset := 2
+	for offset+4 <= len(data) {
+		if data[offset] != 0xFF {
+			return 0, errors.New("invalid JPEG marker")
+		}
+		marker := data[offset+1]
+		length := int(data[offset+2])<<8 | int(data[offset+3])
+		if marker == 0xDA || length < 2 || offset+2+length > len(data) {
+			// The image data starts at SOS, so there's no more metadata after it
+			break
+		}
+		segment := data[offset+4 : offset+2+length]
+		if marker == 0xE1 && bytes.HasPrefix(segment, []byte("Exif\x00\x00")) {
+			return tiffOrientation(segment[6:])
+		}
+		offset += 2 + length
+	}
+	return 1, nil
+}
+
+func tiffOrientation(tiff []byte) (int, error) {
+	if len(tiff) < 8 {
+		return 0, errors.New("truncated TIFF header")
+	}
+	var uint16At func(int) int
+	var uint32At func(int) int
+	switch string(tiff[:2]) {
+	case "II":
+		uint16At = func(i int) int { return int(tiff[i]) | int(tiff[i+1])<<8 }
+		uint32At = func(i int) int { return uint16At(i) | uint16At(i+2)<<16 }
+	case "MM":
+		uint16At = func(i int) int { return int(tiff[i])<<8 | int(tiff[i+1]) }
+		uint32At = func(i int) int { return uint16At(i)<<16 | uint16At(i+2) }
+	default:
+		return 0, errors.New("unknown TIFF byte order")
+	}
+	ifd := uint32At(4)
+	if ifd < 8 || ifd+2 > len(tiff) {
+		return 0, errors.New("invalid IFD offset")
+	}
+	entries := uint16At(ifd)
+	for i := 0; i < entries; i++ {
+		entry := ifd + 2 + i*12
+		if entry+12 > len(tiff) {
+			return 0, errors.New("truncated IFD")
+		}
+		if uint16At(entry) == 0x0112 {
+			return uint16At(entry + 8), nil
+		}
+	}
+	return 1, nil
+}
@@ -0,0 +1,170 @@
+package preprocess
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func readFixture(t *testing.T, name string) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	require.NoError(t, err)
+	return data
+}
+
+func decode(t *testing.T, data []byte) (image.Image, string) {
+	img, format, err := image.Decode(bytes.NewReader(data))
+	require.NoError(t, err)
+	return img, format
+}
+
+func assertColor(t *testing.T, expected color.RGBA, actual color.Color) {
+	r, g, b, _ := actual.RGBA()
+	// JPEG and resampling blur the colors a little
+	assert.InDelta(t, expected.R, r>>8, 24)
+	assert.InDelta(t, expected.G, g>>8, 24)
+	assert.InDelta(t, expected.B, b>>8, 24)
+}
+
+func TestProcess(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	blue := color.RGBA{0, 0, 255, 255}
+	green := color.RGBA{0, 255, 0, 255}
+	tests := []struct {
+		name    string
+		fixture string
+		options Options
+		format  string
+		size    image.Point
+		// Colors expected at points in the processed image
+		colors map[image.Point]color.RGBA
+	}{
+		{
+			name:    "Rotates JPEGs to match their EXIF orientation",
+			fixture: "rotated.jpg",
+			format:  "jpeg",
+			size:    image.Pt(32, 64),
+			colors:  map[image.Point]color.RGBA{{16, 8}: red, {16, 56}: blue},
+		},
+		{
+			name:    "Scales down images larger than the max dimension",
+			fixture: "large.png",
+			options: Options{MaxDimension: 1500},
+			format:  "png",
+			size:    image.Pt(1500, 500),
+			colors:  map[image.Point]color.RGBA{{100, 250}: red, {1400, 250}: blue},
+		},
+		{
+			name:    "Scales up tiny images",
+			fixture: "tiny.png",
+			options: Options{MinDimension: 1000},
+			format:  "png",
+			size:    image.Pt(1000, 400),
+		},
+		{
+			name:    "Scales up no further than the max dimension",
+			fixture: "tiny.png",
+			options: Options{MinDimension: 1000, MaxDimension: 500},
+			format:  "png",
+			size:    image.Pt(500, 200),
+		},
+		{
+			name:    "Converts the first frame of a GIF to PNG",
+			fixture: "animated.gif",
+			format:  "png",
+			size:    image.Pt(40, 40),
+			colors:  map[image.Point]color.RGBA{{20, 20}: green},
+		},
+		{
+			name:    "Converts WebP to PNG",
+			fixture: "photo.webp",
+			format:  "png",
+			size:    image.Pt(150, 100),
+		},
+		{
+			name:    "Converts to JPEG, then scales down, to fit the max bytes",
+			fixture: "noise.png",
+			options: Options{MaxBytes: 20000},
+			format:  "jpeg",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			processed, err := Process(readFixture(t, test.fixture), test.options)
+			require.NoError(t, err)
+			img, format := decode(t, processed)
+			assert.Equal(t, test.format, format)
+			if test.size != (image.Point{}) {
+				assert.Equal(t, test.size, img.Bounds().Size())
+			}
+			if test.options.MaxBytes > 0 {
+				assert.LessOrEqual(t, len(processed), test.options.MaxBytes)
+			}
+			for point, expected := range test.colors {
+				assertColor(t, expected, img.At(point.X, point.Y))
+			}
+		})
+	}
+}
+
+func TestProcessLeavesImagesWhichFitAlone(t *testing.T) {
+	for _, fixture := range []string{"upright.jpg", "tiny.png"} {
+		data := readFixture(t, fixture)
+		processed, err := Process(data, Options{MaxDimension: 4096, MaxBytes: 1024 * 1024})
+		assert.NoError(t, err)
+		assert.Equal(t, data, processed)
+	}
+}
+
+func TestProcessRejectsInvalidImages(t *testing.T) {
+	_, err := Process([]byte("not an image"), Options{})
+	assert.Error(t, err)
+}
+
+func TestOrient(t *testing.T) {
+	// A 2x1 image with a red pixel then a blue one
+	src := image.NewNRGBA(image.Rect(0, 0, 2, 1))
+	src.Set(0, 0, color.NRGBA{255, 0, 0, 255})
+	src.Set(1, 0, color.NRGBA{0, 0, 255, 255})
+	red := color.NRGBA{255, 0, 0, 255}
+	blue := color.NRGBA{0, 0, 255, 255}
+	tests := map[int][]color.NRGBA{
+		// Listed left to right, then top to bottom
+		1: {red, blue},
+		2: {blue, red},
+		3: {blue, red},
+		4: {red, blue},
+		5: {red, blue},
+		6: {red, blue},
+		7: {blue, red},
+		8: {blue, red},
+	}
+	for orientation, expected := range tests {
+		oriented := orient(src, orientation)
+		bounds := oriented.Bounds()
+		if orientation >= 5 {
+			assert.Equal(t, image.Pt(1, 2), bounds.Size(), "orientation %d", orientation)
+		} else {
+			assert.Equal(t, image.Pt(2, 1), bounds.Size(), "orientation %d", orientation)
+		}
+		actual := []color.NRGBA{}
+		for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+			for x := bounds.Min.X; x < bounds.Max.X; x++ {
+				actual = append(actual, color.NRGBAModel.Convert(oriented.At(x, y)).(color.NRGBA))
+			}
+		}
+		assert.Equal(t, expected, actual, "orientation %d", orientation)
+	}
+}
+
+func TestExifOrientation(t *testing.T) {
+	assert.Equal(t, 6, exifOrientation(readFixture(t, "rotated.jpg")))
+	assert.Equal(t, 1, exifOrientation(readFixture(t, "upright.jpg")))
+	assert.Equal(t, 1, exifOrientation([]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x08, 'E', 'x', 'i', 'f', 0, 0}))
+}
@@ -0,0 +1,121 @@
+package retry
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/sirupsen/logrus"
+)
+
+type Policy struct {
+	// The total number of calls to make, including the first one
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	// Each backoff is randomly adjusted by up to this fraction, so calls which failed together don't retry together
+	Jitter float64
+	// Give up instead of waiting if the server asks us to come back later than this
+	MaxRetryAfter time.Duration
+}
+
+var DefaultPolicy = Policy{
+	MaxAttempts:    4,
+	InitialBackoff: time.Millisecond * 500,
+	MaxBackoff:     time.Second * 8,
+	Jitter:         0.2,
+	MaxRetryAfter:  time.Second * 30,
+}
+
+// Overridden by tests
+var after = time.After
+var now = time.Now
+var random = rand.Float64
+
+// Calls attempt until it succeeds, returns an error which isn't structured_error.IsRetryable,
+// or the policy runs out of attempts. Returns the error from the last attempt.
+// Never waits past the context deadline, since the next attempt would fail anyways
+func Do(ctx context.Context, policy Policy, attempt func() error) error {
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil || !structured_error.IsRetryable(err) || i >= policy.MaxAttempts {
+			return err
+		}
+
+		delay, ok := policy.delay(i, structured_error.RetryAfter(err))
+		if !ok {
+			logrus.Debug(fmt.Sprintf("Not retrying, the server asked us to wait %v", structured_error.RetryAfter(err)))
+			return err
+		}
+		if deadline, ok := ctx.Deadline(); ok && now().Add(delay).After(deadline) {
+			logrus.Debug(fmt.Sprintf("Not retrying, waiting %v would pass the deadline", delay))
+			return err
+		}
+
+		logrus.Debug(fmt.Sprintf("Attempt %d failed with %v, retrying in %v", i, err, delay))
+		select {
+		case <-after(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// How long to wait after the given (1-indexed) attempt failed
+func (p Policy) delay(attempt int, retryAfter time.Duration) (time.Duration, bool) {
+	if p.MaxRetryAfter > 0 && retryAfter > p.MaxRetryAfter {
+		return 0, false
+	}
+	backoff := float64(p.InitialBackoff) * math.Pow(2, float64(attempt-1))
+	if p.MaxBackoff > 0 {
+		backoff = math.Min(backoff, float64(p.MaxBackoff))
+	}
+	backoff *= 1 + p.Jitter*(2*random()-1)
+	delay := time.Duration(backoff)
+	if retryAfter > delay {
+		delay = retryAfter
+	}
+	return delay, true
+}
+
+// Statuses which mean the server is temporarily unable to handle the request
+func IsTransientStatus(statusCode int) bool {
+	switch statusCode {
+	case http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Parses the Retry-After header, which is either a number of seconds or an HTTP date.
+// Returns 0 if it's missing or invalid
+func RetryAfter(response *http.Response) time.Duration {
+	if response == nil {
+		return 0
+	}
+	value := response.Header.Get("Retry-After")
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		if delay := at.Sub(now()); delay > 0 {
+			return delay
+		}
+	}
+	return 0
+}
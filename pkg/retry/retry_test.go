@@ -0,0 +1,181 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/stretchr/testify/assert"
+)
+
+var testPolicy = Policy{
+	MaxAttempts:    4,
+	InitialBackoff: time.Second,
+	MaxBackoff:     time.Second * 3,
+	MaxRetryAfter:  time.Minute,
+}
+
+func withFakeTime(t *testing.T) *[]time.Duration {
+	delays := []time.Duration{}
+	start := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	oldAfter, oldNow, oldRandom := after, now, random
+	after = func(d time.Duration) <-chan time.Time {
+		delays = append(delays, d)
+		channel := make(chan time.Time, 1)
+		channel <- start
+		return channel
+	}
+	now = func() time.Time { return start }
+	random = func() float64 { return 0.5 }
+	t.Cleanup(func() {
+		after, now, random = oldAfter, oldNow, oldRandom
+	})
+	return &delays
+}
+
+func TestDo(t *testing.T) {
+	transient := structured_error.WrapRetryable(errors.New("503"), structured_error.TwitterError, 0)
+	permanent := structured_error.Wrap(errors.New("404"), structured_error.TweetNotFound)
+	tests := []struct {
+		name           string
+		policy         Policy
+		errs           []error
+		deadline       time.Duration
+		expectedErr    error
+		expectedDelays []time.Duration
+	}{
+		{
+			name:           "Returns immediately on success",
+			policy:         testPolicy,
+			errs:           []error{nil},
+			expectedDelays: []time.Duration{},
+		},
+		{
+			name:           "Does not retry permanent errors",
+			policy:         testPolicy,
+			errs:           []error{permanent},
+			expectedErr:    permanent,
+			expectedDelays: []time.Duration{},
+		},
+		{
+			name:           "Retries transient errors until they succeed",
+			policy:         testPolicy,
+			errs:           []error{transient, transient, nil},
+			expectedDelays: []time.Duration{time.Second, time.Second * 2},
+		},
+		{
+			name:           "Stops after a permanent error",
+			policy:         testPolicy,
+			errs:           []error{transient, permanent},
+			expectedErr:    permanent,
+			expectedDelays: []time.Duration{time.Second},
+		},
+		{
+			name:           "Gives up after the max attempts and caps the backoff",
+			policy:         testPolicy,
+			errs:           []error{transient, transient, transient, transient},
+			expectedErr:    transient,
+			expectedDelays: []time.Duration{time.Second, time.Second * 2, time.Second * 3},
+		},
+		{
+			name:           "A zero policy never retries",
+			errs:           []error{transient},
+			expectedErr:    transient,
+			expectedDelays: []time.Duration{},
+		},
+		{
+			name:           "Waits for as long as the server asks",
+			policy:         testPolicy,
+			errs:           []error{structured_error.WrapRetryable(errors.New("429"), structured_error.RateLimited, time.Second*20), nil},
+			expectedDelays: []time.Duration{time.Second * 20},
+		},
+		{
+			name:           "Gives up if the server asks us to wait too long",
+			policy:         testPolicy,
+			errs:           []error{structured_error.WrapRetryable(permanent, structured_error.RateLimited, time.Hour)},
+			expectedErr:    permanent,
+			expectedDelays: []time.Duration{},
+		},
+		{
+			name:           "Gives up if waiting would pass the deadline",
+			policy:         testPolicy,
+			errs:           []error{transient, transient},
+			deadline:       time.Millisecond * 1500,
+			expectedErr:    transient,
+			expectedDelays: []time.Duration{time.Second},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			delays := withFakeTime(t)
+			ctx := context.Background()
+			if test.deadline != 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithDeadline(ctx, now().Add(test.deadline))
+				defer cancel()
+			}
+			calls := 0
+			err := Do(ctx, test.policy, func() error {
+				err := test.errs[calls]
+				calls++
+				return err
+			})
+			if test.expectedErr == nil {
+				assert.NoError(t, err)
+			} else {
+				assert.Equal(t, test.expectedErr.Error(), err.Error())
+			}
+			assert.Equal(t, test.expectedDelays, *delays)
+		})
+	}
+}
+
+func TestDoStopsWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := Do(ctx, testPolicy, func() error {
+		calls++
+		cancel()
+		return structured_error.WrapRetryable(errors.New("503"), structured_error.OCRError, 0)
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestJitter(t *testing.T) {
+	policy := Policy{InitialBackoff: time.Second, Jitter: 0.5}
+	withFakeTime(t)
+	random = func() float64 { return 0 }
+	delay, _ := policy.delay(1, 0)
+	assert.Equal(t, time.Millisecond*500, delay)
+	random = func() float64 { return 1 }
+	delay, _ = policy.delay(1, 0)
+	assert.Equal(t, time.Millisecond*1500, delay)
+}
+
+func TestRetryAfter(t *testing.T) {
+	withFakeTime(t)
+	tests := []struct {
+		name     string
+		header   string
+		expected time.Duration
+	}{
+		{name: "Missing header", expected: 0},
+		{name: "Seconds", header: "120", expected: time.Minute * 2},
+		{name: "HTTP date", header: now().Add(time.Second * 30).Format(http.TimeFormat), expected: time.Second * 30},
+		{name: "A date in the past", header: now().Add(-time.Hour).Format(http.TimeFormat), expected: 0},
+		{name: "Garbage", header: "soon", expected: 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			response := &http.Response{Header: http.Header{}}
+			if test.header != "" {
+				response.Header.Set("Retry-After", test.header)
+			}
+			assert.Equal(t, test.expected, RetryAfter(response))
+		})
+	}
+}
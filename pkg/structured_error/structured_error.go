@@ -1,5 +1,10 @@
 package structured_error
 
+import (
+	"errors"
+	"time"
+)
+
 type ErrorType int
 
 const (
@@ -19,6 +24,14 @@ const (
 	TranscribeError
 	UnsupportedLanguage
 	Unknown
+	// New types go at the end, so the values of the existing ones never change
+
+	// The job ran out of time before the work finished
+	Timeout
+	// A question about an image couldn't be answered
+	AnswerError
+	// Nothing in an image could be named
+	LabelError
 )
 
 type StructuredError interface {
@@ -52,3 +65,40 @@ func Wrap(err error, errorType ErrorType) StructuredError {
 	}
 	return &wrappedErr{err: err, errorType: errorType}
 }
+
+type retryableErr struct {
+	wrappedErr
+	retryAfter time.Duration
+}
+
+func (e *retryableErr) Retryable() bool {
+	return true
+}
+
+func (e *retryableErr) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// Like Wrap, but marks the error as transient (a 503, a dropped connection, etc) so it's worth trying again.
+// retryAfter is how long the server asked us to wait, or 0 if it didn't say
+func WrapRetryable(err error, errorType ErrorType, retryAfter time.Duration) StructuredError {
+	if err == nil {
+		return nil
+	}
+	sErr := Wrap(err, errorType)
+	return &retryableErr{wrappedErr: wrappedErr{err: sErr, errorType: sErr.Type()}, retryAfter: retryAfter}
+}
+
+func IsRetryable(err error) bool {
+	var retryable interface{ Retryable() bool }
+	return errors.As(err, &retryable) && retryable.Retryable()
+}
+
+// Returns how long the server asked us to wait before trying again, or 0 if it didn't say
+func RetryAfter(err error) time.Duration {
+	var retryable interface{ RetryAfter() time.Duration }
+	if errors.As(err, &retryable) {
+		return retryable.RetryAfter()
+	}
+	return 0
+}
@@ -0,0 +1,260 @@
+package twitter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	GetTweetRoute     = "get_tweet"
+	TweetReplyRoute   = "tweet_reply"
+	DeleteTweetRoute  = "delete_tweet"
+	UserTimelineRoute = "user_timeline"
+)
+
+// If twitter doesn't tell us when to try again, we'll give them 30 seconds
+const defaultRetryAfter = time.Second * 30
+
+// Lets tests control the passage of time
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+func (realClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+// Allows Limit calls within any Window. Used for limits that twitter enforces but doesn't report in the headers
+type Budget struct {
+	Limit  int
+	Window time.Duration
+}
+
+type LimiterConfig struct {
+	Clock Clock
+	// Budgets which apply to a single route
+	Routes map[string][]Budget
+	// Budgets shared between every route in PostingRoutes
+	Posting       []Budget
+	PostingRoutes []string
+	// Once a route has used this fraction of its ceiling, the remaining calls are spaced out evenly until the next window
+	SpreadThreshold float64
+}
+
+// The account-wide posting caps from https://help.twitter.com/en/rules-and-policies/twitter-limits
+// Twitter doesn't send headers for these, it just starts failing with error 185
+var DefaultLimiterConfig = LimiterConfig{
+	Posting: []Budget{
+		{Limit: 300, Window: time.Hour * 3},
+		{Limit: 2400, Window: time.Hour * 24},
+	},
+	PostingRoutes:   []string{TweetReplyRoute},
+	SpreadThreshold: 0.75,
+}
+
+type twitterLimiter struct {
+	lock   sync.Mutex
+	clock  Clock
+	config LimiterConfig
+	// The latest limits twitter reported in the response headers
+	limits map[string]RateLimit
+	// When the most recent call on each route was scheduled, used to spread calls out
+	scheduled      map[string]time.Time
+	routeWindows   map[string][]*callWindow
+	postingWindows []*callWindow
+	postingRoutes  map[string]bool
+}
+
+// Remembers when calls were made (or are scheduled to be made) to enforce a Budget over a sliding window
+type callWindow struct {
+	budget Budget
+	calls  []time.Time
+}
+
+func newTwitterLimiter(config LimiterConfig) *twitterLimiter {
+	clock := config.Clock
+	if clock == nil {
+		clock = realClock{}
+	}
+	tl := &twitterLimiter{
+		clock:         clock,
+		config:        config,
+		limits:        map[string]RateLimit{},
+		scheduled:     map[string]time.Time{},
+		routeWindows:  map[string][]*callWindow{},
+		postingRoutes: map[string]bool{},
+	}
+	for route, budgets := range config.Routes {
+		for _, budget := range budgets {
+			tl.routeWindows[route] = append(tl.routeWindows[route], &callWindow{budget: budget})
+		}
+	}
+	for _, budget := range config.Posting {
+		tl.postingWindows = append(tl.postingWindows, &callWindow{budget: budget})
+	}
+	for _, route := range config.PostingRoutes {
+		tl.postingRoutes[route] = true
+	}
+	return tl
+}
+
+func (tl *twitterLimiter) getLimit(route string) RateLimit {
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	limit := tl.limits[route]
+	now := tl.clock.Now()
+	if next := tl.nextAvailable(route, now); next.After(now) {
+		limit.Delay = next.Sub(now)
+	}
+	return limit
+}
+
+func (tl *twitterLimiter) setLimit(route string, response *http.Response) {
+	if response != nil {
+		limit := getRateLimit(response)
+		logrus.Debug(fmt.Sprintf("route %s received RateLimit %v", route, limit))
+		tl.lock.Lock()
+		defer tl.lock.Unlock()
+		tl.limits[route] = limit
+	}
+}
+
+// Blocks until route can be called without going over any of its limits
+func (tl *twitterLimiter) wait(ctx context.Context, route string) error {
+	tl.lock.Lock()
+	now := tl.clock.Now()
+	at := tl.nextAvailable(route, now)
+	tl.reserve(route, at)
+	limit := tl.limits[route]
+	tl.lock.Unlock()
+
+	if !at.After(now) {
+		return nil
+	}
+	logrus.Debug(fmt.Sprintf("route %s waiting %v for the rate limit", route, at.Sub(now)))
+	select {
+	case <-tl.clock.After(at.Sub(now)):
+		return nil
+	case <-ctx.Done():
+		tl.lock.Lock()
+		defer tl.lock.Unlock()
+		tl.release(route, at)
+		return fmt.Errorf("timeout on route %s with limit %v", route, limit)
+	}
+}
+
+// Returns the earliest time route can be called. Must be called with the lock held
+func (tl *twitterLimiter) nextAvailable(route string, now time.Time) time.Time {
+	next := now
+	limit := tl.limits[route]
+	if limit.Remaining != nil && *limit.Remaining <= 0 {
+		if limit.NextWindow == nil {
+			next = later(next, now.Add(defaultRetryAfter))
+		} else {
+			next = later(next, *limit.NextWindow)
+		}
+	} else if interval, ok := tl.spreadInterval(limit, now); ok {
+		if last, ok := tl.scheduled[route]; ok {
+			next = later(next, last.Add(interval))
+		}
+	}
+
+	for _, window := range tl.windows(route) {
+		next = later(next, window.nextAvailable(now))
+	}
+	return next
+}
+
+// Once a route is running low, space the remaining calls out evenly instead of
+// using them all up at once and then waiting for the window to reset
+func (tl *twitterLimiter) spreadInterval(limit RateLimit, now time.Time) (time.Duration, bool) {
+	if limit.Remaining == nil || limit.Ceiling == nil || limit.NextWindow == nil || *limit.Ceiling <= 0 {
+		return 0, false
+	}
+	used := float64(*limit.Ceiling-*limit.Remaining) / float64(*limit.Ceiling)
+	if used < tl.config.SpreadThreshold || !limit.NextWindow.After(now) {
+		return 0, false
+	}
+	return limit.NextWindow.Sub(now) / time.Duration(*limit.Remaining+1), true
+}
+
+// Records a call at the given time. Must be called with the lock held
+func (tl *twitterLimiter) reserve(route string, at time.Time) {
+	tl.scheduled[route] = at
+	if limit, ok := tl.limits[route]; ok && limit.Remaining != nil && *limit.Remaining > 0 {
+		// Count the call now, rather than waiting for the response headers, so concurrent calls don't overshoot
+		remaining := *limit.Remaining - 1
+		limit.Remaining = &remaining
+		tl.limits[route] = limit
+	}
+	for _, window := range tl.windows(route) {
+		window.record(at)
+	}
+}
+
+// Gives back a reservation for a call which never happened. Must be called with the lock held
+func (tl *twitterLimiter) release(route string, at time.Time) {
+	for _, window := range tl.windows(route) {
+		window.remove(at)
+	}
+}
+
+func (tl *twitterLimiter) windows(route string) []*callWindow {
+	windows := tl.routeWindows[route]
+	if tl.postingRoutes[route] {
+		windows = append(append([]*callWindow{}, windows...), tl.postingWindows...)
+	}
+	return windows
+}
+
+func (w *callWindow) nextAvailable(now time.Time) time.Time {
+	w.prune(now)
+	if len(w.calls) < w.budget.Limit {
+		return now
+	}
+	return w.calls[len(w.calls)-w.budget.Limit].Add(w.budget.Window)
+}
+
+func (w *callWindow) record(at time.Time) {
+	index := sort.Search(len(w.calls), func(i int) bool { return w.calls[i].After(at) })
+	w.calls = append(w.calls, time.Time{})
+	copy(w.calls[index+1:], w.calls[index:])
+	w.calls[index] = at
+}
+
+func (w *callWindow) remove(at time.Time) {
+	for i, call := range w.calls {
+		if call.Equal(at) {
+			w.calls = append(w.calls[:i], w.calls[i+1:]...)
+			return
+		}
+	}
+}
+
+func (w *callWindow) prune(now time.Time) {
+	expired := 0
+	for expired < len(w.calls) && !w.calls[expired].Add(w.budget.Window).After(now) {
+		expired++
+	}
+	w.calls = w.calls[expired:]
+}
+
+func later(a time.Time, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
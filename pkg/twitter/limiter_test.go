@@ -0,0 +1,330 @@
+package twitter
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeClock struct {
+	lock    sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+type fakeWaiter struct {
+	at      time.Time
+	channel chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	channel := make(chan time.Time, 1)
+	if d <= 0 {
+		channel <- c.now
+	} else {
+		c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), channel: channel})
+	}
+	return channel
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+	waiting := []fakeWaiter{}
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			waiting = append(waiting, waiter)
+		} else {
+			waiter.channel <- c.now
+		}
+	}
+	c.waiters = waiting
+}
+
+func (c *fakeClock) waitForWaiters(t *testing.T, count int) {
+	require.Eventually(t, func() bool {
+		c.lock.Lock()
+		defer c.lock.Unlock()
+		return len(c.waiters) == count
+	}, time.Second, time.Millisecond)
+}
+
+func TestTwitterLimiterGetSet(t *testing.T) {
+	ten := 10
+	zero := 0
+	future := time.Now().Add(time.Second * 30)
+	tests := []struct {
+		name         string
+		initialLimit *RateLimit
+		limit        *RateLimit
+		expected     RateLimit
+	}{
+		{
+			name:     "Does nothing if the response is nil",
+			expected: RateLimit{},
+		},
+		{
+			name:         "returns the initial rate limit if theres no response",
+			initialLimit: &RateLimit{Remaining: &ten, Ceiling: &ten},
+			expected:     RateLimit{Remaining: &ten, Ceiling: &ten},
+		},
+		{
+			name:     "Sets the limit to nils if the response doesnt contain anything",
+			limit:    &RateLimit{},
+			expected: RateLimit{},
+		},
+		{
+			name:     "Records the rate limit even when not limited",
+			limit:    &RateLimit{Remaining: &ten},
+			expected: RateLimit{Remaining: &ten},
+		},
+		{
+			name:         "Overwrites an expired rate limit with a still expired one",
+			initialLimit: &RateLimit{Remaining: &zero},
+			limit:        &RateLimit{Remaining: &ten, NextWindow: &future, Ceiling: &ten},
+			expected:     RateLimit{Remaining: &ten, NextWindow: &future, Ceiling: &ten},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newTwitterLimiter(LimiterConfig{})
+			if test.initialLimit != nil {
+				limiter.limits["my_route"] = *test.initialLimit
+			}
+
+			var response *http.Response
+			if test.limit != nil {
+				response = &http.Response{Header: http.Header{}}
+				if test.limit.Ceiling != nil {
+					response.Header.Set("x-rate-limit-limit", fmt.Sprintf("%d", *test.limit.Ceiling))
+				}
+				if test.limit.Remaining != nil {
+					response.Header.Set("x-rate-limit-remaining", fmt.Sprintf("%d", *test.limit.Remaining))
+				}
+				if test.limit.NextWindow != nil {
+					response.Header.Set("x-rate-limit-reset", fmt.Sprintf("%d", test.limit.NextWindow.Unix()))
+				}
+			}
+
+			limiter.setLimit("my_route", response)
+
+			newLimit := limiter.getLimit("my_route")
+			if test.expected.NextWindow == nil {
+				assert.Equal(t, test.expected, newLimit)
+			} else {
+				assert.NotNil(t, newLimit.NextWindow)
+				assert.Equal(t, test.expected.NextWindow.Unix(), newLimit.NextWindow.Unix())
+				expectedWithoutWindow := test.expected
+				expectedWithoutWindow.NextWindow = nil
+				actualWithoutWindow := newLimit
+				actualWithoutWindow.NextWindow = nil
+				assert.Equal(t, expectedWithoutWindow, actualWithoutWindow)
+			}
+		})
+	}
+}
+
+func TestTwitterLimiterWait(t *testing.T) {
+	ten := 10
+	zero := 0
+	tests := []struct {
+		name           string
+		initialLimit   *RateLimit
+		windowDuration time.Duration
+		expectedWait   time.Duration
+		cancel         bool
+	}{
+		{
+			name: "Returns immediately if there is no limit",
+		},
+		{
+			name:         "Returns immediately if the limit is currently valid",
+			initialLimit: &RateLimit{Remaining: &ten},
+		},
+		{
+			name:           "Returns immediately if the window has already reset",
+			initialLimit:   &RateLimit{Remaining: &zero},
+			windowDuration: -time.Second,
+		},
+		{
+			name:           "Waits for the next window until trying again",
+			initialLimit:   &RateLimit{Remaining: &zero},
+			windowDuration: time.Minute * 5,
+			expectedWait:   time.Minute * 5,
+		},
+		{
+			name:         "Waits for 30 seconds if no window is given",
+			initialLimit: &RateLimit{Remaining: &zero},
+			expectedWait: time.Second * 30,
+		},
+		{
+			name:           "Times out if the context cancels",
+			initialLimit:   &RateLimit{Remaining: &zero},
+			windowDuration: time.Minute * 5,
+			expectedWait:   time.Minute * 5,
+			cancel:         true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			clock := newFakeClock()
+			limiter := newTwitterLimiter(LimiterConfig{Clock: clock})
+			if test.initialLimit != nil {
+				if test.windowDuration != 0 {
+					nextWindow := clock.Now().Add(test.windowDuration)
+					test.initialLimit.NextWindow = &nextWindow
+				}
+				limiter.limits["my_route"] = *test.initialLimit
+			}
+			assert.Equal(t, test.expectedWait, limiter.getLimit("my_route").Delay)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			errChan := make(chan error, 1)
+			go func() {
+				errChan <- limiter.wait(ctx, "my_route")
+			}()
+
+			if test.expectedWait > 0 {
+				clock.waitForWaiters(t, 1)
+				select {
+				case <-errChan:
+					assert.Fail(t, "wait returned before the limit reset")
+				default:
+				}
+				if test.cancel {
+					cancel()
+				} else {
+					clock.Advance(test.expectedWait)
+				}
+			}
+
+			err := <-errChan
+			if test.cancel {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestTwitterLimiterBudgets(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newTwitterLimiter(LimiterConfig{
+		Clock:         clock,
+		Routes:        map[string][]Budget{"search": {{Limit: 1, Window: time.Minute}}},
+		Posting:       []Budget{{Limit: 2, Window: time.Hour}},
+		PostingRoutes: []string{"reply", "retweet"},
+	})
+	ctx := context.Background()
+
+	assert.NoError(t, limiter.wait(ctx, "reply"))
+	assert.NoError(t, limiter.wait(ctx, "retweet"))
+	// The posting budget is shared between routes, but doesn't affect the others
+	assert.Equal(t, time.Hour, limiter.getLimit("reply").Delay)
+	assert.Equal(t, time.Hour, limiter.getLimit("retweet").Delay)
+	assert.Equal(t, time.Duration(0), limiter.getLimit("search").Delay)
+
+	assert.NoError(t, limiter.wait(ctx, "search"))
+	assert.Equal(t, time.Minute, limiter.getLimit("search").Delay)
+
+	clock.Advance(time.Minute * 10)
+	assert.Equal(t, time.Duration(0), limiter.getLimit("search").Delay)
+	assert.Equal(t, time.Minute*50, limiter.getLimit("reply").Delay)
+
+	clock.Advance(time.Minute * 50)
+	assert.Equal(t, time.Duration(0), limiter.getLimit("reply").Delay)
+}
+
+func TestTwitterLimiterQueuesCallsOverBudget(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newTwitterLimiter(LimiterConfig{
+		Clock:         clock,
+		Posting:       []Budget{{Limit: 1, Window: time.Minute}},
+		PostingRoutes: []string{"reply"},
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.NoError(t, limiter.wait(ctx, "reply"))
+	second := make(chan error, 1)
+	go func() { second <- limiter.wait(ctx, "reply") }()
+	clock.waitForWaiters(t, 1)
+
+	// Each caller reserves its own slot, so the third call has to wait for the one after
+	assert.Equal(t, time.Minute*2, limiter.getLimit("reply").Delay)
+
+	clock.Advance(time.Minute)
+	assert.NoError(t, <-second)
+}
+
+func TestTwitterLimiterReleasesCancelledCalls(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newTwitterLimiter(LimiterConfig{
+		Clock:         clock,
+		Posting:       []Budget{{Limit: 1, Window: time.Minute}},
+		PostingRoutes: []string{"reply"},
+	})
+	assert.NoError(t, limiter.wait(context.Background(), "reply"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errChan := make(chan error, 1)
+	go func() { errChan <- limiter.wait(ctx, "reply") }()
+	clock.waitForWaiters(t, 1)
+	assert.Equal(t, time.Minute*2, limiter.getLimit("reply").Delay)
+	cancel()
+	assert.Error(t, <-errChan)
+	assert.Equal(t, time.Minute, limiter.getLimit("reply").Delay)
+}
+
+func TestTwitterLimiterSpreadsCalls(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newTwitterLimiter(LimiterConfig{Clock: clock, SpreadThreshold: 0.75})
+	ceiling := 100
+	remaining := 11
+	nextWindow := clock.Now().Add(time.Second * 110)
+	limiter.limits["my_route"] = RateLimit{Ceiling: &ceiling, Remaining: &remaining, NextWindow: &nextWindow}
+
+	// Nothing has been called yet, so there's nothing to spread out from
+	assert.Equal(t, time.Duration(0), limiter.getLimit("my_route").Delay)
+	assert.NoError(t, limiter.wait(context.Background(), "my_route"))
+
+	// 10 calls left in 110 seconds, so they should be 10 seconds apart
+	assert.Equal(t, time.Second*10, limiter.getLimit("my_route").Delay)
+	clock.Advance(time.Second * 10)
+	assert.Equal(t, time.Duration(0), limiter.getLimit("my_route").Delay)
+}
+
+func TestTwitterLimiterDoesNotSpreadBelowThreshold(t *testing.T) {
+	clock := newFakeClock()
+	limiter := newTwitterLimiter(LimiterConfig{Clock: clock, SpreadThreshold: 0.75})
+	ceiling := 100
+	remaining := 50
+	nextWindow := clock.Now().Add(time.Minute * 15)
+	limiter.limits["my_route"] = RateLimit{Ceiling: &ceiling, Remaining: &remaining, NextWindow: &nextWindow}
+
+	assert.NoError(t, limiter.wait(context.Background(), "my_route"))
+	limit := limiter.getLimit("my_route")
+	assert.Equal(t, time.Duration(0), limit.Delay)
+	assert.Equal(t, 49, *limit.Remaining)
+}
@@ -21,7 +21,10 @@ type MockTwitter struct {
 	GetTweetMock           func(tweetID string) (*twitter.Tweet, error)
 	GetTweetRawMock        func(tweetID string) (*http.Response, error)
 	TweetReplyMock         func(tweet *twitter.Tweet, message string) (*twitter.Tweet, error)
+	DeleteTweetMock        func(tweetID string) error
 	UserTimelineMock       func(screenName string, tweetID string) ([]*twitter.Tweet, error)
+	// Optional, defaults to not being rate limited
+	RateLimitMock func(route string) twitter.RateLimit
 }
 
 func (m *MockTwitter) GetWebhooks(ctx context.Context) ([]twitter.Webhook, structured_error.StructuredError) {
@@ -78,8 +81,21 @@ func (m *MockTwitter) TweetReply(ctx context.Context, tweet *twitter.Tweet, mess
 	return tweet, structured_error.Wrap(err, structured_error.TwitterError)
 }
 
+func (m *MockTwitter) DeleteTweet(ctx context.Context, tweetID string) structured_error.StructuredError {
+	assert.NotNil(m.T, m.DeleteTweetMock)
+	err := m.DeleteTweetMock(tweetID)
+	return structured_error.Wrap(err, structured_error.TwitterError)
+}
+
 func (m *MockTwitter) UserTimeline(ctx context.Context, screenName string, tweetID string) ([]*twitter.Tweet, structured_error.StructuredError) {
 	assert.NotNil(m.T, m.UserTimelineMock)
 	tweets, err := m.UserTimelineMock(screenName, tweetID)
 	return tweets, structured_error.Wrap(err, structured_error.TwitterError)
 }
+
+func (m *MockTwitter) RateLimit(route string) twitter.RateLimit {
+	if m.RateLimitMock == nil {
+		return twitter.RateLimit{}
+	}
+	return m.RateLimitMock(route)
+}
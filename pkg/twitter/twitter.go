@@ -9,9 +9,9 @@ import (
 	"net/url"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/mrjones/oauth"
 	"github.com/sirupsen/logrus"
@@ -20,13 +20,16 @@ import (
 type twitter struct {
 	client  *http.Client
 	bearer  string
-	limiter twitterLimiter
+	limiter *twitterLimiter
+	retry   retry.Policy
 }
 
 type RateLimit struct {
 	Ceiling    *int
 	Remaining  *int
 	NextWindow *time.Time
+	// How long a call made now would wait, taking every budget for the route into account
+	Delay time.Duration
 }
 
 func (r RateLimit) String() string {
@@ -42,50 +45,7 @@ func (r RateLimit) String() string {
 	if r.NextWindow != nil {
 		nextWindow = r.NextWindow.String()
 	}
-	return fmt.Sprintf("ceiling: %s, remaining %s, nextWindow %v", ceiling, remaining, nextWindow)
-}
-
-type twitterLimiter struct {
-	lock   sync.RWMutex
-	limits map[string]RateLimit
-}
-
-func (tl *twitterLimiter) getLimit(route string) RateLimit {
-	tl.lock.RLock()
-	defer tl.lock.RUnlock()
-	return tl.limits[route]
-}
-
-func (tl *twitterLimiter) setLimit(route string, response *http.Response) {
-	if response != nil {
-		limit := getRateLimit(response)
-		logrus.Debug(fmt.Sprintf("route %s received RateLimit %v", route, limit))
-		existing := tl.getLimit(route)
-		if existing.Remaining != nil && *existing.Remaining == 0 {
-			tl.lock.Lock()
-			defer tl.lock.Unlock()
-			tl.limits[route] = limit
-		}
-	}
-}
-
-func (tl *twitterLimiter) wait(ctx context.Context, route string) error {
-	limit := tl.getLimit(route)
-	var duration time.Duration = 0
-	if limit.Remaining != nil && *limit.Remaining == 0 {
-		if limit.NextWindow == nil {
-			// If twitter doesn't tell us when to try again, we'll give them 30 seconds
-			duration = time.Second * 30
-		} else {
-			duration = time.Until(*limit.NextWindow)
-		}
-	}
-	select {
-	case <-time.After(duration):
-		return nil
-	case <-ctx.Done():
-		return fmt.Errorf("timeout %v on route %s", route, limit)
-	}
+	return fmt.Sprintf("ceiling: %s, remaining %s, nextWindow %v, delay %v", ceiling, remaining, nextWindow, r.Delay)
 }
 
 type Twitter interface {
@@ -98,7 +58,9 @@ type Twitter interface {
 	GetTweetRaw(ctx context.Context, tweetID string) (*http.Response, structured_error.StructuredError)
 	GetTweet(ctx context.Context, tweetID string) (*Tweet, structured_error.StructuredError)
 	TweetReply(ctx context.Context, parentTweet *Tweet, message string) (*Tweet, structured_error.StructuredError)
+	DeleteTweet(ctx context.Context, tweetID string) structured_error.StructuredError
 	UserTimeline(ctx context.Context, screenName string, tweetID string) ([]*Tweet, structured_error.StructuredError)
+	RateLimit(route string) RateLimit
 }
 
 type Webhook struct {
@@ -126,7 +88,12 @@ func NewTwitter(consumerKey string, consumerSecret string, accessToken string, a
 	c := oauth.NewConsumer(consumerKey, consumerSecret, oauth.ServiceProvider{})
 	token := oauth.AccessToken{Token: accessToken, Secret: accessTokenSecret}
 	client, _ := c.MakeHttpClient(&token)
-	return &twitter{client: client, bearer: bearerToken}
+	return &twitter{client: client, bearer: bearerToken, limiter: newTwitterLimiter(DefaultLimiterConfig), retry: retry.DefaultPolicy}
+}
+
+// Returns the current rate limit state of route, so callers can decide whether it's worth waiting
+func (t *twitter) RateLimit(route string) RateLimit {
+	return t.limiter.getLimit(route)
 }
 
 func (t *twitter) GetWebhooks(ctx context.Context) ([]Webhook, structured_error.StructuredError) {
@@ -140,25 +107,17 @@ func (t *twitter) GetWebhooks(ctx context.Context) ([]Webhook, structured_error.
 }
 
 func (t *twitter) DeleteWebhook(ctx context.Context, webhookID string) structured_error.StructuredError {
-	err := t.limiter.wait(ctx, "delete_webhook")
 	url := fmt.Sprintf("%saccount_activity/all/dev/webhooks/%s.json", URL, webhookID)
 	logrus.Debug(fmt.Sprintf("DeleteWebhook calling %s", url))
+	response, err := t.do(ctx, "delete_webhook", t.client, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	})
 	if err == nil {
-		var request *http.Request
-		var response *http.Response
-		request, err = http.NewRequestWithContext(ctx, "DELETE", url, nil)
+		var body []byte
+		body, err = ioutil.ReadAll(response.Body)
+		logrus.Debug(fmt.Sprintf("Twitter response:\n%v\n", string(body)))
 		if err == nil {
-			response, err = t.client.Do(request)
-			t.limiter.setLimit("delete_webhook", response)
-
-			if err == nil {
-				var body []byte
-				body, err = ioutil.ReadAll(response.Body)
-				logrus.Debug(fmt.Sprintf("Twitter response:\n%v\n", string(body)))
-				if err == nil {
-					err = validateResponse(response.StatusCode, body)
-				}
-			}
+			err = validateResponse(response.StatusCode, body)
 		}
 	}
 	return structured_error.Wrap(err, structured_error.TwitterError)
@@ -178,48 +137,38 @@ func (t *twitter) GetSubscriptions(ctx context.Context) ([]Subscription, structu
 		Subscriptions []Subscription `json:"subscriptions"`
 	}
 	var subscriptions []Subscription
-	err := t.limiter.wait(ctx, "get_subscriptions")
-	if err == nil {
-		var request *http.Request
-		request, err = http.NewRequestWithContext(ctx, "GET", URL+"account_activity/all/dev/subscriptions/list.json", nil)
+	response, err := t.do(ctx, "get_subscriptions", &http.Client{}, func() (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "GET", URL+"account_activity/all/dev/subscriptions/list.json", nil)
 		if err == nil {
 			request.Header.Set("Authorization", "Bearer "+t.bearer)
-			client := http.Client{}
-			var response *http.Response
-			response, err = client.Do(request)
-			t.limiter.setLimit("get_subscriptions", response)
-			if err == nil {
-				api := apiResponse{}
-				err = GetJSON(response, &api)
-				if err == nil {
-					subscriptions = api.Subscriptions
-				}
-			}
+		}
+		return request, err
+	})
+	if err == nil {
+		api := apiResponse{}
+		err = GetJSON(response, &api)
+		if err == nil {
+			subscriptions = api.Subscriptions
 		}
 	}
 	return subscriptions, structured_error.Wrap(err, structured_error.TwitterError)
 }
 
 func (t *twitter) DeleteSubscription(ctx context.Context, subscriptionID string) structured_error.StructuredError {
-	err := t.limiter.wait(ctx, "delete_subscription")
-	if err == nil {
-		url := fmt.Sprintf("%saccount_activity/all/dev/subscriptions/%s.json", URL, subscriptionID)
-		var request *http.Request
-		request, err = http.NewRequestWithContext(ctx, "DELETE", url, nil)
+	url := fmt.Sprintf("%saccount_activity/all/dev/subscriptions/%s.json", URL, subscriptionID)
+	response, err := t.do(ctx, "delete_subscription", &http.Client{}, func() (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
 		if err == nil {
 			request.Header.Set("Authorization", "Bearer "+t.bearer)
-			client := http.Client{}
-			var response *http.Response
-			response, err = client.Do(request)
-			t.limiter.setLimit("delete_subscription", response)
-			if err == nil {
-				var body []byte
-				body, err = ioutil.ReadAll(response.Body)
-				logrus.Debug(fmt.Sprintf("Twitter response:\n%v\n", string(body)))
-				if err == nil {
-					err = validateResponse(response.StatusCode, body)
-				}
-			}
+		}
+		return request, err
+	})
+	if err == nil {
+		var body []byte
+		body, err = ioutil.ReadAll(response.Body)
+		logrus.Debug(fmt.Sprintf("Twitter response:\n%v\n", string(body)))
+		if err == nil {
+			err = validateResponse(response.StatusCode, body)
 		}
 	}
 	return structured_error.Wrap(err, structured_error.TwitterError)
@@ -248,23 +197,15 @@ func (t *twitter) GetTweet(ctx context.Context, tweetID string) (*Tweet, structu
 }
 
 func (t *twitter) GetTweetRaw(ctx context.Context, tweetID string) (*http.Response, structured_error.StructuredError) {
-	var response *http.Response
-	err := t.limiter.wait(ctx, "get_tweet")
-	if err == nil {
-		var req *http.Request
-		req, err = http.NewRequestWithContext(ctx, "GET", URL+"statuses/show.json", nil)
-		if err == nil {
-			query := req.URL.Query()
-			query.Add("id", tweetID)
-			query.Add("include_entities", "true")
-			query.Add("include_ext_alt_text", "true")
-			query.Add("tweet_mode", "extended")
-			req.URL.RawQuery = query.Encode()
-			logrus.Debug(fmt.Sprintf("Request URL %s\n", req.URL.String()))
-			response, err = t.client.Do(req)
-			t.limiter.setLimit("get_tweet", response)
-		}
+	query := url.Values{
+		"id":                   []string{tweetID},
+		"include_entities":     []string{"true"},
+		"include_ext_alt_text": []string{"true"},
+		"tweet_mode":           []string{"extended"},
 	}
+	requestUrl := URL + "statuses/show.json?" + query.Encode()
+	logrus.Debug(fmt.Sprintf("Request URL %s\n", requestUrl))
+	response, err := t.get(ctx, GetTweetRoute, requestUrl)
 	return response, structured_error.Wrap(err, structured_error.TwitterError)
 }
 
@@ -289,13 +230,22 @@ func (t *twitter) TweetReply(ctx context.Context, parentTweet *Tweet, message st
 		"tweet_mode":                   []string{"extended"},
 	}
 	logrus.Debug(fmt.Sprintf("%s: Sending tweet %s", parentTweet.Id, message))
-	response, err := t.post(ctx, "tweet_reply", URL+"statuses/update.json", values)
+	response, err := t.post(ctx, TweetReplyRoute, URL+"statuses/update.json", values)
 	if err == nil {
 		err = GetJSON(response, &tweet)
 	}
 	return &tweet, structured_error.Wrap(err, structured_error.TwitterError)
 }
 
+func (t *twitter) DeleteTweet(ctx context.Context, tweetID string) structured_error.StructuredError {
+	logrus.Debug(fmt.Sprintf("Deleting tweet %s", tweetID))
+	response, err := t.post(ctx, DeleteTweetRoute, fmt.Sprintf("%sstatuses/destroy/%s.json", URL, tweetID), url.Values{})
+	if err == nil {
+		err = GetJSON(response, &Tweet{})
+	}
+	return structured_error.Wrap(err, structured_error.TwitterError)
+}
+
 func (t *twitter) UserTimeline(ctx context.Context, screenName string, tweetID string) ([]*Tweet, structured_error.StructuredError) {
 	var tweets []*Tweet
 	values := url.Values{
@@ -305,7 +255,7 @@ func (t *twitter) UserTimeline(ctx context.Context, screenName string, tweetID s
 		"include_rts":     []string{"true"},
 		"tweet_mode":      []string{"extended"},
 	}
-	response, err := t.get(ctx, "user_timeline", URL+"statuses/user_timeline.json?"+values.Encode())
+	response, err := t.get(ctx, UserTimelineRoute, URL+"statuses/user_timeline.json?"+values.Encode())
 	if err == nil {
 		err = GetJSON(response, &tweets)
 	}
@@ -313,34 +263,80 @@ func (t *twitter) UserTimeline(ctx context.Context, screenName string, tweetID s
 }
 
 func (t *twitter) get(ctx context.Context, endpoint string, url string) (*http.Response, error) {
-	var request *http.Request
-	var response *http.Response
-	err := t.limiter.wait(ctx, endpoint)
-	if err == nil {
-		request, err = http.NewRequestWithContext(ctx, "GET", url, nil)
+	return t.do(ctx, endpoint, t.client, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, "GET", url, nil)
+	})
+}
+
+func (t *twitter) post(ctx context.Context, endpoint string, url string, data url.Values) (*http.Response, error) {
+	return t.do(ctx, endpoint, t.client, func() (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data.Encode()))
 		if err == nil {
-			response, err = t.client.Do(request)
-			t.limiter.setLimit(endpoint, response)
+			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 		}
-	}
-	return response, err
+		return request, err
+	})
 }
 
-func (t *twitter) post(ctx context.Context, endpoint string, url string, data url.Values) (*http.Response, error) {
-	var request *http.Request
+// Sends the request from newRequest, retrying transient failures according to t.retry.
+// newRequest is called for every attempt since a request body can only be read once
+func (t *twitter) do(ctx context.Context, endpoint string, client *http.Client, newRequest func() (*http.Request, error)) (*http.Response, error) {
 	var response *http.Response
-	err := t.limiter.wait(ctx, endpoint)
-	if err == nil {
-		request, err = http.NewRequestWithContext(ctx, "POST", url, strings.NewReader(data.Encode()))
+	err := retry.Do(ctx, t.retry, func() error {
+		response = nil
+		err := t.limiter.wait(ctx, endpoint)
 		if err == nil {
-			request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-			response, err = t.client.Do(request)
-			t.limiter.setLimit(endpoint, response)
+			var request *http.Request
+			request, err = newRequest()
+			if err == nil {
+				response, err = client.Do(request)
+				t.limiter.setLimit(endpoint, response)
+				err = t.classifyFailure(ctx, endpoint, request, response, err)
+			}
 		}
-	}
+		return err
+	})
 	return response, err
 }
 
+// Marks failures which are likely to succeed if we try again as retryable.
+// A POST which failed in flight, or with a 5xx, may have gone through anyways, so those are only retried
+// when twitter rate limited the request and so never processed it, to avoid posting the same tweet twice
+func (t *twitter) classifyFailure(ctx context.Context, endpoint string, request *http.Request, response *http.Response, err error) error {
+	idempotent := request.Method != http.MethodPost
+	if err != nil {
+		if idempotent && ctx.Err() == nil {
+			return structured_error.WrapRetryable(err, structured_error.TwitterError, 0)
+		}
+		return err
+	}
+
+	statusCode := response.StatusCode
+	if !retry.IsTransientStatus(statusCode) ||
+		(!idempotent && statusCode != http.StatusTooManyRequests) {
+		return nil
+	}
+	body, readErr := ioutil.ReadAll(response.Body)
+	response.Body.Close()
+	logrus.Debug(fmt.Sprintf("Twitter response:\n%v\n", string(body)))
+	if readErr != nil {
+		body = []byte{}
+	}
+	var twitterErr error = validateResponse(statusCode, body)
+	if twitterErr == nil {
+		twitterErr = fmt.Errorf("Twitter error (%d): %s", statusCode, string(body))
+	}
+
+	retryAfter := retry.RetryAfter(response)
+	if statusCode == http.StatusTooManyRequests {
+		// The next attempt will have to wait for the limiter, so take that into account when deciding whether to retry
+		if delay := t.limiter.getLimit(endpoint).Delay; delay > retryAfter {
+			retryAfter = delay
+		}
+	}
+	return structured_error.WrapRetryable(twitterErr, structured_error.TwitterError, retryAfter)
+}
+
 func validateResponse(statusCode int, body []byte) structured_error.StructuredError {
 	var err structured_error.StructuredError = nil
 	if statusCode < 200 || statusCode >= 300 {
@@ -350,7 +346,7 @@ func validateResponse(statusCode int, body []byte) structured_error.StructuredEr
 			errorType := structured_error.TwitterError
 			for _, twitterError := range errResponse.Errors {
 				switch twitterError.Code {
-				case 88:
+				case 88, 185:
 					errorType = structured_error.RateLimited
 				case 186:
 					errorType = structured_error.TweetTooLong
@@ -358,6 +354,8 @@ func validateResponse(statusCode int, body []byte) structured_error.StructuredEr
 					errorType = structured_error.DuplicateTweet
 				case 136:
 					errorType = structured_error.UserBlockedBot
+				case 144:
+					errorType = structured_error.TweetNotFound
 				case 385:
 					errorType = structured_error.CaseOfTheMissingTweet
 				}
@@ -3,194 +3,17 @@ package twitter
 import (
 	"context"
 	"errors"
-	"fmt"
 	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"testing"
 	"time"
 
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/stretchr/testify/assert"
 )
 
-func TestTwitterLimiterGetSet(t *testing.T) {
-	ten := 10
-	zero := 0
-	future := time.Now().Add(time.Second * 30)
-	tests := []struct {
-		name         string
-		initialLimit *RateLimit
-		limit        *RateLimit
-		expected     RateLimit
-	}{
-		{
-			name:     "Does nothing if the response is nil",
-			expected: RateLimit{},
-		},
-		{
-			name:         "returns the initial rate limit if theres no response",
-			initialLimit: &RateLimit{Remaining: &ten, Ceiling: &ten},
-			expected:     RateLimit{Remaining: &ten, Ceiling: &ten},
-		},
-		{
-			name:     "Sets the limit to nils if the response doesnt contain anything",
-			limit:    &RateLimit{},
-			expected: RateLimit{},
-		},
-		{
-			name:     "Ignores setting a new rate limit when not already limited",
-			limit:    &RateLimit{Remaining: &ten},
-			expected: RateLimit{},
-		},
-		{
-			name:         "Overwrites an expired rate limit with a still expired one",
-			initialLimit: &RateLimit{Remaining: &zero},
-			limit:        &RateLimit{Remaining: &ten, NextWindow: &future, Ceiling: &ten},
-			expected:     RateLimit{Remaining: &ten, NextWindow: &future, Ceiling: &ten},
-		},
-	}
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			limiter := twitterLimiter{}
-			if test.initialLimit != nil {
-				limiter.limits = map[string]RateLimit{"my_route": *test.initialLimit}
-			}
-
-			var response *http.Response
-			if test.limit != nil {
-				response = &http.Response{Header: http.Header{}}
-				if test.limit.Ceiling != nil {
-					response.Header.Set("x-rate-limit-limit", fmt.Sprintf("%d", *test.limit.Ceiling))
-				}
-				if test.limit.Remaining != nil {
-					response.Header.Set("x-rate-limit-remaining", fmt.Sprintf("%d", *test.limit.Remaining))
-				}
-				if test.limit.NextWindow != nil {
-					response.Header.Set("x-rate-limit-reset", fmt.Sprintf("%d", test.limit.NextWindow.Unix()))
-				}
-			}
-
-			limiter.setLimit("my_route", response)
-
-			newLimit := limiter.getLimit("my_route")
-			if test.expected.NextWindow == nil {
-				assert.Equal(t, test.expected, newLimit)
-			} else {
-				assert.NotNil(t, newLimit.NextWindow)
-				assert.Equal(t, test.expected.NextWindow.Unix(), newLimit.NextWindow.Unix())
-				expectedWithoutWindow := test.expected
-				expectedWithoutWindow.NextWindow = nil
-				actualWithoutWindow := newLimit
-				actualWithoutWindow.NextWindow = nil
-				assert.Equal(t, expectedWithoutWindow, actualWithoutWindow)
-			}
-		})
-	}
-}
-
-func TestTwitterLimiterWait(t *testing.T) {
-	stillWaitingErr := errors.New("still waiting yo")
-	ctxTimeoutErr := errors.New("The context gave up")
-	ten := 10
-	zero := 0
-	tests := []struct {
-		name           string
-		contextTimeout time.Duration
-		initialLimit   *RateLimit
-		windowDuration time.Duration
-		expectedErr    error
-		expectedWait   time.Duration
-	}{
-		{
-			name:         "Returns immediately if there is no limit",
-			expectedErr:  nil,
-			expectedWait: 0,
-		},
-		{
-			name:         "Returns immediately if the limit is currently valid",
-			initialLimit: &RateLimit{Remaining: &ten},
-			expectedErr:  nil,
-			expectedWait: 0,
-		},
-		{
-			name:           "Waits for the next window until trying again",
-			initialLimit:   &RateLimit{Remaining: &zero},
-			windowDuration: time.Millisecond * 50,
-			expectedErr:    nil,
-			expectedWait:   time.Millisecond * 60,
-		},
-		{
-			name:         "Waits for 30 seconds if no window is given",
-			initialLimit: &RateLimit{Remaining: &zero},
-			expectedErr:  stillWaitingErr,
-			expectedWait: time.Millisecond * 60, // Not actually going to wait the 30 seconds
-		},
-		{
-			name:           "Times out if the context cancels",
-			initialLimit:   &RateLimit{Remaining: &zero},
-			windowDuration: time.Millisecond * 50,
-			contextTimeout: time.Millisecond * 1,
-			expectedErr:    ctxTimeoutErr,
-		},
-	}
-	for _, test := range tests {
-		t.Run(test.name, func(t *testing.T) {
-			limiter := twitterLimiter{}
-			if test.initialLimit != nil {
-				if test.windowDuration != 0 {
-					future := time.Now().Add(test.windowDuration)
-					test.initialLimit.NextWindow = &future
-				}
-				limiter.limits = map[string]RateLimit{"my_route": *test.initialLimit}
-			}
-
-			ctx := context.Background()
-			var onComplete context.CancelFunc
-			if test.contextTimeout != 0 {
-				ctx, onComplete = context.WithTimeout(context.Background(), test.contextTimeout)
-			}
-			errChan := make(chan error, 1)
-			go func() {
-				errChan <- limiter.wait(ctx, "my_route")
-				if onComplete != nil {
-					onComplete()
-				}
-				close(errChan)
-			}()
-
-			upperLimit := test.expectedWait * 2
-			if upperLimit == 0 {
-				upperLimit = time.Millisecond * 5
-			}
-			var lowerLimit time.Duration = 0
-			if test.expectedWait > 0 {
-				lowerLimit = test.expectedWait / 2
-			}
-
-			begin := time.Now()
-			var err error
-			select {
-			case err = <-errChan:
-			case <-time.After(upperLimit):
-				err = stillWaitingErr
-			}
-			end := time.Now()
-			duration := end.Sub(begin)
-			assert.GreaterOrEqual(t, duration, lowerLimit)
-
-			switch test.expectedErr {
-			case nil:
-				assert.Nil(t, err)
-			case ctxTimeoutErr:
-				assert.Error(t, err)
-			case stillWaitingErr:
-				assert.Equal(t, stillWaitingErr, err)
-			default:
-				assert.Fail(t, "unexpected error")
-			}
-		})
-	}
-}
-
 func TestValidateResponse(t *testing.T) {
 	anError := errors.New("oops")
 	tests := []struct {
@@ -216,6 +39,18 @@ func TestValidateResponse(t *testing.T) {
 			statusCode: 429,
 			expected:   structured_error.Wrap(anError, structured_error.RateLimited),
 		},
+		{
+			name:       "Parses the daily posting limit as a rate limit error",
+			json:       "{\"errors\":[{\"code\":185,\"message\":\"User is over daily status update limit.\"}]}",
+			statusCode: 403,
+			expected:   structured_error.Wrap(anError, structured_error.RateLimited),
+		},
+		{
+			name:       "Parses a missing tweet error",
+			json:       "{\"errors\":[{\"code\":144,\"message\":\"No status found with that ID.\"}]}",
+			statusCode: 404,
+			expected:   structured_error.Wrap(anError, structured_error.TweetNotFound),
+		},
 		{
 			name:       "Returns a generic Twitter error if unknow",
 			json:       "{\"errors\":[{\"code\":999,\"message\":\"staaaahp\"}]}",
@@ -241,3 +76,97 @@ func TestValidateResponse(t *testing.T) {
 		})
 	}
 }
+
+func TestRetriesTransientFailures(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		statuses      []int
+		expectedCalls int
+		expectedErr   bool
+		retryable     bool
+	}{
+		{
+			name:          "Retries a GET after a 503",
+			method:        http.MethodGet,
+			statuses:      []int{503, 200},
+			expectedCalls: 2,
+		},
+		{
+			name:          "Retries a GET after a 500",
+			method:        http.MethodGet,
+			statuses:      []int{500, 502, 200},
+			expectedCalls: 3,
+		},
+		{
+			name:          "Does not retry a 404",
+			method:        http.MethodGet,
+			statuses:      []int{404, 200},
+			expectedCalls: 1,
+		},
+		{
+			name:          "Gives up after running out of attempts",
+			method:        http.MethodGet,
+			statuses:      []int{503, 503, 503, 200},
+			expectedCalls: 3,
+			expectedErr:   true,
+			retryable:     true,
+		},
+		{
+			name:          "Retries a POST after a 429 since twitter didn't process it",
+			method:        http.MethodPost,
+			statuses:      []int{429, 200},
+			expectedCalls: 2,
+		},
+		{
+			name:          "Does not retry a POST after a 503 since it may have been posted",
+			method:        http.MethodPost,
+			statuses:      []int{503, 200},
+			expectedCalls: 1,
+		},
+		{
+			name:          "Does not retry a POST after a 500 since it may have been posted",
+			method:        http.MethodPost,
+			statuses:      []int{500, 200},
+			expectedCalls: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			calls := 0
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				assert.Equal(t, test.method, r.Method)
+				status := test.statuses[calls]
+				calls++
+				if status == 503 || status == 429 {
+					w.Header().Set("Retry-After", "0")
+				}
+				w.WriteHeader(status)
+				w.Write([]byte("{}"))
+			}))
+			defer server.Close()
+
+			client := &twitter{
+				client:  server.Client(),
+				limiter: newTwitterLimiter(LimiterConfig{}),
+				retry:   retry.Policy{MaxAttempts: 3, InitialBackoff: time.Millisecond},
+			}
+			var response *http.Response
+			var err error
+			if test.method == http.MethodGet {
+				response, err = client.get(context.Background(), "my_route", server.URL)
+			} else {
+				response, err = client.post(context.Background(), "my_route", server.URL, url.Values{"status": []string{"hi"}})
+			}
+
+			assert.Equal(t, test.expectedCalls, calls)
+			if test.expectedErr {
+				assert.Error(t, err)
+				assert.Equal(t, test.retryable, structured_error.IsRetryable(err))
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, test.statuses[calls-1], response.StatusCode)
+			}
+		})
+	}
+}
@@ -0,0 +1,324 @@
+// Package twitter_text measures tweets using the v3 weighted length rules from twitter-text.
+// Most latin characters count as 1, everything else (CJK, emoji sequences) counts as 2, and urls count as 23
+package twitter_text
+
+import (
+	"bytes"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/AnilRedshift/twitter-text-go/extract"
+	"golang.org/x/text/unicode/norm"
+)
+
+const MaxWeightedLength = 280
+
+const (
+	scale                = 100
+	defaultWeight        = 200
+	transformedURLLength = 23
+	// The longest top level domain the extract package knows, vermögensberatung, in runes
+	maxTLDLength = 17
+)
+
+type weightRange struct {
+	start  rune
+	end    rune
+	weight int
+}
+
+var weightRanges = []weightRange{
+	{start: 0, end: 4351, weight: 100},
+	{start: 8192, end: 8205, weight: 100},
+	{start: 8208, end: 8223, weight: 100},
+	{start: 8242, end: 8247, weight: 100},
+}
+
+// Counter tracks the weighted length of a tweet as it is built up one rune at a time.
+// Only the current whitespace-delimited token is ever re-examined, since urls, emoji sequences
+// and NFC compositions can't span whitespace. Within a token, everything up to the last point
+// which can't be affected by later runes is counted once and remembered
+type Counter struct {
+	// The scaled weight of everything before the current token
+	committed int
+	token     []byte
+	// token[:stable] can no longer change weight, (ignoring urls)
+	stable       int
+	stableWeight int
+	// token[:stable] in NFC, so urls can be looked for without normalizing the whole token again
+	normalized []byte
+	mayBeURL   bool
+	// The urls in normalized[:urlStable] have been counted, and it's assumed nothing added later changes them
+	urlStable       int
+	urlStableWeight int
+	// normalized[:urlChecked] has been searched for places where the urls are settled
+	urlChecked int
+	// normalized[:urlChecked] ends in the domain of a url with a protocol, which can contain any letter
+	inProtocolDomain bool
+	// How many runes have been checked since the last dot after a latin character.
+	// Urls without a protocol have latin domains, but their top level domain can be in any script
+	sinceDot int
+	// A url anywhere in the rest of the domain which normalized[:urlChecked] ends in may be skipped
+	mayBeSkipped bool
+	// The rune before that domain, and the last rune in normalized[:urlChecked]. 0 at the start of the token
+	beforeDomain rune
+	lastChecked  rune
+}
+
+func NewCounter() *Counter {
+	return &Counter{sinceDot: maxTLDLength}
+}
+
+// Returns the weighted length of text, the way twitter would count it
+func WeightedLength(text string) int {
+	counter := NewCounter()
+	counter.AddString(text)
+	return counter.WeightedLength()
+}
+
+func (c *Counter) Add(r rune) {
+	if unicode.IsSpace(r) {
+		c.committed += c.tokenWeight() + runeWeight(r)
+		c.token = c.token[:0]
+		c.stable = 0
+		c.stableWeight = 0
+		c.normalized = c.normalized[:0]
+		c.mayBeURL = false
+		c.urlStable = 0
+		c.urlStableWeight = 0
+		c.urlChecked = 0
+		c.inProtocolDomain = false
+		c.sinceDot = maxTLDLength
+		c.mayBeSkipped = false
+		c.beforeDomain = 0
+		c.lastChecked = 0
+		return
+	}
+
+	var encoded [utf8.UTFMax]byte
+	size := utf8.EncodeRune(encoded[:], r)
+	c.token = append(c.token, encoded[:size]...)
+	if r == '.' {
+		// Every url twitter recognizes has a dot somewhere in the domain
+		c.mayBeURL = true
+	}
+}
+
+func (c *Counter) AddString(text string) {
+	for _, r := range text {
+		c.Add(r)
+	}
+}
+
+// The weighted length of everything added so far
+func (c *Counter) WeightedLength() int {
+	return (c.committed + c.tokenWeight()) / scale
+}
+
+func (c *Counter) tokenWeight() int {
+	if boundary := c.stable + lastSafeBoundary(c.token[c.stable:]); boundary > c.stable {
+		// Nothing after a safe boundary changes how the text before it is normalized,
+		// so the stable part only ever needs normalizing once
+		normalized := norm.NFC.Bytes(c.token[c.stable:boundary])
+		c.normalized = append(c.normalized, normalized...)
+		c.stableWeight += normalizedWeight(normalized)
+		c.stable = boundary
+	}
+	if c.mayBeURL {
+		// Only the text since the urls were last settled needs searching again,
+		// otherwise a long token would be searched all over again for every rune
+		c.settleURLs()
+		unsettled := c.normalized[c.urlStable:]
+		normalized := make([]byte, 0, len(unsettled)+len(c.token)-c.stable)
+		normalized = append(normalized, unsettled...)
+		normalized = append(normalized, norm.NFC.Bytes(c.token[c.stable:])...)
+		return c.urlStableWeight + urlAwareWeight(normalized)
+	}
+	return c.stableWeight + plainWeight(c.token[c.stable:])
+}
+
+// Counts the urls up to the last rune which nothing added later can pull into a url, keeping that rune
+// so it's still there as the preceding character of the next one. Without a protocol, urls are latin
+// other than their top level domain, so in CJK text this is usually the last character.
+// The extract package's rules are intricate, so this only follows them as far as everyday text needs.
+// It can still disagree with counting the token at once in contrived cases like "狗.中国/:t.co"
+func (c *Counter) settleURLs() {
+	for c.urlChecked < len(c.normalized) {
+		index := c.urlChecked
+		r, size := utf8.DecodeRune(c.normalized[index:])
+		c.urlChecked += size
+		previous := c.lastChecked
+		c.checkSkipped(previous, r)
+		c.lastChecked = r
+		c.sinceDot++
+		if r == '.' && mayBeInURL(previous) {
+			c.sinceDot = 0
+		}
+		if r == '/' && bytes.HasSuffix(c.normalized[:index], []byte(":/")) {
+			c.inProtocolDomain = true
+			continue
+		}
+		if c.inProtocolDomain && !endsDomain(r) {
+			continue
+		}
+		c.inProtocolDomain = false
+		// Searching from r lets a url start right after it, so only do that if one could in the full text
+		if !mayBeInURL(r) && c.sinceDot > maxTLDLength && !c.mayBeSkipped && mayPrecedeURL(previous) && index > c.urlStable {
+			c.urlStableWeight += urlAwareWeight(c.normalized[c.urlStable:index])
+			c.urlStable = index
+		}
+	}
+}
+
+// The extract package skips urls without a protocol which follow a -, _, . or /, and they're
+// matched against the longest domain it can find, so a url can be skipped because of a character
+// long before it, e.g. "/猫abc.com"
+func (c *Counter) checkSkipped(previous rune, r rune) {
+	switch {
+	case endsDomain(r):
+		c.mayBeSkipped = r == '/'
+		c.beforeDomain = r
+	case r == '-', r == '_':
+		c.mayBeSkipped = true
+	case r == '.':
+		// A dot after a letter just separates the labels of the domain, unless that letter could be
+		// the end of an earlier url, or no url can start with the domain
+		if endsDomain(previous) || mayBeInURL(previous) || !mayPrecedeURL(c.beforeDomain) {
+			c.mayBeSkipped = true
+		}
+	}
+}
+
+// Urls can't come straight after letters, numbers, or the symbols for mentions, hashtags and cashtags
+func mayPrecedeURL(r rune) bool {
+	// The extract package matches case insensitively, so ſ counts as an s
+	for folded := unicode.SimpleFold(r); ; folded = unicode.SimpleFold(folded) {
+		if folded < utf8.RuneSelf && (unicode.IsLetter(folded) || unicode.IsDigit(folded)) {
+			return false
+		}
+		if folded == r {
+			break
+		}
+	}
+	return !strings.ContainsRune("@＠$#＃\u202A\u202B\u202C\u202D\u202E", r)
+}
+
+// Domains can contain anything other than punctuation and spaces
+func endsDomain(r rune) bool {
+	if r < utf8.RuneSelf {
+		return (unicode.IsPunct(r) || unicode.IsSymbol(r) || unicode.IsControl(r)) && r != '.' && r != '-' && r != '_'
+	}
+	return isDirectionalMarker(r)
+}
+
+// Whether r could be in a url without a protocol, or in the path or query of any url
+func mayBeInURL(r rune) bool {
+	switch {
+	case isDirectionalMarker(r):
+		return false
+	case r < utf8.RuneSelf:
+		return !unicode.IsControl(r) && !strings.ContainsRune("\"<>\\^`{}", r)
+	}
+	// The extract package allows latin accents and diacritics, and matches case insensitively,
+	// so be generous rather than list exactly which ones
+	return unicode.In(r, unicode.Latin, unicode.Mn) || r == '\u02BB'
+}
+
+// Expects text to already be in NFC
+func urlAwareWeight(normalized []byte) int {
+	weight := 0
+	last := 0
+	for _, url := range extractUrls(string(normalized)) {
+		if url.Start < last {
+			// The extract package can return the same url twice, e.g. for "猫がexample.co"
+			continue
+		}
+		weight += normalizedWeight(normalized[last:url.Start])
+		weight += transformedURLLength * scale
+		last = url.Stop
+	}
+	return weight + normalizedWeight(normalized[last:])
+}
+
+// Twitter allows urls to be surrounded by directional formatting characters,
+// but the extract package doesn't, so look for urls in between them
+func extractUrls(text string) []extract.Range {
+	ranges := []extract.Range{}
+	start := 0
+	for start < len(text) {
+		end := strings.IndexFunc(text[start:], isDirectionalMarker)
+		size := 0
+		if end == -1 {
+			end = len(text)
+		} else {
+			end += start
+			_, size = utf8.DecodeRuneInString(text[end:])
+		}
+		for _, url := range extract.ExtractUrls(text[start:end]) {
+			ranges = append(ranges, extract.Range{Start: start + url.ByteRange.Start, Stop: start + url.ByteRange.Stop})
+		}
+		start = end + size
+	}
+	return ranges
+}
+
+func isDirectionalMarker(r rune) bool {
+	switch {
+	case r == '\u061C', r == '\u200E', r == '\u200F':
+		return true
+	case r >= '\u202A' && r <= '\u202E':
+		return true
+	case r >= '\u2066' && r <= '\u2069':
+		return true
+	}
+	return false
+}
+
+func plainWeight(text []byte) int {
+	return normalizedWeight(norm.NFC.Bytes(text))
+}
+
+// Like plainWeight, for text which is already in NFC
+func normalizedWeight(text []byte) int {
+	weight := 0
+	for len(text) > 0 {
+		if size := emojiLength(text); size > 0 {
+			weight += defaultWeight
+			text = text[size:]
+			continue
+		}
+		r, size := utf8.DecodeRune(text)
+		weight += runeWeight(r)
+		text = text[size:]
+	}
+	return weight
+}
+
+func runeWeight(r rune) int {
+	for _, weightRange := range weightRanges {
+		if r >= weightRange.start && r <= weightRange.end {
+			return weightRange.weight
+		}
+	}
+	return defaultWeight
+}
+
+// Returns the largest byte index in text such that no rune appended to text
+// could change how text[:index] is normalized or counted
+func lastSafeBoundary(text []byte) int {
+	end := len(text)
+	for end > 0 {
+		r, size := utf8.DecodeLastRune(text[:end])
+		index := end - size
+		if index == 0 {
+			break
+		}
+		previous, _ := utf8.DecodeLastRune(text[:index])
+		if norm.NFC.Properties(text[index:]).BoundaryBefore() && !continuesEmoji(previous, r) {
+			return index
+		}
+		end = index
+	}
+	return 0
+}
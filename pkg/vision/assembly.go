@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"time"
 
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/sirupsen/logrus"
 )
@@ -45,27 +46,25 @@ func (a *assemblyAi) Transcribe(ctx context.Context, url string) ([]Transcriptio
 	type transcriptRequest struct {
 		AudioUrl string `json:"audio_url"`
 	}
-	buf := new(bytes.Buffer)
-	err := json.NewEncoder(buf).Encode(transcriptRequest{AudioUrl: url})
+	body, err := json.Marshal(transcriptRequest{AudioUrl: url})
 	if err != nil {
 		return nil, structured_error.Wrap(err, structured_error.TranscribeError)
 	}
-	request, err := http.NewRequest(http.MethodPost, "https://api.assemblyai.com/v2/transcript", buf)
 	ctx, onComplete := context.WithTimeout(ctx, time.Second*30)
+	newRequest := func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodPost, "https://api.assemblyai.com/v2/transcript", bytes.NewReader(body))
+	}
 loop:
 	for {
 		if err != nil {
 			break loop
 		}
 		var response *http.Response
-		response, err = a.client.Do(request)
+		response, err = a.do(ctx, newRequest)
 		select {
 		case <-ctx.Done():
 			err = errors.New("timeout")
 		default:
-			if err == nil && (response.StatusCode < 200 || response.StatusCode >= 300) {
-				err = fmt.Errorf("transcript returned a %d status code", response.StatusCode)
-			}
 			if err == nil {
 				defer response.Body.Close()
 				type transcriptResponse struct {
@@ -89,7 +88,10 @@ loop:
 					} else if parsed.Status == "error" {
 						err = errors.New(parsed.Error)
 					} else {
-						request, err = http.NewRequest(http.MethodGet, "https://api.assemblyai.com/v2/transcript/"+parsed.Id, nil)
+						id := parsed.Id
+						newRequest = func() (*http.Request, error) {
+							return http.NewRequestWithContext(ctx, http.MethodGet, "https://api.assemblyai.com/v2/transcript/"+id, nil)
+						}
 					}
 				}
 			}
@@ -99,3 +101,18 @@ loop:
 	onComplete()
 	return result, structured_error.Wrap(err, structured_error.TranscribeError)
 }
+
+// Sends the request from newRequest, retrying transient failures.
+// newRequest is called for every attempt since a request body can only be read once
+func (a *assemblyAi) do(ctx context.Context, newRequest func() (*http.Request, error)) (*http.Response, error) {
+	var response *http.Response
+	err := retry.Do(ctx, retryPolicy, func() error {
+		request, err := newRequest()
+		if err == nil {
+			response, err = a.client.Do(request)
+			err = classifyResponse(response, err, structured_error.TranscribeError)
+		}
+		return err
+	})
+	return response, err
+}
@@ -1,14 +1,26 @@
 package vision
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"path"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/Azure/azure-sdk-for-go/services/cognitiveservices/v3.1/computervision"
 	"github.com/Azure/go-autorest/autorest"
+	"github.com/gofrs/uuid"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/text/language"
 )
@@ -18,9 +30,62 @@ type azure struct {
 	supportedTags []language.Tag
 }
 
-func NewAzureVision(computerVisionKey string) Describer {
-	client := computervision.New("https://captionspleasecomputervision.cognitiveservices.azure.com")
+// Azure rejects images over 4MB, and OCR only works on images up to 4200 pixels on a side
+var AzureOCRImageOptions = preprocess.Options{MaxDimension: 4200, MinDimension: 1024, MaxBytes: 4 * 1024 * 1024}
+
+// Descriptions don't get any better past a couple thousand pixels, so keep the uploads small
+var AzureDescribeImageOptions = preprocess.Options{MaxDimension: 2048, MinDimension: 50, MaxBytes: 4 * 1024 * 1024}
+
+const DefaultAzureEndpoint = "https://captionspleasecomputervision.cognitiveservices.azure.com"
+
+// The versions of the API images can be described with
+const (
+	// A few captions of the whole image
+	AzureAPIv31 = "v3.1"
+	// Image Analysis 4.0, which also captions the regions of the image
+	AzureAPIv40 = "4.0"
+)
+
+// Which computer vision resource to call, and how
+type AzureConfig struct {
+	// Empty uses DefaultAzureEndpoint
+	Endpoint string
+	// AzureAPIv31 or AzureAPIv40. Empty uses AzureAPIv31
+	APIVersion string
+}
+
+func (config AzureConfig) endpoint() string {
+	if config.Endpoint == "" {
+		return DefaultAzureEndpoint
+	}
+	return strings.TrimSuffix(config.Endpoint, "/")
+}
+
+func NewAzureVision(computerVisionKey string, config AzureConfig) (Describer, error) {
+	switch config.APIVersion {
+	case "", AzureAPIv31:
+		return newAzure(config.endpoint(), computerVisionKey), nil
+	case AzureAPIv40:
+		return newImageAnalysis(config.endpoint(), computerVisionKey), nil
+	}
+	return nil, fmt.Errorf("unknown azure api version %s, must be [%s|%s]", config.APIVersion, AzureAPIv31, AzureAPIv40)
+}
+
+// Labels always come from the v3.1 analyze API, whatever config.APIVersion is
+func NewAzureLabeler(computerVisionKey string, config AzureConfig) Labeler {
+	return newAzure(config.endpoint(), computerVisionKey)
+}
+
+// The printed text and handwriting APIs are only in v3.1, so OCR always uses it, whatever config.APIVersion is
+func NewAzureOCR(computerVisionKey string, config AzureConfig) OCR {
+	return newAzure(config.endpoint(), computerVisionKey)
+}
+
+func newAzure(endpoint string, computerVisionKey string) *azure {
+	client := computervision.New(endpoint)
 	client.Authorizer = autorest.NewCognitiveServicesAuthorizer(computerVisionKey)
+	// Retries are handled by retryPolicy, so autorest shouldn't make its own on top
+	client.RetryAttempts = 0
 	supportedTags := make([]language.Tag, len(languageMapping))
 	i := 0
 	for tag := range languageMapping {
@@ -39,23 +104,38 @@ var languageMapping = map[language.Tag]string{
 }
 
 func (a *azure) Describe(ctx context.Context, url string) ([]VisionResult, structured_error.StructuredError) {
+	imageURL := computervision.ImageURL{URL: &url}
+	return a.describe(ctx, func(language string) (computervision.ImageDescription, error) {
+		return a.client.DescribeImage(ctx, imageURL, nil, language, nil)
+	})
+}
+
+func (a *azure) DescribeBytes(ctx context.Context, image []byte) ([]VisionResult, structured_error.StructuredError) {
+	return a.describe(ctx, func(language string) (computervision.ImageDescription, error) {
+		return a.client.DescribeImageInStream(ctx, newImageStream(image), nil, language, nil)
+	})
+}
+
+func (a *azure) describe(ctx context.Context, describeImage func(language string) (computervision.ImageDescription, error)) ([]VisionResult, structured_error.StructuredError) {
 	var result []VisionResult
 	var err error
-	imageURL := computervision.ImageURL{URL: &url}
 	tag, wrongLangErr := message.GetCompatibleLanguage(ctx, a.supportedTags)
 	if wrongLangErr != nil {
 		logrus.Debug("Azure cannot produce descriptions in the desired language")
 		tag = language.English
 	}
 	var description computervision.ImageDescription
-	description, err = a.client.DescribeImage(ctx, imageURL, nil, languageMapping[tag], nil)
+	err = retry.Do(ctx, retryPolicy, func() error {
+		var err error
+		description, err = describeImage(languageMapping[tag])
+		return classifyAzureError(err, structured_error.DescribeError)
+	})
 	logDebugJSON(description)
 	if err == nil && description.Captions != nil {
 		result = make([]VisionResult, 0, len(*description.Captions))
-		for i, caption := range *description.Captions {
+		for _, caption := range *description.Captions {
 			if caption.Confidence != nil && caption.Text != nil {
-				result = result[:len(result)+1]
-				result[i] = VisionResult{Text: *caption.Text, Confidence: float32(*caption.Confidence)}
+				result = append(result, VisionResult{Text: *caption.Text, Confidence: float32(*caption.Confidence)})
 			}
 		}
 		logDebugJSON(result)
@@ -69,22 +149,164 @@ func (a *azure) Describe(ctx context.Context, url string) ([]VisionResult, struc
 	return result, structured_error.Wrap(err, structured_error.DescribeError)
 }
 
-func (a *azure) GetOCR(ctx context.Context, url string) (*OCRResult, structured_error.StructuredError) {
-	var ocr *OCRResult
+// Landmarks are a detail of the categories, so they're needed too
+var azureLabelFeatures = []computervision.VisualFeatureTypes{
+	computervision.VisualFeatureTypesTags,
+	computervision.VisualFeatureTypesObjects,
+	computervision.VisualFeatureTypesBrands,
+	computervision.VisualFeatureTypesCategories,
+}
+var azureLabelDetails = []computervision.Details{computervision.DetailsLandmarks}
+
+func (a *azure) GetLabels(ctx context.Context, url string) ([]Label, structured_error.StructuredError) {
 	imageURL := computervision.ImageURL{URL: &url}
-	result, err := a.client.RecognizePrintedText(ctx, true, imageURL, computervision.OcrLanguagesUnk)
-	builder := strings.Builder{}
-	if err == nil && result.Regions != nil {
-		for _, region := range *result.Regions {
-			for _, line := range *region.Lines {
-				for _, word := range *line.Words {
-					builder.WriteString(*word.Text + " ")
+	return a.getLabels(ctx, func() (computervision.ImageAnalysis, error) {
+		return a.client.AnalyzeImage(ctx, imageURL, azureLabelFeatures, azureLabelDetails, "en", nil)
+	})
+}
+
+func (a *azure) GetLabelsFromBytes(ctx context.Context, image []byte) ([]Label, structured_error.StructuredError) {
+	return a.getLabels(ctx, func() (computervision.ImageAnalysis, error) {
+		return a.client.AnalyzeImageInStream(ctx, newImageStream(image), azureLabelFeatures, azureLabelDetails, "en", nil)
+	})
+}
+
+// Objects and brands are only named in English, so the labels are always in English for the caller to translate
+func (a *azure) getLabels(ctx context.Context, analyzeImage func() (computervision.ImageAnalysis, error)) ([]Label, structured_error.StructuredError) {
+	_, wrongLangErr := message.GetCompatibleLanguage(ctx, []language.Tag{language.English})
+	var analysis computervision.ImageAnalysis
+	err := retry.Do(ctx, retryPolicy, func() error {
+		var err error
+		analysis, err = analyzeImage()
+		return classifyAzureError(err, structured_error.LabelError)
+	})
+	logDebugJSON(analysis)
+	var result []Label
+	if err == nil {
+		result = getAzureLabels(analysis)
+		logDebugJSON(result)
+		err = wrongLangErr
+	} else {
+		logrus.Debug(fmt.Sprintf("azure analyze returned error %v", err))
+	}
+	return result, structured_error.Wrap(err, structured_error.LabelError)
+}
+
+func getAzureLabels(analysis computervision.ImageAnalysis) []Label {
+	labels := []Label{}
+	add := func(name *string, confidence *float64, kind LabelKind, rect *computervision.BoundingRect) {
+		if name == nil || *name == "" {
+			return
+		}
+		label := Label{Text: *name, Kind: kind}
+		if confidence != nil {
+			label.Confidence = float32(*confidence)
+		}
+		if rect != nil && rect.X != nil && rect.Y != nil && rect.W != nil && rect.H != nil {
+			label.Bounds = &Bounds{X: int(*rect.X), Y: int(*rect.Y), Width: int(*rect.W), Height: int(*rect.H)}
+		}
+		labels = append(labels, label)
+	}
+	if analysis.Categories != nil {
+		for _, category := range *analysis.Categories {
+			if category.Detail != nil && category.Detail.Landmarks != nil {
+				for _, landmark := range *category.Detail.Landmarks {
+					add(landmark.Name, landmark.Confidence, LandmarkLabel, nil)
 				}
-				builder.WriteString(" ")
 			}
-			builder.WriteString("\n\n")
 		}
+	}
+	if analysis.Brands != nil {
+		for _, brand := range *analysis.Brands {
+			add(brand.Name, brand.Confidence, BrandLabel, brand.Rectangle)
+		}
+	}
+	if analysis.Objects != nil {
+		for _, object := range *analysis.Objects {
+			add(object.Object, object.Confidence, ObjectLabel, object.Rectangle)
+		}
+	}
+	if analysis.Tags != nil {
+		for _, tag := range *analysis.Tags {
+			add(tag.Name, tag.Confidence, TagLabel, nil)
+		}
+	}
+	return labels
+}
+
+// How long to wait between asking whether the Read API has finished with an image
+var readPollInterval = time.Second
+
+// The languages printed text can be read in, and the ones handwriting can be read in, keyed by what Azure calls them
+var azureOCRLanguages = map[language.Tag]string{}
+var azureReadLanguages = map[language.Tag]string{}
+
+func init() {
+	for _, code := range computervision.PossibleOcrLanguagesValues() {
+		addAzureLanguage(azureOCRLanguages, string(code))
+	}
+	for _, code := range computervision.PossibleOcrDetectionLanguageValues() {
+		addAzureLanguage(azureReadLanguages, string(code))
+	}
+}
+
+func addAzureLanguage(languages map[language.Tag]string, code string) {
+	// unk asks Azure to work out the language itself
+	if tag, err := language.Parse(code); err == nil && tag != language.Und {
+		languages[tag] = code
+	}
+}
+
+// What Azure calls the first hinted language it supports, or "" if it doesn't support any of them
+func azureHintedLanguage(hints OCRHints, languages map[language.Tag]string) string {
+	supported := make([]language.Tag, 0, len(languages))
+	for tag := range languages {
+		supported = append(supported, tag)
+	}
+	// Map order is random, so sort them to match the same way every time
+	sort.Slice(supported, func(i, j int) bool { return supported[i].String() < supported[j].String() })
+	if tag, ok := hintedLanguage(hints, supported); ok {
+		return languages[tag]
+	}
+	return ""
+}
+
+func (a *azure) GetOCR(ctx context.Context, url string) (*OCRResult, structured_error.StructuredError) {
+	imageURL := computervision.ImageURL{URL: &url}
+	if getOCRHints(ctx).Handwriting {
+		return a.read(ctx, func(language computervision.OcrDetectionLanguage) (autorest.Response, error) {
+			return a.client.Read(ctx, imageURL, language)
+		})
+	}
+	return a.getOCR(ctx, func(language computervision.OcrLanguages) (computervision.OcrResult, error) {
+		return a.client.RecognizePrintedText(ctx, true, imageURL, language)
+	})
+}
 
+func (a *azure) GetOCRFromBytes(ctx context.Context, image []byte) (*OCRResult, structured_error.StructuredError) {
+	if getOCRHints(ctx).Handwriting {
+		return a.read(ctx, func(language computervision.OcrDetectionLanguage) (autorest.Response, error) {
+			return a.client.ReadInStream(ctx, newImageStream(image), language)
+		})
+	}
+	return a.getOCR(ctx, func(language computervision.OcrLanguages) (computervision.OcrResult, error) {
+		return a.client.RecognizePrintedTextInStream(ctx, true, newImageStream(image), language)
+	})
+}
+
+func (a *azure) getOCR(ctx context.Context, recognize func(language computervision.OcrLanguages) (computervision.OcrResult, error)) (*OCRResult, structured_error.StructuredError) {
+	ocrLanguage := computervision.OcrLanguagesUnk
+	if code := azureHintedLanguage(getOCRHints(ctx), azureOCRLanguages); code != "" {
+		ocrLanguage = computervision.OcrLanguages(code)
+	}
+	var ocr *OCRResult
+	var result computervision.OcrResult
+	err := retry.Do(ctx, retryPolicy, func() error {
+		var err error
+		result, err = recognize(ocrLanguage)
+		return classifyAzureError(err, structured_error.OCRError)
+	})
+	if err == nil && result.Regions != nil {
 		ocrLanguage := OCRLanguage{Tag: language.English, Confidence: 0.0}
 		if result.Language != nil {
 			tag, parseErr := language.Parse(*result.Language)
@@ -92,10 +314,236 @@ func (a *azure) GetOCR(ctx context.Context, url string) (*OCRResult, structured_
 				ocrLanguage = OCRLanguage{Tag: tag, Confidence: 1.0}
 			}
 		}
-		ocr = &OCRResult{
-			Text:     builder.String(),
+
+		blocks := []OCRBlock{}
+		for _, region := range *result.Regions {
+			block := OCRBlock{
+				// Azure only detects one language for the whole image, so every region shares it
+				Language: ocrLanguage,
+				Bounds:   parseAzureBounds(region.BoundingBox),
+			}
+			lineTexts := []string{}
+			if region.Lines != nil {
+				for _, azureLine := range *region.Lines {
+					line := OCRLine{Bounds: parseAzureBounds(azureLine.BoundingBox)}
+					if azureLine.Words != nil {
+						for _, word := range *azureLine.Words {
+							if word.Text != nil {
+								line.Words = append(line.Words, OCRWord{Text: *word.Text, Bounds: parseAzureBounds(word.BoundingBox)})
+							}
+						}
+					}
+					if len(line.Words) > 0 {
+						block.Lines = append(block.Lines, line)
+						lineTexts = append(lineTexts, line.Text())
+					}
+				}
+			}
+			block.Text = strings.Join(lineTexts, " ")
+			if block.Text != "" {
+				blocks = append(blocks, block)
+			}
+		}
+
+		blocks = ReadingOrder(blocks)
+		ocr = NormalizeOCR(&OCRResult{
+			Text:     blocksText(blocks),
 			Language: ocrLanguage,
+			Blocks:   blocks,
+		}, getNormalizeOptions(ctx))
+	}
+	return ocr, structured_error.Wrap(err, structured_error.OCRError)
+}
+
+// Handwriting is read by the asynchronous Read API. Starting a read gives back where to poll for the results
+func (a *azure) read(ctx context.Context, start func(language computervision.OcrDetectionLanguage) (autorest.Response, error)) (*OCRResult, structured_error.StructuredError) {
+	readLanguage := computervision.OcrDetectionLanguage(azureHintedLanguage(getOCRHints(ctx), azureReadLanguages))
+	var operationID uuid.UUID
+	err := retry.Do(ctx, retryPolicy, func() error {
+		response, err := start(readLanguage)
+		if err == nil {
+			operationID, err = getReadOperationID(response)
 		}
+		return classifyAzureError(err, structured_error.OCRError)
+	})
+	var result computervision.ReadOperationResult
+	if err == nil {
+		result, err = a.waitForRead(ctx, operationID)
+	}
+	logDebugJSON(result)
+
+	var ocr *OCRResult
+	if err == nil {
+		blocks, ocrLanguage := getReadBlocks(result)
+		blocks = ReadingOrder(blocks)
+		ocr = NormalizeOCR(&OCRResult{
+			Text:     blocksText(blocks),
+			Language: ocrLanguage,
+			Blocks:   blocks,
+		}, getNormalizeOptions(ctx))
 	}
 	return ocr, structured_error.Wrap(err, structured_error.OCRError)
 }
+
+// The Operation-Location header is the url of the results, which ends with the id of the read
+func getReadOperationID(response autorest.Response) (uuid.UUID, error) {
+	if response.Response == nil {
+		return uuid.Nil, errors.New("azure did not respond to the read request")
+	}
+	location := response.Header.Get("Operation-Location")
+	if location == "" {
+		return uuid.Nil, errors.New("azure did not say where to find the read results")
+	}
+	return uuid.FromString(path.Base(location))
+}
+
+// Polls the Read API until it's finished with the image, or ctx is done
+func (a *azure) waitForRead(ctx context.Context, operationID uuid.UUID) (computervision.ReadOperationResult, error) {
+	for {
+		var result computervision.ReadOperationResult
+		err := retry.Do(ctx, retryPolicy, func() error {
+			var err error
+			result, err = a.client.GetReadResult(ctx, operationID)
+			return classifyAzureError(err, structured_error.OCRError)
+		})
+		if err != nil {
+			return result, err
+		}
+		switch result.Status {
+		case computervision.Succeeded:
+			return result, nil
+		case computervision.Failed:
+			return result, errors.New("azure failed to read the image")
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(readPollInterval):
+		}
+	}
+}
+
+// The Read API only finds lines, so lines which follow on from each other are put back together into blocks
+func getReadBlocks(result computervision.ReadOperationResult) ([]OCRBlock, OCRLanguage) {
+	blocks := []OCRBlock{}
+	ocrLanguage := OCRLanguage{Tag: language.English, Confidence: 0.0}
+	if result.AnalyzeResult == nil || result.AnalyzeResult.ReadResults == nil {
+		return blocks, ocrLanguage
+	}
+	for i, page := range *result.AnalyzeResult.ReadResults {
+		pageLanguage := parseAzureLanguage(page.Language, ocrLanguage)
+		if i == 0 {
+			ocrLanguage = pageLanguage
+		}
+		if page.Lines == nil {
+			continue
+		}
+		// Only the blocks on this page can be continued by its lines
+		pageStart := len(blocks)
+		for _, azureLine := range *page.Lines {
+			line := getReadLine(azureLine)
+			if len(line.Words) == 0 {
+				continue
+			}
+			// Lines only have a language when it's different from the page's
+			lineLanguage := parseAzureLanguage(azureLine.Language, pageLanguage)
+			if len(blocks) > pageStart && continuesBlock(blocks[len(blocks)-1], line, lineLanguage) {
+				block := &blocks[len(blocks)-1]
+				block.Lines = append(block.Lines, line)
+				block.Bounds = block.Bounds.union(line.Bounds)
+				block.Text = block.Text + " " + line.Text()
+			} else {
+				blocks = append(blocks, OCRBlock{
+					Text:     line.Text(),
+					Language: lineLanguage,
+					Bounds:   line.Bounds,
+					Lines:    []OCRLine{line},
+				})
+			}
+		}
+	}
+	return blocks, ocrLanguage
+}
+
+func getReadLine(azureLine computervision.Line) OCRLine {
+	line := OCRLine{Bounds: parseAzurePolygon(azureLine.BoundingBox)}
+	if azureLine.Words != nil {
+		for _, word := range *azureLine.Words {
+			if word.Text == nil {
+				continue
+			}
+			ocrWord := OCRWord{Text: *word.Text, Bounds: parseAzurePolygon(word.BoundingBox)}
+			if word.Confidence != nil {
+				ocrWord.Confidence = float32(*word.Confidence)
+			}
+			line.Words = append(line.Words, ocrWord)
+		}
+	}
+	return line
+}
+
+// A line carries on the block above it when it's in the same language, overlaps it horizontally,
+// and starts within a line's height of where the block ends
+func continuesBlock(block OCRBlock, line OCRLine, lineLanguage OCRLanguage) bool {
+	previous := block.Lines[len(block.Lines)-1].Bounds
+	gap := line.Bounds.Y - previous.bottom()
+	overlaps := line.Bounds.X < block.Bounds.right() && block.Bounds.X < line.Bounds.right()
+	return block.Language.Tag == lineLanguage.Tag && overlaps && gap <= maxInt(previous.Height, line.Bounds.Height)
+}
+
+func parseAzureLanguage(code *string, fallback OCRLanguage) OCRLanguage {
+	if code == nil {
+		return fallback
+	}
+	tag, err := language.Parse(*code)
+	if err != nil {
+		return fallback
+	}
+	return OCRLanguage{Tag: tag, Confidence: 1.0}
+}
+
+// The Read API's bounding boxes are the x,y of each corner, clockwise from the top left
+func parseAzurePolygon(box *[]float64) Bounds {
+	if box == nil || len(*box) != 8 {
+		return Bounds{}
+	}
+	minX, minY := math.Inf(1), math.Inf(1)
+	maxX, maxY := math.Inf(-1), math.Inf(-1)
+	for i := 0; i < len(*box); i += 2 {
+		x, y := (*box)[i], (*box)[i+1]
+		minX, maxX = math.Min(minX, x), math.Max(maxX, x)
+		minY, maxY = math.Min(minY, y), math.Max(maxY, y)
+	}
+	return Bounds{X: int(minX), Y: int(minY), Width: int(math.Round(maxX - minX)), Height: int(math.Round(maxY - minY))}
+}
+
+// Azure's bounding boxes are "left,top,width,height"
+func parseAzureBounds(box *string) Bounds {
+	if box == nil {
+		return Bounds{}
+	}
+	parts := strings.Split(*box, ",")
+	if len(parts) != 4 {
+		return Bounds{}
+	}
+	values := make([]int, len(parts))
+	for i, part := range parts {
+		value, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return Bounds{}
+		}
+		values[i] = value
+	}
+	return Bounds{X: values[0], Y: values[1], Width: values[2], Height: values[3]}
+}
+
+// The client doesn't hold any connections open, so there's nothing to close
+func (a *azure) Close() error {
+	return nil
+}
+
+// Every retry sends the image again, so each attempt needs a fresh reader
+func newImageStream(image []byte) io.ReadCloser {
+	return ioutil.NopCloser(bytes.NewReader(image))
+}
@@ -0,0 +1,142 @@
+package vision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
+)
+
+// The REST api-version of Image Analysis 4.0
+const imageAnalysisVersion = "2023-10-01"
+
+// Captions are only written in English
+var imageAnalysisLanguages = []language.Tag{language.English}
+
+// Adds the subscription key to every request, then sends it with base
+type azureKeyTransport struct {
+	base http.RoundTripper
+	key  string
+}
+
+func (t *azureKeyTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't modify the caller's request
+	request = request.Clone(request.Context())
+	request.Header.Set("Ocp-Apim-Subscription-Key", t.key)
+	return t.base.RoundTrip(request)
+}
+
+// Describes images with Image Analysis 4.0, which captions the whole image and then each of the regions it finds
+type imageAnalysis struct {
+	client   *http.Client
+	endpoint string
+}
+
+func newImageAnalysis(endpoint string, computerVisionKey string) *imageAnalysis {
+	return &imageAnalysis{
+		client:   &http.Client{Transport: &azureKeyTransport{base: http.DefaultTransport, key: computerVisionKey}},
+		endpoint: endpoint,
+	}
+}
+
+type imageAnalysisCaption struct {
+	Text        string  `json:"text"`
+	Confidence  float32 `json:"confidence"`
+	BoundingBox *struct {
+		X      int `json:"x"`
+		Y      int `json:"y"`
+		Width  int `json:"w"`
+		Height int `json:"h"`
+	} `json:"boundingBox"`
+}
+
+type imageAnalysisResult struct {
+	CaptionResult       *imageAnalysisCaption `json:"captionResult"`
+	DenseCaptionsResult *struct {
+		Values []imageAnalysisCaption `json:"values"`
+	} `json:"denseCaptionsResult"`
+	Metadata struct {
+		Width  int `json:"width"`
+		Height int `json:"height"`
+	} `json:"metadata"`
+}
+
+func (a *imageAnalysis) Describe(ctx context.Context, imageURL string) ([]VisionResult, structured_error.StructuredError) {
+	body, err := json.Marshal(map[string]string{"url": imageURL})
+	if err != nil {
+		return nil, structured_error.Wrap(err, structured_error.DescribeError)
+	}
+	return a.analyze(ctx, body, "application/json")
+}
+
+func (a *imageAnalysis) DescribeBytes(ctx context.Context, image []byte) ([]VisionResult, structured_error.StructuredError) {
+	return a.analyze(ctx, image, "application/octet-stream")
+}
+
+func (a *imageAnalysis) analyze(ctx context.Context, body []byte, contentType string) ([]VisionResult, structured_error.StructuredError) {
+	_, wrongLangErr := message.GetCompatibleLanguage(ctx, imageAnalysisLanguages)
+	if wrongLangErr != nil {
+		logrus.Debug("Image Analysis cannot produce captions in the desired language")
+	}
+	query := url.Values{
+		"api-version":            {imageAnalysisVersion},
+		"features":               {"caption,denseCaptions"},
+		"language":               {"en"},
+		"gender-neutral-caption": {"true"},
+	}
+	var parsed imageAnalysisResult
+	err := doJSON(ctx, a.client, func() (*http.Request, error) {
+		request, err := http.NewRequestWithContext(ctx, http.MethodPost, a.endpoint+"/computervision/imageanalysis:analyze?"+query.Encode(), bytes.NewReader(body))
+		if err == nil {
+			request.Header.Set("Content-Type", contentType)
+		}
+		return request, err
+	}, structured_error.DescribeError, &parsed)
+
+	var result []VisionResult
+	if err == nil {
+		logDebugJSON(parsed)
+		result = parsed.visionResults()
+		logDebugJSON(result)
+		err = wrongLangErr
+	} else {
+		logrus.Debug(fmt.Sprintf("azure image analysis returned error %v", err))
+	}
+	return result, structured_error.Wrap(err, structured_error.DescribeError)
+}
+
+// The caption of the whole image comes first, followed by the regions from most to least confident
+func (r imageAnalysisResult) visionResults() []VisionResult {
+	results := []VisionResult{}
+	if r.CaptionResult != nil && r.CaptionResult.Text != "" {
+		results = append(results, VisionResult{Text: r.CaptionResult.Text, Confidence: r.CaptionResult.Confidence})
+	}
+	if r.DenseCaptionsResult == nil {
+		return results
+	}
+	image := Bounds{Width: r.Metadata.Width, Height: r.Metadata.Height}
+	regions := []VisionResult{}
+	for _, caption := range r.DenseCaptionsResult.Values {
+		if caption.Text == "" || caption.BoundingBox == nil {
+			continue
+		}
+		bounds := Bounds{X: caption.BoundingBox.X, Y: caption.BoundingBox.Y, Width: caption.BoundingBox.Width, Height: caption.BoundingBox.Height}
+		if bounds == image {
+			// The first dense caption is of the whole image, which the caption already covers
+			continue
+		}
+		regions = append(regions, VisionResult{Text: caption.Text, Confidence: caption.Confidence, Bounds: &bounds})
+	}
+	sort.SliceStable(regions, func(i, j int) bool {
+		return regions[i].Confidence > regions[j].Confidence
+	})
+	return append(results, regions...)
+}
@@ -0,0 +1,134 @@
+package vision
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
+)
+
+const testImageAnalysisResponse = `{
+	"modelVersion": "2023-10-01",
+	"metadata": {"width": 640, "height": 480},
+	"captionResult": {"text": "a busy street", "confidence": 0.8},
+	"denseCaptionsResult": {"values": [
+		{"text": "a busy street", "confidence": 0.8, "boundingBox": {"x": 0, "y": 0, "w": 640, "h": 480}},
+		{"text": "a man riding a bike", "confidence": 0.6, "boundingBox": {"x": 10, "y": 20, "w": 100, "h": 200}},
+		{"text": "a red car", "confidence": 0.7, "boundingBox": {"x": 300, "y": 200, "w": 250, "h": 120}}
+	]}
+}`
+
+func TestImageAnalysis(t *testing.T) {
+	origRetryPolicy := retryPolicy
+	retryPolicy = retry.Policy{MaxAttempts: 1}
+	defer func() {
+		retryPolicy = origRetryPolicy
+	}()
+
+	expected := []VisionResult{
+		{Text: "a busy street", Confidence: 0.8},
+		{Text: "a red car", Confidence: 0.7, Bounds: &Bounds{X: 300, Y: 200, Width: 250, Height: 120}},
+		{Text: "a man riding a bike", Confidence: 0.6, Bounds: &Bounds{X: 10, Y: 20, Width: 100, Height: 200}},
+	}
+	tests := []struct {
+		name     string
+		lang     language.Tag
+		bytes    bool
+		status   int
+		expected []VisionResult
+		hasErr   bool
+		errType  structured_error.ErrorType
+	}{
+		{
+			name:     "Captions the image and its regions from a url",
+			lang:     language.English,
+			expected: expected,
+		},
+		{
+			name:     "Captions the image and its regions from its bytes",
+			lang:     language.English,
+			bytes:    true,
+			expected: expected,
+		},
+		{
+			name:     "Captions in english when the user wants another language",
+			lang:     language.German,
+			expected: expected,
+			hasErr:   true,
+			errType:  structured_error.UnsupportedLanguage,
+		},
+		{
+			name:    "Fails when azure rejects the request",
+			lang:    language.English,
+			status:  http.StatusBadRequest,
+			hasErr:  true,
+			errType: structured_error.DescribeError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/computervision/imageanalysis:analyze", r.URL.Path)
+				assert.Equal(t, "key", r.Header.Get("Ocp-Apim-Subscription-Key"))
+				assert.Equal(t, "caption,denseCaptions", r.URL.Query().Get("features"))
+				assert.Equal(t, imageAnalysisVersion, r.URL.Query().Get("api-version"))
+				body, err := ioutil.ReadAll(r.Body)
+				require.NoError(t, err)
+				if test.bytes {
+					assert.Equal(t, "application/octet-stream", r.Header.Get("Content-Type"))
+					assert.Equal(t, "image", string(body))
+				} else {
+					var request map[string]string
+					require.NoError(t, json.Unmarshal(body, &request))
+					assert.Equal(t, "https://example.com/street.jpg", request["url"])
+				}
+				if test.status != 0 {
+					w.WriteHeader(test.status)
+					return
+				}
+				w.Write([]byte(testImageAnalysisResponse))
+			}))
+			defer server.Close()
+
+			describer, err := NewAzureVision("key", AzureConfig{Endpoint: server.URL + "/", APIVersion: AzureAPIv40})
+			require.NoError(t, err)
+			ctx := message.WithLanguage(context.Background(), test.lang)
+			var results []VisionResult
+			var describeErr structured_error.StructuredError
+			if test.bytes {
+				results, describeErr = describer.DescribeBytes(ctx, []byte("image"))
+			} else {
+				results, describeErr = describer.Describe(ctx, "https://example.com/street.jpg")
+			}
+			if test.hasErr {
+				require.Error(t, describeErr)
+				assert.Equal(t, test.errType, describeErr.Type())
+			} else {
+				require.NoError(t, describeErr)
+			}
+			assert.Equal(t, test.expected, results)
+		})
+	}
+}
+
+func TestNewAzureVision(t *testing.T) {
+	describer, err := NewAzureVision("key", AzureConfig{})
+	require.NoError(t, err)
+	assert.Equal(t, DefaultAzureEndpoint, describer.(*azure).client.Endpoint)
+
+	describer, err = NewAzureVision("key", AzureConfig{Endpoint: "https://example.cognitiveservices.azure.com/", APIVersion: AzureAPIv31})
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.cognitiveservices.azure.com", describer.(*azure).client.Endpoint)
+
+	_, err = NewAzureVision("key", AzureConfig{APIVersion: "v2.0"})
+	assert.Error(t, err)
+}
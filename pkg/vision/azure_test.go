@@ -0,0 +1,275 @@
+package vision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
+)
+
+const testReadOperationID = "7bd0a9a5-4d2a-4a3e-8a3c-4a0a2a1c2f3e"
+
+func TestAzureOCRLanguageHints(t *testing.T) {
+	origRetryPolicy := retryPolicy
+	retryPolicy = retry.Policy{MaxAttempts: 1}
+	defer func() {
+		retryPolicy = origRetryPolicy
+	}()
+
+	tests := []struct {
+		name     string
+		hints    OCRHints
+		expected string
+	}{
+		{
+			name:     "Lets azure detect the language without any hints",
+			expected: "unk",
+		},
+		{
+			name:     "Passes the hinted language",
+			hints:    OCRHints{Languages: []language.Tag{language.Spanish}},
+			expected: "es",
+		},
+		{
+			name:     "Uses the first hinted language azure supports",
+			hints:    OCRHints{Languages: []language.Tag{language.Swahili, language.MustParse("zh-Hant")}},
+			expected: "zh-Hant",
+		},
+		{
+			name:     "Ignores languages azure doesn't support",
+			hints:    OCRHints{Languages: []language.Tag{language.Swahili}},
+			expected: "unk",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/vision/v3.1/ocr", r.URL.Path)
+				assert.Equal(t, test.expected, r.URL.Query().Get("language"))
+				w.Header().Set("Content-Type", "application/json")
+				w.Write([]byte(`{"language": "es", "regions": [{"boundingBox": "0,0,100,20", "lines": [{"boundingBox": "0,0,100,20", "words": [{"boundingBox": "0,0,40,20", "text": "hola"}, {"boundingBox": "60,0,40,20", "text": "amigo"}]}]}]}`))
+			}))
+			defer server.Close()
+
+			ctx := WithOCRHints(context.Background(), test.hints)
+			result, err := newAzure(server.URL, "key").GetOCRFromBytes(ctx, []byte("image"))
+			require.NoError(t, err)
+			assert.Equal(t, "hola amigo", result.Text)
+			assert.Equal(t, OCRLanguage{Tag: language.Spanish, Confidence: 1.0}, result.Language)
+		})
+	}
+}
+
+func TestAzureReadsHandwriting(t *testing.T) {
+	origRetryPolicy := retryPolicy
+	origReadPollInterval := readPollInterval
+	retryPolicy = retry.Policy{MaxAttempts: 1}
+	readPollInterval = 0
+	defer func() {
+		retryPolicy = origRetryPolicy
+		readPollInterval = origReadPollInterval
+	}()
+
+	box := func(x, y, width, height float64) []float64 {
+		return []float64{x, y, x + width, y, x + width, y + height, x, y + height}
+	}
+	line := func(text string, y float64, lineLanguage string) map[string]interface{} {
+		line := map[string]interface{}{
+			"boundingBox": box(10, y, 100, 20),
+			"text":        text,
+			"words":       []map[string]interface{}{{"boundingBox": box(10, y, 100, 20), "text": text, "confidence": 0.9}},
+		}
+		if lineLanguage != "" {
+			line["language"] = lineLanguage
+		}
+		return line
+	}
+	readResult := map[string]interface{}{
+		"status": "succeeded",
+		"analyzeResult": map[string]interface{}{
+			"readResults": []map[string]interface{}{{
+				"page":     1,
+				"language": "en",
+				"lines": []map[string]interface{}{
+					line("Dear Ada,", 10, ""),
+					line("see you", 35, ""),
+					line("tomorrow", 100, ""),
+					line("Tschüss", 125, "de"),
+				},
+			}},
+		},
+	}
+
+	tests := []struct {
+		name             string
+		hints            OCRHints
+		status           string
+		expectedLanguage string
+		hasErr           bool
+	}{
+		{
+			// The sdk asks for english when it isn't given a language
+			name:             "Reads the handwriting once azure is done with it",
+			hints:            OCRHints{Handwriting: true},
+			status:           "succeeded",
+			expectedLanguage: "en",
+		},
+		{
+			name:             "Passes the hinted language",
+			hints:            OCRHints{Handwriting: true, Languages: []language.Tag{language.German}},
+			status:           "succeeded",
+			expectedLanguage: "de",
+		},
+		{
+			name:             "Fails when azure can't read the image",
+			hints:            OCRHints{Handwriting: true},
+			status:           "failed",
+			expectedLanguage: "en",
+			hasErr:           true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			polls := 0
+			var server *httptest.Server
+			server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				switch r.URL.Path {
+				case "/vision/v3.1/read/analyze":
+					assert.Equal(t, http.MethodPost, r.Method)
+					assert.Equal(t, test.expectedLanguage, r.URL.Query().Get("language"))
+					w.Header().Set("Operation-Location", server.URL+"/vision/v3.1/read/analyzeResults/"+testReadOperationID)
+					w.WriteHeader(http.StatusAccepted)
+				case "/vision/v3.1/read/analyzeResults/" + testReadOperationID:
+					polls++
+					if polls == 1 {
+						// Azure needs a moment before it's done
+						w.Write([]byte(`{"status": "running"}`))
+						return
+					}
+					readResult["status"] = test.status
+					json.NewEncoder(w).Encode(readResult)
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			ctx := WithOCRHints(context.Background(), test.hints)
+			result, err := newAzure(server.URL, "key").GetOCR(ctx, "https://example.com/note.jpg")
+			assert.Equal(t, 2, polls)
+			if test.hasErr {
+				require.Error(t, err)
+				assert.Equal(t, structured_error.OCRError, err.Type())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, "Dear Ada, see you\n\ntomorrow\n\nTschüss", result.Text)
+			assert.Equal(t, OCRLanguage{Tag: language.English, Confidence: 1.0}, result.Language)
+			languages := make([]language.Tag, len(result.Blocks))
+			for i, block := range result.Blocks {
+				languages[i] = block.Language.Tag
+			}
+			assert.Equal(t, []language.Tag{language.English, language.English, language.German}, languages)
+			assert.Equal(t, Bounds{X: 10, Y: 10, Width: 100, Height: 45}, result.Blocks[0].Bounds)
+		})
+	}
+}
+
+func TestAzureReadStopsPollingWhenCanceled(t *testing.T) {
+	origReadPollInterval := readPollInterval
+	readPollInterval = 0
+	defer func() {
+		readPollInterval = origReadPollInterval
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Method == http.MethodPost {
+			w.Header().Set("Operation-Location", server.URL+"/vision/v3.1/read/analyzeResults/"+testReadOperationID)
+			w.WriteHeader(http.StatusAccepted)
+			return
+		}
+		// Never finishes
+		cancel()
+		w.Write([]byte(`{"status": "running"}`))
+	}))
+	defer server.Close()
+
+	ctx = WithOCRHints(ctx, OCRHints{Handwriting: true})
+	_, err := newAzure(server.URL, "key").GetOCRFromBytes(ctx, []byte("image"))
+	require.Error(t, err)
+	assert.Equal(t, structured_error.OCRError, err.Type())
+}
+
+func TestAzureLabels(t *testing.T) {
+	origRetryPolicy := retryPolicy
+	retryPolicy = retry.Policy{MaxAttempts: 1}
+	defer func() {
+		retryPolicy = origRetryPolicy
+	}()
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/vision/v3.1/analyze", r.URL.Path)
+		assert.Equal(t, "Tags,Objects,Brands,Categories", r.URL.Query().Get("visualFeatures"))
+		assert.Equal(t, "Landmarks", r.URL.Query().Get("details"))
+		assert.Equal(t, "en", r.URL.Query().Get("language"))
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{
+			"categories": [{"name": "building_", "score": 0.9, "detail": {"landmarks": [{"name": "Eiffel Tower", "confidence": 0.95}]}}],
+			"brands": [{"name": "Acme", "confidence": 0.7, "rectangle": {"x": 1, "y": 2, "w": 3, "h": 4}}],
+			"objects": [{"object": "person", "confidence": 0.6, "rectangle": {"x": 10, "y": 20, "w": 30, "h": 40}}],
+			"tags": [{"name": "outdoor", "confidence": 0.99}, {"name": "", "confidence": 0.5}]
+		}`))
+	}))
+	defer server.Close()
+	expected := []Label{
+		{Text: "Eiffel Tower", Confidence: 0.95, Kind: LandmarkLabel},
+		{Text: "Acme", Confidence: 0.7, Kind: BrandLabel, Bounds: &Bounds{X: 1, Y: 2, Width: 3, Height: 4}},
+		{Text: "person", Confidence: 0.6, Kind: ObjectLabel, Bounds: &Bounds{X: 10, Y: 20, Width: 30, Height: 40}},
+		{Text: "outdoor", Confidence: 0.99, Kind: TagLabel},
+	}
+
+	labeler := NewAzureLabeler("key", AzureConfig{Endpoint: server.URL})
+	labels, err := labeler.GetLabelsFromBytes(message.WithLanguage(context.Background(), language.English), []byte("image"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, labels)
+
+	// The labels are still in English, for the caller to translate
+	labels, err = labeler.GetLabels(message.WithLanguage(context.Background(), language.Spanish), "https://example.com/paris.jpg")
+	require.Error(t, err)
+	assert.Equal(t, structured_error.UnsupportedLanguage, err.Type())
+	assert.Equal(t, expected, labels)
+
+	status = http.StatusBadRequest
+	_, err = labeler.GetLabels(context.Background(), "https://example.com/paris.jpg")
+	require.Error(t, err)
+	assert.Equal(t, structured_error.LabelError, err.Type())
+}
+
+func TestAzureDescribeSkipsIncompleteCaptions(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/vision/v3.1/describe", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"description": {"captions": [{"confidence": 0.4}, {"text": "a dog", "confidence": 0.9}]}}`))
+	}))
+	defer server.Close()
+
+	describer, err := NewAzureVision("key", AzureConfig{Endpoint: server.URL})
+	require.NoError(t, err)
+	results, describeErr := describer.Describe(message.WithLanguage(context.Background(), language.English), "https://example.com/dog.jpg")
+	require.NoError(t, describeErr)
+	assert.Equal(t, []VisionResult{{Text: "a dog", Confidence: 0.9}}, results)
+}
@@ -0,0 +1,111 @@
+package vision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
+)
+
+// Adds the auth key to every request, then sends it with base
+type deepLTransport struct {
+	base http.RoundTripper
+	key  string
+}
+
+func (t *deepLTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	// A RoundTripper mustn't modify the caller's request
+	request = request.Clone(request.Context())
+	request.Header.Set("Authorization", "DeepL-Auth-Key "+t.key)
+	return t.base.RoundTrip(request)
+}
+
+type deepL struct {
+	client    *http.Client
+	url       string
+	languages supportedLanguages
+}
+
+type DeepL interface {
+	Translator
+}
+
+func NewDeepL(key string) DeepL {
+	// Keys for the free plan only work with the free API
+	url := "https://api.deepl.com"
+	if strings.HasSuffix(key, ":fx") {
+		url = "https://api-free.deepl.com"
+	}
+	return &deepL{
+		client: &http.Client{Transport: &deepLTransport{base: http.DefaultTransport, key: key}},
+		url:    url,
+	}
+}
+
+func (d *deepL) Translate(ctx context.Context, toTranslate string) (language.Tag, string, structured_error.StructuredError) {
+	var translated string
+	tag, code, err := d.languages.targetCode(ctx, d.supportedCodes)
+	if err == nil {
+		type translateRequest struct {
+			Text       []string `json:"text"`
+			TargetLang string   `json:"target_lang"`
+		}
+		var body []byte
+		body, err = json.Marshal(translateRequest{Text: []string{toTranslate}, TargetLang: code})
+		if err == nil {
+			var parsed struct {
+				Translations []struct {
+					Text string `json:"text"`
+				} `json:"translations"`
+			}
+			logrus.Debug(fmt.Sprintf("Calling DeepL with target %s", code))
+			err = doJSON(ctx, d.client, func() (*http.Request, error) {
+				request, err := http.NewRequestWithContext(ctx, http.MethodPost, d.url+"/v2/translate", bytes.NewReader(body))
+				if err == nil {
+					request.Header.Set("Content-Type", "application/json")
+				}
+				return request, err
+			}, structured_error.TranslateError, &parsed)
+			if err == nil && len(parsed.Translations) == 0 {
+				err = errors.New("no results")
+			}
+			if err == nil {
+				texts := make([]string, len(parsed.Translations))
+				for i, translation := range parsed.Translations {
+					texts[i] = translation.Text
+				}
+				translated = strings.Join(texts, "\n")
+			}
+		}
+	}
+
+	if err != nil {
+		logrus.Debug(fmt.Sprintf("Translation failed with %v", err))
+	}
+	return tag, translated, structured_error.Wrap(err, structured_error.TranslateError)
+}
+
+func (d *deepL) supportedCodes(ctx context.Context) ([]string, error) {
+	var languages []struct {
+		Language string `json:"language"`
+	}
+	err := doJSON(ctx, d.client, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, d.url+"/v2/languages?type=target", nil)
+	}, structured_error.TranslateError, &languages)
+	codes := make([]string, len(languages))
+	for i, lang := range languages {
+		codes[i] = lang.Language
+	}
+	return codes, err
+}
+
+func (d *deepL) Close() error {
+	return nil
+}
@@ -0,0 +1,108 @@
+package vision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
+)
+
+func TestNewDeepL(t *testing.T) {
+	assert.Equal(t, "https://api-free.deepl.com", NewDeepL("abc:fx").(*deepL).url)
+	assert.Equal(t, "https://api.deepl.com", NewDeepL("abc").(*deepL).url)
+}
+
+type recordingTransport struct {
+	requests []*http.Request
+}
+
+func (t *recordingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	t.requests = append(t.requests, request)
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestDeepLTransport(t *testing.T) {
+	base := &recordingTransport{}
+	transport := &deepLTransport{base: base, key: "secret"}
+	request := httptest.NewRequest(http.MethodGet, "https://api.deepl.com/v2/languages", nil)
+	_, err := transport.RoundTrip(request)
+	require.NoError(t, err)
+	require.Len(t, base.requests, 1)
+	assert.Equal(t, "DeepL-Auth-Key secret", base.requests[0].Header.Get("Authorization"))
+	// The caller's request is left alone
+	assert.Empty(t, request.Header.Get("Authorization"))
+}
+
+func TestDeepL(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "DeepL-Auth-Key secret", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/v2/languages":
+			assert.Equal(t, "target", r.URL.Query().Get("type"))
+			w.Write([]byte(`[{"language": "DE", "name": "German"}, {"language": "EN-GB", "name": "English (British)"}, {"language": "EN-US", "name": "English (American)"}]`))
+		case "/v2/translate":
+			var request struct {
+				Text       []string `json:"text"`
+				TargetLang string   `json:"target_lang"`
+			}
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+			response := map[string][]map[string]string{"translations": {}}
+			for _, text := range request.Text {
+				response["translations"] = append(response["translations"], map[string]string{"detected_source_language": "ES", "text": request.TargetLang + ": " + text})
+			}
+			json.NewEncoder(w).Encode(response)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name        string
+		lang        language.Tag
+		expectedTag language.Tag
+		expected    string
+		hasErr      bool
+	}{
+		{
+			name:        "Translates into the requested language",
+			lang:        language.German,
+			expectedTag: language.German,
+			expected:    "DE: hola",
+		},
+		{
+			name:        "Translates into the requested variant",
+			lang:        language.AmericanEnglish,
+			expectedTag: language.AmericanEnglish,
+			expected:    "EN-US: hola",
+		},
+		{
+			name:   "Fails for languages DeepL doesn't support",
+			lang:   language.Japanese,
+			hasErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			translator := NewDeepL("secret").(*deepL)
+			translator.url = server.URL
+			ctx := message.WithLanguage(context.Background(), test.lang)
+			tag, translated, err := translator.Translate(ctx, "hola")
+			if test.hasErr {
+				require.Error(t, err)
+				assert.Equal(t, structured_error.UnsupportedLanguage, err.Type())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedTag, tag)
+			assert.Equal(t, test.expected, translated)
+		})
+	}
+}
@@ -0,0 +1,25 @@
+package vision
+
+import (
+	"context"
+)
+
+type describeHintsCtxKey int
+
+const theDescribeHintsKey describeHintsCtxKey = 0
+
+// What the caller knows about an image, which some describers use to say more about it
+type DescribeHints struct {
+	// What the image was posted with
+	TweetText string
+}
+
+// Passes hints to the descriptions made with ctx
+func WithDescribeHints(ctx context.Context, hints DescribeHints) context.Context {
+	return context.WithValue(ctx, theDescribeHintsKey, hints)
+}
+
+func getDescribeHints(ctx context.Context) DescribeHints {
+	hints, _ := ctx.Value(theDescribeHintsKey).(DescribeHints)
+	return hints
+}
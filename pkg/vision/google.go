@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"math"
 	"net/http"
 	"os"
 	"os/exec"
@@ -20,6 +21,8 @@ import (
 	"cloud.google.com/go/translate"
 	vision "cloud.google.com/go/vision/apiv1"
 	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/google/uuid"
 	"github.com/sirupsen/logrus"
@@ -36,10 +39,14 @@ type google struct {
 	supportedTags    []language.Tag
 }
 
+// Google accepts images up to 20MB, but reads small text much better once it's been scaled up
+var GoogleImageOptions = preprocess.Options{MaxDimension: 8192, MinDimension: 1024, MaxBytes: 10 * 1024 * 1024}
+
 type Google interface {
 	OCR
 	Translator
 	Transcriber
+	Labeler
 }
 
 func NewGoogle(privateKeyId string, privateKey string) (Google, error) {
@@ -85,9 +92,28 @@ func NewGoogle(privateKeyId string, privateKey string) (Google, error) {
 }
 
 func (g *google) GetOCR(ctx context.Context, url string) (*OCRResult, structured_error.StructuredError) {
+	return g.getOCR(ctx, vision.NewImageFromURI(url))
+}
+
+func (g *google) GetOCRFromBytes(ctx context.Context, image []byte) (*OCRResult, structured_error.StructuredError) {
+	return g.getOCR(ctx, &pb.Image{Content: image})
+}
+
+func (g *google) getOCR(ctx context.Context, image *pb.Image) (*OCRResult, structured_error.StructuredError) {
 	var result *OCRResult
-	image := vision.NewImageFromURI(url)
-	annotations, err := g.visionClient.DetectDocumentText(ctx, image, nil)
+	var annotations *pb.TextAnnotation
+	var imageContext *pb.ImageContext
+	if hints := getOCRHints(ctx); len(hints.Languages) > 0 {
+		imageContext = &pb.ImageContext{}
+		for _, tag := range hints.Languages {
+			imageContext.LanguageHints = append(imageContext.LanguageHints, tag.String())
+		}
+	}
+	err := retry.Do(ctx, retryPolicy, func() error {
+		var err error
+		annotations, err = g.visionClient.DetectDocumentText(ctx, image, imageContext)
+		return classifyGoogleError(err, structured_error.OCRError)
+	})
 	if annotations == nil && err == nil {
 		err = errors.New("no results")
 	}
@@ -96,13 +122,79 @@ func (g *google) GetOCR(ctx context.Context, url string) (*OCRResult, structured
 	// logrus.Debug(fmt.Sprintf("Google annotations\n%v\nerr: %v", string(annotationsJSON), err))
 	logrus.Debug(fmt.Sprintf("Have Google annotations %v", annotations != nil))
 	if err == nil {
-		text := getText(annotations.Pages)
 		language := getLanguage(annotations.Pages)
-		result = &OCRResult{Text: text, Language: language}
+		blocks := ReadingOrder(getBlocks(annotations.Pages, language))
+		result = NormalizeOCR(&OCRResult{Text: blocksText(blocks), Language: language, Blocks: blocks}, getNormalizeOptions(ctx))
 	}
 	return result, structured_error.Wrap(err, structured_error.OCRError)
 }
 
+var googleLabelFeatures = []*pb.Feature{
+	{Type: pb.Feature_LANDMARK_DETECTION},
+	{Type: pb.Feature_LOGO_DETECTION},
+	{Type: pb.Feature_OBJECT_LOCALIZATION},
+	{Type: pb.Feature_LABEL_DETECTION},
+}
+
+func (g *google) GetLabels(ctx context.Context, url string) ([]Label, structured_error.StructuredError) {
+	return g.getLabels(ctx, vision.NewImageFromURI(url))
+}
+
+func (g *google) GetLabelsFromBytes(ctx context.Context, image []byte) ([]Label, structured_error.StructuredError) {
+	return g.getLabels(ctx, &pb.Image{Content: image})
+}
+
+// Google only names things in English, so the caller has to translate them
+func (g *google) getLabels(ctx context.Context, image *pb.Image) ([]Label, structured_error.StructuredError) {
+	_, wrongLangErr := message.GetCompatibleLanguage(ctx, []language.Tag{language.English})
+	var response *pb.AnnotateImageResponse
+	err := retry.Do(ctx, retryPolicy, func() error {
+		var err error
+		response, err = g.visionClient.AnnotateImage(ctx, &pb.AnnotateImageRequest{Image: image, Features: googleLabelFeatures})
+		return classifyGoogleError(err, structured_error.LabelError)
+	})
+	// Unlike the other detections, AnnotateImage leaves problems with the image in the response
+	if err == nil && response.GetError() != nil {
+		err = errors.New(response.Error.GetMessage())
+	}
+	var result []Label
+	if err == nil {
+		result = getGoogleLabels(response)
+		logDebugJSON(result)
+		err = wrongLangErr
+	} else {
+		logrus.Debug(fmt.Sprintf("google label detection returned error %v", err))
+	}
+	return result, structured_error.Wrap(err, structured_error.LabelError)
+}
+
+// Objects are only located relative to the size of the image, so they're left without bounds
+func getGoogleLabels(response *pb.AnnotateImageResponse) []Label {
+	labels := []Label{}
+	addEntities := func(entities []*pb.EntityAnnotation, kind LabelKind) {
+		for _, entity := range entities {
+			if entity.GetDescription() == "" {
+				continue
+			}
+			label := Label{Text: entity.Description, Confidence: entity.Score, Kind: kind}
+			if entity.BoundingPoly != nil && len(entity.BoundingPoly.Vertices) > 0 {
+				bounds := getBounds(entity.BoundingPoly)
+				label.Bounds = &bounds
+			}
+			labels = append(labels, label)
+		}
+	}
+	addEntities(response.GetLandmarkAnnotations(), LandmarkLabel)
+	addEntities(response.GetLogoAnnotations(), BrandLabel)
+	for _, object := range response.GetLocalizedObjectAnnotations() {
+		if object.GetName() != "" {
+			labels = append(labels, Label{Text: object.Name, Confidence: object.Score, Kind: ObjectLabel})
+		}
+	}
+	addEntities(response.GetLabelAnnotations(), TagLabel)
+	return labels
+}
+
 func (g *google) Close() error {
 	errs := []error{
 		g.visionClient.Close(),
@@ -131,8 +223,12 @@ func (g *google) Translate(ctx context.Context, toTranslate string) (language.Ta
 		if err == nil {
 			var translations []translate.Translation
 			logrus.Debug(fmt.Sprintf("Calling translate with tag %s", tag.String()))
-			translations, err = g.translateClient.Translate(ctx, []string{toTranslate}, tag, &translate.Options{
-				Format: translate.Text,
+			err = retry.Do(ctx, retryPolicy, func() error {
+				var err error
+				translations, err = g.translateClient.Translate(ctx, []string{toTranslate}, tag, &translate.Options{
+					Format: translate.Text,
+				})
+				return classifyGoogleError(err, structured_error.TranslateError)
 			})
 			if len(translations) == 0 && err == nil {
 				err = errors.New("no results")
@@ -166,7 +262,7 @@ func (g *google) Transcribe(ctx context.Context, url string) ([]TranscriptionRes
 		language := message.GetLanguage(ctx)
 		var operation *speech.LongRunningRecognizeOperation
 
-		operation, err = g.transcribeClient.LongRunningRecognize(ctx, &speechpb.LongRunningRecognizeRequest{
+		request := &speechpb.LongRunningRecognizeRequest{
 			Config: &speechpb.RecognitionConfig{
 				Encoding:                            speechpb.RecognitionConfig_FLAC,
 				EnableSeparateRecognitionPerChannel: false,
@@ -186,6 +282,11 @@ func (g *google) Transcribe(ctx context.Context, url string) ([]TranscriptionRes
 					Uri: fmt.Sprintf("gs://captions_please_transcribe/%s", objectName),
 				},
 			},
+		}
+		err = retry.Do(ctx, retryPolicy, func() error {
+			var err error
+			operation, err = g.transcribeClient.LongRunningRecognize(ctx, request)
+			return classifyGoogleError(err, structured_error.TranscribeError)
 		})
 
 		if err == nil {
@@ -266,7 +367,12 @@ func (g *google) getCloudObject(objectName string) *storage.ObjectHandle {
 
 func (g *google) loadSupportedLanguages(ctx context.Context) {
 	if len(g.supportedTags) == 0 {
-		languages, err := g.translateClient.SupportedLanguages(ctx, language.English)
+		var languages []translate.Language
+		err := retry.Do(ctx, retryPolicy, func() error {
+			var err error
+			languages, err = g.translateClient.SupportedLanguages(ctx, language.English)
+			return classifyGoogleError(err, structured_error.TranslateError)
+		})
 		if err == nil {
 			tags := make([]language.Tag, len(languages))
 			for i, lang := range languages {
@@ -318,42 +424,140 @@ func getLanguage(pages []*pb.Page) OCRLanguage {
 	return ocrLanguage
 }
 
-func getText(pages []*pb.Page) string {
-	builder := strings.Builder{}
-	// Apparently, google returns nil pointers sometimes so we have to check everything. sigh.
+// Splits the text up by block, each with the language google detected for it.
+// Blocks google didn't detect a language for are assumed to be in pageLanguage
+func getBlocks(pages []*pb.Page, pageLanguage OCRLanguage) []OCRBlock {
+	blocks := []OCRBlock{}
 	for _, page := range pages {
 		if page == nil {
 			continue
 		}
 		for _, block := range page.Blocks {
-			if block == nil {
+			builder := strings.Builder{}
+			writeBlockText(&builder, block)
+			text := strings.TrimSpace(builder.String())
+			if text != "" {
+				blocks = append(blocks, OCRBlock{
+					Text:       text,
+					Language:   getBlockLanguage(block, pageLanguage),
+					Bounds:     getBounds(block.BoundingBox),
+					Confidence: block.Confidence,
+					Lines:      getLines(block),
+				})
+			}
+		}
+	}
+	return blocks
+}
+
+func getBlockLanguage(block *pb.Block, fallback OCRLanguage) OCRLanguage {
+	ocrLanguage := fallback
+	if block.Property == nil {
+		return ocrLanguage
+	}
+	found := false
+	for _, detectedLanguage := range block.Property.DetectedLanguages {
+		if detectedLanguage == nil {
+			continue
+		}
+		tag, err := language.Parse(detectedLanguage.LanguageCode)
+		if err == nil && (!found || detectedLanguage.Confidence > ocrLanguage.Confidence) {
+			ocrLanguage = OCRLanguage{Tag: tag, Confidence: detectedLanguage.Confidence}
+			found = true
+		}
+	}
+	return ocrLanguage
+}
+
+// Google groups words by paragraph, rather than by line, so they're split up wherever google found the end of a line
+func getLines(block *pb.Block) []OCRLine {
+	lines := []OCRLine{}
+	for _, paragraph := range block.Paragraphs {
+		if paragraph == nil {
+			continue
+		}
+		line := OCRLine{}
+		for _, word := range paragraph.Words {
+			if word == nil {
 				continue
 			}
-			for _, paragraph := range block.Paragraphs {
-				if paragraph == nil {
+			builder := strings.Builder{}
+			endsLine := false
+			for _, symbol := range word.Symbols {
+				if symbol == nil {
 					continue
 				}
-				for _, word := range paragraph.Words {
-					if word == nil {
-						continue
-					}
-					for _, symbol := range word.Symbols {
-						if symbol == nil {
-							continue
-						}
-						if symbol.Property != nil && symbol.Property.DetectedBreak != nil && symbol.Property.DetectedBreak.IsPrefix {
-							builder.WriteString(" ")
-						}
-						builder.WriteString(symbol.Text)
-						if symbol.Property != nil && symbol.Property.DetectedBreak != nil && !symbol.Property.DetectedBreak.IsPrefix {
-							builder.WriteString(" ")
-						}
+				builder.WriteString(symbol.Text)
+				if symbol.Property != nil && symbol.Property.DetectedBreak != nil {
+					switch symbol.Property.DetectedBreak.Type {
+					case pb.TextAnnotation_DetectedBreak_EOL_SURE_SPACE, pb.TextAnnotation_DetectedBreak_LINE_BREAK, pb.TextAnnotation_DetectedBreak_HYPHEN:
+						endsLine = true
 					}
 				}
-				builder.WriteString("\n\n")
+			}
+			bounds := getBounds(word.BoundingBox)
+			line.Words = append(line.Words, OCRWord{Text: builder.String(), Bounds: bounds, Confidence: word.Confidence})
+			line.Bounds = line.Bounds.union(bounds)
+			if endsLine {
+				lines = append(lines, line)
+				line = OCRLine{}
+			}
+		}
+		if len(line.Words) > 0 {
+			lines = append(lines, line)
+		}
+		if len(lines) > 0 {
+			lines[len(lines)-1].EndsParagraph = true
+		}
+	}
+	return lines
+}
+
+func getBounds(poly *pb.BoundingPoly) Bounds {
+	if poly == nil || len(poly.Vertices) == 0 {
+		return Bounds{}
+	}
+	left, top, right, bottom := math.MaxInt32, math.MaxInt32, math.MinInt32, math.MinInt32
+	for _, vertex := range poly.Vertices {
+		if vertex == nil {
+			continue
+		}
+		left = minInt(left, int(vertex.X))
+		top = minInt(top, int(vertex.Y))
+		right = maxInt(right, int(vertex.X))
+		bottom = maxInt(bottom, int(vertex.Y))
+	}
+	if left > right {
+		return Bounds{}
+	}
+	return Bounds{X: left, Y: top, Width: right - left, Height: bottom - top}
+}
+
+func writeBlockText(builder *strings.Builder, block *pb.Block) {
+	if block == nil {
+		return
+	}
+	for _, paragraph := range block.Paragraphs {
+		if paragraph == nil {
+			continue
+		}
+		for _, word := range paragraph.Words {
+			if word == nil {
+				continue
+			}
+			for _, symbol := range word.Symbols {
+				if symbol == nil {
+					continue
+				}
+				if symbol.Property != nil && symbol.Property.DetectedBreak != nil && symbol.Property.DetectedBreak.IsPrefix {
+					builder.WriteString(" ")
+				}
+				builder.WriteString(symbol.Text)
+				if symbol.Property != nil && symbol.Property.DetectedBreak != nil && !symbol.Property.DetectedBreak.IsPrefix {
+					builder.WriteString(" ")
+				}
 			}
 		}
+		builder.WriteString("\n\n")
 	}
-	text := strings.TrimSpace(builder.String())
-	return text
 }
@@ -0,0 +1,200 @@
+package vision
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	vision "cloud.google.com/go/vision/apiv1"
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
+	"google.golang.org/api/option"
+	pb "google.golang.org/genproto/googleapis/cloud/vision/v1"
+	"google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+)
+
+func newTestBox(x, y, width, height int32) *pb.BoundingPoly {
+	return &pb.BoundingPoly{Vertices: []*pb.Vertex{{X: x, Y: y}, {X: x + width, Y: y}, {X: x + width, Y: y + height}, {X: x, Y: y + height}}}
+}
+
+// Each line of text is a line in the block, and its words are laid out 10 pixels wide, 10 pixels apart
+func newTestBlock(text string, languages ...*pb.TextAnnotation_DetectedLanguage) *pb.Block {
+	words := []*pb.Word{}
+	for y, line := range strings.Split(text, "\n") {
+		fields := strings.Fields(line)
+		for x, field := range fields {
+			symbols := []*pb.Symbol{}
+			for _, r := range field {
+				symbols = append(symbols, &pb.Symbol{Text: string(r)})
+			}
+			breakType := pb.TextAnnotation_DetectedBreak_SPACE
+			if x == len(fields)-1 {
+				breakType = pb.TextAnnotation_DetectedBreak_EOL_SURE_SPACE
+			}
+			symbols[len(symbols)-1].Property = &pb.TextAnnotation_TextProperty{DetectedBreak: &pb.TextAnnotation_DetectedBreak{Type: breakType}}
+			words = append(words, &pb.Word{Symbols: symbols, BoundingBox: newTestBox(int32(x*20), int32(y*20), 10, 10), Confidence: 0.5})
+		}
+	}
+	block := &pb.Block{Paragraphs: []*pb.Paragraph{{Words: words}}, Confidence: 0.8}
+	if len(languages) > 0 {
+		block.Property = &pb.TextAnnotation_TextProperty{DetectedLanguages: languages}
+	}
+	return block
+}
+
+func TestGetBlocks(t *testing.T) {
+	pageLanguage := OCRLanguage{Tag: language.English, Confidence: 0.6}
+	pages := []*pb.Page{
+		nil,
+		{Blocks: []*pb.Block{
+			newTestBlock("hello", &pb.TextAnnotation_DetectedLanguage{LanguageCode: "en", Confidence: 0.9}),
+			newTestBlock("hola", &pb.TextAnnotation_DetectedLanguage{LanguageCode: "en", Confidence: 0.2}, &pb.TextAnnotation_DetectedLanguage{LanguageCode: "es", Confidence: 0.7}),
+			nil,
+			newTestBlock("??"),
+			newTestBlock(""),
+		}},
+	}
+	blocks := getBlocks(pages, pageLanguage)
+	languages := make([]OCRLanguage, len(blocks))
+	for i, block := range blocks {
+		languages[i] = block.Language
+	}
+	assert.Equal(t, []OCRLanguage{{Tag: language.English, Confidence: 0.9}, {Tag: language.Spanish, Confidence: 0.7}, pageLanguage}, languages)
+	assert.Equal(t, "hello\n\nhola\n\n??", blocksText(blocks))
+}
+
+func TestGetBlocksSplitsLines(t *testing.T) {
+	pages := []*pb.Page{{Blocks: []*pb.Block{newTestBlock("one two\nthree")}}}
+	expected := []OCRBlock{{
+		Text:       "one two three",
+		Language:   OCRLanguage{},
+		Confidence: 0.8,
+		Lines: []OCRLine{
+			{
+				Words: []OCRWord{
+					{Text: "one", Bounds: Bounds{X: 0, Y: 0, Width: 10, Height: 10}, Confidence: 0.5},
+					{Text: "two", Bounds: Bounds{X: 20, Y: 0, Width: 10, Height: 10}, Confidence: 0.5},
+				},
+				Bounds: Bounds{X: 0, Y: 0, Width: 30, Height: 10},
+			},
+			{
+				Words:         []OCRWord{{Text: "three", Bounds: Bounds{X: 0, Y: 20, Width: 10, Height: 10}, Confidence: 0.5}},
+				Bounds:        Bounds{X: 0, Y: 20, Width: 10, Height: 10},
+				EndsParagraph: true,
+			},
+		},
+	}}
+	assert.Equal(t, expected, getBlocks(pages, OCRLanguage{}))
+}
+
+// Answers every request with the same text, unless it's given a response, and remembers what it was asked for
+type fakeImageAnnotator struct {
+	pb.UnimplementedImageAnnotatorServer
+	requests []*pb.AnnotateImageRequest
+	response *pb.AnnotateImageResponse
+}
+
+func (f *fakeImageAnnotator) BatchAnnotateImages(ctx context.Context, request *pb.BatchAnnotateImagesRequest) (*pb.BatchAnnotateImagesResponse, error) {
+	f.requests = append(f.requests, request.Requests...)
+	if f.response != nil {
+		return &pb.BatchAnnotateImagesResponse{Responses: []*pb.AnnotateImageResponse{f.response}}, nil
+	}
+	annotation := &pb.TextAnnotation{Text: "hola", Pages: []*pb.Page{{Blocks: []*pb.Block{newTestBlock("hola")}}}}
+	return &pb.BatchAnnotateImagesResponse{Responses: []*pb.AnnotateImageResponse{{FullTextAnnotation: annotation}}}, nil
+}
+
+func newFakeGoogle(t *testing.T) (*google, *fakeImageAnnotator) {
+	listener, err := net.Listen("tcp", "localhost:0")
+	require.NoError(t, err)
+	server := grpc.NewServer()
+	annotator := &fakeImageAnnotator{}
+	pb.RegisterImageAnnotatorServer(server, annotator)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	client, err := vision.NewImageAnnotatorClient(context.Background(),
+		option.WithEndpoint(listener.Addr().String()),
+		option.WithoutAuthentication(),
+		option.WithGRPCDialOption(grpc.WithInsecure()))
+	require.NoError(t, err)
+	t.Cleanup(func() { client.Close() })
+	return &google{visionClient: client}, annotator
+}
+
+func TestGoogleOCRLanguageHints(t *testing.T) {
+	tests := []struct {
+		name     string
+		hints    OCRHints
+		expected *pb.ImageContext
+	}{
+		{
+			name: "Lets google detect the language without any hints",
+		},
+		{
+			name:     "Passes every hinted language",
+			hints:    OCRHints{Languages: []language.Tag{language.Spanish, language.MustParse("sr-Latn")}},
+			expected: &pb.ImageContext{LanguageHints: []string{"es", "sr-Latn"}},
+		},
+		{
+			name:  "Reads handwriting the same as printed text",
+			hints: OCRHints{Handwriting: true},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			g, annotator := newFakeGoogle(t)
+			ctx := WithOCRHints(context.Background(), test.hints)
+			result, err := g.GetOCRFromBytes(ctx, []byte("image"))
+			require.NoError(t, err)
+			assert.Equal(t, "hola", result.Text)
+			require.Len(t, annotator.requests, 1)
+			if test.expected == nil {
+				assert.Nil(t, annotator.requests[0].ImageContext)
+			} else {
+				assert.Equal(t, test.expected.LanguageHints, annotator.requests[0].ImageContext.GetLanguageHints())
+			}
+		})
+	}
+}
+
+func TestGoogleLabels(t *testing.T) {
+	response := &pb.AnnotateImageResponse{
+		LabelAnnotations:           []*pb.EntityAnnotation{{Description: "Tower", Score: 0.9}, {Description: ""}},
+		LandmarkAnnotations:        []*pb.EntityAnnotation{{Description: "Eiffel Tower", Score: 0.8, BoundingPoly: newTestBox(10, 20, 30, 40)}},
+		LogoAnnotations:            []*pb.EntityAnnotation{{Description: "Acme", Score: 0.7}},
+		LocalizedObjectAnnotations: []*pb.LocalizedObjectAnnotation{{Name: "Person", Score: 0.6}},
+	}
+	expected := []Label{
+		{Text: "Eiffel Tower", Confidence: 0.8, Kind: LandmarkLabel, Bounds: &Bounds{X: 10, Y: 20, Width: 30, Height: 40}},
+		{Text: "Acme", Confidence: 0.7, Kind: BrandLabel},
+		{Text: "Person", Confidence: 0.6, Kind: ObjectLabel},
+		{Text: "Tower", Confidence: 0.9, Kind: TagLabel},
+	}
+
+	g, annotator := newFakeGoogle(t)
+	annotator.response = response
+	labels, err := g.GetLabelsFromBytes(message.WithLanguage(context.Background(), language.English), []byte("image"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, labels)
+	require.Len(t, annotator.requests, 1)
+	features := []pb.Feature_Type{}
+	for _, feature := range annotator.requests[0].Features {
+		features = append(features, feature.Type)
+	}
+	assert.Equal(t, []pb.Feature_Type{pb.Feature_LANDMARK_DETECTION, pb.Feature_LOGO_DETECTION, pb.Feature_OBJECT_LOCALIZATION, pb.Feature_LABEL_DETECTION}, features)
+
+	labels, err = g.GetLabels(message.WithLanguage(context.Background(), language.German), "https://example.com/paris.jpg")
+	require.Error(t, err)
+	assert.Equal(t, structured_error.UnsupportedLanguage, err.Type())
+	assert.Equal(t, expected, labels)
+
+	annotator.response = &pb.AnnotateImageResponse{Error: &status.Status{Message: "bad image"}}
+	_, err = g.GetLabelsFromBytes(context.Background(), []byte("image"))
+	require.Error(t, err)
+	assert.Equal(t, structured_error.LabelError, err.Type())
+}
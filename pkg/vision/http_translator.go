@@ -0,0 +1,76 @@
+package vision
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
+)
+
+// Remembers which languages a translation API can translate into, so they're only looked up once
+type supportedLanguages struct {
+	lock sync.Mutex
+	tags []language.Tag
+	// The code the API uses for each of the tags
+	codes map[language.Tag]string
+}
+
+// Returns the API's code for the language the reply should be in. fetch returns every code the API supports
+func (s *supportedLanguages) targetCode(ctx context.Context, fetch func(ctx context.Context) ([]string, error)) (language.Tag, string, error) {
+	s.lock.Lock()
+	if len(s.tags) == 0 {
+		codes, err := fetch(ctx)
+		if err != nil {
+			s.lock.Unlock()
+			return language.Tag{}, "", fmt.Errorf("cannot determine supported tags for translation: %v", err)
+		}
+		s.codes = map[language.Tag]string{}
+		for _, code := range codes {
+			tag, err := language.Parse(code)
+			if err != nil {
+				logrus.Debug(fmt.Sprintf("Ignoring the unknown translation language %s", code))
+				continue
+			}
+			s.tags = append(s.tags, tag)
+			s.codes[tag] = code
+		}
+	}
+	tags := s.tags
+	codes := s.codes
+	s.lock.Unlock()
+
+	if len(tags) == 0 {
+		return language.Tag{}, "", errors.New("cannot determine supported tags for translation")
+	}
+	tag, err := message.GetCompatibleLanguage(ctx, tags)
+	if err != nil {
+		return tag, "", err
+	}
+	return tag, codes[tag], nil
+}
+
+// Sends the request from newRequest, retrying transient failures, and decodes the JSON response into result.
+// newRequest is called for every attempt since a request body can only be read once
+func doJSON(ctx context.Context, client *http.Client, newRequest func() (*http.Request, error), errorType structured_error.ErrorType, result interface{}) error {
+	return retry.Do(ctx, retryPolicy, func() error {
+		request, err := newRequest()
+		if err != nil {
+			return err
+		}
+		response, err := client.Do(request)
+		err = classifyResponse(response, err, errorType)
+		if err != nil {
+			return err
+		}
+		defer response.Body.Close()
+		return json.NewDecoder(response.Body).Decode(result)
+	})
+}
@@ -0,0 +1,92 @@
+package vision
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language"
+)
+
+type libreTranslate struct {
+	client    *http.Client
+	url       string
+	key       string
+	languages supportedLanguages
+}
+
+type LibreTranslate interface {
+	Translator
+}
+
+// Translates with a LibreTranslate server, such as one started with `docker run -p 5000:5000 libretranslate/libretranslate`.
+// key can be empty if the server doesn't require one
+func NewLibreTranslate(url string, key string) LibreTranslate {
+	return &libreTranslate{
+		client: &http.Client{},
+		url:    strings.TrimSuffix(url, "/"),
+		key:    key,
+	}
+}
+
+func (l *libreTranslate) Translate(ctx context.Context, toTranslate string) (language.Tag, string, structured_error.StructuredError) {
+	var translated string
+	tag, code, err := l.languages.targetCode(ctx, l.supportedCodes)
+	if err == nil {
+		type translateRequest struct {
+			Q      string `json:"q"`
+			Source string `json:"source"`
+			Target string `json:"target"`
+			Format string `json:"format"`
+			ApiKey string `json:"api_key,omitempty"`
+		}
+		var body []byte
+		body, err = json.Marshal(translateRequest{Q: toTranslate, Source: "auto", Target: code, Format: "text", ApiKey: l.key})
+		if err == nil {
+			var parsed struct {
+				TranslatedText string `json:"translatedText"`
+			}
+			logrus.Debug(fmt.Sprintf("Calling LibreTranslate with target %s", code))
+			err = doJSON(ctx, l.client, func() (*http.Request, error) {
+				request, err := http.NewRequestWithContext(ctx, http.MethodPost, l.url+"/translate", bytes.NewReader(body))
+				if err == nil {
+					request.Header.Set("Content-Type", "application/json")
+				}
+				return request, err
+			}, structured_error.TranslateError, &parsed)
+			if err == nil && parsed.TranslatedText == "" {
+				err = errors.New("no results")
+			}
+			translated = parsed.TranslatedText
+		}
+	}
+
+	if err != nil {
+		logrus.Debug(fmt.Sprintf("Translation failed with %v", err))
+	}
+	return tag, translated, structured_error.Wrap(err, structured_error.TranslateError)
+}
+
+func (l *libreTranslate) supportedCodes(ctx context.Context) ([]string, error) {
+	var languages []struct {
+		Code string `json:"code"`
+	}
+	err := doJSON(ctx, l.client, func() (*http.Request, error) {
+		return http.NewRequestWithContext(ctx, http.MethodGet, l.url+"/languages", nil)
+	}, structured_error.TranslateError, &languages)
+	codes := make([]string, len(languages))
+	for i, lang := range languages {
+		codes[i] = lang.Code
+	}
+	return codes, err
+}
+
+func (l *libreTranslate) Close() error {
+	return nil
+}
@@ -0,0 +1,119 @@
+package vision
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
+)
+
+func TestLibreTranslate(t *testing.T) {
+	origRetryPolicy := retryPolicy
+	retryPolicy = retry.Policy{MaxAttempts: 2}
+	defer func() {
+		retryPolicy = origRetryPolicy
+	}()
+
+	tests := []struct {
+		name        string
+		lang        language.Tag
+		key         string
+		failures    int
+		status      int
+		expectedTag language.Tag
+		expected    string
+		hasErr      bool
+		errType     structured_error.ErrorType
+	}{
+		{
+			name:        "Translates into the requested language",
+			lang:        language.German,
+			expectedTag: language.German,
+			expected:    "de: hola",
+		},
+		{
+			name:        "Sends the api key",
+			lang:        language.English,
+			key:         "secret",
+			expectedTag: language.English,
+			expected:    "en: hola",
+		},
+		{
+			name:        "Retries when the server is busy",
+			lang:        language.English,
+			failures:    1,
+			expectedTag: language.English,
+			expected:    "en: hola",
+		},
+		{
+			name:    "Fails for languages the server doesn't support",
+			lang:    language.Japanese,
+			hasErr:  true,
+			errType: structured_error.UnsupportedLanguage,
+		},
+		{
+			name:    "Fails when the server rejects the request",
+			lang:    language.English,
+			status:  http.StatusBadRequest,
+			hasErr:  true,
+			errType: structured_error.TranslateError,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			languageCalls := 0
+			failures := test.failures
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/languages":
+					languageCalls++
+					w.Write([]byte(`[{"code": "en", "name": "English"}, {"code": "de", "name": "German"}, {"code": "not a language"}]`))
+				case "/translate":
+					if failures > 0 {
+						failures--
+						w.WriteHeader(http.StatusServiceUnavailable)
+						return
+					}
+					if test.status != 0 {
+						w.WriteHeader(test.status)
+						w.Write([]byte(`{"error": "nope"}`))
+						return
+					}
+					var request map[string]string
+					require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+					assert.Equal(t, "auto", request["source"])
+					assert.Equal(t, test.key, request["api_key"])
+					json.NewEncoder(w).Encode(map[string]string{"translatedText": request["target"] + ": " + request["q"]})
+				default:
+					w.WriteHeader(http.StatusNotFound)
+				}
+			}))
+			defer server.Close()
+
+			translator := NewLibreTranslate(server.URL+"/", test.key)
+			ctx := message.WithLanguage(context.Background(), test.lang)
+			tag, translated, err := translator.Translate(ctx, "hola")
+			if test.hasErr {
+				require.Error(t, err)
+				assert.Equal(t, test.errType, err.Type())
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, test.expectedTag, tag)
+			assert.Equal(t, test.expected, translated)
+
+			// The supported languages are only looked up once
+			_, _, err = translator.Translate(ctx, "hola")
+			require.NoError(t, err)
+			assert.Equal(t, 1, languageCalls)
+		})
+	}
+}
@@ -0,0 +1,48 @@
+package vision
+
+import (
+	"context"
+
+	"golang.org/x/text/language"
+)
+
+type ocrHintsCtxKey int
+
+const theOCRHintsKey ocrHintsCtxKey = 0
+
+// What the caller knows about the text in an image, to help the provider read it
+type OCRHints struct {
+	// The languages the text is probably in
+	Languages []language.Tag
+	// The text is handwritten. Azure reads it with the slower Read API, google reads it the same as printed text
+	Handwriting bool
+}
+
+// Passes hints to the OCR calls made with ctx
+func WithOCRHints(ctx context.Context, hints OCRHints) context.Context {
+	return context.WithValue(ctx, theOCRHintsKey, hints)
+}
+
+func getOCRHints(ctx context.Context) OCRHints {
+	hints, _ := ctx.Value(theOCRHintsKey).(OCRHints)
+	return hints
+}
+
+// The first of the hinted languages the provider supports, or false if none of them are
+func hintedLanguage(hints OCRHints, supported []language.Tag) (language.Tag, bool) {
+	if len(hints.Languages) == 0 || len(supported) == 0 {
+		return language.Und, false
+	}
+	matcher := language.NewMatcher(supported)
+	for _, hint := range hints.Languages {
+		_, index, confidence := matcher.Match(hint)
+		// The matcher falls back to languages commonly spoken by the same people, like English for Swahili,
+		// which would make the provider read the text as the wrong language
+		hintBase, _ := hint.Base()
+		supportedBase, _ := supported[index].Base()
+		if confidence >= language.High && hintBase == supportedBase {
+			return supported[index], true
+		}
+	}
+	return language.Und, false
+}
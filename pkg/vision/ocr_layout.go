@@ -0,0 +1,167 @@
+package vision
+
+import (
+	"sort"
+	"strings"
+)
+
+func (b Bounds) right() int {
+	return b.X + b.Width
+}
+
+func (b Bounds) bottom() int {
+	return b.Y + b.Height
+}
+
+// The smallest bounds containing both
+func (b Bounds) union(other Bounds) Bounds {
+	if b == (Bounds{}) {
+		return other
+	} else if other == (Bounds{}) {
+		return b
+	}
+	x := minInt(b.X, other.X)
+	y := minInt(b.Y, other.Y)
+	return Bounds{X: x, Y: y, Width: maxInt(b.right(), other.right()) - x, Height: maxInt(b.bottom(), other.bottom()) - y}
+}
+
+func (l OCRLine) Text() string {
+	text := ""
+	for _, word := range l.Words {
+		text = joinWords(text, word.Text)
+	}
+	return text
+}
+
+// A tree of the blocks, split wherever there's a gap running all the way across them.
+// Reading it depth first gives the blocks in reading order
+type layoutNode struct {
+	// Set for leaves, which have no children
+	block    *OCRBlock
+	children []*layoutNode
+	// The children are columns, left to right, rather than rows, top to bottom
+	sideBySide bool
+}
+
+// Sorts the blocks into the order they'd be read in, so multiple columns are read one after another instead of
+// line by line across all of them. Text spanning the columns, like a heading, is read before or after them
+func ReadingOrder(blocks []OCRBlock) []OCRBlock {
+	ordered := make([]OCRBlock, 0, len(blocks))
+	return newLayout(blocks).appendBlocks(ordered)
+}
+
+// Cuts the blocks into columns where possible, otherwise into rows. This is the recursive XY-cut algorithm
+func newLayout(blocks []OCRBlock) *layoutNode {
+	if len(blocks) == 0 {
+		return &layoutNode{}
+	} else if len(blocks) == 1 {
+		return &layoutNode{block: &blocks[0]}
+	}
+
+	node := &layoutNode{}
+	groups := splitAtGaps(blocks, horizontalExtent)
+	if len(groups) > 1 {
+		node.sideBySide = true
+	} else {
+		groups = keepColumnsTogether(splitAtGaps(blocks, verticalExtent))
+	}
+
+	if len(groups) == 1 {
+		// Nothing separates the blocks, so read them top to bottom
+		for i := range groups[0] {
+			node.children = append(node.children, &layoutNode{block: &groups[0][i]})
+		}
+		return node
+	}
+	for _, group := range groups {
+		node.children = append(node.children, newLayout(group))
+	}
+	return node
+}
+
+func horizontalExtent(b Bounds) (int, int) {
+	return b.X, b.right()
+}
+
+func verticalExtent(b Bounds) (int, int) {
+	return b.Y, b.bottom()
+}
+
+// Something spanning the columns, like a heading, stops them from being cut apart. Cutting the rows above and below it
+// would also cut across the columns, so the rows which are made up of columns are put back together to be cut again
+func keepColumnsTogether(rows [][]OCRBlock) [][]OCRBlock {
+	merged := [][]OCRBlock{}
+	previousHasColumns := false
+	for _, row := range rows {
+		hasColumns := len(splitAtGaps(row, horizontalExtent)) > 1
+		if hasColumns && previousHasColumns {
+			merged[len(merged)-1] = append(merged[len(merged)-1], row...)
+		} else {
+			merged = append(merged, row)
+		}
+		previousHasColumns = hasColumns
+	}
+	if len(merged) == 1 {
+		// The columns don't line up with each other, so the rows are the best we can do
+		return rows
+	}
+	return merged
+}
+
+// Sorts the blocks by where extent says they start, then groups together the ones which overlap
+func splitAtGaps(blocks []OCRBlock, extent func(Bounds) (start int, end int)) [][]OCRBlock {
+	sorted := make([]OCRBlock, len(blocks))
+	copy(sorted, blocks)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		iStart, _ := extent(sorted[i].Bounds)
+		jStart, _ := extent(sorted[j].Bounds)
+		return iStart < jStart
+	})
+
+	groups := [][]OCRBlock{}
+	groupStart := 0
+	_, groupEnd := extent(sorted[0].Bounds)
+	for i := 1; i < len(sorted); i++ {
+		start, end := extent(sorted[i].Bounds)
+		if start >= groupEnd {
+			// Capped so appending to a group can't overwrite the next one
+			groups = append(groups, sorted[groupStart:i:i])
+			groupStart = i
+		}
+		groupEnd = maxInt(groupEnd, end)
+	}
+	return append(groups, sorted[groupStart:])
+}
+
+func (node *layoutNode) appendBlocks(blocks []OCRBlock) []OCRBlock {
+	if node.block != nil {
+		return append(blocks, *node.block)
+	}
+	for _, child := range node.children {
+		blocks = child.appendBlocks(blocks)
+	}
+	return blocks
+}
+
+// Joins the text of each block, in the order given
+func blocksText(blocks []OCRBlock) string {
+	texts := make([]string, len(blocks))
+	for i, block := range blocks {
+		texts[i] = block.Text
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
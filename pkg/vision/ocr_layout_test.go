@@ -0,0 +1,73 @@
+package vision
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A block at the given position, with a line for each line of text
+func newLayoutBlock(text string, x, y, width, height int) OCRBlock {
+	block := OCRBlock{Text: strings.ReplaceAll(text, "\n", " "), Bounds: Bounds{X: x, Y: y, Width: width, Height: height}}
+	for _, line := range strings.Split(text, "\n") {
+		ocrLine := OCRLine{}
+		for _, word := range strings.Fields(line) {
+			ocrLine.Words = append(ocrLine.Words, OCRWord{Text: word})
+		}
+		block.Lines = append(block.Lines, ocrLine)
+	}
+	return block
+}
+
+func texts(blocks []OCRBlock) []string {
+	result := make([]string, len(blocks))
+	for i, block := range blocks {
+		result[i] = block.Text
+	}
+	return result
+}
+
+func TestReadingOrder(t *testing.T) {
+	tests := []struct {
+		name     string
+		blocks   []OCRBlock
+		expected []string
+	}{
+		{
+			name: "Reads each column before the next",
+			blocks: []OCRBlock{
+				newLayoutBlock("heading", 0, 0, 200, 20),
+				newLayoutBlock("left 1", 0, 30, 90, 50),
+				newLayoutBlock("right 1", 110, 30, 90, 50),
+				newLayoutBlock("left 2", 0, 90, 90, 50),
+				newLayoutBlock("right 2", 110, 90, 90, 50),
+				newLayoutBlock("footer", 0, 150, 200, 20),
+			},
+			expected: []string{"heading", "left 1", "left 2", "right 1", "right 2", "footer"},
+		},
+		{
+			name: "Reads overlapping blocks top to bottom",
+			blocks: []OCRBlock{
+				newLayoutBlock("bottom", 0, 20, 100, 30),
+				newLayoutBlock("top", 50, 0, 100, 30),
+			},
+			expected: []string{"top", "bottom"},
+		},
+		{
+			name:     "Keeps the order of blocks without any bounds",
+			blocks:   []OCRBlock{{Text: "one"}, {Text: "two"}, {Text: "three"}},
+			expected: []string{"one", "two", "three"},
+		},
+		{
+			name:     "Handles no blocks",
+			blocks:   []OCRBlock{},
+			expected: []string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, texts(ReadingOrder(test.blocks)))
+		})
+	}
+}
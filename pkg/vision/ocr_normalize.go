@@ -0,0 +1,142 @@
+package vision
+
+import (
+	"context"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+type normalizeCtxKey int
+
+const theNormalizeKey normalizeCtxKey = 0
+
+// How the text from every OCR provider is cleaned up
+type NormalizeOptions struct {
+	// Drops words the provider was less sure of than this, which are usually specks in the image read as letters.
+	// Zero keeps everything. Words the provider didn't give a confidence for are always kept
+	MinConfidence float32
+}
+
+// Sets how the OCR results fetched with ctx are cleaned up
+func WithNormalizeOptions(ctx context.Context, options NormalizeOptions) context.Context {
+	return context.WithValue(ctx, theNormalizeKey, options)
+}
+
+func getNormalizeOptions(ctx context.Context) NormalizeOptions {
+	options, _ := ctx.Value(theNormalizeKey).(NormalizeOptions)
+	return options
+}
+
+// Cleans up the text, so it reads the same no matter which provider it came from. Words are put back together
+// where they were hyphenated at the end of a line, the lines of each paragraph are joined, extra whitespace is
+// removed, and the text is NFC normalized. result is left as is
+func NormalizeOCR(result *OCRResult, options NormalizeOptions) *OCRResult {
+	normalized := *result
+	if len(result.Blocks) == 0 {
+		normalized.Text = normalizeText(result.Text)
+		return &normalized
+	}
+
+	normalized.Blocks = make([]OCRBlock, 0, len(result.Blocks))
+	for _, block := range result.Blocks {
+		if len(block.Lines) > 0 {
+			block.Lines = removeNoise(block.Lines, options.MinConfidence)
+			block.Text = linesText(block.Lines)
+		}
+		block.Text = normalizeText(block.Text)
+		if block.Text != "" {
+			normalized.Blocks = append(normalized.Blocks, block)
+		}
+	}
+	normalized.Text = blocksText(normalized.Blocks)
+	return &normalized
+}
+
+func removeNoise(lines []OCRLine, minConfidence float32) []OCRLine {
+	kept := make([]OCRLine, 0, len(lines))
+	for _, line := range lines {
+		words := make([]OCRWord, 0, len(line.Words))
+		for _, word := range line.Words {
+			if word.Confidence == 0 || word.Confidence >= minConfidence {
+				words = append(words, word)
+			}
+		}
+		if len(words) > 0 {
+			line.Words = words
+			kept = append(kept, line)
+		} else if line.EndsParagraph && len(kept) > 0 {
+			kept[len(kept)-1].EndsParagraph = true
+		}
+	}
+	return kept
+}
+
+// One line per line, with a blank line between paragraphs
+func linesText(lines []OCRLine) string {
+	builder := strings.Builder{}
+	for _, line := range lines {
+		builder.WriteString(line.Text())
+		builder.WriteString("\n")
+		if line.EndsParagraph {
+			builder.WriteString("\n")
+		}
+	}
+	return builder.String()
+}
+
+// Paragraphs are separated by blank lines. Each comes out as a single line
+func normalizeText(text string) string {
+	text = norm.NFC.String(text)
+	paragraphs := []string{}
+	paragraph := ""
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.Join(strings.Fields(line), " ")
+		if line != "" {
+			paragraph = joinLines(paragraph, line)
+		} else if paragraph != "" {
+			paragraphs = append(paragraphs, paragraph)
+			paragraph = ""
+		}
+	}
+	if paragraph != "" {
+		paragraphs = append(paragraphs, paragraph)
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
+
+// Puts a word hyphenated across the two lines back together
+func joinLines(previous string, next string) string {
+	if strings.HasSuffix(previous, "-") {
+		beforeHyphen, _ := utf8.DecodeLastRuneInString(strings.TrimSuffix(previous, "-"))
+		first, _ := utf8.DecodeRuneInString(next)
+		if unicode.IsLetter(beforeHyphen) && unicode.IsLower(first) {
+			return strings.TrimSuffix(previous, "-") + next
+		}
+	}
+	return joinWords(previous, next)
+}
+
+// Chinese and Japanese don't put spaces between words
+func joinWords(previous string, next string) string {
+	if previous == "" {
+		return next
+	} else if next == "" {
+		return previous
+	}
+	last, _ := utf8.DecodeLastRuneInString(previous)
+	first, _ := utf8.DecodeRuneInString(next)
+	if isUnspaced(last) && isUnspaced(first) {
+		return previous + next
+	}
+	return previous + " " + next
+}
+
+// The CJK symbols and punctuation block, like 、 and 。
+var cjkPunctuation = &unicode.RangeTable{R16: []unicode.Range16{{Lo: 0x3000, Hi: 0x303f, Stride: 1}}}
+
+func isUnspaced(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana, cjkPunctuation)
+}
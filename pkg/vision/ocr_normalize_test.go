@@ -0,0 +1,52 @@
+package vision
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "Rewrite the golden files with the current output")
+
+// Each testdata/normalize/<name>.json has the OCR result to normalize, and <name>.golden has the text it should end up with
+func TestNormalizeOCR(t *testing.T) {
+	inputs, err := filepath.Glob(filepath.Join("testdata", "normalize", "*.json"))
+	require.NoError(t, err)
+	require.NotEmpty(t, inputs)
+	for _, input := range inputs {
+		name := strings.TrimSuffix(filepath.Base(input), ".json")
+		t.Run(name, func(t *testing.T) {
+			data, err := ioutil.ReadFile(input)
+			require.NoError(t, err)
+			var test struct {
+				Options NormalizeOptions
+				Result  OCRResult
+			}
+			require.NoError(t, json.Unmarshal(data, &test))
+
+			normalized := NormalizeOCR(&test.Result, test.Options)
+			golden := filepath.Join("testdata", "normalize", name+".golden")
+			if *updateGolden {
+				require.NoError(t, ioutil.WriteFile(golden, []byte(normalized.Text), 0644))
+			}
+			expected, err := ioutil.ReadFile(golden)
+			require.NoError(t, err)
+			assert.Equal(t, string(expected), normalized.Text)
+		})
+	}
+}
+
+func TestNormalizeOCRLeavesTheResultAlone(t *testing.T) {
+	result := &OCRResult{Blocks: []OCRBlock{{Lines: []OCRLine{{Words: []OCRWord{{Text: "~", Confidence: 0.1}, {Text: "hi", Confidence: 0.9}}}}}}}
+	normalized := NormalizeOCR(result, NormalizeOptions{MinConfidence: 0.5})
+	assert.Equal(t, "hi", normalized.Text)
+	assert.Len(t, normalized.Blocks[0].Lines[0].Words, 1)
+	assert.Len(t, result.Blocks[0].Lines[0].Words, 2)
+	assert.Equal(t, "", result.Text)
+}
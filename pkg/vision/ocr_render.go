@@ -0,0 +1,115 @@
+package vision
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// Writes out each block on its own, keeping the lines the provider found
+func RenderText(result *OCRResult) string {
+	if len(result.Blocks) == 0 {
+		return strings.TrimSpace(result.Text)
+	}
+	texts := make([]string, len(result.Blocks))
+	for i, block := range result.Blocks {
+		texts[i] = blockLines(block)
+	}
+	return strings.Join(texts, "\n\n")
+}
+
+// Like RenderText, except text laid out in a grid is written out as a table
+func RenderMarkdown(result *OCRResult) string {
+	if len(result.Blocks) == 0 {
+		return strings.TrimSpace(result.Text)
+	}
+	parts := newLayout(result.Blocks).appendMarkdown([]string{})
+	return strings.Join(parts, "\n\n")
+}
+
+// Everything the provider found, including where it is in the image
+func RenderJSON(result *OCRResult) (string, error) {
+	rendered, err := json.MarshalIndent(result, "", "  ")
+	return string(rendered), err
+}
+
+func blockLines(block OCRBlock) string {
+	if len(block.Lines) == 0 {
+		return block.Text
+	}
+	lines := make([]string, len(block.Lines))
+	for i, line := range block.Lines {
+		lines[i] = line.Text()
+	}
+	return strings.Join(lines, "\n")
+}
+
+func (node *layoutNode) appendMarkdown(parts []string) []string {
+	if node.block != nil {
+		return append(parts, blockLines(*node.block))
+	}
+	if rows, ok := node.tableRows(); ok {
+		return append(parts, markdownTable(rows))
+	}
+	for _, child := range node.children {
+		parts = child.appendMarkdown(parts)
+	}
+	return parts
+}
+
+// Columns of single lines, with the same number of lines in each column, lined up with each other, are a table
+func (node *layoutNode) tableRows() ([][]string, bool) {
+	if !node.sideBySide || len(node.children) < 2 {
+		return nil, false
+	}
+	columns := make([][]OCRBlock, len(node.children))
+	for i, child := range node.children {
+		if child.sideBySide {
+			return nil, false
+		}
+		cells := []*layoutNode{child}
+		if child.block == nil {
+			cells = child.children
+		}
+		for _, cell := range cells {
+			if cell.block == nil || len(cell.block.Lines) > 1 {
+				return nil, false
+			}
+			columns[i] = append(columns[i], *cell.block)
+		}
+		if len(columns[i]) < 2 || len(columns[i]) != len(columns[0]) {
+			return nil, false
+		}
+	}
+
+	rows := make([][]string, len(columns[0]))
+	for i := range rows {
+		first := columns[0][i].Bounds
+		for _, column := range columns {
+			cell := column[i]
+			if cell.Bounds.Y >= first.bottom() || first.Y >= cell.Bounds.bottom() {
+				// The cells aren't on the same row
+				return nil, false
+			}
+			rows[i] = append(rows[i], strings.ReplaceAll(blockLines(cell), "|", "\\|"))
+		}
+	}
+	return rows, true
+}
+
+func markdownTable(rows [][]string) string {
+	builder := strings.Builder{}
+	writeRow := func(cells []string) {
+		builder.WriteString(fmt.Sprintf("| %s |\n", strings.Join(cells, " | ")))
+	}
+	writeRow(rows[0])
+	divider := make([]string, len(rows[0]))
+	for i := range divider {
+		divider[i] = "---"
+	}
+	writeRow(divider)
+	for _, row := range rows[1:] {
+		writeRow(row)
+	}
+	return strings.TrimSuffix(builder.String(), "\n")
+}
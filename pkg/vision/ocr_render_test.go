@@ -0,0 +1,64 @@
+package vision
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRender(t *testing.T) {
+	table := &OCRResult{Blocks: []OCRBlock{
+		newLayoutBlock("Pets", 0, 0, 200, 20),
+		newLayoutBlock("Name", 0, 30, 90, 20),
+		newLayoutBlock("Ada", 0, 60, 90, 20),
+		newLayoutBlock("Bo|b", 0, 90, 90, 20),
+		newLayoutBlock("Age", 110, 30, 90, 20),
+		newLayoutBlock("3", 110, 60, 90, 20),
+		newLayoutBlock("4", 110, 90, 90, 20),
+	}}
+	columns := &OCRResult{Blocks: []OCRBlock{
+		newLayoutBlock("once upon\na time", 0, 0, 90, 40),
+		newLayoutBlock("the end", 0, 50, 90, 20),
+		newLayoutBlock("and then\nsomething", 110, 0, 90, 40),
+		newLayoutBlock("happened", 110, 50, 90, 20),
+	}}
+	tests := []struct {
+		name     string
+		result   *OCRResult
+		text     string
+		markdown string
+	}{
+		{
+			name:     "Renders text in a grid as a table",
+			result:   table,
+			text:     "Pets\n\nName\n\nAda\n\nBo|b\n\nAge\n\n3\n\n4",
+			markdown: "Pets\n\n| Name | Age |\n| --- | --- |\n| Ada | 3 |\n| Bo\\|b | 4 |",
+		},
+		{
+			name:     "Keeps paragraphs in columns as they are",
+			result:   columns,
+			text:     "once upon\na time\n\nthe end\n\nand then\nsomething\n\nhappened",
+			markdown: "once upon\na time\n\nthe end\n\nand then\nsomething\n\nhappened",
+		},
+		{
+			name:     "Falls back to the text without any blocks",
+			result:   &OCRResult{Text: "hello \n\n"},
+			text:     "hello",
+			markdown: "hello",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.text, RenderText(test.result))
+			assert.Equal(t, test.markdown, RenderMarkdown(test.result))
+
+			rendered, err := RenderJSON(test.result)
+			require.NoError(t, err)
+			var parsed OCRResult
+			require.NoError(t, json.Unmarshal([]byte(rendered), &parsed))
+			assert.Equal(t, *test.result, parsed)
+		})
+	}
+}
@@ -0,0 +1,276 @@
+package vision
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strings"
+	"text/template"
+	"unicode/utf8"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/text/language/display"
+)
+
+// Asks for a phrase, rather than a sentence, so it reads naturally after "It's" or "I think it's"
+const DefaultOpenAIPrompt = `Write alt text for this image, for someone who can't see it. ` +
+	`Answer in {{.Language}} with a single phrase describing what's in the image, like "a dog catching a frisbee in a park". ` +
+	`Don't start with "an image of" or "a picture of", and include any important text in the image.` +
+	`{{if .TweetText}} It was posted with the text: {{.TweetText}}{{end}}`
+
+// Answers are read on their own, so unlike descriptions they're full sentences
+const DefaultOpenAIQuestionPrompt = `Answer this question about the image, for someone who can't see it: {{.Question}}
+Answer in {{.Language}} with one or two short sentences. If the image doesn't show the answer, say so.` +
+	`{{if .TweetText}} It was posted with the text: {{.TweetText}}{{end}}`
+
+// Alt text is most useful when it's short, and twitter cuts it off at 1000 characters anyway
+const (
+	defaultOpenAIMaxTokens = 150
+	defaultOpenAIMaxLength = 1000
+)
+
+// OpenAI scales images down to fit in 2048x2048 before the model sees them, so there's no point sending more.
+// The image is sent inline, so keep it small
+var OpenAIImageOptions = preprocess.Options{MaxDimension: 2048, MinDimension: 50, MaxBytes: 4 * 1024 * 1024}
+
+// Chat models don't say how sure they are unless the server gives back logprobs, so fall back to wording the
+// description as a likely one. Not every server supports logprobs, so they're only asked for with OpenAIConfig.Logprobs
+const defaultOpenAIConfidence = 0.6
+
+type OpenAIConfig struct {
+	// Where the chat completions API is, e.g. https://api.openai.com/v1 or http://localhost:8080/v1 for llama.cpp
+	URL string
+	// Which vision model to ask, e.g. gpt-4o-mini. Local servers which only have one model can leave it empty
+	Model string
+	// A text/template with the {{.Language}} to answer in and the {{.TweetText}} the image was posted with.
+	// Empty uses DefaultOpenAIPrompt
+	Prompt string
+	// Like Prompt, with the {{.Question}} the user asked about the image. Empty uses DefaultOpenAIQuestionPrompt
+	QuestionPrompt string
+	// The most tokens the model can answer with. Zero uses a limit suited to alt text
+	MaxTokens int
+	// Longer answers are cut off at a word boundary. Zero uses twitter's alt text limit of 1000 characters
+	MaxLength int
+	// Asks for the logprobs of the answer, to work out how confident the model is. Some servers reject the request
+	// when this is set, and otherwise the answer is worded as a likely one
+	Logprobs bool
+}
+
+type OpenAI interface {
+	Describer
+	QuestionAnswerer
+}
+
+type openAI struct {
+	client         *http.Client
+	config         OpenAIConfig
+	key            string
+	prompt         *template.Template
+	questionPrompt *template.Template
+}
+
+// The fields of OpenAIConfig.Prompt and OpenAIConfig.QuestionPrompt
+type openAIPromptData struct {
+	Language  string
+	TweetText string
+	// Only set for QuestionPrompt
+	Question string
+}
+
+// Describes images, and answers questions about them, with any server that has an OpenAI compatible
+// chat completions API and a model that can see images. key can be empty if the server doesn't require one
+func NewOpenAI(config OpenAIConfig, key string) (OpenAI, error) {
+	if config.URL == "" {
+		return nil, errors.New("describing with an openai compatible server needs its url")
+	}
+	config.URL = strings.TrimSuffix(config.URL, "/")
+	if config.Prompt == "" {
+		config.Prompt = DefaultOpenAIPrompt
+	}
+	if config.QuestionPrompt == "" {
+		config.QuestionPrompt = DefaultOpenAIQuestionPrompt
+	}
+	if config.MaxTokens <= 0 {
+		config.MaxTokens = defaultOpenAIMaxTokens
+	}
+	if config.MaxLength <= 0 {
+		config.MaxLength = defaultOpenAIMaxLength
+	}
+	prompt, err := template.New("prompt").Parse(config.Prompt)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the openai prompt: %v", err)
+	}
+	questionPrompt, err := template.New("question").Parse(config.QuestionPrompt)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse the openai question prompt: %v", err)
+	}
+	return &openAI{client: &http.Client{}, config: config, key: key, prompt: prompt, questionPrompt: questionPrompt}, nil
+}
+
+func (o *openAI) Describe(ctx context.Context, url string) ([]VisionResult, structured_error.StructuredError) {
+	return o.complete(ctx, o.prompt, "", url, structured_error.DescribeError)
+}
+
+// The image is sent inline as a data url
+func (o *openAI) DescribeBytes(ctx context.Context, image []byte) ([]VisionResult, structured_error.StructuredError) {
+	return o.complete(ctx, o.prompt, "", toDataURL(image), structured_error.DescribeError)
+}
+
+func (o *openAI) Answer(ctx context.Context, url string, question string) ([]VisionResult, structured_error.StructuredError) {
+	return o.complete(ctx, o.questionPrompt, question, url, structured_error.AnswerError)
+}
+
+func (o *openAI) AnswerBytes(ctx context.Context, image []byte, question string) ([]VisionResult, structured_error.StructuredError) {
+	return o.complete(ctx, o.questionPrompt, question, toDataURL(image), structured_error.AnswerError)
+}
+
+func toDataURL(image []byte) string {
+	return fmt.Sprintf("data:%s;base64,%s", http.DetectContentType(image), base64.StdEncoding.EncodeToString(image))
+}
+
+type openAIImageURL struct {
+	URL string `json:"url"`
+}
+
+type openAIContent struct {
+	Type     string          `json:"type"`
+	Text     string          `json:"text,omitempty"`
+	ImageURL *openAIImageURL `json:"image_url,omitempty"`
+}
+
+type openAIMessage struct {
+	Role    string          `json:"role"`
+	Content []openAIContent `json:"content"`
+}
+
+type openAIRequest struct {
+	Model     string          `json:"model,omitempty"`
+	MaxTokens int             `json:"max_tokens"`
+	Logprobs  bool            `json:"logprobs,omitempty"`
+	Messages  []openAIMessage `json:"messages"`
+}
+
+type openAIResponse struct {
+	Choices []struct {
+		Message struct {
+			Content string `json:"content"`
+		} `json:"message"`
+		FinishReason string `json:"finish_reason"`
+		Logprobs     *struct {
+			Content []struct {
+				Logprob float64 `json:"logprob"`
+			} `json:"content"`
+		} `json:"logprobs"`
+	} `json:"choices"`
+}
+
+// Asks the model about the image with the prompt. question is empty for descriptions
+func (o *openAI) complete(ctx context.Context, promptTemplate *template.Template, question string, imageURL string, errorType structured_error.ErrorType) ([]VisionResult, structured_error.StructuredError) {
+	var result []VisionResult
+	prompt, err := o.renderPrompt(ctx, promptTemplate, question)
+	var body []byte
+	if err == nil {
+		body, err = json.Marshal(o.newRequest(prompt, imageURL))
+	}
+	var parsed openAIResponse
+	if err == nil {
+		logrus.Debug(fmt.Sprintf("Calling %s/chat/completions with model %s", o.config.URL, o.config.Model))
+		err = doJSON(ctx, o.client, func() (*http.Request, error) {
+			request, err := http.NewRequestWithContext(ctx, http.MethodPost, o.config.URL+"/chat/completions", bytes.NewReader(body))
+			if err == nil {
+				request.Header.Set("Content-Type", "application/json")
+				if o.key != "" {
+					request.Header.Set("Authorization", "Bearer "+o.key)
+				}
+			}
+			return request, err
+		}, errorType, &parsed)
+	}
+	if err == nil {
+		logDebugJSON(parsed)
+		for _, choice := range parsed.Choices {
+			var text string
+			if question == "" {
+				text = cleanDescription(choice.Message.Content, o.config.MaxLength)
+			} else {
+				text = truncateAtWord(strings.TrimSpace(choice.Message.Content), o.config.MaxLength)
+			}
+			if text == "" {
+				continue
+			}
+			if choice.FinishReason == "length" {
+				logrus.Debug("The description ran out of tokens, and was cut off")
+			}
+			confidence := float32(defaultOpenAIConfidence)
+			if choice.Logprobs != nil && len(choice.Logprobs.Content) > 0 {
+				sum := 0.0
+				for _, token := range choice.Logprobs.Content {
+					sum += token.Logprob
+				}
+				// The geometric mean of the probability of each token
+				confidence = float32(math.Exp(sum / float64(len(choice.Logprobs.Content))))
+			}
+			result = append(result, VisionResult{Text: text, Confidence: confidence})
+		}
+		if len(result) == 0 {
+			err = errors.New("the model didn't say anything about the image")
+		}
+	} else {
+		logrus.Debug(fmt.Sprintf("openai chat completion returned error %v", err))
+	}
+	return result, structured_error.Wrap(err, errorType)
+}
+
+func (o *openAI) renderPrompt(ctx context.Context, promptTemplate *template.Template, question string) (string, error) {
+	data := openAIPromptData{
+		// The name in English, which every model understands
+		Language:  display.English.Tags().Name(message.GetLanguage(ctx)),
+		TweetText: strings.TrimSpace(getDescribeHints(ctx).TweetText),
+		Question:  strings.TrimSpace(question),
+	}
+	builder := &strings.Builder{}
+	err := promptTemplate.Execute(builder, data)
+	return builder.String(), err
+}
+
+func (o *openAI) newRequest(prompt string, imageURL string) openAIRequest {
+	content := []openAIContent{
+		{Type: "text", Text: prompt},
+		{Type: "image_url", ImageURL: &openAIImageURL{URL: imageURL}},
+	}
+	return openAIRequest{
+		Model:     o.config.Model,
+		MaxTokens: o.config.MaxTokens,
+		Logprobs:  o.config.Logprobs,
+		Messages:  []openAIMessage{{Role: "user", Content: content}},
+	}
+}
+
+// Models like to wrap their answer in quotes and end it with a period, neither of which fit after "It's"
+func cleanDescription(text string, maxLength int) string {
+	text = strings.TrimSpace(text)
+	text = strings.Trim(text, "\"“”'")
+	text = strings.TrimSuffix(strings.TrimSpace(text), ".")
+	return truncateAtWord(text, maxLength)
+}
+
+// Cuts text off at the last word that fits in maxLength characters, including the ellipsis
+func truncateAtWord(text string, maxLength int) string {
+	if utf8.RuneCountInString(text) <= maxLength {
+		return text
+	}
+	runes := []rune(text)
+	cut := string(runes[:maxLength-1])
+	if space := strings.LastIndexAny(cut, " \n"); space > 0 {
+		cut = cut[:space]
+	}
+	return strings.TrimRight(cut, " ,;:") + "…"
+}
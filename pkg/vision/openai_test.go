@@ -0,0 +1,223 @@
+package vision
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/message"
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
+)
+
+func TestOpenAI(t *testing.T) {
+	origRetryPolicy := retryPolicy
+	retryPolicy = retry.Policy{MaxAttempts: 1}
+	defer func() {
+		retryPolicy = origRetryPolicy
+	}()
+
+	pngHeader := []byte("\x89PNG\x0D\x0A\x1A\x0A")
+	tests := []struct {
+		name           string
+		config         OpenAIConfig
+		key            string
+		lang           language.Tag
+		hints          DescribeHints
+		bytes          []byte
+		response       string
+		status         int
+		expectedPrompt []string
+		expectedImage  string
+		expected       []VisionResult
+		hasErr         bool
+	}{
+		{
+			name:           "Describes the image from a url",
+			key:            "key",
+			lang:           language.English,
+			response:       `{"choices": [{"message": {"content": "a dog catching a frisbee"}, "finish_reason": "stop"}]}`,
+			expectedPrompt: []string{"Answer in English"},
+			expectedImage:  "https://example.com/dog.jpg",
+			expected:       []VisionResult{{Text: "a dog catching a frisbee", Confidence: defaultOpenAIConfidence}},
+		},
+		{
+			name:           "Describes the image from its bytes",
+			lang:           language.English,
+			bytes:          pngHeader,
+			response:       `{"choices": [{"message": {"content": "a dog catching a frisbee"}}]}`,
+			expectedPrompt: []string{"Answer in English"},
+			expectedImage:  "data:image/png;base64,iVBORw0KGgo=",
+			expected:       []VisionResult{{Text: "a dog catching a frisbee", Confidence: defaultOpenAIConfidence}},
+		},
+		{
+			name:           "Asks for the description in the users language, with the tweet text",
+			lang:           language.German,
+			hints:          DescribeHints{TweetText: " Bruno at the beach "},
+			response:       `{"choices": [{"message": {"content": "ein Hund am Strand"}}]}`,
+			expectedPrompt: []string{"Answer in German", "It was posted with the text: Bruno at the beach"},
+			expectedImage:  "https://example.com/dog.jpg",
+			expected:       []VisionResult{{Text: "ein Hund am Strand", Confidence: defaultOpenAIConfidence}},
+		},
+		{
+			name:           "Uses a custom prompt",
+			config:         OpenAIConfig{Prompt: "Describe this in {{.Language}}: {{.TweetText}}"},
+			lang:           language.Spanish,
+			hints:          DescribeHints{TweetText: "mi perro"},
+			response:       `{"choices": [{"message": {"content": "un perro"}}]}`,
+			expectedPrompt: []string{"Describe this in Spanish: mi perro"},
+			expectedImage:  "https://example.com/dog.jpg",
+			expected:       []VisionResult{{Text: "un perro", Confidence: defaultOpenAIConfidence}},
+		},
+		{
+			name:          "Works out the confidence from the logprobs",
+			config:        OpenAIConfig{Logprobs: true},
+			lang:          language.English,
+			response:      `{"choices": [{"message": {"content": "a dog"}, "logprobs": {"content": [{"logprob": -0.1}, {"logprob": -0.3}]}}]}`,
+			expectedImage: "https://example.com/dog.jpg",
+			expected:      []VisionResult{{Text: "a dog", Confidence: float32(math.Exp(-0.2))}},
+		},
+		{
+			name:          "Tidies up the description so it reads well after It's",
+			lang:          language.English,
+			response:      `{"choices": [{"message": {"content": " \"A dog catching a frisbee.\"\n"}}]}`,
+			expectedImage: "https://example.com/dog.jpg",
+			expected:      []VisionResult{{Text: "A dog catching a frisbee", Confidence: defaultOpenAIConfidence}},
+		},
+		{
+			name:          "Cuts long descriptions off at a word",
+			config:        OpenAIConfig{MaxLength: 20},
+			lang:          language.English,
+			response:      `{"choices": [{"message": {"content": "a dog catching a frisbee in a park"}, "finish_reason": "length"}]}`,
+			expectedImage: "https://example.com/dog.jpg",
+			expected:      []VisionResult{{Text: "a dog catching a…", Confidence: defaultOpenAIConfidence}},
+		},
+		{
+			name:          "Fails when the model doesn't describe the image",
+			lang:          language.English,
+			response:      `{"choices": [{"message": {"content": "  "}}]}`,
+			expectedImage: "https://example.com/dog.jpg",
+			hasErr:        true,
+		},
+		{
+			name:          "Fails when the server rejects the request",
+			lang:          language.English,
+			status:        http.StatusUnauthorized,
+			expectedImage: "https://example.com/dog.jpg",
+			hasErr:        true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				require.Equal(t, "/v1/chat/completions", r.URL.Path)
+				if test.key == "" {
+					assert.Empty(t, r.Header.Get("Authorization"))
+				} else {
+					assert.Equal(t, "Bearer "+test.key, r.Header.Get("Authorization"))
+				}
+				var request openAIRequest
+				require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+				assert.Equal(t, "llava", request.Model)
+				assert.Equal(t, defaultOpenAIMaxTokens, request.MaxTokens)
+				assert.Equal(t, test.config.Logprobs, request.Logprobs)
+				require.Len(t, request.Messages, 1)
+				require.Len(t, request.Messages[0].Content, 2)
+				prompt := request.Messages[0].Content[0].Text
+				for _, expected := range test.expectedPrompt {
+					assert.Contains(t, prompt, expected)
+				}
+				if test.hints.TweetText == "" {
+					assert.NotContains(t, prompt, "posted with")
+				}
+				assert.Equal(t, test.expectedImage, request.Messages[0].Content[1].ImageURL.URL)
+				if test.status != 0 {
+					w.WriteHeader(test.status)
+					return
+				}
+				w.Write([]byte(test.response))
+			}))
+			defer server.Close()
+
+			config := test.config
+			config.URL = server.URL + "/v1/"
+			config.Model = "llava"
+			describer, err := NewOpenAI(config, test.key)
+			require.NoError(t, err)
+			ctx := message.WithLanguage(context.Background(), test.lang)
+			ctx = WithDescribeHints(ctx, test.hints)
+			var results []VisionResult
+			var describeErr structured_error.StructuredError
+			if test.bytes != nil {
+				results, describeErr = describer.DescribeBytes(ctx, test.bytes)
+			} else {
+				results, describeErr = describer.Describe(ctx, "https://example.com/dog.jpg")
+			}
+			if test.hasErr {
+				require.Error(t, describeErr)
+				assert.Equal(t, structured_error.DescribeError, describeErr.Type())
+				return
+			}
+			require.NoError(t, describeErr)
+			assert.Equal(t, test.expected, results)
+		})
+	}
+}
+
+func TestNewOpenAI(t *testing.T) {
+	_, err := NewOpenAI(OpenAIConfig{}, "key")
+	assert.Error(t, err)
+
+	_, err = NewOpenAI(OpenAIConfig{URL: "http://localhost:8080/v1", Prompt: "{{.Language"}, "key")
+	assert.Error(t, err)
+
+	_, err = NewOpenAI(OpenAIConfig{URL: "http://localhost:8080/v1"}, "")
+	assert.NoError(t, err)
+}
+
+func TestCleanDescription(t *testing.T) {
+	assert.Equal(t, "a cat", cleanDescription("“a cat.”", 1000))
+	assert.Equal(t, strings.Repeat("a", 9)+"…", cleanDescription(strings.Repeat("a", 20), 10))
+}
+
+func TestOpenAIAnswersQuestions(t *testing.T) {
+	origRetryPolicy := retryPolicy
+	retryPolicy = retry.Policy{MaxAttempts: 1}
+	defer func() {
+		retryPolicy = origRetryPolicy
+	}()
+
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request openAIRequest
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&request))
+		prompt := request.Messages[0].Content[0].Text
+		assert.Contains(t, prompt, "What does the sign say?")
+		assert.Contains(t, prompt, "Answer in German")
+		assert.Contains(t, prompt, "It was posted with the text: Berlin")
+		w.WriteHeader(status)
+		// Unlike descriptions, answers are full sentences
+		w.Write([]byte(`{"choices": [{"message": {"content": " Auf dem Schild steht „Ausgang“. "}}]}`))
+	}))
+	defer server.Close()
+
+	answerer, err := NewOpenAI(OpenAIConfig{URL: server.URL}, "")
+	require.NoError(t, err)
+	ctx := message.WithLanguage(context.Background(), language.German)
+	ctx = WithDescribeHints(ctx, DescribeHints{TweetText: "Berlin"})
+	results, answerErr := answerer.AnswerBytes(ctx, []byte("image"), " What does the sign say? ")
+	require.NoError(t, answerErr)
+	assert.Equal(t, []VisionResult{{Text: "Auf dem Schild steht „Ausgang“.", Confidence: defaultOpenAIConfidence}}, results)
+
+	status = http.StatusBadRequest
+	_, answerErr = answerer.Answer(ctx, "https://example.com/sign.jpg", "What does the sign say?")
+	require.Error(t, answerErr)
+	assert.Equal(t, structured_error.AnswerError, answerErr.Type())
+}
@@ -0,0 +1,61 @@
+package vision
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/retry"
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/Azure/go-autorest/autorest"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Shared by every provider, overridden by tests
+var retryPolicy = retry.DefaultPolicy
+
+// Google's gRPC APIs (vision, speech) report failures as status codes, and the REST ones (translate) as a googleapi.Error
+func classifyGoogleError(err error, errorType structured_error.ErrorType) error {
+	if err == nil {
+		return nil
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.Unavailable, codes.ResourceExhausted, codes.Aborted:
+			return structured_error.WrapRetryable(err, errorType, 0)
+		}
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) && retry.IsTransientStatus(apiErr.Code) {
+		return structured_error.WrapRetryable(err, errorType, retry.RetryAfter(&http.Response{Header: apiErr.Header}))
+	}
+	return err
+}
+
+func classifyAzureError(err error, errorType structured_error.ErrorType) error {
+	if err == nil {
+		return nil
+	}
+	var detailed autorest.DetailedError
+	if errors.As(err, &detailed) {
+		if statusCode, ok := detailed.StatusCode.(int); ok && retry.IsTransientStatus(statusCode) {
+			return structured_error.WrapRetryable(err, errorType, retry.RetryAfter(detailed.Response))
+		}
+	}
+	return err
+}
+
+// Turns a non-2xx response into an error, which is retryable if the status is transient
+func classifyResponse(response *http.Response, err error, errorType structured_error.ErrorType) error {
+	if err != nil || (response.StatusCode >= 200 && response.StatusCode < 300) {
+		return err
+	}
+	response.Body.Close()
+	err = fmt.Errorf("request returned a %d status code", response.StatusCode)
+	if retry.IsTransientStatus(response.StatusCode) {
+		return structured_error.WrapRetryable(err, errorType, retry.RetryAfter(response))
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package vision
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/Azure/go-autorest/autorest"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyErrors(t *testing.T) {
+	retryAfter := http.Header{}
+	retryAfter.Set("Retry-After", "5")
+	tests := []struct {
+		name       string
+		err        error
+		classify   func(error, structured_error.ErrorType) error
+		retryable  bool
+		retryAfter time.Duration
+	}{
+		{name: "Google nil", classify: classifyGoogleError},
+		{name: "Google unavailable", err: status.Error(codes.Unavailable, "try later"), classify: classifyGoogleError, retryable: true},
+		{name: "Google resource exhausted", err: status.Error(codes.ResourceExhausted, "slow down"), classify: classifyGoogleError, retryable: true},
+		{name: "Google invalid argument", err: status.Error(codes.InvalidArgument, "bad image"), classify: classifyGoogleError},
+		{name: "Google REST 503", err: &googleapi.Error{Code: 503, Header: retryAfter}, classify: classifyGoogleError, retryable: true, retryAfter: time.Second * 5},
+		{name: "Google REST 400", err: &googleapi.Error{Code: 400}, classify: classifyGoogleError},
+		{name: "Google other errors", err: errors.New("oops"), classify: classifyGoogleError},
+		{name: "Azure 429", err: autorest.DetailedError{StatusCode: 429, Response: &http.Response{Header: retryAfter}}, classify: classifyAzureError, retryable: true, retryAfter: time.Second * 5},
+		{name: "Azure 500", err: autorest.DetailedError{StatusCode: 500}, classify: classifyAzureError, retryable: true},
+		{name: "Azure 401", err: autorest.DetailedError{StatusCode: 401}, classify: classifyAzureError},
+		{name: "Azure other errors", err: errors.New("oops"), classify: classifyAzureError},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.classify(test.err, structured_error.OCRError)
+			if test.err == nil {
+				assert.NoError(t, err)
+				return
+			}
+			assert.Equal(t, test.retryable, structured_error.IsRetryable(err))
+			assert.Equal(t, test.retryAfter, structured_error.RetryAfter(err))
+			if test.retryable {
+				assert.Equal(t, structured_error.OCRError, structured_error.Wrap(err, structured_error.Unknown).Type())
+			}
+		})
+	}
+}
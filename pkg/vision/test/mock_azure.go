@@ -12,6 +12,11 @@ import (
 type MockAzure struct {
 	T            *testing.T
 	DescribeMock func(url string) ([]vision.VisionResult, error)
+	// Optional, defaults to calling DescribeMock with the image as a string
+	DescribeBytesMock func(image []byte) ([]vision.VisionResult, error)
+	GetOCRMock        func(url string) (result *vision.OCRResult, err error)
+	// Optional, defaults to calling GetOCRMock with the image as a string
+	GetOCRFromBytesMock func(image []byte) (result *vision.OCRResult, err error)
 }
 
 func (a *MockAzure) Describe(ctx context.Context, url string) ([]vision.VisionResult, structured_error.StructuredError) {
@@ -19,3 +24,29 @@ func (a *MockAzure) Describe(ctx context.Context, url string) ([]vision.VisionRe
 	result, err := a.DescribeMock(url)
 	return result, structured_error.Wrap(err, structured_error.DescribeError)
 }
+
+func (a *MockAzure) DescribeBytes(ctx context.Context, image []byte) ([]vision.VisionResult, structured_error.StructuredError) {
+	if a.DescribeBytesMock == nil {
+		return a.Describe(ctx, string(image))
+	}
+	result, err := a.DescribeBytesMock(image)
+	return result, structured_error.Wrap(err, structured_error.DescribeError)
+}
+
+func (a *MockAzure) GetOCR(ctx context.Context, url string) (*vision.OCRResult, structured_error.StructuredError) {
+	assert.NotNil(a.T, a.GetOCRMock)
+	result, err := a.GetOCRMock(url)
+	return result, structured_error.Wrap(err, structured_error.OCRError)
+}
+
+func (a *MockAzure) GetOCRFromBytes(ctx context.Context, image []byte) (*vision.OCRResult, structured_error.StructuredError) {
+	if a.GetOCRFromBytesMock == nil {
+		return a.GetOCR(ctx, string(image))
+	}
+	result, err := a.GetOCRFromBytesMock(image)
+	return result, structured_error.Wrap(err, structured_error.OCRError)
+}
+
+func (a *MockAzure) Close() error {
+	return nil
+}
@@ -39,9 +39,11 @@ vf2FL8Z20ZOKoy5CJ26qQiT87BwuL+GS7w+HzjYmCL39SE3QzxY+rs4=
 -----END RSA PRIVATE KEY-----`
 
 type MockGoogle struct {
-	T             *testing.T
-	GetOCRMock    func(url string) (result *vision.OCRResult, err error)
-	TranslateMock func(message string) (language.Tag, string, error)
+	T          *testing.T
+	GetOCRMock func(url string) (result *vision.OCRResult, err error)
+	// Optional, defaults to calling GetOCRMock with the image as a string
+	GetOCRFromBytesMock func(image []byte) (result *vision.OCRResult, err error)
+	TranslateMock       func(message string) (language.Tag, string, error)
 }
 
 func (g *MockGoogle) GetOCR(ctx context.Context, url string) (*vision.OCRResult, structured_error.StructuredError) {
@@ -50,6 +52,14 @@ func (g *MockGoogle) GetOCR(ctx context.Context, url string) (*vision.OCRResult,
 	return result, structured_error.Wrap(err, structured_error.OCRError)
 }
 
+func (g *MockGoogle) GetOCRFromBytes(ctx context.Context, image []byte) (*vision.OCRResult, structured_error.StructuredError) {
+	if g.GetOCRFromBytesMock == nil {
+		return g.GetOCR(ctx, string(image))
+	}
+	result, err := g.GetOCRFromBytesMock(image)
+	return result, structured_error.Wrap(err, structured_error.OCRError)
+}
+
 func (g *MockGoogle) Translate(ctx context.Context, message string) (language.Tag, string, structured_error.StructuredError) {
 	assert.NotNil(g.T, g.TranslateMock)
 	tag, result, err := g.TranslateMock(message)
@@ -0,0 +1,25 @@
+package vision_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockLabeler struct {
+	T          *testing.T
+	LabelsMock func(url string) ([]vision.Label, structured_error.StructuredError)
+}
+
+func (l *MockLabeler) GetLabels(ctx context.Context, url string) ([]vision.Label, structured_error.StructuredError) {
+	assert.NotNil(l.T, l.LabelsMock)
+	return l.LabelsMock(url)
+}
+
+// Calls LabelsMock with the image as a string
+func (l *MockLabeler) GetLabelsFromBytes(ctx context.Context, image []byte) ([]vision.Label, structured_error.StructuredError) {
+	return l.GetLabels(ctx, string(image))
+}
@@ -0,0 +1,26 @@
+package vision_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
+	"github.com/AnilRedshift/captions_please_go/pkg/vision"
+	"github.com/stretchr/testify/assert"
+)
+
+type MockQuestionAnswerer struct {
+	T          *testing.T
+	AnswerMock func(url string, question string) ([]vision.VisionResult, error)
+}
+
+func (a *MockQuestionAnswerer) Answer(ctx context.Context, url string, question string) ([]vision.VisionResult, structured_error.StructuredError) {
+	assert.NotNil(a.T, a.AnswerMock)
+	result, err := a.AnswerMock(url, question)
+	return result, structured_error.Wrap(err, structured_error.AnswerError)
+}
+
+// Calls AnswerMock with the image as a string
+func (a *MockQuestionAnswerer) AnswerBytes(ctx context.Context, image []byte, question string) ([]vision.VisionResult, structured_error.StructuredError) {
+	return a.Answer(ctx, string(image), question)
+}
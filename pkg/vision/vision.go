@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 
+	"github.com/AnilRedshift/captions_please_go/pkg/preprocess"
 	"github.com/AnilRedshift/captions_please_go/pkg/structured_error"
 	"github.com/sirupsen/logrus"
 	"golang.org/x/text/language"
@@ -14,25 +15,104 @@ type OCRLanguage struct {
 	Confidence float32
 }
 
-type OCRResult struct {
+// Where something is in the image, in pixels from the top left corner
+type Bounds struct {
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+type OCRWord struct {
+	Text   string
+	Bounds Bounds
+	// Between 0 and 1. Zero means the provider didn't say
+	Confidence float32
+}
+
+type OCRLine struct {
+	Words  []OCRWord
+	Bounds Bounds
+	// The next line starts a new paragraph
+	EndsParagraph bool
+}
+
+// A separate piece of text in the image, such as a caption or a sign
+type OCRBlock struct {
 	Text     string
 	Language OCRLanguage
+	Bounds   Bounds
+	// Between 0 and 1. Zero means the provider didn't say
+	Confidence float32
+	Lines      []OCRLine
+}
+
+type OCRResult struct {
+	Text string
+	// The most likely language across all of the text
+	Language OCRLanguage
+	// Text joins these together, in reading order. Each may be in a different language than the rest
+	Blocks []OCRBlock
 }
 
 type VisionResult struct {
 	Text       string
 	Confidence float32
+	// Set when the result only describes part of the image
+	Bounds *Bounds `json:",omitempty"`
 }
 
 type TranscriptionResult VisionResult
 
+// Naming things doesn't need much detail, and Azure rejects images over 4MB
+var LabelImageOptions = preprocess.Options{MaxDimension: 2048, MinDimension: 50, MaxBytes: 4 * 1024 * 1024}
+
+// What kind of thing a label names
+type LabelKind int
+
+const (
+	// Something in the image, or about it as a whole, such as "outdoor"
+	TagLabel LabelKind = iota
+	// Something the provider found in a particular place in the image
+	ObjectLabel
+	LandmarkLabel
+	// A logo or brand name
+	BrandLabel
+)
+
+type Label struct {
+	Text string
+	// Between 0 and 1. Zero means the provider didn't say
+	Confidence float32
+	Kind       LabelKind
+	// Set when the provider said where it is in the image
+	Bounds *Bounds `json:",omitempty"`
+}
+
+// Each image can either be fetched by the provider from its url,
+// or sent inline when the caller has already downloaded it
 type OCR interface {
 	GetOCR(ctx context.Context, url string) (*OCRResult, structured_error.StructuredError)
+	GetOCRFromBytes(ctx context.Context, image []byte) (*OCRResult, structured_error.StructuredError)
 	Close() error
 }
 
 type Describer interface {
 	Describe(ctx context.Context, url string) ([]VisionResult, structured_error.StructuredError)
+	DescribeBytes(ctx context.Context, image []byte) ([]VisionResult, structured_error.StructuredError)
+}
+
+// Names the things in an image, such as its objects, landmarks and brands
+type Labeler interface {
+	GetLabels(ctx context.Context, url string) ([]Label, structured_error.StructuredError)
+	GetLabelsFromBytes(ctx context.Context, image []byte) ([]Label, structured_error.StructuredError)
+}
+
+// Answers a free form question about an image, such as "what does the sign say?".
+// The answer is written in the language of ctx
+type QuestionAnswerer interface {
+	Answer(ctx context.Context, url string, question string) ([]VisionResult, structured_error.StructuredError)
+	AnswerBytes(ctx context.Context, image []byte, question string) ([]VisionResult, structured_error.StructuredError)
 }
 
 type Translator interface {